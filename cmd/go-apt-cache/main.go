@@ -9,7 +9,9 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -47,6 +49,30 @@ func (ci *CacheInitializer) Initialize() (storage.Cache, storage.HeaderCache, st
 	var cache storage.Cache
 	var headerCache storage.HeaderCache
 
+	if redisCfg := cfg.Cache.HeaderRedis; redisCfg.Address != "" {
+		headerCache, err = storage.NewRedisHeaderCache(storage.RedisHeaderCacheOptions{
+			Address:   redisCfg.Address,
+			Password:  redisCfg.Password,
+			DB:        redisCfg.DB,
+			KeyPrefix: redisCfg.KeyPrefix,
+			TTL:       time.Duration(redisCfg.TTL) * time.Second,
+		})
+		if err != nil {
+			return nil, nil, nil, utils.WrapError("failed to create redis header cache", err)
+		}
+		logging.Info("Using redis header cache at %s", redisCfg.Address)
+	} else {
+		headerCache, err = storage.NewFileHeaderCache(cacheDir)
+		if err != nil {
+			return nil, nil, nil, utils.WrapError("failed to create header cache", err)
+		}
+		logging.Info("Using header cache at %s", cacheDir)
+	}
+	if entries := cfg.Cache.HeaderCacheEntries; entries > 0 {
+		headerCache = storage.NewMemoryHeaderCache(headerCache, entries)
+		logging.Info("Keeping up to %d headers in memory", entries)
+	}
+
 	if cfg.Cache.LRU {
 		maxSizeBytes, err := utils.ParseSize(cfg.Cache.MaxSize)
 		if err != nil {
@@ -61,9 +87,22 @@ func (ci *CacheInitializer) Initialize() (storage.Cache, storage.HeaderCache, st
 		}
 
 		lruOptions := storage.LRUCacheOptions{
-			BasePath:     cacheDir,
-			MaxSizeBytes: maxSizeBytes,
-			CleanOnStart: cfg.Cache.CleanOnStart,
+			BasePath:            cacheDir,
+			MaxSizeBytes:        maxSizeBytes,
+			MaxEntries:          cfg.Cache.MaxEntries,
+			Dedup:               cfg.Cache.Dedup,
+			CleanOnStart:        cfg.Cache.CleanOnStart,
+			EvictionGracePeriod: time.Duration(cfg.Cache.EvictionGracePeriod) * time.Second,
+			EvictionGuard:       handlers.IsFetchInProgress,
+			Admission:           cfg.Cache.Admission == "tinylfu",
+			// Headers are removed with their body so no orphans accumulate.
+			OnRemove: func(key string) {
+				if err := headerCache.DeleteHeaders(key); err != nil {
+					logging.Warning("Failed to remove headers of %s: %v", key, err)
+				}
+				handlers.CacheSpaceFreed()
+				handlers.PublishEvent(handlers.Event{Type: handlers.EventEvict, Key: key})
+			},
 		}
 		lruCache, err := storage.NewLRUCacheWithOptions(lruOptions)
 		if err != nil {
@@ -80,12 +119,6 @@ func (ci *CacheInitializer) Initialize() (storage.Cache, storage.HeaderCache, st
 		cache = storage.NewNoopCache()
 	}
 
-	headerCache, err = storage.NewFileHeaderCache(cacheDir)
-	if err != nil {
-		return nil, nil, nil, utils.WrapError("failed to create header cache", err)
-	}
-	logging.Info("Using header cache at %s", cacheDir)
-
 	validationTTL := time.Duration(cfg.Cache.ValidationCacheTTL) * time.Second
 	validationCache := storage.NewMemoryValidationCache(validationTTL)
 	logging.Info("Using in-memory validation cache with TTL of %v", validationTTL)
@@ -99,14 +132,46 @@ type ServerSetup struct {
 	HeaderCache     storage.HeaderCache
 	ValidationCache storage.ValidationCache
 	HTTPClient      *http.Client
+	routes          repositoryRoutes
+}
+
+// repositoryRoutes serves the repositories of the current configuration. A
+// reload swaps in a new mux atomically: requests already being served finish
+// on the handlers they started with, new ones use the new routes.
+type repositoryRoutes struct {
+	mux     atomic.Pointer[http.ServeMux]
+	mu      sync.Mutex                   // Serializes reloads
+	mounted map[string]mountedRepository // By base path
+}
+
+type mountedRepository struct {
+	repo    config.Repository
+	handler http.Handler
+	close   func() // Stops the repository's background work, nil if it has none
+}
+
+func (rr *repositoryRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rr.mux.Load().ServeHTTP(w, r)
 }
 
 func (ss *ServerSetup) CreateServer() *http.Server {
 	mux := http.NewServeMux()
 
-	ss.registerRepositoryHandlers(mux)
+	ss.ReloadRepositories(ss.Config.Repositories)
+	mux.Handle("/", &ss.routes)
 
 	mux.HandleFunc("/status", ss.handleStatus)
+	mux.HandleFunc("/robots.txt", handlers.HandleRobots(ss.Config.Server.RobotsTxt))
+	mux.HandleFunc("/favicon.ico", handlers.HandleFavicon(ss.Config.Server.FaviconStatus))
+	if ss.Config.Server.AggregateIndexes {
+		mux.HandleFunc("/aggregate/Packages", handlers.HandleAggregatePackages(ss.Cache))
+	}
+
+	if ss.Config.Admin.ListenAddress == "" {
+		adminHandler := ss.adminHandler()
+		mux.Handle("/admin/", adminHandler)
+		mux.Handle("/metrics", adminHandler)
+	}
 
 	middlewareChain := handlers.CreateMiddlewareChain(ss.Config)
 	handler := middlewareChain.Apply(mux)
@@ -122,34 +187,155 @@ func (ss *ServerSetup) CreateServer() *http.Server {
 	return server
 }
 
-func (ss *ServerSetup) registerRepositoryHandlers(mux *http.ServeMux) {
-	for _, repo := range ss.Config.Repositories {
+// CreateAdminServer returns a server for the admin routes when they are
+// configured to use their own listener, or nil when they share the main one.
+func (ss *ServerSetup) CreateAdminServer() *http.Server {
+	if ss.Config.Admin.ListenAddress == "" {
+		return nil
+	}
+
+	return &http.Server{
+		Addr:         ss.Config.Admin.ListenAddress,
+		Handler:      ss.adminHandler(),
+		ReadTimeout:  time.Duration(ss.Config.Server.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(ss.Config.Server.WriteTimeout) * time.Second,
+		IdleTimeout:  time.Duration(ss.Config.Server.IdleTimeout) * time.Second,
+	}
+}
+
+func (ss *ServerSetup) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/inflight", handlers.HandleInflight)
+	mux.HandleFunc("/admin/singleflight", handlers.HandleSingleFlightStats)
+	mux.HandleFunc("/admin/prefetch", handlers.HandlePrefetch)
+	mux.HandleFunc("/admin/prefetch/", handlers.HandlePrefetch)
+	mux.HandleFunc("/admin/selftest", handlers.HandleSelfTest)
+	mux.HandleFunc("/admin/entry", handlers.HandleEntry(ss.Cache, ss.HeaderCache))
+	mux.HandleFunc("/admin/purge", handlers.HandlePurge(ss.Cache, ss.HeaderCache))
+	mux.HandleFunc("/admin/events", handlers.HandleEvents)
+	if ss.Config.Server.SuiteStats {
+		mux.HandleFunc("/admin/suites", handlers.HandleSuiteStats(ss.Cache))
+	}
+	mux.HandleFunc("/admin/manifest", handlers.HandleManifest)
+	mux.HandleFunc("/admin/manifest/", handlers.HandleManifest)
+	mux.HandleFunc("/metrics", handlers.HandleMetrics)
+
+	if ss.Config.Admin.Token == "" && ss.Config.Admin.Username == "" {
+		logging.Warning("Admin routes are not protected, set admin.token or admin.username to require credentials")
+	}
+
+	return handlers.NewAdminAuthMiddleware(mux, ss.Config.Admin)
+}
+
+// ReloadRepositories serves the given repositories from now on. Repositories
+// whose settings did not change keep their handlers, and with them their
+// warm-up state and origin probes; those removed or changed are closed once
+// the new routes are in place, so no request reaches a closed handler.
+// Settings outside the repositories are those the server was started with.
+func (ss *ServerSetup) ReloadRepositories(repos []config.Repository) {
+	rr := &ss.routes
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	unchanged := make(map[string]bool)
+	for _, repo := range repos {
+		basePath := utils.NormalizeBasePath(repo.Path)
+		if current, ok := rr.mounted[basePath]; ok && repo.Enabled && reflect.DeepEqual(current.repo, repo) {
+			unchanged[basePath] = true
+		}
+	}
+	mux := http.NewServeMux()
+	mounted := make(map[string]mountedRepository, len(repos))
+	for _, repo := range repos {
 		if !repo.Enabled {
 			logging.Info("Skipping disabled repository: %s", repo.URL)
 			continue
 		}
 
 		basePath := utils.NormalizeBasePath(repo.Path)
-		upstreamURL := utils.NormalizeURL(repo.URL) + "/"
+		if _, exists := mounted[basePath]; exists {
+			logging.Error("Skipping repository %s: path %s is already in use", repo.URL, basePath)
+			continue
+		}
+		if unchanged[basePath] {
+			mounted[basePath] = rr.mounted[basePath]
+			mux.Handle(basePath, mounted[basePath].handler)
+			continue
+		}
 
-		logging.Info("Setting up mirror for %s at path %s", upstreamURL, basePath)
+		route, ok := ss.mountRepository(basePath, repo)
+		if !ok {
+			continue
+		}
+		mounted[basePath] = route
+		mux.Handle(basePath, route.handler)
+	}
+
+	previous := rr.mounted
+	rr.mounted = mounted
+	rr.mux.Store(mux)
+
+	for basePath, current := range previous {
+		if unchanged[basePath] {
+			continue
+		}
+		logging.Info("Removing repository %s at path %s", current.repo.URL, basePath)
+		if current.close != nil {
+			current.close()
+		}
+	}
+}
 
-		handler := handlers.NewRepositoryHandler(
-			upstreamURL,
-			ss.Cache,
-			ss.HeaderCache,
-			ss.ValidationCache,
-			ss.HTTPClient,
-			basePath,
-			ss.Config,
-		)
+// mountRepository sets up the handler serving a repository at basePath.
+func (ss *ServerSetup) mountRepository(basePath string, repo config.Repository) (mountedRepository, bool) {
+	originURL, err := utils.NormalizeOriginURL(repo.URL, ss.Config.Server.DefaultOriginScheme, ss.Config.Server.DefaultOriginPort)
+	if err != nil {
+		logging.Error("Skipping repository with invalid URL: %v", err)
+		return mountedRepository{}, false
+	}
+
+	if root, ok := utils.LocalOriginPath(originURL); ok {
+		logging.Info("Serving local repository %s at path %s", root, basePath)
+		return mountedRepository{
+			repo:    repo,
+			handler: http.StripPrefix(basePath, handlers.NewLocalOriginHandler(root)),
+		}, true
+	}
+
+	upstreamURL := originURL + "/"
 
-		mux.Handle(basePath, http.StripPrefix(basePath, handler))
+	logging.Info("Setting up mirror for %s at path %s", upstreamURL, basePath)
+
+	handler := handlers.NewRepositoryHandler(
+		upstreamURL,
+		ss.Cache,
+		ss.HeaderCache,
+		ss.ValidationCache,
+		ss.HTTPClient,
+		basePath,
+		repo,
+		ss.Config,
+	)
+
+	route := mountedRepository{repo: repo, handler: http.StripPrefix(basePath, handler)}
+	if closer, ok := handler.(interface{ Close() }); ok {
+		route.close = closer.Close
 	}
+	return route, true
 }
 
 func (ss *ServerSetup) handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
+	if since, ok := handlers.CachePassThroughSince(); ok {
+		fmt.Fprintf(w, "\nCache: pass-through since %s, disk full", since.UTC().Format(time.RFC3339))
+	}
+	if ratio, requests, window := handlers.WindowedHitRatio(); window > 0 && requests > 0 {
+		fmt.Fprintf(w, "\nHit ratio: %.1f%% of %d requests in the last %v", ratio*100, requests, window)
+	}
+	if deleted, reclaimed, lastRun := handlers.PoolGCStats(); !lastRun.IsZero() {
+		fmt.Fprintf(w, "\nPool GC: reclaimed %s in %d files, last run %s",
+			utils.FormatSize(reclaimed), deleted, lastRun.UTC().Format(time.RFC3339))
+	}
 }
 
 type ConfigManager struct {
@@ -176,6 +362,9 @@ func NewConfigManager() *ConfigManager {
 	disableTerminal := flag.Bool("disable-terminal-log", false, "Disable terminal logging")
 	logMaxSize := flag.String("log-max-size", "", "Maximum log file size (e.g. 10MB, 1GB)")
 	logLevel := flag.String("log-level", "", "Log level (debug, info, warning, error, fatal)")
+	logFormat := flag.String("log-format", "", "Log format (text, json)")
+	importDir := flag.String("import", "", "Seed the cache from an existing mirror tree in this directory and exit")
+	importRepo := flag.String("import-repo", "", "Path of the repository the -import tree mirrors (e.g. debian)")
 
 	flag.Parse()
 
@@ -192,6 +381,9 @@ func NewConfigManager() *ConfigManager {
 	cm.CommandLineFlags["disableTerminal"] = *disableTerminal
 	cm.CommandLineFlags["logMaxSize"] = *logMaxSize
 	cm.CommandLineFlags["logLevel"] = *logLevel
+	cm.CommandLineFlags["logFormat"] = *logFormat
+	cm.CommandLineFlags["importDir"] = *importDir
+	cm.CommandLineFlags["importRepo"] = *importRepo
 
 	return cm
 }
@@ -272,10 +464,17 @@ func (cm *ConfigManager) applyCommandLineFlags(cfg *config.Config) {
 	if logLevel, ok := cm.CommandLineFlags["logLevel"].(string); ok && logLevel != "" {
 		cfg.Logging.Level = logLevel
 	}
+
+	if logFormat, ok := cm.CommandLineFlags["logFormat"].(string); ok && logFormat != "" {
+		cfg.Logging.Format = logFormat
+	}
 }
 
 type ServerManager struct {
-	Server *http.Server
+	Server      *http.Server
+	AdminServer *http.Server // Nil when admin routes are served by Server
+	HeaderCache storage.HeaderCache
+	Reload      func() // Reloads the configuration on SIGHUP, may be nil
 }
 
 func setupUnixSocket(server *http.Server, socketPath string, serverError chan<- error) (net.Listener, error) {
@@ -324,6 +523,24 @@ func (sm *ServerManager) StartAndWait() error {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+	go func() {
+		for range reload {
+			logging.Info("Received SIGHUP, reloading configuration and manifest")
+			if sm.Reload != nil {
+				sm.Reload()
+			}
+			if err := handlers.ReloadManifest(); err != nil {
+				logging.Error("Manifest reload failed: %v", err)
+			}
+			if err := handlers.ReloadErrorPages(); err != nil {
+				logging.Error("Error page reload failed: %v", err)
+			}
+		}
+	}()
+
 	serverError := make(chan error, 1)
 
 	var unixListener net.Listener
@@ -356,6 +573,16 @@ func (sm *ServerManager) StartAndWait() error {
 		}
 	}()
 
+	if sm.AdminServer != nil {
+		go func() {
+			logging.Info("Admin server listening on %s", sm.AdminServer.Addr)
+			if err := sm.AdminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logging.Error("Admin server error: %v", err)
+				serverError <- err
+			}
+		}()
+	}
+
 	select {
 	case <-stop:
 		logging.Info("Shutting down server...")
@@ -366,10 +593,28 @@ func (sm *ServerManager) StartAndWait() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	if sm.AdminServer != nil {
+		if err := sm.AdminServer.Shutdown(ctx); err != nil {
+			logging.Warning("Admin server shutdown failed: %v", err)
+		}
+	}
+
 	if err := sm.Server.Shutdown(ctx); err != nil {
 		return fmt.Errorf("server shutdown failed: %w", err)
 	}
 
+	if err := handlers.FlushPendingUpdates(ctx); err != nil {
+		logging.Warning("Timed out waiting for pending cache writes: %v", err)
+	}
+	if err := handlers.FlushTraces(ctx); err != nil {
+		logging.Warning("Timed out exporting traces: %v", err)
+	}
+	if sm.HeaderCache != nil {
+		if err := sm.HeaderCache.Close(); err != nil {
+			logging.Warning("Failed to close header cache: %v", err)
+		}
+	}
+
 	if middleware, ok := sm.Server.Handler.(interface{ GetConfig() *config.Config }); ok {
 		if cfg := middleware.GetConfig(); cfg != nil && cfg.Server.UnixSocketPath != "" {
 			if err := os.Remove(cfg.Server.UnixSocketPath); err != nil {
@@ -400,8 +645,64 @@ func main() {
 		logging.Fatal("Failed to initialize cache: %v", err)
 	}
 
+	startOrphanSweeps(cfg, cache, headerCache)
+	startPoolGC(cfg, cache, headerCache)
+
 	client := createHTTPClient(cfg)
 
+	if err := handlers.LoadManifest(cfg.Cache.ManifestFile); err != nil {
+		logging.Fatal("Error loading manifest: %v", err)
+	}
+	if err := handlers.LoadErrorPages(cfg.Server.ErrorPages); err != nil {
+		logging.Fatal("Error loading error pages: %v", err)
+	}
+
+	if importDir, _ := configManager.CommandLineFlags["importDir"].(string); importDir != "" {
+		importRepo, _ := configManager.CommandLineFlags["importRepo"].(string)
+		err := importMirrorTree(cfg, cache, headerCache, validationCache, client, importDir, importRepo)
+		headerCache.Close()
+		if err != nil {
+			logging.Fatal("Import failed: %v", err)
+		}
+		return
+	}
+
+	if cfg.Server.OriginBandwidthLimit != "" {
+		limit, _ := utils.ParseSize(cfg.Server.OriginBandwidthLimit)
+		handlers.SetOriginBandwidthLimit(limit)
+		logging.Info("Limiting origin bandwidth to %s per second", cfg.Server.OriginBandwidthLimit)
+	}
+
+	if cfg.Server.MaxBufferedBytes != "" {
+		limit, _ := utils.ParseSize(cfg.Server.MaxBufferedBytes)
+		handlers.SetBufferBudget(limit)
+	}
+
+	if tracing := cfg.Server.Tracing; tracing.Endpoint != "" {
+		serviceName := tracing.ServiceName
+		if serviceName == "" {
+			serviceName = config.DefaultTracingServiceName
+		}
+		handlers.SetTraceExporter(tracing.Endpoint, serviceName, tracing.Headers)
+		logging.Info("Exporting traces to %s", tracing.Endpoint)
+	}
+
+	handlers.SetBackgroundPool(cfg.Server.BackgroundWorkers, cfg.Server.BackgroundQueue)
+
+	hitRatioWindow := cfg.Server.HitRatioWindow
+	if hitRatioWindow == 0 {
+		hitRatioWindow = config.DefaultHitRatioWindow
+	}
+	handlers.SetHitRatioWindow(time.Duration(hitRatioWindow) * time.Second)
+
+	if cfg.Server.RetryBudgetRatio > 0 {
+		minRetries := cfg.Server.RetryBudgetMinRetries
+		if minRetries == 0 {
+			minRetries = config.DefaultRetryBudgetMinRetries
+		}
+		handlers.SetRetryBudget(cfg.Server.RetryBudgetRatio, minRetries)
+	}
+
 	serverSetup := &ServerSetup{
 		Config:          &cfg,
 		Cache:           cache,
@@ -412,28 +713,189 @@ func main() {
 
 	server := serverSetup.CreateServer()
 
-	serverManager := &ServerManager{Server: server}
+	serverManager := &ServerManager{
+		Server:      server,
+		AdminServer: serverSetup.CreateAdminServer(),
+		HeaderCache: headerCache,
+		Reload: func() {
+			reloaded, err := configManager.LoadConfig()
+			if err != nil {
+				logging.Error("Configuration reload failed, keeping the current configuration: %v", err)
+				return
+			}
+			serverSetup.ReloadRepositories(reloaded.Repositories)
+
+			current := *serverSetup.Config
+			current.Repositories, reloaded.Repositories = nil, nil
+			if !reflect.DeepEqual(current, reloaded) {
+				logging.Warning("Only repositories are reloaded, restart to apply the other configuration changes")
+			}
+		},
+	}
 	if err := serverManager.StartAndWait(); err != nil {
 		logging.Fatal("Server failed: %v", err)
 	}
 }
 
+// importMirrorTree seeds the cache of the repository served at repoPath from
+// an existing mirror tree of it.
+func importMirrorTree(cfg config.Config, cache storage.Cache, headerCache storage.HeaderCache, validationCache storage.ValidationCache, client *http.Client, dir, repoPath string) error {
+	if !cfg.Cache.Enabled {
+		return fmt.Errorf("the cache is disabled")
+	}
+
+	basePath := utils.NormalizeBasePath(repoPath)
+	for _, repo := range cfg.Repositories {
+		if utils.NormalizeBasePath(repo.Path) != basePath {
+			continue
+		}
+		originURL, err := utils.NormalizeOriginURL(repo.URL, cfg.Server.DefaultOriginScheme, cfg.Server.DefaultOriginPort)
+		if err != nil {
+			return err
+		}
+		if _, ok := utils.LocalOriginPath(originURL); ok {
+			return fmt.Errorf("repository %s is served from a local directory and not cached", repo.Path)
+		}
+
+		serverConfig := handlers.NewRepositoryServerConfig(originURL+"/", cache, headerCache, validationCache, client, &cfg)
+		serverConfig.LocalPath = basePath
+		serverConfig.IncludePaths = repo.Include
+		serverConfig.ExcludePaths = repo.Exclude
+
+		logging.Info("Importing %s into the cache of repository %s", dir, basePath)
+		start := time.Now()
+		result, err := handlers.ImportTree(serverConfig, dir)
+		if err != nil {
+			return err
+		}
+		logging.Info("Imported %d files (%s, %d hardlinked) in %s, skipped %d, failed %d",
+			result.Files, utils.FormatSize(result.Bytes), result.Linked, time.Since(start).Round(time.Second), result.Skipped, result.Failed)
+		return nil
+	}
+	return fmt.Errorf("no repository is configured at path %q, set -import-repo", repoPath)
+}
+
 func setupLogging(cfg config.Config) error {
 	logConfig := logging.LogConfig{
 		FilePath:        cfg.Logging.FilePath,
 		DisableTerminal: cfg.Logging.DisableTerminal,
 		MaxSize:         cfg.Logging.MaxSize,
 		Level:           logging.ParseLogLevel(cfg.Logging.Level),
+		Format:          cfg.Logging.Format,
+	}
+	if cfg.Logging.Output != "" {
+		output, err := logging.NewRemoteOutput(cfg.Logging.Output)
+		if err != nil {
+			return err
+		}
+		logConfig.Output = output
 	}
 
 	return logging.Initialize(logConfig)
 }
 
+// startOrphanSweeps reconciles the cache with the header cache in the
+// background, once now and then periodically, removing headers without a body
+// and bodies without headers.
+func startOrphanSweeps(cfg config.Config, cache storage.Cache, headerCache storage.HeaderCache) {
+	_, cacheListable := cache.(storage.KeyLister)
+	_, headersListable := headerCache.(storage.KeyLister)
+	if !cacheListable || !headersListable {
+		logging.Debug("Orphan sweeps need a disk cache and file header cache, skipping them")
+		return
+	}
+
+	interval := time.Duration(cfg.Cache.OrphanSweepInterval) * time.Second
+	if cfg.Cache.OrphanSweepInterval == 0 {
+		interval = config.DefaultOrphanSweepInterval * time.Second
+	}
+
+	sweep := func() {
+		result, err := storage.SweepOrphans(cache, headerCache, handlers.IsFetchInProgress)
+		if err != nil {
+			logging.Error("Orphan sweep failed: %v", err)
+			return
+		}
+		if result.OrphanedHeaders > 0 || result.OrphanedBodies > 0 {
+			logging.Info("Orphan sweep removed %d headers without a body and %d bodies without headers",
+				result.OrphanedHeaders, result.OrphanedBodies)
+		}
+	}
+
+	go func() {
+		sweep()
+		if interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sweep()
+		}
+	}()
+}
+
+// startPoolGC periodically removes cached pool files that no cached index
+// references any more, if poolGCInterval is set. The first collection runs
+// one interval after startup, once clients had a chance to refresh the
+// indexes.
+func startPoolGC(cfg config.Config, cache storage.Cache, headerCache storage.HeaderCache) {
+	if cfg.Cache.PoolGCInterval <= 0 {
+		return
+	}
+	_, listable := cache.(storage.KeyLister)
+	_, timed := cache.(storage.EntryTimesLister)
+	if !listable || !timed {
+		logging.Warning("Pool GC needs the LRU disk cache, skipping it")
+		return
+	}
+
+	interval := time.Duration(cfg.Cache.PoolGCInterval) * time.Second
+	grace := time.Duration(cfg.Cache.PoolGCGracePeriod) * time.Second
+	if cfg.Cache.PoolGCGracePeriod == 0 {
+		grace = config.DefaultPoolGCGracePeriod * time.Second
+	}
+	maxIndexAge := time.Duration(cfg.Cache.PoolGCMaxIndexAge) * time.Second
+	if cfg.Cache.PoolGCMaxIndexAge == 0 {
+		maxIndexAge = config.DefaultPoolGCMaxIndexAge * time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			result, err := handlers.CollectOrphanPoolFiles(cache, headerCache, grace, maxIndexAge)
+			if err != nil {
+				logging.Error("Pool GC failed: %v", err)
+				continue
+			}
+			logging.Info("Pool GC removed %d unreferenced pool files (%s) from %d archives, skipped %d archives",
+				result.Deleted, utils.FormatSize(result.Reclaimed), result.Archives, result.Skipped)
+		}
+	}()
+}
+
 func createHTTPClient(cfg config.Config) *http.Client {
 	timeoutSeconds := cfg.Server.Timeout
 	if timeoutSeconds <= 0 {
 		timeoutSeconds = 30
 	}
 
-	return utils.CreateHTTPClient(timeoutSeconds)
+	client := utils.CreateHTTPClient(timeoutSeconds)
+	originTLS := cfg.Server.OriginTLS
+	if tlsConfig, err := utils.OriginTLSConfig(originTLS.MinVersion, originTLS.CipherSuites, originTLS.Pins); err == nil {
+		if transport, ok := client.Transport.(*http.Transport); ok {
+			transport.TLSClientConfig = tlsConfig
+		}
+	}
+	if cfg.Server.MinThroughput != "" {
+		// Bodies are bounded by the throughput limit instead, so the timeout
+		// only limits the wait for the response headers.
+		if transport, ok := client.Transport.(*http.Transport); ok {
+			transport.ResponseHeaderTimeout = client.Timeout
+			client.Timeout = 0
+		}
+	}
+	client.CheckRedirect = utils.RedirectPolicy(cfg.Server.MaxRedirects, cfg.Server.RedirectSameHost, cfg.Server.RedirectAllowedHosts)
+	return client
 }
@@ -4,25 +4,107 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/yolkispalkis/go-apt-cache/internal/utils"
 )
 
 type Repository struct {
-	URL     string `json:"url"`
-	Path    string `json:"path"`
-	Enabled bool   `json:"enabled"`
+	URL          string        `json:"url"`
+	Path         string        `json:"path"`
+	Enabled      bool          `json:"enabled"`
+	WarmupPaths  []string      `json:"warmupPaths"`  // Critical metadata fetched at startup, e.g. "dists/stable/InRelease"
+	OriginHost   string        `json:"originHost"`   // Host header sent to the origin instead of the URL's host
+	SelfTestPath string        `json:"selfTestPath"` // Canary fetched end to end by /admin/selftest
+	SuiteOrigins []SuiteOrigin `json:"suiteOrigins"` // Suites fetched from another origin, e.g. security updates
+	Include      []string      `json:"include"`      // Path globs served, everything if empty, e.g. "dists/*/main/**"
+	Exclude      []string      `json:"exclude"`      // Path globs answered with 404, e.g. "pool/non-free/**"
+	Mirrors      []string      `json:"mirrors"`      // Further origins with the same content as URL, used when it is down
+	OriginOrder  string        `json:"originOrder"`  // "static" (default) tries URL and mirrors in order, "latency" the fastest first
+	PassThrough  []PassThrough `json:"passThrough"`  // Paths proxied uncached for methods other than GET and HEAD
+}
+
+// SuiteOrigin fetches the suites matching Suite, and the paths matching
+// Paths, from URL instead of the repository's own origin.
+type SuiteOrigin struct {
+	Suite string   `json:"suite"` // Glob matched against the suite name, e.g. "*-security"
+	URL   string   `json:"url"`
+	Paths []string `json:"paths"` // Further globs relative to the repository, e.g. "pool/updates/**"
+}
+
+// PassThrough lets requests with further methods than GET and HEAD, such as
+// the POSTs of a search API, through to the origin for the paths matching
+// Path. They are proxied as they are and never cached.
+type PassThrough struct {
+	Path    string   `json:"path"`    // Glob relative to the repository, e.g. "api/search"
+	Methods []string `json:"methods"` // Defaults to POST
 }
 
 type CacheConfig struct {
-	Directory          string `json:"directory"`
-	MaxSize            string `json:"maxSize"`
-	Enabled            bool   `json:"enabled"`
-	LRU                bool   `json:"lru"`
-	CleanOnStart       bool   `json:"cleanOnStart"`
-	ValidationCacheTTL int    `json:"validationCacheTTL"`
+	Directory               string              `json:"directory"`
+	MaxSize                 string              `json:"maxSize"`
+	MaxEntries              int                 `json:"maxEntries"` // Zero means no limit on the number of cached files
+	Dedup                   bool                `json:"dedup"`      // Store identical content once, shared by hard links
+	Enabled                 bool                `json:"enabled"`
+	LRU                     bool                `json:"lru"`
+	CleanOnStart            bool                `json:"cleanOnStart"`
+	ValidationCacheTTL      int                 `json:"validationCacheTTL"`
+	Allowlist               []string            `json:"allowlist"`    // Path globs that may be cached, empty allows everything
+	ManifestFile            string              `json:"manifestFile"` // Newline-delimited path globs that may be cached, reloaded on SIGHUP
+	ImmutableFastPath       bool                `json:"immutableFastPath"`
+	ImmutablePaths          []string            `json:"immutablePaths"` // Extra immutable path globs, e.g. snapshot trees
+	ImmutableEntries        int                 `json:"immutableEntries"`
+	SuiteConsistencyLock    bool                `json:"suiteConsistencyLock"`
+	SuiteBatchRefresh       bool                `json:"suiteBatchRefresh"`
+	InReleaseNotFoundTTL    int                 `json:"inReleaseNotFoundTTL"` // Seconds an InRelease 404 is remembered
+	CanonicalCompression    string              `json:"canonicalCompression"` // "gz" serves uncompressed indexes from the cached .gz, "none" or empty caches every requested variant
+	HeaderRedis             RedisConfig         `json:"headerRedis"`
+	HeaderCacheEntries      int                 `json:"headerCacheEntries"`    // Headers kept in memory in front of the header cache, zero disables
+	StreamToDiskThreshold   string              `json:"streamToDiskThreshold"` // Size with unit, e.g. "64MB", empty disables
+	StreamToDiskTee         bool                `json:"streamToDiskTee"`
+	NegativeCacheRules      []NegativeCacheRule `json:"negativeCacheRules"`
+	StaleWhileRefresh       bool                `json:"staleWhileRefresh"`
+	DisableRevalidation     bool                `json:"disableRevalidation"`     // Never revalidate cached files, not even Release files, for frozen snapshots
+	HonorClientCacheControl bool                `json:"honorClientCacheControl"` // Honor no-cache and only-if-cached in client requests
+	ValidateDebStructure    bool                `json:"validateDebStructure"`
+	RejectCaptivePortals    bool                `json:"rejectCaptivePortals"`
+	VerifyIndexChecksums    bool                `json:"verifyIndexChecksums"`
+	MinimumChecksum         string              `json:"minimumChecksum"`       // "MD5", "SHA1", "SHA256" or "SHA512", empty accepts any
+	EvictionGracePeriod     int                 `json:"evictionGracePeriod"`   // Seconds a new entry is protected from eviction
+	OrphanSweepInterval     int                 `json:"orphanSweepInterval"`   // Seconds between header/body consistency sweeps, defaults to 3600, negative sweeps only at startup
+	Admission               string              `json:"admission"`             // Admission policy for new pool files, "tinylfu" or empty to cache everything
+	DiskFullRetryInterval   int                 `json:"diskFullRetryInterval"` // Seconds between cache write attempts while the disk is full, defaults to 30, negative disables pass-through
+	CacheSetCookieResponses bool                `json:"cacheSetCookieResponses"`
+	ResumeAttempts          int                 `json:"resumeAttempts"`    // Range requests made to complete a large download that broke off, defaults to 3, negative disables
+	PoolGCInterval          int                 `json:"poolGCInterval"`    // Seconds between collections of pool files no cached index references, zero disables
+	PoolGCGracePeriod       int                 `json:"poolGCGracePeriod"` // Seconds an unreferenced pool file is kept after it was fetched, defaults to 604800
+	PoolGCMaxIndexAge       int                 `json:"poolGCMaxIndexAge"` // Seconds since its Release was fetched for a suite to count as fresh, defaults to 86400
+}
+
+// NegativeCacheRule sets how long an upstream error status is remembered for
+// paths matching Path. The first matching rule applies; Status defaults to
+// 404 and a TTL of zero disables negative caching for the matched paths.
+type NegativeCacheRule struct {
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	TTL    int    `json:"ttl"` // Seconds
+}
+
+// RedisConfig points the header cache at a Redis server shared by several
+// mirror nodes. An empty address keeps headers on local disk.
+type RedisConfig struct {
+	Address   string `json:"address"`
+	Password  string `json:"password"`
+	DB        int    `json:"db"`
+	KeyPrefix string `json:"keyPrefix"`
+	TTL       int    `json:"ttl"` // Seconds, zero keeps headers until Redis evicts them
 }
 
 type LoggingConfig struct {
@@ -30,21 +112,156 @@ type LoggingConfig struct {
 	DisableTerminal bool   `json:"disableTerminal"`
 	MaxSize         string `json:"maxSize"`
 	Level           string `json:"level"`
+	Format          string `json:"format"` // "text" (default) or "json"
+	Output          string `json:"output"` // Also send log lines to "tcp://host:port" or "udp://host:port"
+}
+
+// QueryStringRule allows the listed query keys on paths matching Path when
+// the query string mode is "allow".
+type QueryStringRule struct {
+	Path string   `json:"path"`
+	Keys []string `json:"keys"`
 }
 
 type ServerConfig struct {
-	ListenAddress         string      `json:"listenAddress"`
-	UnixSocketPath        string      `json:"unixSocketPath"`
-	UnixSocketPermissions os.FileMode `json:"unixSocketPermissions"`
-	LogRequests           bool        `json:"logRequests"`
-	Timeout               int         `json:"timeout"` // General timeout, kept for backward compatibility
-	ReadTimeout           int         `json:"readTimeout"`
-	WriteTimeout          int         `json:"writeTimeout"`
-	IdleTimeout           int         `json:"idleTimeout"`
+	ListenAddress          string            `json:"listenAddress"`
+	UnixSocketPath         string            `json:"unixSocketPath"`
+	UnixSocketPermissions  os.FileMode       `json:"unixSocketPermissions"`
+	LogRequests            bool              `json:"logRequests"`
+	Timeout                int               `json:"timeout"` // General timeout, kept for backward compatibility
+	ReadTimeout            int               `json:"readTimeout"`
+	WriteTimeout           int               `json:"writeTimeout"`
+	ClientWriteTimeout     int               `json:"clientWriteTimeout"` // Seconds a single write to a client fetching from upstream may take, zero disables
+	IdleTimeout            int               `json:"idleTimeout"`
+	SlowRequestThreshold   int               `json:"slowRequestThreshold"` // Seconds, zero disables slow upstream logging
+	ClockSkewTolerance     int               `json:"clockSkewTolerance"`   // Seconds an origin Last-Modified may lie ahead of the local clock, defaults to 60
+	DownstreamCacheHeaders bool              `json:"downstreamCacheHeaders"`
+	DownstreamMaxAge       int               `json:"downstreamMaxAge"` // Seconds advertised for rarely changing files
+	SniffContentType       bool              `json:"sniffContentType"`
+	ContentDisposition     bool              `json:"contentDisposition"`
+	MaxWaiters             int               `json:"maxWaiters"` // Requests allowed to wait on one in-flight fetch, zero is unlimited
+	HopByHopHeaders        []string          `json:"hopByHopHeaders"`
+	QueryStringMode        string            `json:"queryStringMode"` // "reject" (default), "strip" or "allow"
+	QueryStringRules       []QueryStringRule `json:"queryStringRules"`
+	ResponseHeaders        map[string]string `json:"responseHeaders"` // Added to every client response, e.g. Strict-Transport-Security
+	ErrorPages             map[string]string `json:"errorPages"`      // HTML template files by status code, served instead of plain text errors to browsers
+	AdaptiveTimeout        bool              `json:"adaptiveTimeout"`
+	AdaptiveTimeoutFactor  float64           `json:"adaptiveTimeoutFactor"` // Multiplier applied to the origin's P95 latency
+	AdaptiveTimeoutMin     int               `json:"adaptiveTimeoutMin"`    // Seconds
+	AdaptiveTimeoutMax     int               `json:"adaptiveTimeoutMax"`    // Seconds, defaults to timeout
+	BypassUserAgents       []string          `json:"bypassUserAgents"`      // Regular expressions matched against User-Agent
+	BypassMode             string            `json:"bypassMode"`            // "revalidate" (default) or "passthrough"
+	CacheBypassHeader      string            `json:"cacheBypassHeader"`     // Defaults to X-Cache-Bypass
+	CacheBypassToken       string            `json:"cacheBypassToken"`
+	CacheBypassNetworks    []string          `json:"cacheBypassNetworks"`   // CIDRs or addresses allowed to bypass the cache
+	WarmupThreshold        float64           `json:"warmupThreshold"`       // Fraction of warmupPaths that must be cached, defaults to all
+	WarmupMaxWait          int               `json:"warmupMaxWait"`         // Seconds after which warming ends regardless
+	OriginProbeInterval    int               `json:"originProbeInterval"`   // Seconds between probes of repositories with mirrors, defaults to 60
+	BackgroundWorkers      int               `json:"backgroundWorkers"`     // Goroutines running background refreshes, defaults to 8, zero is unbounded
+	BackgroundQueue        int               `json:"backgroundQueue"`       // Background tasks waiting for a worker before new ones are dropped, defaults to 256
+	WarmupRetryAfter       int               `json:"warmupRetryAfter"`      // Seconds sent in Retry-After while warming
+	PrefetchWorkers        int               `json:"prefetchWorkers"`       // Concurrent warm-up fetches per repository, defaults to 1
+	OriginBandwidthLimit   string            `json:"originBandwidthLimit"`  // Bytes per second from all origins, e.g. "50MB", empty is unlimited
+	MaxRedirects           int               `json:"maxRedirects"`          // Redirect hops followed per upstream request, defaults to 10
+	MinThroughput          string            `json:"minThroughput"`         // Bytes per second an upstream body must sustain, e.g. "20KB", empty disables
+	MaxBufferedBytes       string            `json:"maxBufferedBytes"`      // Response bytes buffered by concurrent cache misses, e.g. "1GB", empty is unlimited
+	RetryBudgetRatio       float64           `json:"retryBudgetRatio"`      // Retries allowed per successful origin request, zero is unlimited
+	RetryBudgetMinRetries  int               `json:"retryBudgetMinRetries"` // Retries per second allowed regardless of the ratio, defaults to 10
+	RateLimitBackoff       int               `json:"rateLimitBackoff"`      // Seconds to leave an origin alone after a 429 without Retry-After, 0 forwards 429s
+	MaxRateLimitBackoff    int               `json:"maxRateLimitBackoff"`   // Longest back-off a Retry-After can ask for, in seconds
+	RedirectSameHost       bool              `json:"redirectSameHost"`      // Only follow redirects to the origin's own host
+	RedirectAllowedHosts   []string          `json:"redirectAllowedHosts"`  // Further hosts redirects may lead to
+	StickyRedirectWindow   int               `json:"stickyRedirectWindow"`  // Seconds a suite's files follow the mirror its Release was redirected to, 0 disables
+	Overload               OverloadConfig    `json:"overload"`
+	Tracing                TracingConfig     `json:"tracing"`
+	OriginTLS              OriginTLSConfig   `json:"originTLS"`
+	Tenants                TenantConfig      `json:"tenants"`
+	MetricLabels           MetricLabelConfig `json:"metricLabels"`
+	SuiteStats             bool              `json:"suiteStats"`          // Break hit ratio and traffic down by suite at /admin/suites
+	HitRatioWindow         int               `json:"hitRatioWindow"`      // Seconds the hit ratio in /metrics and /status covers, defaults to 300, negative disables
+	AggregateIndexes       bool              `json:"aggregateIndexes"`    // Serve the Packages of several components merged at /aggregate/Packages
+	CacheFill              bool              `json:"cacheFill"`           // Store the body of authenticated PUT requests in the cache, requires admin credentials
+	RobotsTxt              string            `json:"robotsTxt"`           // Served at /robots.txt, empty disallows everything
+	FaviconStatus          int               `json:"faviconStatus"`       // 204 (default) or 404 for /favicon.ico
+	DefaultOriginScheme    string            `json:"defaultOriginScheme"` // Used for repository URLs without a scheme, defaults to https
+	DefaultOriginPort      string            `json:"defaultOriginPort"`   // Used for repository URLs without a port
+	EarlyHints             bool              `json:"earlyHints"`          // Experimental: 103 Early Hints for indexes listed in Release files
+	EarlyHintPaths         []string          `json:"earlyHintPaths"`
+}
+
+// OverloadConfig sets the limits of the overload controller. Zero disables a
+// limit; with all of them zero the controller is off.
+type OverloadConfig struct {
+	MaxRequests      int `json:"maxRequests"`      // Concurrent requests above which origin work is shed
+	HardMaxRequests  int `json:"hardMaxRequests"`  // Concurrent requests above which everything is shed
+	MaxOriginFetches int `json:"maxOriginFetches"` // Concurrent client fetches from origins
+	MaxGoroutines    int `json:"maxGoroutines"`
+	RetryAfter       int `json:"retryAfter"` // Seconds, defaults to 5
+}
+
+// TracingConfig sets where OpenTelemetry spans are exported to. Tracing is off
+// without an endpoint.
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint"`    // OTLP/HTTP traces URL, e.g. "http://localhost:4318/v1/traces"
+	ServiceName string            `json:"serviceName"` // Defaults to go-apt-cache
+	Headers     map[string]string `json:"headers"`     // Sent with every export, e.g. for authentication
+}
+
+// TenantConfig sets where the tenant of a request is read from. Each tenant
+// gets its own cache namespace; origin fetches are still shared.
+type TenantConfig struct {
+	Header     string   `json:"header"`     // Request header carrying the tenant, e.g. "X-Tenant"
+	PathPrefix bool     `json:"pathPrefix"` // Take the tenant from the first path segment and strip it
+	Names      []string `json:"names"`      // The known tenants, required; others in the header are rejected
+}
+
+// MetricLabelConfig breaks request metrics down by labels whose values rules
+// derive from the request path, never the path itself, so the number of
+// series stays bounded however many paths are requested.
+type MetricLabelConfig struct {
+	Rules     []MetricLabelRule `json:"rules"`
+	MaxValues int               `json:"maxValues"` // Distinct values per label before further ones count as "other", defaults to 32
+}
+
+// MetricLabelRule gives a label Value for request paths matching Pattern.
+// The first matching rule of a label wins; a label no rule matches is "none".
+type MetricLabelRule struct {
+	Label   string `json:"label"`   // e.g. "area", "arch" or "suite"
+	Pattern string `json:"pattern"` // Regular expression matched against the request path
+	Value   string `json:"value"`   // May refer to submatches, e.g. "$1"
+}
+
+// OriginTLSConfig restricts TLS connections to HTTPS origins.
+type OriginTLSConfig struct {
+	MinVersion   string              `json:"minVersion"`   // "1.0" to "1.3", defaults to 1.2
+	CipherSuites []string            `json:"cipherSuites"` // Go names of the TLS 1.2 suites allowed, all secure ones if empty
+	Pins         map[string][]string `json:"pins"`         // SHA-256 certificate fingerprints accepted per host, "*" for all others
+}
+
+func (t TenantConfig) Enabled() bool {
+	return t.Header != "" || t.PathPrefix
+}
+
+func (m MetricLabelConfig) Enabled() bool {
+	return len(m.Rules) > 0
+}
+
+func (o OverloadConfig) Enabled() bool {
+	return o.MaxRequests > 0 || o.HardMaxRequests > 0 || o.MaxOriginFetches > 0 || o.MaxGoroutines > 0
+}
+
+// AdminConfig protects the /admin/* and /metrics routes. With neither a
+// token nor a username configured the routes are open.
+type AdminConfig struct {
+	ListenAddress string `json:"listenAddress"` // Serve admin routes on their own listener instead of the main one
+	Token         string `json:"token"`         // Accepted as "Authorization: Bearer <token>"
+	Username      string `json:"username"`      // Accepted through basic auth together with Password
+	Password      string `json:"password"`
 }
 
 type Config struct {
 	Server       ServerConfig  `json:"server"`
+	Admin        AdminConfig   `json:"admin"`
 	Cache        CacheConfig   `json:"cache"`
 	Logging      LoggingConfig `json:"logging"`
 	Repositories []Repository  `json:"repositories"`
@@ -60,6 +277,37 @@ const (
 	DefaultLogLevel      = "info"
 	DefaultLogMaxSize    = "10MB"
 	DefaultTimeout       = 60
+
+	DefaultImmutableEntries      = 100000
+	DefaultSlowRequestThreshold  = 10
+	DefaultDownstreamMaxAge      = 86400
+	DefaultInReleaseNotFoundTTL  = 60
+	DefaultOrphanSweepInterval   = 3600
+	DefaultDiskFullRetryInterval = 30
+	DefaultResumeAttempts        = 3
+	DefaultHitRatioWindow        = 300
+	DefaultPoolGCGracePeriod     = 7 * 24 * 3600
+	DefaultPoolGCMaxIndexAge     = 24 * 3600
+	DefaultMetricLabelMaxValues  = 32
+
+	DefaultAdaptiveTimeoutFactor = 3.0
+	DefaultAdaptiveTimeoutMin    = 5
+
+	DefaultWarmupMaxWait = 300
+
+	DefaultOriginProbeInterval = 60
+
+	DefaultClockSkewTolerance = 60
+
+	DefaultBackgroundWorkers = 8
+	DefaultBackgroundQueue   = 256
+
+	DefaultRetryBudgetMinRetries = 10
+
+	DefaultRateLimitBackoff    = 60
+	DefaultMaxRateLimitBackoff = 3600
+
+	DefaultTracingServiceName = "go-apt-cache"
 )
 
 func DefaultConfig() Config {
@@ -73,6 +321,14 @@ func DefaultConfig() Config {
 			ReadTimeout:           DefaultReadTimeout,
 			WriteTimeout:          DefaultWriteTimeout,
 			IdleTimeout:           DefaultIdleTimeout,
+			SlowRequestThreshold:  DefaultSlowRequestThreshold,
+			WarmupMaxWait:         DefaultWarmupMaxWait,
+			OriginProbeInterval:   DefaultOriginProbeInterval,
+			ClockSkewTolerance:    DefaultClockSkewTolerance,
+			BackgroundWorkers:     DefaultBackgroundWorkers,
+			BackgroundQueue:       DefaultBackgroundQueue,
+			RateLimitBackoff:      DefaultRateLimitBackoff,
+			MaxRateLimitBackoff:   DefaultMaxRateLimitBackoff,
 		},
 		Cache: CacheConfig{
 			Directory:          "./cache",
@@ -145,16 +401,99 @@ func CreateDefaultConfigFile(path string) error {
 	return SaveConfig(config, path)
 }
 
+// headerNamePattern matches valid HTTP header names (RFC 9110 tokens).
+var headerNamePattern = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// metricLabelPattern matches valid Prometheus label names; names starting
+// with two underscores are reserved.
+var metricLabelPattern = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// protectedResponseHeaders describe the body or the connection and cannot be
+// set through responseHeaders.
+var protectedResponseHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Content-Range":     true,
+	"Content-Encoding":  true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Upgrade":           true,
+	"Trailer":           true,
+}
+
 func ValidateConfig(config Config) error {
 	if len(config.Repositories) == 0 {
 		return fmt.Errorf("no repositories configured")
 	}
 
+	basePaths := make(map[string]bool, len(config.Repositories))
+	for _, repo := range config.Repositories {
+		if !repo.Enabled {
+			continue
+		}
+		basePath := utils.NormalizeBasePath(repo.Path)
+		if basePaths[basePath] {
+			return fmt.Errorf("more than one repository is served at path %s", basePath)
+		}
+		basePaths[basePath] = true
+		originURL, err := utils.NormalizeOriginURL(repo.URL, config.Server.DefaultOriginScheme, config.Server.DefaultOriginPort)
+		if err != nil {
+			return fmt.Errorf("invalid url for repository %s: %w", repo.Path, err)
+		}
+		if root, ok := utils.LocalOriginPath(originURL); ok {
+			if info, err := os.Stat(root); err != nil || !info.IsDir() {
+				return fmt.Errorf("directory %s of repository %s does not exist", root, repo.Path)
+			}
+		}
+		for _, mirror := range repo.Mirrors {
+			mirrorURL, err := utils.NormalizeOriginURL(mirror, config.Server.DefaultOriginScheme, config.Server.DefaultOriginPort)
+			if err != nil {
+				return fmt.Errorf("invalid mirror for repository %s: %w", repo.Path, err)
+			}
+			if _, ok := utils.LocalOriginPath(mirrorURL); ok {
+				return fmt.Errorf("mirror %s of repository %s must not be a local directory", mirror, repo.Path)
+			}
+		}
+		switch repo.OriginOrder {
+		case "", "static", "latency":
+		default:
+			return fmt.Errorf("invalid origin order %q for repository %s", repo.OriginOrder, repo.Path)
+		}
+		for _, rule := range repo.SuiteOrigins {
+			if _, err := path.Match(rule.Suite, ""); err != nil {
+				return fmt.Errorf("invalid suite pattern %q for repository %s", rule.Suite, repo.Path)
+			}
+			if rule.Suite == "" && len(rule.Paths) == 0 {
+				return fmt.Errorf("suite origin %s of repository %s matches nothing", rule.URL, repo.Path)
+			}
+			ruleURL, err := utils.NormalizeOriginURL(rule.URL, config.Server.DefaultOriginScheme, config.Server.DefaultOriginPort)
+			if err != nil {
+				return fmt.Errorf("invalid suite origin for repository %s: %w", repo.Path, err)
+			}
+			if _, ok := utils.LocalOriginPath(ruleURL); ok {
+				return fmt.Errorf("suite origin %s of repository %s must not be a local directory", rule.URL, repo.Path)
+			}
+		}
+		for _, rule := range repo.PassThrough {
+			if _, err := path.Match(rule.Path, ""); err != nil || strings.Trim(rule.Path, "/") == "" {
+				return fmt.Errorf("invalid pass-through path %q for repository %s", rule.Path, repo.Path)
+			}
+			for _, method := range rule.Methods {
+				if !headerNamePattern.MatchString(method) || method == http.MethodConnect || method == http.MethodTrace {
+					return fmt.Errorf("invalid pass-through method %q for repository %s", method, repo.Path)
+				}
+			}
+		}
+	}
+
 	if config.Cache.Enabled {
 		if config.Cache.Directory == "" {
 			return fmt.Errorf("cache directory not specified")
 		}
 
+		if config.Cache.HeaderCacheEntries < 0 {
+			return fmt.Errorf("headerCacheEntries must not be negative")
+		}
 		if _, err := utils.ParseSize(config.Cache.MaxSize); err != nil {
 			return fmt.Errorf("invalid cache max size: %s", config.Cache.MaxSize)
 		}
@@ -168,5 +507,216 @@ func ValidateConfig(config Config) error {
 		return fmt.Errorf("invalid listen address: %s", config.Server.ListenAddress)
 	}
 
+	if _, _, err := net.SplitHostPort(config.Admin.ListenAddress); config.Admin.ListenAddress != "" && err != nil {
+		return fmt.Errorf("invalid admin listen address: %s", config.Admin.ListenAddress)
+	}
+
+	if config.Admin.Username != "" && config.Admin.Password == "" {
+		return fmt.Errorf("admin username requires a password")
+	}
+
+	for _, pattern := range config.Server.BypassUserAgents {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid bypass user agent pattern %q: %w", pattern, err)
+		}
+	}
+
+	switch config.Server.FaviconStatus {
+	case 0, 204, 404:
+	default:
+		return fmt.Errorf("invalid favicon status: %d", config.Server.FaviconStatus)
+	}
+
+	switch config.Server.BypassMode {
+	case "", "revalidate", "passthrough":
+	default:
+		return fmt.Errorf("invalid bypass mode: %s", config.Server.BypassMode)
+	}
+
+	switch config.Cache.CanonicalCompression {
+	case "", "none", "gz":
+	default:
+		return fmt.Errorf("invalid canonical compression: %s", config.Cache.CanonicalCompression)
+	}
+
+	switch config.Logging.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("invalid log format: %s", config.Logging.Format)
+	}
+
+	switch config.Server.QueryStringMode {
+	case "", "reject", "strip", "allow":
+	default:
+		return fmt.Errorf("invalid query string mode: %s", config.Server.QueryStringMode)
+	}
+
+	if _, err := utils.ParseNetworks(config.Server.CacheBypassNetworks); err != nil {
+		return fmt.Errorf("invalid cache bypass network: %w", err)
+	}
+
+	if config.Server.MinThroughput != "" {
+		if _, err := utils.ParseSize(config.Server.MinThroughput); err != nil {
+			return fmt.Errorf("invalid minimum throughput: %s", config.Server.MinThroughput)
+		}
+	}
+
+	if config.Server.MaxRedirects < 0 {
+		return fmt.Errorf("invalid max redirects: %d", config.Server.MaxRedirects)
+	}
+
+	if config.Server.MaxWaiters < 0 {
+		return fmt.Errorf("invalid max waiters: %d", config.Server.MaxWaiters)
+	}
+
+	if config.Server.MaxBufferedBytes != "" {
+		if _, err := utils.ParseSize(config.Server.MaxBufferedBytes); err != nil {
+			return fmt.Errorf("invalid max buffered bytes: %s", config.Server.MaxBufferedBytes)
+		}
+	}
+
+	if config.Server.ClientWriteTimeout < 0 {
+		return fmt.Errorf("invalid client write timeout: %d", config.Server.ClientWriteTimeout)
+	}
+
+	if config.Server.RetryBudgetRatio < 0 {
+		return fmt.Errorf("invalid retry budget ratio: %v", config.Server.RetryBudgetRatio)
+	}
+	if config.Server.RetryBudgetMinRetries < 0 {
+		return fmt.Errorf("invalid retry budget minimum: %d", config.Server.RetryBudgetMinRetries)
+	}
+
+	if _, err := utils.OriginTLSConfig(config.Server.OriginTLS.MinVersion, config.Server.OriginTLS.CipherSuites, config.Server.OriginTLS.Pins); err != nil {
+		return fmt.Errorf("invalid origin TLS settings: %w", err)
+	}
+
+	if config.Server.BackgroundWorkers < 0 {
+		return fmt.Errorf("invalid background workers: %d", config.Server.BackgroundWorkers)
+	}
+
+	if config.Server.BackgroundQueue < 0 {
+		return fmt.Errorf("invalid background queue: %d", config.Server.BackgroundQueue)
+	}
+
+	if config.Server.CacheFill && config.Admin.Token == "" && config.Admin.Username == "" {
+		return fmt.Errorf("cache fill requires admin.token or admin.username")
+	}
+	for code, file := range config.Server.ErrorPages {
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 400 || status > 599 {
+			return fmt.Errorf("invalid error page status %q, expected a 4xx or 5xx code", code)
+		}
+		if file == "" {
+			return fmt.Errorf("error page for %d has no template file", status)
+		}
+	}
+
+	for name := range config.Server.ResponseHeaders {
+		if !headerNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid response header name %q", name)
+		}
+		if strings.ContainsAny(config.Server.ResponseHeaders[name], "\r\n") {
+			return fmt.Errorf("value of response header %s must be a single line", name)
+		}
+		if protectedResponseHeaders[http.CanonicalHeaderKey(name)] {
+			return fmt.Errorf("response header %s is set by the server and cannot be configured", name)
+		}
+	}
+
+	if config.Server.RateLimitBackoff < 0 || config.Server.MaxRateLimitBackoff < 0 {
+		return fmt.Errorf("invalid rate limit back-off: %d (max %d)", config.Server.RateLimitBackoff, config.Server.MaxRateLimitBackoff)
+	}
+	if config.Server.StickyRedirectWindow < 0 {
+		return fmt.Errorf("invalid sticky redirect window: %d", config.Server.StickyRedirectWindow)
+	}
+	if config.Server.ClockSkewTolerance < 0 {
+		return fmt.Errorf("invalid clock skew tolerance: %d", config.Server.ClockSkewTolerance)
+	}
+
+	if config.Server.OriginProbeInterval < 0 {
+		return fmt.Errorf("invalid origin probe interval: %d", config.Server.OriginProbeInterval)
+	}
+
+	if config.Server.PrefetchWorkers < 0 {
+		return fmt.Errorf("invalid prefetch workers: %d", config.Server.PrefetchWorkers)
+	}
+
+	overload := config.Server.Overload
+	if overload.MaxRequests < 0 || overload.HardMaxRequests < 0 || overload.MaxOriginFetches < 0 || overload.MaxGoroutines < 0 {
+		return fmt.Errorf("overload limits must not be negative")
+	}
+	if overload.MaxRequests > 0 && overload.HardMaxRequests > 0 && overload.HardMaxRequests < overload.MaxRequests {
+		return fmt.Errorf("overload hardMaxRequests (%d) is below maxRequests (%d)", overload.HardMaxRequests, overload.MaxRequests)
+	}
+
+	tenants := config.Server.Tenants
+	if tenants.Enabled() && len(tenants.Names) == 0 {
+		return fmt.Errorf("tenants need the tenant names")
+	}
+	for _, name := range tenants.Names {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid tenant name %q", name)
+		}
+	}
+
+	metricLabels := config.Server.MetricLabels
+	if metricLabels.MaxValues < 0 {
+		return fmt.Errorf("metricLabels maxValues must not be negative")
+	}
+	for _, rule := range metricLabels.Rules {
+		if !metricLabelPattern.MatchString(rule.Label) || strings.HasPrefix(rule.Label, "__") {
+			return fmt.Errorf("invalid metric label name %q", rule.Label)
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern for metric label %s: %w", rule.Label, err)
+		}
+		if rule.Value == "" {
+			return fmt.Errorf("metric label rule for %s has no value", rule.Label)
+		}
+	}
+
+	if endpoint := config.Server.Tracing.Endpoint; endpoint != "" {
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid tracing endpoint: %s", endpoint)
+		}
+	}
+
+	if config.Server.OriginBandwidthLimit != "" {
+		if _, err := utils.ParseSize(config.Server.OriginBandwidthLimit); err != nil {
+			return fmt.Errorf("invalid origin bandwidth limit: %s", config.Server.OriginBandwidthLimit)
+		}
+	}
+
+	if config.Cache.MinimumChecksum != "" {
+		if _, err := utils.ParseChecksumAlgorithm(config.Cache.MinimumChecksum); err != nil {
+			return fmt.Errorf("invalid minimum checksum: %w", err)
+		}
+	}
+
+	switch config.Cache.Admission {
+	case "", "tinylfu":
+	default:
+		return fmt.Errorf("invalid cache admission policy: %s", config.Cache.Admission)
+	}
+
+	if config.Cache.EvictionGracePeriod < 0 {
+		return fmt.Errorf("invalid eviction grace period: %d", config.Cache.EvictionGracePeriod)
+	}
+	if config.Cache.PoolGCInterval < 0 || config.Cache.PoolGCGracePeriod < 0 || config.Cache.PoolGCMaxIndexAge < 0 {
+		return fmt.Errorf("poolGCInterval, poolGCGracePeriod and poolGCMaxIndexAge must not be negative")
+	}
+
+	for _, rule := range config.Cache.NegativeCacheRules {
+		if rule.Path == "" {
+			return fmt.Errorf("negative cache rule without a path")
+		}
+		if rule.Status != 0 && (rule.Status < 400 || rule.Status > 599) {
+			return fmt.Errorf("invalid negative cache status for %s: %d", rule.Path, rule.Status)
+		}
+		if rule.TTL < 0 {
+			return fmt.Errorf("invalid negative cache ttl for %s: %d", rule.Path, rule.TTL)
+		}
+	}
+
 	return nil
 }
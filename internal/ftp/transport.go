@@ -0,0 +1,275 @@
+// Package ftp implements an http.RoundTripper for ftp:// URLs so that FTP
+// origins can be fetched through the same http.Client as HTTP origins.
+package ftp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPort = "21"
+
+// Transport fetches files from FTP servers using passive mode. GET and HEAD
+// are supported; Last-Modified comes from MDTM and Content-Length from SIZE.
+type Transport struct {
+	DialTimeout time.Duration
+}
+
+func NewTransport(dialTimeout time.Duration) *Transport {
+	return &Transport{DialTimeout: dialTimeout}
+}
+
+type session struct {
+	conn net.Conn
+	text *textproto.Conn
+	data net.Conn
+}
+
+func (s *session) close() {
+	if s.data != nil {
+		s.data.Close()
+	}
+	s.text.Close()
+}
+
+func (s *session) cmd(format string, args ...interface{}) (int, string, error) {
+	if err := s.text.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	return s.text.ReadResponse(0)
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return newResponse(req, http.StatusMethodNotAllowed, nil, -1), nil
+	}
+
+	ctx := req.Context()
+	s, err := t.connect(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, s.close)
+
+	resp, err := t.fetch(req, s, stop)
+	if err != nil || resp.Body == http.NoBody {
+		stop()
+		s.close()
+	}
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+func (t *Transport) connect(ctx context.Context, req *http.Request) (*session, error) {
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(req.URL.Hostname(), defaultPort)
+	}
+
+	dialer := &net.Dialer{Timeout: t.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("ftp: dial %s: %w", host, err)
+	}
+	s := &session{conn: conn, text: textproto.NewConn(conn)}
+
+	if _, _, err := s.text.ReadResponse(220); err != nil {
+		s.close()
+		return nil, fmt.Errorf("ftp: greeting: %w", err)
+	}
+
+	user, pass := "anonymous", "anonymous@"
+	if req.URL.User != nil {
+		user = req.URL.User.Username()
+		if p, ok := req.URL.User.Password(); ok {
+			pass = p
+		}
+	}
+
+	code, msg, err := s.cmd("USER %s", user)
+	if err == nil && code == 331 {
+		code, msg, err = s.cmd("PASS %s", pass)
+	}
+	if err == nil && code != 230 && code != 202 {
+		err = fmt.Errorf("%d %s", code, msg)
+	}
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("ftp: login: %w", err)
+	}
+
+	if code, msg, err := s.cmd("TYPE I"); err != nil || code != 200 {
+		s.close()
+		if err == nil {
+			err = fmt.Errorf("%d %s", code, msg)
+		}
+		return nil, fmt.Errorf("ftp: TYPE I: %w", err)
+	}
+
+	return s, nil
+}
+
+func (t *Transport) fetch(req *http.Request, s *session, stop func() bool) (*http.Response, error) {
+	path := req.URL.Path
+	header := make(http.Header)
+
+	code, msg, err := s.cmd("SIZE %s", path)
+	if err != nil {
+		return nil, fmt.Errorf("ftp: SIZE: %w", err)
+	}
+	if code == 550 {
+		return newResponse(req, http.StatusNotFound, header, -1), nil
+	}
+	size := int64(-1)
+	if code == 213 {
+		if n, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err == nil {
+			size = n
+			header.Set("Content-Length", strconv.FormatInt(n, 10))
+		}
+	}
+
+	var modTime time.Time
+	if code, msg, err := s.cmd("MDTM %s", path); err == nil && code == 213 {
+		if parsed, ok := parseMDTM(msg); ok {
+			modTime = parsed
+			header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		}
+	}
+
+	if !modTime.IsZero() {
+		if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && !modTime.Truncate(time.Second).After(since) {
+			return newResponse(req, http.StatusNotModified, header, -1), nil
+		}
+	}
+
+	if req.Method == http.MethodHead {
+		return newResponse(req, http.StatusOK, header, size), nil
+	}
+
+	dataAddr, err := s.passive()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: t.DialTimeout}
+	s.data, err = dialer.DialContext(req.Context(), "tcp", dataAddr)
+	if err != nil {
+		return nil, fmt.Errorf("ftp: data connection: %w", err)
+	}
+
+	code, msg, err = s.cmd("RETR %s", path)
+	if err != nil {
+		return nil, fmt.Errorf("ftp: RETR: %w", err)
+	}
+	if code == 550 {
+		return newResponse(req, http.StatusNotFound, header, -1), nil
+	}
+	if code != 125 && code != 150 {
+		return nil, fmt.Errorf("ftp: RETR: %d %s", code, msg)
+	}
+
+	resp := newResponse(req, http.StatusOK, header, size)
+	resp.Body = &retrBody{session: s, stop: stop}
+	return resp, nil
+}
+
+// passive enters passive mode, preferring EPSV, and returns the address of
+// the data connection. The host announced by PASV is ignored in favour of
+// the control connection's peer, since servers behind NAT often announce
+// private addresses.
+func (s *session) passive() (string, error) {
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return "", fmt.Errorf("ftp: %w", err)
+	}
+
+	if code, msg, err := s.cmd("EPSV"); err == nil && code == 229 {
+		start := strings.Index(msg, "(|||")
+		end := strings.LastIndex(msg, "|)")
+		if start >= 0 && end > start+4 {
+			return net.JoinHostPort(host, msg[start+4:end]), nil
+		}
+	}
+
+	code, msg, err := s.cmd("PASV")
+	if err != nil {
+		return "", fmt.Errorf("ftp: PASV: %w", err)
+	}
+	if code != 227 {
+		return "", fmt.Errorf("ftp: PASV: %d %s", code, msg)
+	}
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("ftp: malformed PASV reply: %s", msg)
+	}
+	parts := strings.Split(msg[start+1:end], ",")
+	if len(parts) != 6 {
+		return "", fmt.Errorf("ftp: malformed PASV reply: %s", msg)
+	}
+	p1, err1 := strconv.Atoi(strings.TrimSpace(parts[4]))
+	p2, err2 := strconv.Atoi(strings.TrimSpace(parts[5]))
+	if err1 != nil || err2 != nil {
+		return "", fmt.Errorf("ftp: malformed PASV reply: %s", msg)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p1*256+p2)), nil
+}
+
+// retrBody streams a RETR transfer and completes the FTP exchange on Close.
+type retrBody struct {
+	session *session
+	stop    func() bool
+	closed  bool
+}
+
+func (b *retrBody) Read(p []byte) (int, error) {
+	return b.session.data.Read(p)
+}
+
+func (b *retrBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.stop()
+
+	b.session.data.Close()
+	b.session.data = nil
+	b.session.text.ReadResponse(226)
+	b.session.text.PrintfLine("QUIT")
+	return b.session.text.Close()
+}
+
+// parseMDTM parses an MDTM reply of the form YYYYMMDDHHMMSS[.sss] in UTC.
+func parseMDTM(msg string) (time.Time, bool) {
+	value := strings.TrimSpace(msg)
+	if idx := strings.IndexByte(value, '.'); idx >= 0 {
+		value = value[:idx]
+	}
+	t, err := time.ParseInLocation("20060102150405", value, time.UTC)
+	return t, err == nil
+}
+
+func newResponse(req *http.Request, status int, header http.Header, contentLength int64) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          http.NoBody,
+		ContentLength: contentLength,
+		Request:       req,
+	}
+}
@@ -0,0 +1,142 @@
+package ftp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveFTP runs a minimal single-session FTP server that knows one file.
+func serveFTP(t *testing.T, name, content string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleFTPSession(conn, name, content)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func handleFTPSession(conn net.Conn, name, content string) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	var dataLn net.Listener
+
+	reply("220 test server")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch cmd {
+		case "USER":
+			reply("331 password please")
+		case "PASS":
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 ok")
+		case "SIZE":
+			if arg != name {
+				reply("550 no such file")
+				continue
+			}
+			reply("213 %d", len(content))
+		case "MDTM":
+			reply("213 20240102030405")
+		case "EPSV":
+			dataLn, _ = net.Listen("tcp", "127.0.0.1:0")
+			_, port, _ := net.SplitHostPort(dataLn.Addr().String())
+			reply("229 Entering Extended Passive Mode (|||%s|)", port)
+		case "RETR":
+			reply("150 opening data connection")
+			data, err := dataLn.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(data, content)
+			data.Close()
+			dataLn.Close()
+			reply("226 transfer complete")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestTransportGet(t *testing.T) {
+	addr := serveFTP(t, "/debian/dists/stable/Release", "Release content")
+
+	transport := &http.Transport{}
+	transport.RegisterProtocol("ftp", NewTransport(5*time.Second))
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+	resp, err := client.Get("ftp://" + addr + "/debian/dists/stable/Release")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "Release content" {
+		t.Errorf("Unexpected response: %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Last-Modified") != "Tue, 02 Jan 2024 03:04:05 GMT" {
+		t.Errorf("Unexpected Last-Modified: %q", resp.Header.Get("Last-Modified"))
+	}
+	if resp.ContentLength != int64(len("Release content")) {
+		t.Errorf("Unexpected Content-Length: %d", resp.ContentLength)
+	}
+}
+
+func TestTransportNotFoundAndNotModified(t *testing.T) {
+	addr := serveFTP(t, "/debian/dists/stable/Release", "Release content")
+	client := &http.Client{Transport: NewTransport(5 * time.Second)}
+
+	resp, err := client.Get("ftp://" + addr + "/debian/missing")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodHead, "ftp://"+addr+"/debian/dists/stable/Release", nil)
+	req.Header.Set("If-Modified-Since", "Wed, 03 Jan 2024 00:00:00 GMT")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("HEAD failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304, got %d", resp.StatusCode)
+	}
+}
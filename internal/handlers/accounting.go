@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+)
+
+// byteStats counts bytes across all requests, for the metrics endpoint. The
+// ratio of origin to client bytes shows how much bandwidth the cache saves.
+var byteStats struct {
+	client atomic.Int64 // Bytes of response bodies sent to clients
+	origin atomic.Int64 // Bytes of response bodies read from origins
+}
+
+// byteAccount counts the bytes of a single client request.
+type byteAccount struct {
+	client    atomic.Int64
+	origin    atomic.Int64
+	fetched   atomic.Bool  // An upstream response was received for the request
+	attempted atomic.Bool  // The origin was asked, whether or not it answered
+	status    atomic.Int32 // Sent to the client, zero until the response starts
+}
+
+// cacheStatus summarizes how the request was served for the access log:
+// "hit" without contacting the origin, "revalidated" when the origin was
+// asked but sent no body, "miss" when content came from the origin.
+func (a *byteAccount) cacheStatus() string {
+	switch {
+	case a.origin.Load() > 0:
+		return "miss"
+	case a.fetched.Load():
+		return "revalidated"
+	default:
+		return "hit"
+	}
+}
+
+// outcome tells how a finished request was served, for the hit ratios:
+// "hit" and "revalidated" as in cacheStatus when a cache entry answered it,
+// "miss" when the origin was asked, even if it failed, and "error" when the
+// request was refused without asking the origin, such as filtered, shed or
+// negatively cached ones.
+func (a *byteAccount) outcome() string {
+	status := int(a.status.Load())
+	// A handler that writes nothing sends 200.
+	served := status == 0 || status == http.StatusNotModified || status >= 200 && status < 300
+	switch {
+	case a.origin.Load() > 0:
+		return "miss"
+	case a.fetched.Load() && served:
+		return "revalidated"
+	case a.attempted.Load():
+		return "miss"
+	case served:
+		return "hit"
+	default:
+		return "error"
+	}
+}
+
+type byteAccountKey struct{}
+
+func withByteAccount(r *http.Request) (*http.Request, *byteAccount) {
+	if account := byteAccountFrom(r.Context()); account != nil {
+		return r, account
+	}
+	account := &byteAccount{}
+	return r.WithContext(context.WithValue(r.Context(), byteAccountKey{}, account)), account
+}
+
+func byteAccountFrom(ctx context.Context) *byteAccount {
+	account, _ := ctx.Value(byteAccountKey{}).(*byteAccount)
+	return account
+}
+
+// upstreamContext returns the context for upstream requests made on behalf of
+// r. It carries r's values, such as the byte account, and r's trace context,
+// but is not cancelled when the client goes away, so a fetch that is being
+// cached completes.
+func upstreamContext(r *http.Request) context.Context {
+	return withTraceContext(context.WithoutCancel(r.Context()), r)
+}
+
+// originBody wraps an upstream response body. It counts the bytes read,
+// applies the shared origin bandwidth cap, holds prefetch reads back while
+// client fetches run, and marks a client fetch finished, and its span ended,
+// once the body is read to its end or fails, is closed, or is dropped
+// unclosed.
+type originBody struct {
+	io.ReadCloser
+	ctx       context.Context
+	account   *byteAccount
+	live      bool
+	released  atomic.Bool
+	fetchSpan *span
+	read      atomic.Int64
+}
+
+func newOriginBody(ctx context.Context, body io.ReadCloser, live bool, fetchSpan *span) *originBody {
+	account := byteAccountFrom(ctx)
+	if account != nil {
+		account.fetched.Store(true)
+	}
+	b := &originBody{ReadCloser: body, ctx: ctx, account: account, live: live, fetchSpan: fetchSpan}
+	// A body that is never read to its end nor closed must not count as a
+	// running client fetch forever.
+	runtime.SetFinalizer(b, (*originBody).release)
+	return b
+}
+
+func (b *originBody) Read(p []byte) (int, error) {
+	if !b.live {
+		waitForPrefetchTurn(b.ctx)
+	}
+	n, err := b.ReadCloser.Read(p)
+	originBandwidth.take(b.ctx, n)
+	byteStats.origin.Add(int64(n))
+	b.read.Add(int64(n))
+	if b.account != nil {
+		b.account.origin.Add(int64(n))
+	}
+	if err != nil {
+		b.release()
+	}
+	return n, err
+}
+
+func (b *originBody) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
+
+// release marks the fetch finished, once.
+func (b *originBody) release() {
+	if b.released.Swap(true) {
+		return
+	}
+	runtime.SetFinalizer(b, nil)
+	if b.live {
+		prefetchControl.liveFetches.Add(-1)
+	}
+	b.fetchSpan.set("http.response.body.size", b.read.Load())
+	b.fetchSpan.finish()
+}
+
+// ByteAccountingMiddleware attaches a byte account to every request and
+// counts the bytes written to the client. Bytes read from origins are added
+// to the account by the fetch path.
+type ByteAccountingMiddleware struct {
+	next http.Handler
+}
+
+func NewByteAccountingMiddleware(next http.Handler) http.Handler {
+	return &ByteAccountingMiddleware{next: next}
+}
+
+func (m *ByteAccountingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, account := withByteAccount(r)
+	m.next.ServeHTTP(&accountingResponseWriter{ResponseWriter: w, account: account}, r)
+}
+
+type accountingResponseWriter struct {
+	http.ResponseWriter
+	account *byteAccount
+}
+
+func (aw *accountingResponseWriter) WriteHeader(status int) {
+	// Informational responses such as early hints precede the real one.
+	if status >= 200 {
+		aw.account.status.CompareAndSwap(0, int32(status))
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *accountingResponseWriter) Write(b []byte) (int, error) {
+	aw.account.status.CompareAndSwap(0, http.StatusOK)
+	n, err := aw.ResponseWriter.Write(b)
+	byteStats.client.Add(int64(n))
+	aw.account.client.Add(int64(n))
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (aw *accountingResponseWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+type inflightEntry struct {
+	Path        string  `json:"path"`
+	Started     string  `json:"started"`
+	HeldSeconds float64 `json:"heldSeconds"`
+	Waiters     int32   `json:"waiters"`
+}
+
+// snapshotInflight copies the in-progress fetches while holding the read lock
+// only for as long as the copy takes.
+func snapshotInflight() []inflightEntry {
+	now := time.Now()
+
+	requestLock.RLock()
+	entries := make([]inflightEntry, 0, len(requestLock.inProgress))
+	for _, req := range requestLock.inProgress {
+		entries = append(entries, inflightEntry{
+			Path:        req.cacheKey,
+			Started:     req.started.UTC().Format(time.RFC3339),
+			HeldSeconds: now.Sub(req.started).Seconds(),
+			Waiters:     atomic.LoadInt32(&req.waiters),
+		})
+	}
+	requestLock.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].HeldSeconds > entries[j].HeldSeconds
+	})
+	return entries
+}
+
+// HandleInflight lists the paths currently being fetched from upstream,
+// longest-held first.
+func HandleInflight(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, snapshotInflight())
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logging.Error("Error encoding JSON response: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+)
+
+// admissionStats counts the decisions of the cache's admission policy.
+var admissionStats struct {
+	admitted atomic.Int64
+	rejected atomic.Int64
+}
+
+// recordClientAccess tells the cache a client asked for cacheKey. Reads the
+// proxy makes for itself, and warm-up prefetches, do not count towards the
+// admission policy.
+func recordClientAccess(r *http.Request, config ServerConfig, cacheKey string) {
+	if isPrefetch(r.Context()) {
+		return
+	}
+	if recorder, ok := config.Cache.(storage.AccessRecorder); ok {
+		recorder.RecordAccess(cacheKey)
+	}
+}
+
+// admitToCache asks the cache's admission policy whether a fetched pool file
+// is worth storing. Indexes are always stored, since Release handling relies
+// on them being cached.
+func admitToCache(config ServerConfig, cacheKey, remotePath string, size int64) bool {
+	if !config.CacheAdmission || !isPoolPath(remotePath) {
+		return true
+	}
+	admitter, ok := config.Cache.(storage.Admitter)
+	if !ok {
+		return true
+	}
+	if admitter.Admit(cacheKey, max(size, 0)) {
+		admissionStats.admitted.Add(1)
+		return true
+	}
+	admissionStats.rejected.Add(1)
+	logging.Debug("Admission: Serving %s without caching it", cacheKey)
+	return false
+}
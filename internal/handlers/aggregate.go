@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// aggregateSources are the variants of a Packages index the aggregate can be
+// built from, in order of preference.
+var aggregateSources = []string{"", ".gz", ".bz2"}
+
+// aggregateSource is a cached Packages index that goes into an aggregate.
+type aggregateSource struct {
+	component string
+	key       string
+	suffix    string
+}
+
+// HandleAggregatePackages serves the cached Packages indexes of several
+// components of a suite concatenated into one, for tools that expect a
+// single index. The suite is given by its path up to the suite directory,
+// e.g. suite=debian/dists/bookworm, with arch and a comma-separated list of
+// components, which defaults to those the suite's Release lists. Every index
+// must be listed in the suite's cached Release and match its checksum there,
+// but the aggregate itself is signed by no one: it is marked as such and
+// never cached downstream. Only indexes already in the cache are used.
+func HandleAggregatePackages(cache storage.Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		suiteDir := strings.Trim(query.Get("suite"), "/")
+		arch := query.Get("arch")
+		if prefix, ok := utils.SuitePrefix(suiteDir + "/Packages"); !ok || prefix != suiteDir || !validIndexSegment(arch) {
+			http.Error(w, "suite (e.g. debian/dists/bookworm) and arch are required", http.StatusBadRequest)
+			return
+		}
+		suiteKey := tenantCacheKey(r, suiteDir)
+
+		release := cachedRelease(cache, suiteKey)
+		if release == nil {
+			http.Error(w, "No Release of the suite is cached to check the indexes against", http.StatusNotFound)
+			return
+		}
+		var components []string
+		if list := query.Get("components"); list != "" {
+			for _, component := range strings.Split(list, ",") {
+				components = append(components, strings.TrimSpace(component))
+			}
+		} else {
+			value, _ := release.Fields.Get("Components")
+			components = strings.Fields(value)
+		}
+		if len(components) == 0 {
+			http.Error(w, "No components given and none listed by the Release", http.StatusBadRequest)
+			return
+		}
+
+		sources := make([]aggregateSource, 0, len(components))
+		for _, component := range components {
+			if !validIndexSegment(component) {
+				http.Error(w, "Invalid component "+component, http.StatusBadRequest)
+				return
+			}
+			source, ok := findAggregateSource(cache, suiteKey, component, arch)
+			if !ok {
+				http.Error(w, "Packages of "+component+" are not cached", http.StatusNotFound)
+				return
+			}
+			file := release.Files[strings.TrimPrefix(source.key, suiteKey+"/")]
+			if file == nil {
+				logging.Warning("Aggregate: Cached %s is not listed by its Release", source.key)
+				http.Error(w, "Cached Packages of "+component+" are not listed by the Release", http.StatusBadGateway)
+				return
+			}
+			if matches, _ := cachedIndexMatches(cache, source.key, file); !matches {
+				logging.Warning("Aggregate: Cached %s does not match its Release", source.key)
+				http.Error(w, "Cached Packages of "+component+" do not match the Release", http.StatusBadGateway)
+				return
+			}
+			sources = append(sources, source)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Aggregate-Components", strings.Join(components, ", "))
+		// The aggregate matches no checksum in any Release.
+		w.Header().Set("X-Aggregate-Authoritative", "false")
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		for i, source := range sources {
+			if err := copyAggregateSource(w, cache, source, i > 0); err != nil {
+				// The status has been sent, so the client can only be cut off.
+				logging.Error("Aggregate: Reading %s failed: %v", source.key, err)
+				panic(http.ErrAbortHandler)
+			}
+		}
+	}
+}
+
+// validIndexSegment reports whether s can be used as a component or
+// architecture in an index path.
+func validIndexSegment(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, "/\\")
+}
+
+// findAggregateSource returns the cached variant of a component's Packages
+// the aggregate is built from.
+func findAggregateSource(cache storage.Cache, suiteKey, component, arch string) (aggregateSource, bool) {
+	base := suiteKey + "/" + component + "/binary-" + arch + "/Packages"
+	for _, suffix := range aggregateSources {
+		content, _, _, err := cache.Get(base + suffix)
+		if err != nil {
+			continue
+		}
+		content.Close()
+		return aggregateSource{component: component, key: base + suffix, suffix: suffix}, true
+	}
+	return aggregateSource{}, false
+}
+
+// copyAggregateSource writes the decompressed content of source to w. A
+// blank line separates it from the previous index, so the last stanza of one
+// and the first of the next do not run together.
+func copyAggregateSource(w io.Writer, cache storage.Cache, source aggregateSource, separate bool) error {
+	content, _, _, err := cache.Get(source.key)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	var reader io.Reader = content
+	switch source.suffix {
+	case ".gz":
+		gz, err := gzip.NewReader(content)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	case ".bz2":
+		reader = bzip2.NewReader(content)
+	}
+
+	if separate {
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	trimmer := &trailingNewlines{w: w}
+	if _, err := io.Copy(trimmer, reader); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// trailingNewlines writes through everything but trailing newlines, which it
+// holds back until more content follows, so an index ends with exactly the
+// newline written after it.
+type trailingNewlines struct {
+	w       io.Writer
+	pending int
+}
+
+func (t *trailingNewlines) Write(p []byte) (int, error) {
+	trimmed := bytes.TrimRight(p, "\n")
+	if len(trimmed) == 0 {
+		t.pending += len(p)
+		return len(p), nil
+	}
+	if t.pending > 0 {
+		if _, err := t.w.Write(bytes.Repeat([]byte("\n"), t.pending)); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := t.w.Write(trimmed); err != nil {
+		return 0, err
+	}
+	t.pending = len(p) - len(trimmed)
+	return len(p), nil
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"sync/atomic"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// backgroundPool runs work no client is waiting for, such as
+// stale-while-refresh fetches and suite batch refreshes, on a fixed number
+// of workers fed from a bounded queue. Work that does not fit in the queue
+// is dropped rather than piling up goroutines.
+type backgroundPool struct {
+	tasks   chan backgroundTask
+	busy    atomic.Int64
+	dropped atomic.Int64
+}
+
+type backgroundTask struct {
+	name string
+	run  func()
+}
+
+// background is the active pool, nil when background work is not bounded.
+var background atomic.Pointer[backgroundPool]
+
+// SetBackgroundPool runs background work on workers goroutines with up to
+// queueSize tasks waiting. Zero workers removes the bound, so every task gets
+// a goroutine of its own.
+func SetBackgroundPool(workers, queueSize int) {
+	if workers <= 0 {
+		background.Store(nil)
+		return
+	}
+	pool := &backgroundPool{tasks: make(chan backgroundTask, queueSize)}
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	background.Store(pool)
+}
+
+func (p *backgroundPool) work() {
+	for task := range p.tasks {
+		p.busy.Add(1)
+		task.run()
+		p.busy.Add(-1)
+	}
+}
+
+// runInBackground queues run on the background pool. It returns false if
+// the queue is full and the task was dropped; name identifies it in the log.
+func runInBackground(name string, run func()) bool {
+	p := background.Load()
+	if p == nil {
+		go run()
+		return true
+	}
+	select {
+	case p.tasks <- backgroundTask{name: name, run: run}:
+		return true
+	default:
+		p.dropped.Add(1)
+		logging.Warning("Background queue full, dropping %s", name)
+		return false
+	}
+}
+
+// backgroundStats returns the queued tasks, busy workers and dropped tasks of
+// the background pool.
+func backgroundStats() (queued, busy, dropped int64) {
+	if p := background.Load(); p != nil {
+		return int64(len(p.tasks)), p.busy.Load(), p.dropped.Load()
+	}
+	return 0, 0, 0
+}
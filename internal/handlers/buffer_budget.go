@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// bufferBudgetExemptSize is the body size up to which a fetch never counts
+// against the buffer budget.
+const bufferBudgetExemptSize = 1 << 20
+
+// bufferBudget bounds the response bytes that concurrent cache misses hold in
+// memory, reserved up front from the upstream Content-Length. Package
+// downloads that do not fit are shed; index fetches are counted but always
+// admitted so apt update keeps working while packages are being pulled.
+type bufferBudget struct {
+	mu    sync.Mutex
+	limit int64 // Zero is unlimited
+	used  int64
+	shed  atomic.Int64
+}
+
+var inflightBuffers bufferBudget
+
+// SetBufferBudget caps the bytes buffered by concurrent cache misses. Zero
+// removes the cap.
+func SetBufferBudget(limit int64) {
+	inflightBuffers.mu.Lock()
+	defer inflightBuffers.mu.Unlock()
+	inflightBuffers.limit = limit
+}
+
+// reserve claims size bytes of the budget and returns the function giving
+// them back, or false if a sheddable fetch does not fit. Bodies of unknown
+// length cannot be accounted for and are admitted uncounted, as are small
+// ones. A body larger than the whole budget is admitted while nothing else
+// is buffered, so it can still be fetched at all.
+func (b *bufferBudget) reserve(size int64, sheddable bool) (func(), bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.limit <= 0 || size <= bufferBudgetExemptSize {
+		return func() {}, true
+	}
+	if sheddable && b.used > 0 && b.used+size > b.limit {
+		b.shed.Add(1)
+		return nil, false
+	}
+
+	b.used += size
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.used -= size
+			b.mu.Unlock()
+		})
+	}, true
+}
+
+func (b *bufferBudget) inUse() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+const (
+	BypassRevalidate  = "revalidate"
+	BypassPassThrough = "passthrough"
+)
+
+const defaultCacheBypassHeader = "X-Cache-Bypass"
+
+// matchBypassUserAgent reports whether the user agent matches one of the
+// configured bypass patterns, returning the pattern that matched.
+func matchBypassUserAgent(config ServerConfig, userAgent string) (string, bool) {
+	for _, pattern := range config.BypassUserAgents {
+		if pattern.MatchString(userAgent) {
+			return pattern.String(), true
+		}
+	}
+	return "", false
+}
+
+// compileUserAgentPatterns compiles the configured patterns, skipping invalid
+// ones. The configuration is validated on load, so none are expected.
+func compileUserAgentPatterns(patterns []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		if re, err := regexp.Compile(pattern); err == nil {
+			compiled = append(compiled, re)
+		}
+	}
+	return compiled
+}
+
+// cacheBypassRequested reports whether the request carries the cache bypass
+// header and may use it: either the header holds the configured token, or it
+// is "1" and the client address is in a trusted network. The address is the
+// connection's, never X-Forwarded-For, which clients can forge.
+func cacheBypassRequested(config ServerConfig, r *http.Request) bool {
+	if config.CacheBypassToken == "" && len(config.CacheBypassNetworks) == 0 {
+		return false
+	}
+	value := r.Header.Get(config.CacheBypassHeader)
+	if value == "" {
+		return false
+	}
+
+	if config.CacheBypassToken != "" && secureEqual(value, config.CacheBypassToken) {
+		return true
+	}
+	if value == "1" && isTrustedAddress(r.RemoteAddr, config.CacheBypassNetworks) {
+		return true
+	}
+
+	logging.Warning("Ignoring %s from untrusted client %s for %s", config.CacheBypassHeader, r.RemoteAddr, r.URL.Path)
+	return false
+}
+
+func isTrustedAddress(remoteAddr string, networks []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// captivePortalSniffLength is how much of a response body is looked at for
+// an HTML document start.
+const captivePortalSniffLength = 512
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// captivePortalRejections counts origin responses rejected as captive-portal
+// pages.
+var captivePortalRejections atomic.Int64
+
+// looksLikeCaptivePortal reports whether a successful origin response for
+// remotePath is an HTML page although an apt file was asked for, which is
+// what captive portals and misconfigured proxies send instead of the file.
+// Directory listings and .html files are never suspect. The start of the body
+// is peeked at, so resp.Body is replaced by a reader that still returns it in
+// full.
+func looksLikeCaptivePortal(remotePath string, resp *http.Response) bool {
+	if strings.HasSuffix(remotePath, "/") || remotePath == "" {
+		return false
+	}
+	switch strings.ToLower(path.Ext(remotePath)) {
+	case ".html", ".htm":
+		return false
+	}
+
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+			return true
+		}
+	}
+
+	peeked := bufio.NewReaderSize(resp.Body, captivePortalSniffLength)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{peeked, resp.Body}
+	head, _ := peeked.Peek(captivePortalSniffLength)
+	head = bytes.ToLower(bytes.TrimLeft(bytes.TrimPrefix(head, utf8BOM), " \t\r\n"))
+	return bytes.HasPrefix(head, []byte("<!doctype html")) || bytes.HasPrefix(head, []byte("<html"))
+}
+
+// rejectCaptivePortal answers a response that looks like a captive-portal
+// page with 502 instead of passing it on. It returns true if the response was
+// rejected.
+func rejectCaptivePortal(w http.ResponseWriter, config ServerConfig, remotePath, upstreamURL string, resp *http.Response) bool {
+	if !config.RejectCaptivePortals || resp.StatusCode != http.StatusOK || !looksLikeCaptivePortal(remotePath, resp) {
+		return false
+	}
+	captivePortalRejections.Add(1)
+	logging.Warning("Rejecting HTML response for %s from %s, possibly a captive portal", remotePath, upstreamURL)
+	http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	return true
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"io"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// checksumFailures counts fetched indexes rejected because they did not match
+// the checksum in their suite's Release file, or were listed only with weak
+// checksums.
+var checksumFailures atomic.Int64
+
+// maxReleaseSize bounds how much of a cached Release file is read to find an
+// index's checksum.
+const maxReleaseSize = 16 << 20
+
+// indexVerifier returns a verifier for the strongest checksum the suite's
+// cached InRelease or Release lists for cacheKey. It returns nil if
+// verification is off or no cached Release lists the file, and
+// utils.ErrWeakChecksum if the file is listed only with checksums weaker than
+// the configured minimum.
+func indexVerifier(config ServerConfig, cacheKey string) (*utils.ChecksumVerifier, error) {
+	if !config.VerifyIndexChecksums || utils.IsReleaseFile(cacheKey) {
+		return nil, nil
+	}
+	suiteDir, ok := utils.SuitePrefix(cacheKey)
+	if !ok {
+		return nil, nil
+	}
+	relPath := strings.TrimPrefix(cacheKey, suiteDir+"/")
+
+	release := cachedRelease(config.Cache, suiteDir)
+	if release == nil || release.Files[relPath] == nil {
+		return nil, nil
+	}
+	algorithm, sum, err := utils.SelectChecksum(release.Files[relPath].Hashes, config.MinimumChecksum)
+	if err != nil {
+		return nil, err
+	}
+	return utils.NewChecksumVerifier(algorithm, sum)
+}
+
+// cachedRelease returns the suite's cached InRelease, or else its Release,
+// parsed. It returns nil if neither is cached or can be parsed.
+func cachedRelease(cache storage.Cache, suiteDir string) *utils.Release {
+	for _, name := range []string{"InRelease", "Release"} {
+		content, _, _, err := cache.Get(path.Join(suiteDir, name))
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(content, maxReleaseSize))
+		content.Close()
+		if err != nil {
+			continue
+		}
+		release, err := utils.ParseRelease(data)
+		if err != nil {
+			logging.Warning("Checksums: Cannot parse cached %s/%s: %v", suiteDir, name, err)
+			continue
+		}
+		return release
+	}
+	return nil
+}
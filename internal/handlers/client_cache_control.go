@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// clientCacheDirectives are the request Cache-Control directives the mirror
+// honors when HonorClientCacheControl is set.
+type clientCacheDirectives struct {
+	noCache      bool // Revalidate the cached copy with the origin before serving it
+	onlyIfCached bool // Never contact the origin, answer 504 if nothing is cached
+}
+
+// parseClientCacheControl reads the directives of a request's Cache-Control,
+// falling back to Pragma: no-cache for HTTP/1.0 clients without one.
+// max-age=0 is deliberately not treated like no-cache: apt sends it with
+// every index request by default, which would defeat the validation cache.
+func parseClientCacheControl(r *http.Request) clientCacheDirectives {
+	var directives clientCacheDirectives
+	values := r.Header.Values("Cache-Control")
+	if len(values) == 0 {
+		for _, pragma := range r.Header.Values("Pragma") {
+			if strings.EqualFold(strings.TrimSpace(pragma), "no-cache") {
+				directives.noCache = true
+			}
+		}
+		return directives
+	}
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "no-cache":
+				directives.noCache = true
+			case "only-if-cached":
+				directives.onlyIfCached = true
+			}
+		}
+	}
+	return directives
+}
+
+// serveOnlyIfCached answers a request with only-if-cached from the cache as
+// it is, without revalidation, or with 504 Gateway Timeout if the path is not
+// cached.
+func serveOnlyIfCached(w http.ResponseWriter, r *http.Request, config ServerConfig, cacheKey string) {
+	content, _, lastModified, err := lookupCache(r, config, cacheKey)
+	if err == nil && handleCacheHit(w, r, config, content, lastModified, cacheKey) {
+		return
+	}
+	logging.Debug("Request for %s is only-if-cached, but it is not cached", cacheKey)
+	http.Error(w, "Not cached", http.StatusGatewayTimeout)
+}
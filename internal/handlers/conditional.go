@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// checkAndHandlePreconditions evaluates If-Match and, in its absence,
+// If-Unmodified-Since against the cached entry and answers 412 when the
+// precondition fails. RFC 7232 section 6 has these evaluated before
+// If-None-Match and If-Modified-Since.
+func checkAndHandlePreconditions(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time, config ServerConfig) bool {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !matchesStrongly(ifMatch, etag) {
+			preconditionFailed(w, config, r)
+			return true
+		}
+		return false
+	}
+
+	if ifUnmodifiedSince := r.Header.Get("If-Unmodified-Since"); ifUnmodifiedSince != "" {
+		since, err := time.Parse(http.TimeFormat, ifUnmodifiedSince)
+		if err == nil && !lastModified.IsZero() && lastModified.Truncate(time.Second).After(since) {
+			preconditionFailed(w, config, r)
+			return true
+		}
+	}
+	return false
+}
+
+// matchesStrongly reports whether the If-Match list contains the entity tag
+// under strong comparison, where weak tags never match.
+func matchesStrongly(ifMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if etag != "" && !strings.HasPrefix(etag, "W/") && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func preconditionFailed(w http.ResponseWriter, config ServerConfig, r *http.Request) {
+	if config.LogRequests {
+		logging.Info("Response: Precondition failed %s", r.URL.Path)
+	}
+	http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+}
+
+// isPoolPath reports whether the remote path is a package in the pool. Pool
+// files are never modified once published; a new version gets a new name.
+func isPoolPath(remotePath string) bool {
+	return strings.Contains("/"+remotePath, "/pool/")
+}
+
+// handlePoolNotModified answers a plain If-Modified-Since for a cached pool
+// file with 304 straight from the cache entry's modification time, without
+// reading the header cache or contacting the origin. Requests carrying other
+// validators or preconditions are left to the regular cache hit path.
+func handlePoolNotModified(w http.ResponseWriter, r *http.Request, config ServerConfig, cacheKey string) bool {
+	if r.Header.Get("If-Modified-Since") == "" || r.Header.Get("If-None-Match") != "" ||
+		r.Header.Get("If-Match") != "" || r.Header.Get("If-Unmodified-Since") != "" {
+		return false
+	}
+
+	content, _, lastModified, err := lookupCache(r, config, cacheKey)
+	if err != nil {
+		return false
+	}
+	content.Close()
+
+	return checkAndHandleIfModifiedSince(w, r, "", lastModified, config)
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// clientDelivery sends a response body to the client from a buffer that is
+// filled independently, so the download, and with it the cache write that
+// waiters depend on, proceeds at the origin's pace however slowly the client
+// reads. A client that fails or goes away is simply no longer written to.
+type clientDelivery struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      *bytes.Buffer
+	complete bool
+	done     chan struct{}
+}
+
+// startDelivery starts serving buf to w as it grows. The buffer must only be
+// written through fill, or be complete before finish is called.
+func startDelivery(w io.Writer, buf *bytes.Buffer) *clientDelivery {
+	d := &clientDelivery{buf: buf, done: make(chan struct{})}
+	d.cond = sync.NewCond(&d.mu)
+	go d.serve(w)
+	return d
+}
+
+func (d *clientDelivery) serve(w io.Writer) {
+	defer close(d.done)
+
+	var offset int
+	for {
+		d.mu.Lock()
+		for offset == d.buf.Len() && !d.complete {
+			d.cond.Wait()
+		}
+		// Bytes already in the buffer are never modified by later writes, so
+		// they can be sent without holding the lock.
+		chunk := d.buf.Bytes()[offset:]
+		complete := d.complete
+		d.mu.Unlock()
+
+		if len(chunk) > 0 {
+			if _, err := w.Write(chunk); err != nil {
+				logging.Debug("Delivery: Client stopped receiving: %v", err)
+				return
+			}
+			offset += len(chunk)
+		}
+		if complete && offset == d.buf.Len() {
+			return
+		}
+	}
+}
+
+// fill reads src into the buffer until it ends and marks the body complete.
+func (d *clientDelivery) fill(src io.Reader) error {
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(chunk)
+		d.mu.Lock()
+		d.buf.Write(chunk[:n])
+		if err != nil {
+			d.complete = true
+		}
+		d.cond.Broadcast()
+		d.mu.Unlock()
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// finish marks a buffer that was filled beforehand as complete.
+func (d *clientDelivery) finish() {
+	d.mu.Lock()
+	d.complete = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// wait blocks until the client has received the body or stopped receiving.
+func (d *clientDelivery) wait() {
+	<-d.done
+}
+
+// deadlineWriter bounds every write to the client by the configured timeout,
+// so a client that stops reading is cut off instead of holding a connection.
+type deadlineWriter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+// clientWriter returns w, with a write deadline per write if a client write
+// timeout is configured. Call resetWriteDeadline once the response is written.
+func clientWriter(w http.ResponseWriter, config ServerConfig) io.Writer {
+	if config.ClientWriteTimeout <= 0 {
+		return w
+	}
+	return &deadlineWriter{w: w, rc: http.NewResponseController(w), timeout: config.ClientWriteTimeout}
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	if err := d.rc.SetWriteDeadline(time.Now().Add(d.timeout)); err != nil {
+		logging.Debug("Delivery: Cannot set a write deadline: %v", err)
+	}
+	return d.w.Write(p)
+}
+
+// resetWriteDeadline clears a deadline set by a writer from clientWriter, so
+// it does not carry over to the next request on the connection.
+func resetWriteDeadline(w io.Writer) {
+	if d, ok := w.(*deadlineWriter); ok {
+		d.rc.SetWriteDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// diskFull tracks whether the cache's disk ran out of space. While it did,
+// cache misses are proxied without being stored, except for one probe per
+// retry interval whose write decides whether caching resumes. The state is
+// shared by all repositories since they share the cache directory.
+var diskFull struct {
+	since     atomic.Int64 // Unix nanoseconds when pass-through began, zero while caching
+	nextProbe atomic.Int64 // Unix nanoseconds after which the next miss tries to cache again
+	events    atomic.Int64 // Times the cache switched to pass-through
+}
+
+// noteCacheWrite records the outcome of storing key. A write failing with
+// ENOSPC switches to pass-through; a successful one ends it. Other errors do
+// not change the mode.
+func noteCacheWrite(config ServerConfig, key string, err error) {
+	if err == nil {
+		if since := diskFull.since.Swap(0); since != 0 {
+			logging.Warning("Cache: Disk space available again, caching resumed after %s in pass-through", time.Since(time.Unix(0, since)).Round(time.Second))
+		}
+		return
+	}
+	if config.DiskFullRetryInterval <= 0 || !errors.Is(err, syscall.ENOSPC) {
+		return
+	}
+
+	now := time.Now()
+	diskFull.nextProbe.Store(now.Add(config.DiskFullRetryInterval).UnixNano())
+	if diskFull.since.CompareAndSwap(0, now.UnixNano()) {
+		diskFull.events.Add(1)
+		logging.Error("Cache: DISK FULL while storing %s, serving without caching until space is available: %v", key, err)
+	}
+}
+
+// cachingSuspended reports whether a cache miss should be proxied without
+// being stored because the disk is full. Once the retry interval has passed,
+// a single caller gets false so that it tries to cache again.
+func cachingSuspended(config ServerConfig) bool {
+	if diskFull.since.Load() == 0 {
+		return false
+	}
+	next := diskFull.nextProbe.Load()
+	now := time.Now()
+	if now.UnixNano() < next {
+		return true
+	}
+	return !diskFull.nextProbe.CompareAndSwap(next, now.Add(config.DiskFullRetryInterval).UnixNano())
+}
+
+// CacheSpaceFreed lets the next cache miss try to store its file right away
+// instead of waiting for the retry interval. Call it when entries are evicted
+// or deleted.
+func CacheSpaceFreed() {
+	if diskFull.since.Load() != 0 {
+		diskFull.nextProbe.Store(0)
+	}
+}
+
+// CachePassThroughSince returns when the cache switched to pass-through
+// because the disk was full, and false while files are being cached.
+func CachePassThroughSince() (time.Time, bool) {
+	since := diskFull.since.Load()
+	if since == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, since), true
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"path"
+	"sort"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// maxEarlyHints caps the Link headers sent in one 103 response.
+const maxEarlyHints = 32
+
+// defaultEarlyHintPaths are the indexes apt typically fetches right after a
+// Release, relative to the suite directory.
+var defaultEarlyHintPaths = []string{
+	"*/binary-*/Packages.xz",
+	"*/source/Sources.xz",
+	"*/i18n/Translation-en.xz",
+}
+
+// sendEarlyHints sends a 103 Early Hints response preloading the indexes a
+// cached Release declares, so that clients and proxies can start on them
+// while the Release is still being transferred. Content must be seekable,
+// since it is read here and served afterwards.
+func sendEarlyHints(w http.ResponseWriter, r *http.Request, config ServerConfig, content io.Reader) {
+	seeker, ok := content.(io.ReadSeeker)
+	if !ok {
+		return
+	}
+
+	release, err := io.ReadAll(seeker)
+	if _, seekErr := seeker.Seek(0, io.SeekStart); seekErr != nil {
+		logging.Error("Early hints: Failed to rewind %s: %v", r.URL.Path, seekErr)
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	patterns := config.EarlyHintPaths
+	if len(patterns) == 0 {
+		patterns = defaultEarlyHintPaths
+	}
+
+	var files []string
+	for relPath := range utils.ParseReleaseFileSizes(release) {
+		if utils.MatchAnyPathPattern(patterns, relPath) {
+			files = append(files, relPath)
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+	sort.Strings(files)
+	if len(files) > maxEarlyHints {
+		files = files[:maxEarlyHints]
+	}
+
+	suiteDir := path.Join("/", config.LocalPath, path.Dir(r.URL.Path))
+	for _, file := range files {
+		w.Header().Add("Link", "<"+path.Join(suiteDir, file)+">; rel=preload; as=fetch")
+	}
+	w.WriteHeader(http.StatusEarlyHints)
+	w.Header().Del("Link")
+
+	logging.Debug("Early hints: Sent %d preload links for %s", len(files), r.URL.Path)
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+)
+
+// originDateHeader keeps the Date of the origin response whose content is
+// cached. Unlike Date it is not replaced when a revalidation merges in newer
+// headers, so it tells when the origin generated the entry. Like
+// fetchedAtHeader it is never sent to clients.
+const originDateHeader = "X-Cache-Origin-Date"
+
+// withOriginDate returns a copy of the headers of a full origin response
+// with its Date recorded as the entry's generation time.
+func withOriginDate(headers http.Header) http.Header {
+	stamped := headers.Clone()
+	if stamped == nil {
+		stamped = make(http.Header)
+	}
+	if date := stamped.Get("Date"); date != "" {
+		stamped.Set(originDateHeader, date)
+	}
+	return stamped
+}
+
+type entryInfo struct {
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	OriginDate   string `json:"originDate,omitempty"`   // Date of the origin response that produced the content
+	Date         string `json:"date,omitempty"`         // Date of the latest origin response, including revalidations
+	FetchedAt    string `json:"fetchedAt,omitempty"`    // When the entry was last fetched or validated
+	LastModified string `json:"lastModified,omitempty"` // Last-Modified as sent by the origin
+	StoredMtime  string `json:"storedMtime"`            // Modification time of the cached file
+}
+
+// HandleEntry reports the timestamps of one cached entry side by side, for
+// diagnosing complaints about stale content. The entry is selected by its
+// cache key, as listed by /admin/inflight, in the key query parameter.
+func HandleEntry(cache storage.Cache, headerCache storage.HeaderCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		key := strings.TrimPrefix(r.URL.Query().Get("key"), "/")
+		if key == "" {
+			http.Error(w, "Missing key parameter", http.StatusBadRequest)
+			return
+		}
+
+		content, size, lastModified, err := cache.Get(key)
+		if err != nil {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return
+		}
+		content.Close()
+
+		info := entryInfo{
+			Key:         key,
+			Size:        size,
+			StoredMtime: lastModified.UTC().Format(time.RFC3339),
+		}
+
+		headers, err := headerCache.GetHeaders(key)
+		if err != nil && !errors.Is(err, storage.ErrHeadersNotFound) {
+			http.Error(w, "Failed to read headers", http.StatusInternalServerError)
+			return
+		}
+		if headers != nil {
+			info.OriginDate = headers.Get(originDateHeader)
+			info.Date = headers.Get("Date")
+			info.FetchedAt = headers.Get(fetchedAtHeader)
+			info.LastModified = headers.Get("Last-Modified")
+		}
+
+		writeJSON(w, http.StatusOK, info)
+	}
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// maxErrorMessage bounds the plain text error message kept for a template.
+const maxErrorMessage = 4096
+
+// errorPageSet is the set of error page templates in effect.
+type errorPageSet struct {
+	files     map[string]string // Template files by status code, as configured
+	templates map[int]*template.Template
+}
+
+var errorPages atomic.Pointer[errorPageSet]
+
+// ErrorPageData is what an error page template is executed with.
+type ErrorPageData struct {
+	Status     int
+	StatusText string
+	Message    string // The plain text error, as apt gets it
+	Path       string
+}
+
+// LoadErrorPages parses the HTML error page templates, given as files by
+// status code, and makes them the ones served to browsers. An empty map
+// removes them. On error the previous templates stay in effect.
+func LoadErrorPages(files map[string]string) error {
+	if len(files) == 0 {
+		errorPages.Store(nil)
+		return nil
+	}
+
+	set := &errorPageSet{files: files, templates: make(map[int]*template.Template, len(files))}
+	for code, file := range files {
+		status, err := strconv.Atoi(code)
+		if err != nil {
+			return fmt.Errorf("invalid error page status %q", code)
+		}
+		tmpl, err := template.ParseFiles(file)
+		if err != nil {
+			return fmt.Errorf("failed to load error page for %d: %w", status, err)
+		}
+		set.templates[status] = tmpl
+	}
+	errorPages.Store(set)
+	logging.Info("Loaded %d error page templates", len(set.templates))
+	return nil
+}
+
+// ReloadErrorPages parses the active error page templates again. It does
+// nothing when none are configured.
+func ReloadErrorPages() error {
+	current := errorPages.Load()
+	if current == nil {
+		return nil
+	}
+	return LoadErrorPages(current.files)
+}
+
+// acceptsHTML reports whether the client asked for HTML by name. apt sends no
+// Accept header and tools like curl send */*, so both get plain text.
+func acceptsHTML(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, accepted := range strings.Split(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+			if err != nil || params["q"] == "0" {
+				continue
+			}
+			if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withErrorPages returns w wrapped so that plain text errors with a
+// configured template are replaced by the rendered template for clients
+// accepting HTML. The returned function sends the page and must be called
+// when the handler is done.
+func withErrorPages(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	set := errorPages.Load()
+	if set == nil {
+		return w, func() {}
+	}
+	ew := &errorPageWriter{ResponseWriter: w, request: r, templates: set.templates, html: acceptsHTML(r)}
+	return ew, ew.finish
+}
+
+type errorPageWriter struct {
+	http.ResponseWriter
+	request   *http.Request
+	templates map[int]*template.Template
+	html      bool
+
+	wroteHeader bool
+	template    *template.Template // Set while an error is being replaced
+	status      int
+	message     bytes.Buffer
+}
+
+func (ew *errorPageWriter) WriteHeader(status int) {
+	if ew.wroteHeader || status < http.StatusOK {
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+	ew.wroteHeader = true
+	tmpl := ew.templates[status]
+	if tmpl != nil {
+		// The body depends on Accept whether or not this client gets HTML.
+		ew.Header().Add("Vary", "Accept")
+	}
+	// Only errors from http.Error are replaced, not bodies relayed from the
+	// origin.
+	if tmpl == nil || !ew.html || !strings.HasPrefix(ew.Header().Get("Content-Type"), "text/plain") {
+		ew.ResponseWriter.WriteHeader(status)
+		return
+	}
+	ew.template = tmpl
+	ew.status = status
+}
+
+func (ew *errorPageWriter) Write(b []byte) (int, error) {
+	if !ew.wroteHeader {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.template == nil {
+		return ew.ResponseWriter.Write(b)
+	}
+	if room := maxErrorMessage - ew.message.Len(); room > 0 {
+		ew.message.Write(b[:min(len(b), room)])
+	}
+	return len(b), nil
+}
+
+// finish sends the rendered error page, or the plain text error if the
+// template fails.
+func (ew *errorPageWriter) finish() {
+	if ew.template == nil {
+		return
+	}
+	message := strings.TrimSpace(ew.message.String())
+	var page bytes.Buffer
+	err := ew.template.Execute(&page, ErrorPageData{
+		Status:     ew.status,
+		StatusText: http.StatusText(ew.status),
+		Message:    message,
+		Path:       ew.request.URL.Path,
+	})
+	header := ew.Header()
+	header.Del("Content-Length")
+	if err != nil {
+		logging.Error("Error page for %d failed: %v", ew.status, err)
+		ew.ResponseWriter.WriteHeader(ew.status)
+		ew.ResponseWriter.Write([]byte(message + "\n"))
+		return
+	}
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	ew.ResponseWriter.WriteHeader(ew.status)
+	ew.ResponseWriter.Write(page.Bytes())
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (ew *errorPageWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
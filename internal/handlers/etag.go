@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// syntheticETagHeader marks an ETag computed by the mirror rather than sent
+// by the origin. Such an ETag is served to clients but never sent upstream,
+// where it would mean nothing.
+const syntheticETagHeader = "X-Cache-Synthetic-Etag"
+
+// withSyntheticETag adds a strong ETag derived from the content when the
+// origin sent neither an ETag nor a Last-Modified, so clients can still
+// revalidate with If-None-Match.
+func withSyntheticETag(headers http.Header, body []byte) http.Header {
+	if headers.Get("ETag") != "" || headers.Get("Last-Modified") != "" {
+		return headers
+	}
+
+	sum := sha256.Sum256(body)
+	headers.Set("ETag", `"sha256-`+hex.EncodeToString(sum[:16])+`"`)
+	headers.Set(syntheticETagHeader, "1")
+	return headers
+}
+
+func isSyntheticETag(headers http.Header) bool {
+	return headers.Get(syntheticETagHeader) != ""
+}
+
+// checkAndHandleIfNoneMatch answers 304 when one of the client's entity tags
+// matches the cached one, using the weak comparison RFC 7232 prescribes for
+// If-None-Match.
+func checkAndHandleIfNoneMatch(w http.ResponseWriter, r *http.Request, etag string, config ServerConfig) bool {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.Header().Set("ETag", etag)
+			sendNotModified(w, config, r)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// Event types published to /admin/events subscribers.
+const (
+	EventFetch = "fetch" // A cache miss was fetched from the origin and stored
+	EventEvict = "evict" // An entry was evicted or deleted from the cache
+	EventWarm  = "warm"  // A warm-up prefetch finished
+)
+
+// maxEventSubscribers bounds the clients streaming /admin/events at once.
+const maxEventSubscribers = 16
+
+// eventBacklog is how many events a subscriber may fall behind before it is
+// dropped.
+const eventBacklog = 256
+
+// eventHeartbeat is how often a comment is sent to idle subscribers, so
+// proxies do not close the stream.
+const eventHeartbeat = 15 * time.Second
+
+// Event describes something that happened to the cache. Fields that do not
+// apply to its type are left out.
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Key        string    `json:"key,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	Repository string    `json:"repository,omitempty"`
+	Status     int       `json:"status,omitempty"` // Status a warm-up prefetch was answered with
+	Fetched    int32     `json:"fetched,omitempty"`
+	Total      int       `json:"total,omitempty"`
+	Warm       bool      `json:"warm,omitempty"` // The repository has finished warming up
+}
+
+// eventBus hands published events to the /admin/events subscribers. A
+// subscriber whose backlog is full is dropped rather than holding up the
+// publisher.
+var eventBus = struct {
+	sync.Mutex
+	subscribers map[chan Event]struct{}
+}{subscribers: make(map[chan Event]struct{})}
+
+// PublishEvent sends event to every subscriber of /admin/events. It never
+// blocks and costs next to nothing without subscribers.
+func PublishEvent(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	eventBus.Lock()
+	defer eventBus.Unlock()
+	for events := range eventBus.subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(eventBus.subscribers, events)
+			close(events)
+			logging.Warning("Events: Dropped a subscriber that fell %d events behind", eventBacklog)
+		}
+	}
+}
+
+// subscribeEvents returns a channel receiving published events, or false if
+// there are too many subscribers already. The channel is closed when the
+// subscriber is dropped for falling behind.
+func subscribeEvents() (chan Event, bool) {
+	eventBus.Lock()
+	defer eventBus.Unlock()
+	if len(eventBus.subscribers) >= maxEventSubscribers {
+		return nil, false
+	}
+	events := make(chan Event, eventBacklog)
+	eventBus.subscribers[events] = struct{}{}
+	return events, true
+}
+
+func unsubscribeEvents(events chan Event) {
+	eventBus.Lock()
+	defer eventBus.Unlock()
+	if _, ok := eventBus.subscribers[events]; ok {
+		delete(eventBus.subscribers, events)
+		close(events)
+	}
+}
+
+// HandleEvents streams cache events as Server-Sent Events, one per message
+// with the event type as its name and the Event as JSON data. A comment is
+// sent as a heartbeat while nothing happens. Subscribers that cannot keep up
+// are disconnected and may reconnect.
+func HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	events, ok := subscribeEvents()
+	if !ok {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Too many event subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer unsubscribeEvents(events)
+
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's write timeout.
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logging.Error("Events: Streaming is not supported: %v", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logging.Error("Events: Error encoding event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
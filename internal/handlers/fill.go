@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// pushedHeader marks an entry stored by a cache fill. Such entries have no
+// origin to be revalidated against and are served as they are until they are
+// replaced, purged or evicted. Like fetchedAtHeader it is never sent to
+// clients.
+const pushedHeader = "X-Cache-Pushed"
+
+// maxBufferedFill bounds the body of a cache fill held in memory, for caches
+// that cannot take a finished file.
+const maxBufferedFill = 64 << 20
+
+// errFillRejected is returned, wrapped, when a filled body is incomplete or
+// does not match its checksum.
+var errFillRejected = errors.New("fill rejected")
+
+// fillChecksumHeaders map the request headers carrying a body's expected
+// checksum to the Release checksum algorithm they name.
+var fillChecksumHeaders = map[string]string{
+	"X-Checksum-Sha256": "SHA256",
+	"X-Checksum-Sha512": "SHA512",
+}
+
+// isPushed reports whether cached headers belong to an entry stored by a
+// cache fill.
+func isPushed(headers http.Header) bool {
+	return headers.Get(pushedHeader) != ""
+}
+
+// handleCacheFill stores the body of a PUT request in the cache under the
+// requested path, as if it had been fetched from the origin. The body must
+// have a Content-Length and, if an X-Checksum-Sha256 or X-Checksum-Sha512
+// header is given, match it. Paths the allowlist or manifest keep out of the
+// cache are refused. Content-Type, Last-Modified and ETag are taken
+// from the request. A fetch of the same path that is in progress is waited
+// for and then overwritten; requests for the path arriving during the fill
+// wait for it like for a fetch.
+func handleCacheFill(w http.ResponseWriter, r *http.Request, config ServerConfig) {
+	if strings.HasSuffix(r.URL.Path, "/") {
+		http.Error(w, "Cannot fill a directory", http.StatusBadRequest)
+		return
+	}
+	remotePath := getRemotePath(config, r.URL.Path)
+	if !isPathMirrored(config, remotePath) {
+		http.NotFound(w, r)
+		return
+	}
+	if !isCacheAllowed(config, remotePath) {
+		http.Error(w, "Path may not be cached", http.StatusForbidden)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length required", http.StatusLengthRequired)
+		return
+	}
+	if _, ok := config.Cache.(storage.FilePutter); !ok && r.ContentLength > maxBufferedFill {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var verifier *utils.ChecksumVerifier
+	for header, algorithm := range fillChecksumHeaders {
+		if sum := r.Header.Get(header); sum != "" {
+			var err error
+			if verifier, err = utils.NewChecksumVerifier(algorithm, sum); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			break
+		}
+	}
+
+	cacheKey := tenantCacheKey(r, getCacheKey(config, r.URL.Path))
+	for !acquireLock(cacheKey) {
+		req, _ := joinInflight(cacheKey, 0)
+		if req == nil {
+			continue
+		}
+		select {
+		case <-req.done:
+			atomic.AddInt32(&req.waiters, -1)
+		case <-r.Context().Done():
+			atomic.AddInt32(&req.waiters, -1)
+			return
+		}
+	}
+	defer releaseLock(cacheKey)
+
+	lastModified := time.Now()
+	if parsed, err := http.ParseTime(r.Header.Get("Last-Modified")); err == nil {
+		lastModified = clampToLocalClock(config, parsed)
+	}
+	replaced := false
+	if content, _, _, err := config.Cache.Get(cacheKey); err == nil {
+		content.Close()
+		replaced = true
+	}
+
+	if err := storeFill(config, cacheKey, r.Body, r.ContentLength, lastModified, verifier); err != nil {
+		if errors.Is(err, errFillRejected) {
+			logging.Warning("Cache fill: Rejected %s: %v", cacheKey, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logging.Error("Cache fill: Storing %s failed: %v", cacheKey, err)
+		http.Error(w, "Failed to store the body", http.StatusInternalServerError)
+		return
+	}
+
+	headers := make(http.Header)
+	for _, name := range []string{"Content-Type", "Last-Modified", "ETag"} {
+		if value := r.Header.Get(name); value != "" {
+			headers.Set(name, value)
+		}
+	}
+	if headers.Get("Last-Modified") == "" {
+		headers.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	headers.Set("Content-Length", fmt.Sprint(r.ContentLength))
+	headers.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers.Set(pushedHeader, "1")
+	if err := config.HeaderCache.PutHeaders(cacheKey, withOriginDate(withFetchTime(headers))); err != nil {
+		logging.Error("Cache fill: Error storing headers for %s: %v", cacheKey, err)
+		http.Error(w, "Failed to store headers", http.StatusInternalServerError)
+		return
+	}
+	config.ValidationCache.Put(fmt.Sprintf("validation:%s", cacheKey), time.Now())
+	forgetNegative(cacheKey)
+	if config.ImmutableCache != nil {
+		config.ImmutableCache.Delete(cacheKey)
+	}
+
+	logging.Info("Cache fill: Stored %s (%d bytes)", cacheKey, r.ContentLength)
+	if replaced {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// storeFill writes a filled body to the cache in one step, so readers see
+// either the previous entry or the complete new one. It goes through a
+// temporary file when the cache supports it and through memory otherwise,
+// which handleCacheFill only allows for bodies up to maxBufferedFill.
+func storeFill(config ServerConfig, cacheKey string, body io.Reader, size int64, lastModified time.Time, verifier *utils.ChecksumVerifier) error {
+	var sink io.Writer
+	var buf *bytes.Buffer
+	var file *os.File
+	putter, ok := config.Cache.(storage.FilePutter)
+	if ok {
+		var err error
+		if file, err = putter.CreateTemp(); err != nil {
+			return fmt.Errorf("failed to create temporary file: %w", err)
+		}
+		defer func() {
+			file.Close()
+			os.Remove(file.Name())
+		}()
+		sink = file
+	} else {
+		buf = new(bytes.Buffer)
+		sink = buf
+	}
+	if verifier != nil {
+		sink = io.MultiWriter(sink, verifier)
+	}
+
+	// One byte more than announced is read to detect an overlong body.
+	written, err := io.Copy(sink, io.LimitReader(body, size+1))
+	if err != nil {
+		return fmt.Errorf("%w: failed to read body: %v", errFillRejected, err)
+	}
+	if written != size {
+		return fmt.Errorf("%w: body is %d bytes, Content-Length announced %d", errFillRejected, written, size)
+	}
+	if verifier != nil {
+		if err := verifier.Verify(); err != nil {
+			return fmt.Errorf("%w: %v", errFillRejected, err)
+		}
+	}
+
+	if buf != nil {
+		return config.Cache.Put(cacheKey, buf, size, lastModified)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	return putter.PutFile(cacheKey, file.Name(), lastModified)
+}
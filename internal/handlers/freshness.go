@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// fetchedAtHeader records when the cached entry was last fetched or
+// validated. It is stored alongside the upstream headers but never sent to
+// clients because it is not in allowedResponseHeaders.
+const fetchedAtHeader = "X-Cache-Fetched-At"
+
+// withFetchTime returns a copy of the headers stamped with the current time
+// as the entry's fetch time.
+func withFetchTime(headers http.Header) http.Header {
+	stamped := headers.Clone()
+	if stamped == nil {
+		stamped = make(http.Header)
+	}
+	stamped.Set(fetchedAtHeader, time.Now().UTC().Format(http.TimeFormat))
+	return stamped
+}
+
+// clockSkewClamps counts origin timestamps that were clamped to the local
+// clock.
+var clockSkewClamps atomic.Int64
+
+// clampToLocalClock returns the origin timestamp t, or the current local time
+// if t lies further in the future than the configured clock skew tolerance.
+// An origin whose clock runs ahead would otherwise leave cache entries with
+// modification times in the future. Only the stored modification time is
+// clamped; the Last-Modified header is kept as sent, so validators exchanged
+// with the origin and clients are unaffected. Freshness never depends on
+// origin timestamps: entries are revalidated by the age measured from their
+// last validation on the local monotonic clock.
+func clampToLocalClock(config ServerConfig, t time.Time) time.Time {
+	now := time.Now()
+	if !t.After(now.Add(config.ClockSkewTolerance)) {
+		return t
+	}
+	clockSkewClamps.Add(1)
+	logging.Debug("Origin timestamp %s is %s ahead of the local clock, using the local time", t.Format(http.TimeFormat), t.Sub(now).Round(time.Second))
+	return now
+}
+
+// cacheControlFor returns the Cache-Control value advertised to downstream
+// caches for the given path.
+func cacheControlFor(config ServerConfig, path string) string {
+	if utils.GetFilePatternType(path) == utils.TypeFrequentlyChanging {
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d", int(config.DownstreamMaxAge.Seconds()))
+}
+
+// setDownstreamCacheHeaders emits Age and Cache-Control so that caches in
+// front of the mirror can store responses sensibly.
+func setDownstreamCacheHeaders(w http.ResponseWriter, r *http.Request, config ServerConfig, cachedHeaders http.Header) {
+	if !config.DownstreamCacheHeaders {
+		return
+	}
+
+	w.Header().Set("Cache-Control", cacheControlFor(config, r.URL.Path))
+
+	fetchedAt, err := time.Parse(http.TimeFormat, cachedHeaders.Get(fetchedAtHeader))
+	if err != nil {
+		return
+	}
+	age := time.Since(fetchedAt)
+	if age < 0 {
+		age = 0
+	}
+	w.Header().Set("Age", strconv.FormatInt(int64(age.Seconds()), 10))
+}
@@ -3,12 +3,17 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yolkispalkis/go-apt-cache/internal/logging"
@@ -27,8 +32,14 @@ var requestLock = struct {
 	inProgress map[string]*cacheRequest
 }{inProgress: make(map[string]*cacheRequest)}
 
+// cacheRequest is an origin fetch in progress. Requests are coalesced by the
+// unsalted fetch key, so the leader may be caching under the key of another
+// tenant.
 type cacheRequest struct {
-	done chan struct{}
+	done     chan struct{}
+	started  time.Time
+	cacheKey string // Key the leader stores the result under
+	waiters  int32  // Concurrent requests for the same path that did not become the leader
 }
 
 var allowedResponseHeaders = map[string]bool{
@@ -39,14 +50,105 @@ var allowedResponseHeaders = map[string]bool{
 	"Content-Length": true,
 }
 
+// pendingUpdates tracks cache writes still running in the background after
+// the client response has completed.
+var pendingUpdates sync.WaitGroup
+
+// FlushPendingUpdates waits until background cache writes have finished or
+// the context expires. It is meant to be called during graceful shutdown
+// before the caches are closed.
+func FlushPendingUpdates(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		pendingUpdates.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 var clientCache = struct {
 	sync.RWMutex
 	clients map[int]*http.Client
 }{clients: make(map[int]*http.Client)}
 
 const defaultClientTimeout = 120
+
+// waiterRetryAfter is the Retry-After, in seconds, sent to requests shed
+// because too many others are already waiting for the same path.
+const waiterRetryAfter = 5
 const defaultUserAgent = "Debian APT-HTTP/1.3 (2.2.4)"
 
+// hopByHopHeaders are meaningful only for a single connection (RFC 7230
+// section 6.1) and must never be cached or replayed to clients.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// singleValuedHeaders may appear only once in a response. Origins that send
+// them more than once have their first value kept, which is also the one
+// http.Header.Get and therefore the cache's own logic sees.
+var singleValuedHeaders = []string{"Content-Type", "Content-Length", "Last-Modified", "Etag", "Date"}
+
+// dedupSingleValuedHeaders drops all but the first value of each of
+// singleValuedHeaders, in place.
+func dedupSingleValuedHeaders(headers http.Header) {
+	for _, name := range singleValuedHeaders {
+		if values := headers.Values(name); len(values) > 1 {
+			headers.Set(name, values[0])
+		}
+	}
+}
+
+// privateResponseHeaders belong to the client that triggered a fetch and
+// must never be stored in the shared header cache.
+var privateResponseHeaders = []string{"Set-Cookie", "Set-Cookie2"}
+
+// stripHopByHopHeaders returns a copy of headers without hop-by-hop headers,
+// including any named in the Connection header and the configured extras,
+// and without private headers such as Set-Cookie.
+func stripHopByHopHeaders(headers http.Header, extra []string) http.Header {
+	stripped := headers.Clone()
+	if stripped == nil {
+		return make(http.Header)
+	}
+
+	for _, value := range headers.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				stripped.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		stripped.Del(name)
+	}
+	for _, name := range privateResponseHeaders {
+		stripped.Del(name)
+	}
+	for _, name := range extra {
+		stripped.Del(name)
+	}
+	dedupSingleValuedHeaders(stripped)
+	return stripped
+}
+
+// filterAndSetHeaders copies only allowedResponseHeaders to the client, so
+// hop-by-hop headers are never forwarded. Headers that may appear only once
+// are sent once, even if the origin or a cached entry has duplicates.
 func filterAndSetHeaders(w http.ResponseWriter, headers http.Header) {
 	for header, values := range headers {
 		if allowedResponseHeaders[http.CanonicalHeaderKey(header)] {
@@ -55,44 +157,123 @@ func filterAndSetHeaders(w http.ResponseWriter, headers http.Header) {
 			}
 		}
 	}
+	dedupSingleValuedHeaders(w.Header())
+}
+
+// downloadableSuffixes lists the artifact types that get a
+// Content-Disposition header when that option is enabled.
+var downloadableSuffixes = []string{".deb", ".udeb", ".ddeb", ".dsc"}
+
+func isDownloadableArtifact(path string) bool {
+	base := strings.ToLower(filepath.Base(path))
+	for _, suffix := range downloadableSuffixes {
+		if strings.HasSuffix(base, suffix) {
+			return true
+		}
+	}
+	return strings.HasSuffix(base, ".tar") || strings.Contains(base, ".tar.")
+}
+
+// setContentDisposition suggests the URL's final path segment as the file
+// name for downloadable artifacts. apt ignores it, it is meant for browsers.
+func setContentDisposition(w http.ResponseWriter, config ServerConfig, path string) {
+	if !config.ContentDisposition || !isDownloadableArtifact(path) {
+		return
+	}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)})
+	if disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
 }
 
 func acquireLock(path string) bool {
 	requestLock.Lock()
 	defer requestLock.Unlock()
 
-	if _, exists := requestLock.inProgress[path]; exists {
+	if _, exists := requestLock.inProgress[fetchKey(path)]; exists {
 		return false
 	}
-	req := &cacheRequest{done: make(chan struct{})}
-	requestLock.inProgress[path] = req
+	req := &cacheRequest{done: make(chan struct{}), started: time.Now(), cacheKey: path}
+	requestLock.inProgress[fetchKey(path)] = req
+	recordLeader()
 	return true
 }
 
+// joinInflight registers a waiter on the in-flight request for path. It
+// returns a nil request if the leader has already finished, and false if the
+// request already has maxWaiters waiters (zero means unlimited). The caller
+// must decrement waiters on the returned request when done.
+func joinInflight(path string, maxWaiters int) (*cacheRequest, bool) {
+	requestLock.Lock()
+	defer requestLock.Unlock()
+
+	req, exists := requestLock.inProgress[fetchKey(path)]
+	if !exists {
+		return nil, true
+	}
+	if maxWaiters > 0 && int(atomic.LoadInt32(&req.waiters)) >= maxWaiters {
+		return nil, false
+	}
+	atomic.AddInt32(&req.waiters, 1)
+	return req, true
+}
+
+// IsFetchInProgress reports whether the cache key is currently being fetched
+// from upstream. The cache uses it to hold off evicting such entries.
+func IsFetchInProgress(cacheKey string) bool {
+	return isInflight(cacheKey)
+}
+
+// isInflight reports whether path is currently being fetched from upstream.
+func isInflight(path string) bool {
+	requestLock.RLock()
+	defer requestLock.RUnlock()
+
+	_, exists := requestLock.inProgress[fetchKey(path)]
+	return exists
+}
+
 func releaseLock(path string) {
 	requestLock.Lock()
 	defer requestLock.Unlock()
 
-	if req, exists := requestLock.inProgress[path]; exists {
+	if req, exists := requestLock.inProgress[fetchKey(path)]; exists && req.cacheKey == path {
 		close(req.done)
-		delete(requestLock.inProgress, path)
+		delete(requestLock.inProgress, fetchKey(path))
 	}
 }
 
-func validateRequest(w http.ResponseWriter, r *http.Request) bool {
-	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+func validateRequest(w http.ResponseWriter, r *http.Request, config ServerConfig) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !isPassThrough(config, r) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return false
 	}
 
-	if r.URL.RawQuery != "" {
-		http.Error(w, "Query parameters are not allowed", http.StatusForbidden)
+	if !isPathMirrored(config, getRemotePath(config, r.URL.Path)) {
+		logging.Debug("Path filter: %s is not mirrored", r.URL.Path)
+		http.NotFound(w, r)
 		return false
 	}
 
-	return true
+	return handleQueryString(w, r, config)
 }
 
+// isCacheAllowed reports whether the remote path may be stored in the cache.
+// An empty allowlist permits every path; a manifest, if loaded, must list it
+// as well.
+func isCacheAllowed(config ServerConfig, remotePath string) bool {
+	if !inManifest(remotePath) {
+		return false
+	}
+	if len(config.CacheAllowlist) == 0 {
+		return true
+	}
+	return utils.MatchAnyPathPattern(config.CacheAllowlist, remotePath)
+}
+
+// getClient returns the HTTP client used for every upstream request. All
+// origin traffic must go through it so that tests can inject a client with a
+// custom RoundTripper via ServerConfig.Client instead of a real server.
 func getClient(config ServerConfig) *http.Client {
 	if config.Client != nil {
 		return config.Client
@@ -205,7 +386,9 @@ func updateCache(config ServerConfig, path string, body []byte, lastModified tim
 		defer wg.Done()
 		logging.Debug("Cache update: Storing content for %s (%d bytes)", path, len(body))
 		if len(body) > 0 {
-			if err := config.Cache.Put(path, bytes.NewReader(body), int64(len(body)), lastModified); err != nil {
+			err := config.Cache.Put(path, bytes.NewReader(body), int64(len(body)), lastModified)
+			noteCacheWrite(config, path, err)
+			if err != nil {
 				logging.Error("Cache update: Error storing content - %v", err)
 				errChan <- fmt.Errorf("content error: %w", err)
 				return
@@ -239,6 +422,7 @@ func updateCache(config ServerConfig, path string, body []byte, lastModified tim
 				logging.Info("Cache: Stored headers for %s", path)
 				logging.Info("Cache: Stored content for %s (%d bytes)", path, len(body))
 			}
+			PublishEvent(Event{Type: EventFetch, Key: path, Size: int64(len(body))})
 			body = nil   // Clear the body to help garbage collection
 			runtime.GC() // Force garbage collection after file operations
 		}
@@ -285,8 +469,8 @@ func checkAndHandleIfModifiedSince(w http.ResponseWriter, r *http.Request, lastM
 
 func validateWithUpstream(config ServerConfig, r *http.Request, cachedHeaders http.Header, cacheKey string) (bool, error) {
 	remotePath := getRemotePath(config, r.URL.Path)
-	upstreamURL := fmt.Sprintf("%s%s", config.UpstreamURL, remotePath)
-	req, err := http.NewRequest(http.MethodHead, upstreamURL, nil)
+	upstreamURL := fmt.Sprintf("%s%s%s", upstreamBase(config, remotePath), remotePath, upstreamQuery(r))
+	req, err := http.NewRequestWithContext(upstreamContext(r), http.MethodHead, upstreamURL, nil)
 	if err != nil {
 		return false, fmt.Errorf("error creating HEAD request for validation: %w", err)
 	}
@@ -296,6 +480,9 @@ func validateWithUpstream(config ServerConfig, r *http.Request, cachedHeaders ht
 		req.Header.Set("If-Modified-Since", lastModifiedStr)
 	}
 	etag := cachedHeaders.Get("ETag")
+	if isSyntheticETag(cachedHeaders) {
+		etag = ""
+	}
 	if etag != "" {
 		req.Header.Set("If-None-Match", etag)
 	}
@@ -317,7 +504,7 @@ func validateWithUpstream(config ServerConfig, r *http.Request, cachedHeaders ht
 	}
 
 	client := getClient(config)
-	resp, err := client.Do(req)
+	resp, err := doUpstream(config, client, req)
 	if err != nil {
 		logging.Error("Validation: Error checking with upstream - %v", err)
 		return false, fmt.Errorf("error checking with upstream: %w", err)
@@ -331,7 +518,7 @@ func validateWithUpstream(config ServerConfig, r *http.Request, cachedHeaders ht
 			logging.Info("Validation: Cache is valid according to upstream: %s", r.URL.Path)
 		}
 		mergedHeaders := mergeHeaders(cachedHeaders, resp.Header)
-		config.HeaderCache.PutHeaders(cacheKey, mergedHeaders)
+		config.HeaderCache.PutHeaders(cacheKey, withFetchTime(mergedHeaders))
 		return true, nil
 	}
 
@@ -356,6 +543,7 @@ func mergeHeaders(cachedHeaders, upstreamHeaders http.Header) http.Header {
 			merged[k] = v
 		}
 	}
+	dedupSingleValuedHeaders(merged)
 	return merged
 }
 
@@ -371,15 +559,46 @@ func handleCacheHit(w http.ResponseWriter, r *http.Request, config ServerConfig,
 
 	lastModifiedStr := cachedHeaders.Get("Last-Modified")
 
-	if checkAndHandleIfModifiedSince(w, r, lastModifiedStr, lastModified, config) {
+	setDownstreamCacheHeaders(w, r, config, cachedHeaders)
+
+	preconditionTime := lastModified
+	if parsed, err := time.Parse(http.TimeFormat, lastModifiedStr); err == nil {
+		preconditionTime = parsed
+	}
+	if checkAndHandlePreconditions(w, r, cachedHeaders.Get("ETag"), preconditionTime, config) {
+		return true
+	}
+	if checkAndHandleIfNoneMatch(w, r, cachedHeaders.Get("ETag"), config) {
+		return true
+	}
+	if r.Header.Get("If-None-Match") == "" && checkAndHandleIfModifiedSince(w, r, lastModifiedStr, lastModified, config) {
 		return true
 	}
 
+	if config.EarlyHints && r.Method == http.MethodGet && utils.IsReleaseFile(r.URL.Path) {
+		sendEarlyHints(w, r, config, content)
+	}
+
 	filterAndSetHeaders(w, cachedHeaders)
+	setContentDisposition(w, config, r.URL.Path)
+
+	var body io.Reader = content
+	if cachedHeaders.Get("Content-Type") == "" {
+		body = setFallbackContentType(w, r, config, content)
+	}
+
+	if r.Header.Get("Range") != "" {
+		if seeker, ok := content.(io.ReadSeeker); ok {
+			if _, err := seeker.Seek(0, io.SeekStart); err == nil {
+				http.ServeContent(w, r, filepath.Base(r.URL.Path), lastModified, seeker)
+				return true
+			}
+		}
+	}
 
 	w.WriteHeader(http.StatusOK)
 	if r.Method != http.MethodHead {
-		_, err := io.Copy(w, content)
+		_, err := io.Copy(w, body)
 		if err != nil {
 			if strings.Contains(err.Error(), "context canceled") ||
 				strings.Contains(err.Error(), "connection reset by peer") ||
@@ -395,55 +614,279 @@ func handleCacheHit(w http.ResponseWriter, r *http.Request, config ServerConfig,
 	return true
 }
 
+// setFallbackContentType sets a Content-Type for cached files whose upstream
+// response carried none. The extension is used when known; otherwise, if
+// sniffing is enabled, the content itself is inspected. The returned reader
+// must be used in place of content.
+func setFallbackContentType(w http.ResponseWriter, r *http.Request, config ServerConfig, content io.Reader) io.Reader {
+	if contentType, ok := utils.LookupContentType(r.URL.Path); ok {
+		w.Header().Set("Content-Type", contentType)
+		return content
+	}
+
+	if !config.SniffContentType {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		return content
+	}
+
+	contentType, body, err := utils.SniffContentType(content)
+	if err != nil {
+		logging.Warning("Failed to sniff content type for %s: %v", r.URL.Path, err)
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	return body
+}
+
 func handleCacheMiss(w http.ResponseWriter, r *http.Request, config ServerConfig, cacheKey string) {
+	if !isCacheAllowed(config, getRemotePath(config, r.URL.Path)) {
+		logging.Debug("handleCacheMiss: %s is not in the cache allowlist, proxying without caching", r.URL.Path)
+		handleDirectUpstream(w, r, config)
+		return
+	}
+
+	if cachingSuspended(config) {
+		logging.Debug("handleCacheMiss: Cache disk is full, proxying %s without caching", r.URL.Path)
+		handleDirectUpstream(w, r, config)
+		return
+	}
+
+	if shedOriginRequest(w, r, cacheKey) {
+		return
+	}
+
 	isFirstRequest := acquireLock(cacheKey)
 
 	if isFirstRequest {
-		defer releaseLock(cacheKey)
+		// The lock is normally released here, but once the response has been
+		// handed to updateCache it is released only after the cache write so
+		// that waiters find the file in the cache.
+		lockHandedOff := false
+		defer func() {
+			if !lockHandedOff {
+				releaseLock(cacheKey)
+			}
+		}()
 
 		remotePath := getRemotePath(config, r.URL.Path)
-		upstreamURL := fmt.Sprintf("%s%s", config.UpstreamURL, remotePath)
+		upstreamURL := fmt.Sprintf("%s%s%s", upstreamBase(config, remotePath), remotePath, upstreamQuery(r))
 
 		logging.Debug("handleCacheMiss: Fetching from upstream: %s → %s", cacheKey, upstreamURL)
 
 		client := getClient(config)
-		req, _ := http.NewRequest(r.Method, upstreamURL, nil)
+		// The client's Range header is deliberately not forwarded: the
+		// upstream must always return the full file so it can be cached.
+		// Ranges are served from the cached copy afterwards.
+		req, _ := http.NewRequestWithContext(upstreamContext(r), r.Method, upstreamURL, nil)
 		req.Header.Set("User-Agent", defaultUserAgent)
 
-		resp, err := client.Do(req)
+		fetchStart := time.Now()
+		var fetchedBytes int64
+		defer func() {
+			logSlowUpstreamRequest(config, upstreamURL, time.Since(fetchStart), fetchedBytes)
+		}()
+
+		resp, err := doUpstream(config, client, req)
 		if err != nil {
-			http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+			upstreamError(w, err)
 			logging.Error("Error fetching content from upstream: %v", err)
 			return
 		}
 		defer resp.Body.Close()
 
+		if resp.StatusCode == http.StatusNotFound && isInReleaseFile(remotePath) {
+			rememberMissingInRelease(config, cacheKey)
+		} else if ttl, ok := negativeTTL(config, remotePath, resp.StatusCode); ok {
+			if resp.StatusCode == http.StatusNotFound && isSignatureFallbackFile(remotePath) {
+				ttl, ok = signatureProbeTTL(config, cacheKey, ttl)
+			}
+			if ok {
+				rememberNegative(cacheKey, resp.StatusCode, ttl)
+			}
+		}
+
 		if r.Method == http.MethodHead {
 			filterAndSetHeaders(w, resp.Header)
 			w.WriteHeader(resp.StatusCode)
 			return
 		}
 
+		if resp.StatusCode == http.StatusPartialContent {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			logging.Error("Upstream returned unexpected partial content for %s", upstreamURL)
+			return
+		}
+
+		if rejectCaptivePortal(w, config, remotePath, upstreamURL, resp) {
+			return
+		}
+
+		var verifier *utils.ChecksumVerifier
+		if resp.StatusCode == http.StatusOK {
+			if verifier, err = indexVerifier(config, cacheKey); err != nil {
+				checksumFailures.Add(1)
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				logging.Error("Rejecting %s from upstream: %v", cacheKey, err)
+				return
+			}
+		}
+
+		if resp.StatusCode == http.StatusOK && len(resp.Header.Values("Set-Cookie")) > 0 && !config.CacheSetCookieResponses {
+			// A response meant for one client must not be served to others.
+			logging.Warning("handleCacheMiss: Not caching %s, upstream sent Set-Cookie", cacheKey)
+			fetchedBytes = passThroughResponse(w, r, config, resp)
+			return
+		}
+
+		if resp.StatusCode == http.StatusOK && !admitToCache(config, cacheKey, remotePath, resp.ContentLength) {
+			fetchedBytes = passThroughResponse(w, r, config, resp)
+			return
+		}
+
+		if putter, ok := shouldStreamToDisk(config, resp); ok {
+			written, err := streamToDisk(w, r, config, cacheKey, resp, putter, verifier)
+			fetchedBytes = written
+			noteCacheWrite(config, cacheKey, err)
+			if err != nil {
+				logging.Error("handleCacheMiss: Streaming %s to disk failed: %v", cacheKey, err)
+				if !config.StreamToDiskTee {
+					http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				}
+			}
+			return
+		}
+
+		releaseBuffer, ok := inflightBuffers.reserve(resp.ContentLength, isPoolPath(remotePath))
+		if !ok {
+			logging.Warning("handleCacheMiss: Buffer budget exhausted, rejecting %s (%d bytes)", cacheKey, resp.ContentLength)
+			w.Header().Set("Retry-After", strconv.Itoa(waiterRetryAfter))
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
 		// Get a buffer from the pool to store the response
 		buf := BufferPool.Get().(*bytes.Buffer)
 		buf.Reset()
-		defer BufferPool.Put(buf)
+		defer func() {
+			if !lockHandedOff {
+				BufferPool.Put(buf)
+				releaseBuffer()
+			}
+		}()
+
+		// The client is served from buf by a delivery of its own, so its
+		// speed never holds up the download or the cache write.
+		out := clientWriter(w, config)
+		var delivery *clientDelivery
+		defer func() {
+			if delivery != nil {
+				delivery.wait()
+				resetWriteDeadline(out)
+			}
+		}()
 
-		// Create a multi-writer to write to both the response and our buffer
-		multiWriter := io.MultiWriter(w, buf)
+		lastModifiedTime := upstreamLastModified(config, resp.Header)
 
-		lastModifiedTime := time.Now()
-		if lastModifiedHeader := resp.Header.Get("Last-Modified"); lastModifiedHeader != "" {
-			if parsedTime, err := time.Parse(http.TimeFormat, lastModifiedHeader); err == nil {
-				lastModifiedTime = parsedTime
+		cacheUpdated := false
+		if resp.StatusCode == http.StatusOK && utils.IsReleaseFile(remotePath) {
+			// Release files are small; read them completely so referenced
+			// indexes can be invalidated before the client sees the new Release.
+			if _, err := io.Copy(buf, resp.Body); err != nil {
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				logging.Error("Error reading Release from upstream: %v", err)
+				return
 			}
-		}
+			fetchedBytes = int64(buf.Len())
+			forgetSignatureProbes(cacheKey)
+
+			var invalidated []string
+			if config.SuiteLock {
+				// Swap the Release and its indexes while readers of the
+				// suite are held off, so none of them sees a mixed set.
+				unlock := lockSuiteForRefresh(cacheKey)
+				invalidated = invalidateStaleIndexes(config, cacheKey, buf.Bytes())
+				invalidateReleaseSignature(config, cacheKey)
+				headers := withSyntheticETag(withOriginDate(withFetchTime(stripHopByHopHeaders(resp.Header, config.HopByHopHeaders))), buf.Bytes())
+				writeSpan := startCacheWriteSpan(r, cacheKey, int64(buf.Len()))
+				updateCache(config, cacheKey, buf.Bytes(), lastModifiedTime, headers)
+				writeSpan.finish()
+				unlock()
+				cacheUpdated = true
+			} else {
+				invalidated = invalidateStaleIndexes(config, cacheKey, buf.Bytes())
+				invalidateReleaseSignature(config, cacheKey)
+			}
+			if config.SuiteBatchRefresh {
+				refreshSuiteIndexes(config, r, cacheKey, buf.Bytes(), invalidated)
+			}
+
+			filterAndSetHeaders(w, resp.Header)
+			w.WriteHeader(resp.StatusCode)
+			delivery = startDelivery(out, buf)
+			delivery.finish()
+		} else if verifier != nil {
+			// An index is only passed on once it matches the checksum in
+			// its suite's Release, so a corrupted copy is never served or
+			// cached.
+			if _, err := io.Copy(io.MultiWriter(buf, verifier), resp.Body); err != nil {
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				logging.Error("Error reading index from upstream: %v", err)
+				return
+			}
+			fetchedBytes = int64(buf.Len())
 
-		filterAndSetHeaders(w, resp.Header)
-		w.WriteHeader(resp.StatusCode)
+			if err := verifier.Verify(); err != nil {
+				checksumFailures.Add(1)
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				logging.Error("Rejecting index %s from upstream: %v", cacheKey, err)
+				return
+			}
+
+			filterAndSetHeaders(w, resp.Header)
+			w.WriteHeader(resp.StatusCode)
+			delivery = startDelivery(out, buf)
+			delivery.finish()
+		} else if resp.StatusCode == http.StatusOK && config.ValidateDebStructure && utils.IsDebPackage(remotePath) {
+			// A package is only passed on once it is known to be complete,
+			// so a broken download is never served or cached.
+			if _, err := io.Copy(buf, resp.Body); err != nil {
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				logging.Error("Error reading package from upstream: %v", err)
+				return
+			}
+			fetchedBytes = int64(buf.Len())
+
+			if err := utils.ValidateDebStructure(bytes.NewReader(buf.Bytes())); err != nil {
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				logging.Error("Rejecting invalid package %s from upstream: %v", cacheKey, err)
+				return
+			}
+
+			filterAndSetHeaders(w, resp.Header)
+			setContentDisposition(w, config, r.URL.Path)
+			w.WriteHeader(resp.StatusCode)
+			delivery = startDelivery(out, buf)
+			delivery.finish()
+		} else {
+			filterAndSetHeaders(w, resp.Header)
+			if resp.StatusCode == http.StatusOK {
+				setContentDisposition(w, config, r.URL.Path)
+			}
+			w.WriteHeader(resp.StatusCode)
 
-		if _, err := io.Copy(multiWriter, resp.Body); err != nil {
-			logging.Error("Error copying response body: %v", err)
+			delivery = startDelivery(out, buf)
+			err := delivery.fill(resp.Body)
+			fetchedBytes = int64(buf.Len())
+			if err != nil {
+				logging.Error("Error copying response body: %v", err)
+				return
+			}
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			// Cache hits are always replayed as 200, so only complete
+			// successful responses may be stored.
+			logging.Debug("handleCacheMiss: Not caching %s, upstream status %d", cacheKey, resp.StatusCode)
 			return
 		}
 
@@ -451,16 +894,132 @@ func handleCacheMiss(w http.ResponseWriter, r *http.Request, config ServerConfig
 		validationKey := fmt.Sprintf("validation:%s", cacheKey)
 		config.ValidationCache.Put(validationKey, time.Now())
 		logging.Debug("Cache validation: Updated key %s", validationKey)
-		go updateCache(config, cacheKey, buf.Bytes(), lastModifiedTime, resp.Header)
-		buf.Reset()
+		if !cacheUpdated {
+			lockHandedOff = true
+			headers := withOriginDate(withFetchTime(stripHopByHopHeaders(resp.Header, config.HopByHopHeaders)))
+			pendingUpdates.Add(1)
+			go func() {
+				defer pendingUpdates.Done()
+				writeSpan := startCacheWriteSpan(r, cacheKey, int64(buf.Len()))
+				updateCache(config, cacheKey, buf.Bytes(), lastModifiedTime, withSyntheticETag(headers, buf.Bytes()))
+				writeSpan.finish()
+				releaseLock(cacheKey)
+				// The client may still be reading from the buffer.
+				delivery.wait()
+				buf.Reset()
+				BufferPool.Put(buf)
+				releaseBuffer()
+			}()
+		}
 		runtime.GC() // Force garbage collection after file operations
 
 	} else {
-		handleDirectUpstream(w, r, config)
+		waitForLeader(w, r, config, cacheKey)
+	}
+}
+
+// passThroughResponse sends a successful upstream response to the client
+// without caching it and returns the number of body bytes copied.
+func passThroughResponse(w http.ResponseWriter, r *http.Request, config ServerConfig, resp *http.Response) int64 {
+	filterAndSetHeaders(w, resp.Header)
+	setContentDisposition(w, config, r.URL.Path)
+	w.WriteHeader(resp.StatusCode)
+	written, err := io.Copy(w, resp.Body)
+	if err != nil {
+		logging.Error("Error copying response body: %v", err)
+	}
+	return written
+}
+
+// waitForLeader blocks a follower until the leader fetching the same path has
+// finished, then serves the result from the cache. If the leader did not
+// manage to cache the file the follower fetches it directly, as long as the
+// retry budget allows. Followers beyond the configured cap are turned away
+// with 503 instead of piling up.
+func waitForLeader(w http.ResponseWriter, r *http.Request, config ServerConfig, cacheKey string) {
+	req, admitted := joinInflight(cacheKey, config.MaxWaiters)
+	if !admitted {
+		logging.Warning("Too many requests waiting for %s, rejecting", cacheKey)
+		recordWaiterShed()
+		w.Header().Set("Retry-After", strconv.Itoa(waiterRetryAfter))
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if req != nil {
+		defer atomic.AddInt32(&req.waiters, -1)
+
+		_, waitSpan := startSpan(r.Context(), "single-flight wait", spanKindInternal)
+		waitSpan.set("cache.key", cacheKey)
+		waitStart := time.Now()
+		select {
+		case <-req.done:
+			recordWaiter(time.Since(waitStart))
+			waitSpan.finish()
+		case <-r.Context().Done():
+			recordWaiter(time.Since(waitStart))
+			waitSpan.fail(r.Context().Err())
+			waitSpan.finish()
+			return
+		}
+	}
+
+	if req != nil && req.cacheKey != cacheKey {
+		adoptEntry(config, req.cacheKey, cacheKey)
+	}
+
+	content, _, lastModified, err := lookupCache(r, config, cacheKey)
+	if err == nil {
+		if handleCacheHit(w, r, config, content, lastModified, cacheKey) {
+			return
+		}
+	}
+
+	if !allowRetry() {
+		// The leader most likely failed; with the origin struggling, every
+		// waiter trying again would only add to its load.
+		logging.Warning("Retry budget exhausted, not fetching %s again", cacheKey)
+		w.Header().Set("Retry-After", strconv.Itoa(waiterRetryAfter))
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	logging.Debug("waitForLeader: %s was not cached by the leader, fetching directly", cacheKey)
+	recordWaiterRefetch()
+	handleDirectUpstream(w, r, config)
+}
+
+// upstreamError answers a failed upstream request: 502 when the origin
+// redirected somewhere it may not or presented a certificate that does not
+// match its pins, 504 otherwise.
+func upstreamError(w http.ResponseWriter, err error) {
+	var limitErr *rateLimitError
+	if errors.As(err, &limitErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(limitErr.retryAfter()))
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, utils.ErrRedirectRejected) || errors.Is(err, utils.ErrCertificatePinMismatch) {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+}
+
+// logSlowUpstreamRequest warns about upstream fetches that took longer than
+// the configured threshold.
+func logSlowUpstreamRequest(config ServerConfig, upstreamURL string, duration time.Duration, bytes int64) {
+	if config.SlowRequestThreshold <= 0 || duration < config.SlowRequestThreshold {
+		return
 	}
+	logging.Warning("Slow upstream request: %s took %v (%s)", upstreamURL, duration, utils.FormatSize(bytes))
 }
 
 func handleDirectUpstream(w http.ResponseWriter, r *http.Request, config ServerConfig) {
+	if shedOriginRequest(w, r, "") {
+		return
+	}
+
 	path := r.URL.Path
 	if path == "" {
 		path = "/"
@@ -469,7 +1028,7 @@ func handleDirectUpstream(w http.ResponseWriter, r *http.Request, config ServerC
 	remotePath := getRemotePath(config, path)
 
 	// Remove trailing slash from upstream URL if it exists
-	upstreamURL := strings.TrimSuffix(config.UpstreamURL, "/")
+	upstreamURL := strings.TrimSuffix(upstreamBase(config, remotePath), "/")
 
 	// Ensure remotePath starts with slash if not empty
 	if remotePath != "" && !strings.HasPrefix(remotePath, "/") {
@@ -477,12 +1036,12 @@ func handleDirectUpstream(w http.ResponseWriter, r *http.Request, config ServerC
 	}
 
 	// Combine URLs ensuring single slash between parts
-	fullURL := upstreamURL + remotePath
+	fullURL := upstreamURL + remotePath + upstreamQuery(r)
 
 	logging.Debug("Direct upstream request: %s → %s", path, fullURL)
 
 	client := getClient(config)
-	req, err := http.NewRequest(r.Method, fullURL, nil)
+	req, err := http.NewRequestWithContext(upstreamContext(r), r.Method, fullURL, nil)
 	if err != nil {
 		http.Error(w, "Error creating request to upstream", http.StatusInternalServerError)
 		logging.Error("Error creating request to upstream: %v", err)
@@ -491,19 +1050,26 @@ func handleDirectUpstream(w http.ResponseWriter, r *http.Request, config ServerC
 
 	req.Header.Set("User-Agent", defaultUserAgent)
 
-	resp, err := client.Do(req)
+	resp, err := doUpstream(config, client, req)
 	if err != nil {
-		http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+		upstreamError(w, err)
 		logging.Error("Error fetching content from upstream: %v", err)
 		return
 	}
 	defer resp.Body.Close()
 
+	if r.Method != http.MethodHead && rejectCaptivePortal(w, config, remotePath, fullURL, resp) {
+		return
+	}
+
 	filterAndSetHeaders(w, resp.Header)
 	if resp.StatusCode == http.StatusNotModified {
 		sendNotModified(w, config, r)
 		return
 	}
+	if resp.StatusCode == http.StatusOK {
+		setContentDisposition(w, config, path)
+	}
 	w.WriteHeader(resp.StatusCode)
 
 	if r.Method != http.MethodHead {
@@ -524,34 +1090,101 @@ func handleDirectUpstream(w http.ResponseWriter, r *http.Request, config ServerC
 
 func HandleRequest(config ServerConfig, useIfModifiedSince bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		w = withResponseHeaders(w, config)
+		w, sendErrorPage := withErrorPages(w, r)
+		defer sendErrorPage()
 		if config.LogRequests {
 			logging.Info("Request: %s", r.URL.Path)
 		}
 
-		if !validateRequest(w, r) {
+		if !validateRequest(w, r, config) {
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			handlePassThrough(w, r, config)
 			return
 		}
 
+		var directives clientCacheDirectives
+		if config.HonorClientCacheControl {
+			directives = parseClientCacheControl(r)
+		}
+
 		// Check if this is a directory request (either root or ends with /)
 		if r.URL.Path == "" || r.URL.Path == "/" || strings.HasSuffix(r.URL.Path, "/") {
+			if directives.onlyIfCached {
+				http.Error(w, "Not cached", http.StatusGatewayTimeout)
+				return
+			}
 			logging.Info("Directory request detected, bypassing cache: %s", r.URL.Path)
 			handleDirectUpstream(w, r, config)
 			return
 		}
 
-		cacheKey := getCacheKey(config, r.URL.Path)
+		forceRevalidate := directives.noCache
+		if pattern, matched := matchBypassUserAgent(config, r.UserAgent()); matched && !directives.onlyIfCached {
+			if config.BypassMode == BypassPassThrough {
+				logging.Debug("User agent matches %s, passing %s through", pattern, r.URL.Path)
+				handleDirectUpstream(w, r, config)
+				return
+			}
+			logging.Debug("User agent matches %s, revalidating %s", pattern, r.URL.Path)
+			forceRevalidate = true
+		}
+
+		cacheKey := tenantCacheKey(r, getCacheKey(config, r.URL.Path))
 		logging.Debug("Using cache key: %s for path: %s (repo: %s)",
 			cacheKey, r.URL.Path, strings.Trim(config.LocalPath, "/"))
+		recordClientAccess(r, config, cacheKey)
+
+		if directives.onlyIfCached {
+			serveOnlyIfCached(w, r, config, cacheKey)
+			return
+		}
+
+		if cacheBypassRequested(config, r) {
+			logging.Info("Cache bypass requested by %s, refetching %s", r.RemoteAddr, cacheKey)
+			forgetNegative(cacheKey)
+			handleCacheMiss(w, r, config, cacheKey)
+			return
+		}
+
+		if status, ok := lookupNegative(cacheKey); ok {
+			logging.Debug("Negative cache: Answering %d for %s without contacting upstream", status, cacheKey)
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		if handleTranscoded(w, r, config) {
+			return
+		}
+
+		if !forceRevalidate && config.ImmutableCache != nil && isImmutablePath(config, getRemotePath(config, r.URL.Path)) {
+			if handleImmutableHit(w, r, config, cacheKey) {
+				return
+			}
+			handleCacheMiss(w, r, config, cacheKey)
+			return
+		}
+
+		if !forceRevalidate && isPoolPath(getRemotePath(config, r.URL.Path)) && handlePoolNotModified(w, r, config, cacheKey) {
+			return
+		}
 
 		validationKey := fmt.Sprintf("validation:%s", cacheKey)
 		logging.Debug("Using validation key: %s", validationKey)
 
 		fileType := utils.GetFilePatternType(r.URL.Path)
-		if fileType == utils.TypeFrequentlyChanging {
+		// With revalidation disabled every cached copy is authoritative, so
+		// only misses reach the origin.
+		if !config.DisableRevalidation && (fileType == utils.TypeFrequentlyChanging || forceRevalidate) {
 			isValid, lastValidated := config.ValidationCache.Get(validationKey)
+			if forceRevalidate {
+				isValid = false
+			}
 			if isValid {
 				logging.Info("Validation cache: File %s is valid (last validated: %v)", validationKey, lastValidated)
-				content, _, lastModified, err := config.Cache.Get(cacheKey)
+				content, _, lastModified, err := lookupSuiteFile(r, config, cacheKey)
 				if err == nil {
 					if handleCacheHit(w, r, config, content, lastModified, cacheKey) {
 						return
@@ -559,11 +1192,24 @@ func HandleRequest(config ServerConfig, useIfModifiedSince bool) http.HandlerFun
 				}
 			}
 			if !isValid {
+				unlock := lockSuiteFileForRead(config, r, cacheKey)
 				cachedHeaders, headerErr := config.HeaderCache.GetHeaders(cacheKey)
-				content, _, lastModified, err := config.Cache.Get(cacheKey)
+				content, _, lastModified, err := lookupCache(r, config, cacheKey)
+				unlock()
 
 				if headerErr == nil && err == nil {
+					if isPushed(cachedHeaders) {
+						// Filled entries have no origin to ask.
+						handleCacheHit(w, r, config, content, lastModified, cacheKey)
+						return
+					}
 					cacheIsValid, validationErr := validateWithUpstream(config, r, cachedHeaders, cacheKey)
+					if errors.Is(validationErr, errOriginRateLimited) {
+						logging.Warning("Serving %s without revalidation: %v", cacheKey, validationErr)
+						if handleCacheHit(w, r, config, content, lastModified, cacheKey) {
+							return
+						}
+					}
 					if validationErr != nil {
 						logging.Error("Error validating with upstream: %v", validationErr)
 						handleCacheMiss(w, r, config, cacheKey)
@@ -575,6 +1221,12 @@ func HandleRequest(config ServerConfig, useIfModifiedSince bool) http.HandlerFun
 						if handleCacheHit(w, r, config, content, lastModified, cacheKey) {
 							return
 						}
+					} else if config.StaleWhileRefresh && !forceRevalidate {
+						logging.Info("Upstream has a newer %s, serving the cached copy while refreshing", cacheKey)
+						refreshInBackground(config, r, cacheKey)
+						if handleCacheHit(w, r, config, content, lastModified, cacheKey) {
+							return
+						}
 					} else {
 						handleCacheMiss(w, r, config, cacheKey)
 						return
@@ -584,7 +1236,7 @@ func HandleRequest(config ServerConfig, useIfModifiedSince bool) http.HandlerFun
 					return
 				}
 			} else {
-				content, _, lastModified, err := config.Cache.Get(cacheKey)
+				content, _, lastModified, err := lookupSuiteFile(r, config, cacheKey)
 				if err == nil {
 					if handleCacheHit(w, r, config, content, lastModified, cacheKey) {
 						return
@@ -595,7 +1247,7 @@ func HandleRequest(config ServerConfig, useIfModifiedSince bool) http.HandlerFun
 			}
 
 		} else {
-			content, _, lastModified, err := config.Cache.Get(cacheKey)
+			content, _, lastModified, err := lookupSuiteFile(r, config, cacheKey)
 			if err == nil {
 				if handleCacheHit(w, r, config, content, lastModified, cacheKey) {
 					return
@@ -0,0 +1,3846 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/config"
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// fakeOrigin is an http.RoundTripper that answers upstream requests with
+// canned responses instead of touching the network.
+type fakeOrigin struct {
+	calls   int32
+	respond func(req *http.Request) (*http.Response, error)
+}
+
+func (f *fakeOrigin) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&f.calls, 1)
+	return f.respond(req)
+}
+
+func (f *fakeOrigin) Calls() int {
+	return int(atomic.LoadInt32(&f.calls))
+}
+
+func cannedResponse(req *http.Request, status int, body string, headers http.Header) *http.Response {
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		StatusCode:    status,
+		Status:        http.StatusText(status),
+		Header:        headers,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func newTestServerConfig(t *testing.T, origin *fakeOrigin) ServerConfig {
+	t.Helper()
+
+	tempDir := t.TempDir()
+
+	cache, err := storage.NewLRUCache(tempDir, 1024*1024*10)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+
+	headerCache, err := storage.NewFileHeaderCache(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create header cache: %v", err)
+	}
+
+	config := NewServerConfig()
+	config.UpstreamURL = "http://origin.invalid/debian/"
+	config.Cache = cache
+	config.HeaderCache = headerCache
+	config.ValidationCache = storage.NewMemoryValidationCache(time.Minute)
+	config.Client = &http.Client{Transport: origin}
+	config.LogRequests = false
+	return config
+}
+
+func waitForCache(t *testing.T, config ServerConfig, key string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if content, _, _, err := config.Cache.Get(key); err == nil {
+			content.Close()
+			if _, err := config.HeaderCache.GetHeaders(key); err == nil {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s to be cached", key)
+}
+
+func TestCacheMissThenHitUsesInjectedClient(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "http://origin.invalid/debian/pool/main/h/hello/hello_1.0_amd64.deb" {
+			t.Errorf("Unexpected upstream URL: %s", req.URL)
+		}
+		headers := http.Header{}
+		headers.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		return cannedResponse(req, http.StatusOK, "deb content", headers), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := HandleRequest(config, false)
+
+	path := "pool/main/h/hello/hello_1.0_amd64.deb"
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/"+path, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "deb content" {
+		t.Fatalf("Unexpected miss response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	waitForCache(t, config, getCacheKey(config, "/"+path))
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/"+path, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "deb content" {
+		t.Fatalf("Unexpected hit response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	if origin.Calls() != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", origin.Calls())
+	}
+}
+
+func TestCacheMissUpstreamError(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}}
+	config := newTestServerConfig(t, origin)
+
+	rec := httptest.NewRecorder()
+	HandleRequest(config, false)(rec, httptest.NewRequest(http.MethodGet, "/pool/main/x.deb", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status %d, got %d", http.StatusGatewayTimeout, rec.Code)
+	}
+}
+
+func TestCacheMissRejectsPartialContent(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Range") != "" {
+			t.Errorf("Range header must not be forwarded upstream")
+		}
+		return cannedResponse(req, http.StatusPartialContent, "partial", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+
+	req := httptest.NewRequest(http.MethodGet, "/pool/main/x.deb", nil)
+	req.Header.Set("Range", "bytes=0-3")
+	rec := httptest.NewRecorder()
+	HandleRequest(config, false)(rec, req)
+
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("Expected status %d, got %d", http.StatusBadGateway, rec.Code)
+	}
+	if _, _, _, err := config.Cache.Get(getCacheKey(config, "/pool/main/x.deb")); err == nil {
+		t.Errorf("Partial content must not be cached")
+	}
+}
+
+func TestConcurrentMissesShareOneUpstreamFetch(t *testing.T) {
+	release := make(chan struct{})
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		<-release
+		return cannedResponse(req, http.StatusOK, "shared content", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := HandleRequest(config, false)
+	path := "/pool/main/s/shared/shared_1.0_all.deb"
+
+	results := make(chan *httptest.ResponseRecorder, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			results <- rec
+		}()
+	}
+
+	// Give all requests time to register before the leader's fetch completes.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if entries := snapshotInflight(); len(entries) == 1 && entries[0].Waiters == 2 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(release)
+
+	for i := 0; i < 3; i++ {
+		rec := <-results
+		if rec.Code != http.StatusOK || rec.Body.String() != "shared content" {
+			t.Errorf("Unexpected response: %d %q", rec.Code, rec.Body.String())
+		}
+	}
+	if origin.Calls() != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", origin.Calls())
+	}
+}
+
+func TestInReleaseNotFoundFallsBackToSplitRelease(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		switch path.Base(req.URL.Path) {
+		case "Release":
+			return cannedResponse(req, http.StatusOK, "Suite: split\n", nil), nil
+		case "Release.gpg":
+			return cannedResponse(req, http.StatusOK, "signature", nil), nil
+		default:
+			return cannedResponse(req, http.StatusNotFound, "not found", nil), nil
+		}
+	}}
+	config := newTestServerConfig(t, origin)
+	config.InReleaseNotFoundTTL = time.Minute
+	handler := HandleRequest(config, true)
+
+	get := func(p string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/dists/split/"+p, nil))
+		return rec
+	}
+
+	if rec := get("InRelease"); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for InRelease, got %d", rec.Code)
+	}
+	if rec := get("Release"); rec.Code != http.StatusOK || rec.Body.String() != "Suite: split\n" {
+		t.Fatalf("Unexpected Release response: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("Release.gpg"); rec.Code != http.StatusOK || rec.Body.String() != "signature" {
+		t.Fatalf("Unexpected Release.gpg response: %d %q", rec.Code, rec.Body.String())
+	}
+	waitForCache(t, config, getCacheKey(config, "/dists/split/Release.gpg"))
+
+	calls := origin.Calls()
+	if rec := get("InRelease"); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected remembered 404 for InRelease, got %d", rec.Code)
+	}
+	if origin.Calls() != calls {
+		t.Errorf("Expected the InRelease 404 to be answered without the origin")
+	}
+}
+
+func TestReleaseRefreshDropsCachedSignature(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "Suite: resign\n", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+
+	signatureKey := getCacheKey(config, "/dists/resign/Release.gpg")
+	if err := config.Cache.Put(signatureKey, strings.NewReader("old signature"), int64(len("old signature")), time.Now()); err != nil {
+		t.Fatalf("Failed to seed cache: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	HandleRequest(config, true)(rec, httptest.NewRequest(http.MethodGet, "/dists/resign/Release", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected Release response: %d", rec.Code)
+	}
+
+	if content, _, _, err := config.Cache.Get(signatureKey); err == nil {
+		content.Close()
+		t.Errorf("Expected the cached Release.gpg to be dropped after a Release refresh")
+	}
+}
+
+func TestReleaseRefreshInvalidatesIndexesByChecksum(t *testing.T) {
+	seeded := map[string]string{
+		"/dists/rehash/main/binary-amd64/Packages": "Package: old\n",
+		"/dists/rehash/main/source/Sources":        "Package: src\n",
+	}
+	entry := func(body, relPath string) string {
+		sum := sha256.Sum256([]byte(body))
+		return fmt.Sprintf(" %s %d %s\n", hex.EncodeToString(sum[:]), len(body), relPath)
+	}
+	// Packages was republished with the same size, Sources is unchanged.
+	release := "Suite: rehash\nSHA256:\n" + entry("Package: new\n", "main/binary-amd64/Packages") + entry("Package: src\n", "main/source/Sources")
+
+	for _, test := range []struct {
+		name    string
+		release string
+		dropped bool
+	}{
+		{"checksums", release, true},
+		// A Release that does not parse strictly only has its sizes compared.
+		{"sizes only", release + " malformed\n", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+				return cannedResponse(req, http.StatusOK, test.release, nil), nil
+			}}
+			config := newTestServerConfig(t, origin)
+			for requestPath, body := range seeded {
+				if err := config.Cache.Put(getCacheKey(config, requestPath), strings.NewReader(body), int64(len(body)), time.Now()); err != nil {
+					t.Fatalf("Failed to seed cache: %v", err)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			HandleRequest(config, true)(rec, httptest.NewRequest(http.MethodGet, "/dists/rehash/Release", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Unexpected Release response: %d", rec.Code)
+			}
+			pendingUpdates.Wait()
+
+			for requestPath := range seeded {
+				content, _, _, err := config.Cache.Get(getCacheKey(config, requestPath))
+				if err == nil {
+					content.Close()
+				}
+				if dropped := err != nil; dropped != (test.dropped && strings.HasSuffix(requestPath, "/Packages")) {
+					t.Errorf("Unexpected invalidation of %s: dropped %v", requestPath, dropped)
+				}
+			}
+		})
+	}
+}
+
+func TestCanonicalCompressionTranscodesVariants(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("Package: hello\n"))
+	gz.Close()
+
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/Packages.gz") {
+			return cannedResponse(req, http.StatusOK, compressed.String(), nil), nil
+		}
+		return cannedResponse(req, http.StatusNotFound, "not found", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.CanonicalCompression = CompressionGzip
+	handler := HandleRequest(config, true)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/dists/transcode/main/binary-amd64/Packages", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "Package: hello\n" {
+		t.Fatalf("Unexpected transcoded response: %d %q", rec.Code, rec.Body.String())
+	}
+
+	if content, _, _, err := config.Cache.Get(getCacheKey(config, "/dists/transcode/main/binary-amd64/Packages")); err == nil {
+		content.Close()
+		t.Errorf("Expected only the canonical variant to be cached")
+	}
+	if origin.Calls() != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", origin.Calls())
+	}
+
+	// The canonical file is requested with the client's headers.
+	pendingUpdates.Wait()
+	config.HonorClientCacheControl = true
+	req := httptest.NewRequest(http.MethodGet, "/dists/transcode/main/binary-amd64/Packages", nil)
+	req.Header.Set("Cache-Control", "no-cache")
+	rec = httptest.NewRecorder()
+	HandleRequest(config, true)(rec, req)
+	if rec.Code != http.StatusOK || origin.Calls() == 1 {
+		t.Errorf("Expected no-cache to revalidate the canonical file, got %d with %d upstream requests", rec.Code, origin.Calls())
+	}
+}
+
+func TestImmutableFastPathOnlyWhenEnabled(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "Package: hello\n", nil), nil
+	}}
+	base := newTestServerConfig(t, origin)
+	globalConfig := config.DefaultConfig()
+
+	get := func(config ServerConfig, requestPath string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		HandleRequest(config, true)(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+		pendingUpdates.Wait()
+		return w
+	}
+
+	disabled := NewRepositoryServerConfig(base.UpstreamURL, base.Cache, base.HeaderCache, base.ValidationCache, base.Client, &globalConfig)
+	if disabled.ImmutableCache != nil {
+		t.Fatal("Expected no immutable cache with the fast path off")
+	}
+	disabledPath := "/dists/stable/main/binary-amd64/by-hash/SHA256/0123"
+	get(disabled, disabledPath)
+	if w := get(disabled, disabledPath); w.Code != http.StatusOK || w.Header().Get("Cache-Control") == immutableCacheControl {
+		t.Errorf("Expected a regular cached response with the fast path off, got %d with Cache-Control %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+
+	globalConfig.Cache.ImmutableFastPath = true
+	enabled := NewRepositoryServerConfig(base.UpstreamURL, base.Cache, base.HeaderCache, base.ValidationCache, base.Client, &globalConfig)
+	enabledPath := "/dists/stable/main/binary-amd64/by-hash/SHA256/4567"
+	get(enabled, enabledPath)
+	calls := origin.Calls()
+	if w := get(enabled, enabledPath); w.Code != http.StatusOK || w.Header().Get("Cache-Control") != immutableCacheControl || origin.Calls() != calls {
+		t.Errorf("Expected the fast path to serve the cached file, got %d with Cache-Control %q and %d more origin calls", w.Code, w.Header().Get("Cache-Control"), origin.Calls()-calls)
+	}
+}
+
+func TestCompressedVariantsAreNotRecompressed(t *testing.T) {
+	// Compressed differently from how gzip.Writer would compress it again.
+	var compressed bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&compressed, gzip.NoCompression)
+	gz.Write([]byte("Package: hello\n"))
+	gz.Close()
+
+	var paths []string
+	var mu sync.Mutex
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		paths = append(paths, req.URL.Path)
+		mu.Unlock()
+		if strings.HasSuffix(req.URL.Path, "/Packages.gz") {
+			return cannedResponse(req, http.StatusOK, compressed.String(), nil), nil
+		}
+		return cannedResponse(req, http.StatusOK, "Package: hello\n", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.CanonicalCompression = CompressionNone
+	handler := HandleRequest(config, true)
+
+	for _, requestPath := range []string{"/dists/plain/main/binary-amd64/Packages", "/dists/plain/main/binary-amd64/Packages.gz"} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, requestPath, nil))
+		pendingUpdates.Wait()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected %s to be served, got %d", requestPath, rec.Code)
+		}
+		if strings.HasSuffix(requestPath, ".gz") && rec.Body.String() != compressed.String() {
+			t.Errorf("Expected the origin's bytes of %s, got %q", requestPath, rec.Body.String())
+		}
+	}
+	if len(paths) != 2 || !strings.HasSuffix(paths[1], "/Packages.gz") {
+		t.Errorf("Expected the .gz variant to be fetched from the origin, got requests for %v", paths)
+	}
+}
+
+func TestRangesOfDecompressedVariants(t *testing.T) {
+	plain := "Package: hello\nVersion: 1.0\n"
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(plain))
+	gz.Close()
+
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, compressed.String(), nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.CanonicalCompression = CompressionGzip
+	handler := HandleRequest(config, true)
+	requestPath := "/dists/ranged/main/binary-amd64/Packages"
+
+	get := func(rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, requestPath, nil)
+		req.Header.Set("Range", rangeHeader)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		pendingUpdates.Wait()
+		return w
+	}
+
+	tests := []struct {
+		rangeHeader  string
+		body         string
+		contentRange string
+	}{
+		{"bytes=9-13", plain[9:14], "bytes 9-13/28"},
+		{"bytes=15-", plain[15:], "bytes 15-27/28"},
+		{"bytes=-4", plain[24:], "bytes 24-27/28"},
+		{"bytes=20-100", plain[20:], "bytes 20-27/28"},
+	}
+	for _, test := range tests {
+		w := get(test.rangeHeader)
+		if w.Code != http.StatusPartialContent || w.Body.String() != test.body || w.Header().Get("Content-Range") != test.contentRange {
+			t.Errorf("Range %s: got %d %q %q, expected %q %q", test.rangeHeader, w.Code, w.Body.String(), w.Header().Get("Content-Range"), test.body, test.contentRange)
+		}
+	}
+
+	if w := get("bytes=28-"); w.Code != http.StatusRequestedRangeNotSatisfiable || w.Header().Get("Content-Range") != "bytes */28" {
+		t.Errorf("Expected 416 with the total for a range beyond the end, got %d %q", w.Code, w.Header().Get("Content-Range"))
+	}
+	if w := get("bytes=0-1,4-5"); w.Code != http.StatusOK || w.Body.String() != plain || w.Header().Get("Content-Length") != "28" {
+		t.Errorf("Expected multiple ranges to get the full body with its length, got %d %q", w.Code, w.Header().Get("Content-Length"))
+	}
+
+	headers, err := config.HeaderCache.GetHeaders(getCacheKey(config, requestPath+".gz"))
+	if err != nil || headers.Get(decompressedSizeHeader) != "28" {
+		t.Errorf("Expected the decompressed size to be kept with the canonical entry, got %v", headers)
+	}
+	if origin.Calls() != 1 {
+		t.Errorf("Expected 1 upstream request, got %d", origin.Calls())
+	}
+}
+
+func TestDecompressedSizeIsNotKeptWithReplacedHeaders(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("Package: hello\n"))
+	gz.Close()
+
+	config := newTestServerConfig(t, &fakeOrigin{})
+	key := getCacheKey(config, "/dists/sized/main/binary-amd64/Packages.gz")
+	if err := config.Cache.Put(key, bytes.NewReader(compressed.Bytes()), int64(compressed.Len()), time.Now()); err != nil {
+		t.Fatalf("Failed to seed the index: %v", err)
+	}
+	stored := http.Header{"Last-Modified": {"Tue, 03 Jan 2006 15:04:05 GMT"}}
+	if err := config.HeaderCache.PutHeaders(key, stored); err != nil {
+		t.Fatalf("Failed to seed the headers: %v", err)
+	}
+
+	read := http.Header{"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}}
+	if _, err := decompressedSize(config, key, read); err == nil {
+		t.Error("Expected an error for headers replaced while the size was measured")
+	}
+	if headers, _ := config.HeaderCache.GetHeaders(key); headers.Get(decompressedSizeHeader) != "" || headers.Get("Last-Modified") != stored.Get("Last-Modified") {
+		t.Errorf("Expected the new headers to be left alone, got %v", headers)
+	}
+
+	if size, err := decompressedSize(config, key, stored); err != nil || size != 15 {
+		t.Errorf("Expected a size of 15, got %d: %v", size, err)
+	}
+	if headers, _ := config.HeaderCache.GetHeaders(key); headers.Get(decompressedSizeHeader) != "15" {
+		t.Errorf("Expected the size to be kept with unchanged headers, got %v", headers)
+	}
+}
+
+func TestAdaptiveTimeoutFollowsOriginLatency(t *testing.T) {
+	config := NewServerConfig()
+	config.AdaptiveTimeoutFactor = 3
+	config.AdaptiveTimeoutMin = time.Second
+	config.AdaptiveTimeoutMax = 10 * time.Second
+
+	origin := "adaptive.invalid"
+	if _, ok := adaptiveTimeout(config, origin); ok {
+		t.Fatalf("Expected no adaptive timeout without samples")
+	}
+
+	for i := 0; i < minLatencySamples; i++ {
+		latencyFor(origin).record(time.Second)
+	}
+	if timeout, ok := adaptiveTimeout(config, origin); !ok || timeout != 3*time.Second {
+		t.Errorf("Expected a 3s timeout, got %v (%v)", timeout, ok)
+	}
+
+	for i := 0; i < latencySamples; i++ {
+		latencyFor(origin).record(time.Minute)
+	}
+	if timeout, _ := adaptiveTimeout(config, origin); timeout != config.AdaptiveTimeoutMax {
+		t.Errorf("Expected the timeout to be capped at %v, got %v", config.AdaptiveTimeoutMax, timeout)
+	}
+}
+
+func TestBypassUserAgentRevalidatesCachedFile(t *testing.T) {
+	var heads int32
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodHead {
+			atomic.AddInt32(&heads, 1)
+			return cannedResponse(req, http.StatusNotModified, "", nil), nil
+		}
+		headers := http.Header{}
+		headers.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		return cannedResponse(req, http.StatusOK, "deb content", headers), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.BypassUserAgents = compileUserAgentPatterns([]string{"^release-checker/"})
+	handler := HandleRequest(config, false)
+
+	path := "/pool/main/b/bypass/bypass_1.0_amd64.deb"
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	waitForCache(t, config, getCacheKey(config, path))
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	if atomic.LoadInt32(&heads) != 0 {
+		t.Fatalf("Expected regular clients to be served from the cache")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("User-Agent", "release-checker/1.0")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "deb content" {
+		t.Fatalf("Unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+	if atomic.LoadInt32(&heads) != 1 {
+		t.Errorf("Expected the matching client to trigger revalidation, got %d HEAD requests", heads)
+	}
+}
+
+func TestSyntheticETagForValidatorlessOrigin(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "no validators", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := HandleRequest(config, false)
+
+	path := "/pool/main/n/novalidators/novalidators_1.0_amd64.deb"
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	waitForCache(t, config, getCacheKey(config, path))
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("Expected a synthetic ETag on the cached response")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching If-None-Match, got %d", rec.Code)
+	}
+}
+
+func TestPreconditionsOnCacheHit(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		headers := http.Header{}
+		headers.Set("ETag", `"v1"`)
+		headers.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		return cannedResponse(req, http.StatusOK, "precondition", headers), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := HandleRequest(config, false)
+
+	path := "/pool/main/p/precondition/precondition_1.0_amd64.deb"
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	waitForCache(t, config, getCacheKey(config, path))
+
+	cases := []struct {
+		header, value string
+		status        int
+	}{
+		{"If-Match", `"v1"`, http.StatusOK},
+		{"If-Match", `"v2"`, http.StatusPreconditionFailed},
+		{"If-Match", `W/"v1"`, http.StatusPreconditionFailed},
+		{"If-Unmodified-Since", "Mon, 02 Jan 2006 15:04:05 GMT", http.StatusOK},
+		{"If-Unmodified-Since", "Sun, 01 Jan 2006 00:00:00 GMT", http.StatusPreconditionFailed},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(c.header, c.value)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s: %s: expected %d, got %d", c.header, c.value, c.status, rec.Code)
+		}
+	}
+}
+
+func TestLargeResponseStreamsToDiskAndServesRange(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "0123456789", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.StreamToDiskThreshold = 4
+	handler := HandleRequest(config, false)
+
+	path := "/pool/main/l/large/large_1.0_amd64.deb"
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Range", "bytes=2-5")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" {
+		t.Fatalf("Expected a range served from disk on the first request, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	content, size, _, err := config.Cache.Get(getCacheKey(config, path))
+	if err != nil {
+		t.Fatalf("Expected the file to be cached: %v", err)
+	}
+	content.Close()
+	if size != 10 {
+		t.Errorf("Expected 10 cached bytes, got %d", size)
+	}
+}
+
+func TestNegativeCacheRulesPerPathAndStatus(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/gone.deb") {
+			return cannedResponse(req, http.StatusGone, "gone", nil), nil
+		}
+		return cannedResponse(req, http.StatusNotFound, "not found", nil), nil
+	}}
+	rules := []config.NegativeCacheRule{
+		{Path: "dists/**", TTL: 0},
+		{Path: "pool/**", TTL: 3600},
+		{Path: "**", Status: http.StatusGone, TTL: 3600},
+	}
+	config := newTestServerConfig(t, origin)
+	config.NegativeCacheRules = rules
+	handler := HandleRequest(config, true)
+
+	get := func(p string) int {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		return rec.Code
+	}
+
+	for _, p := range []string{"/pool/main/n/negative/missing.deb", "/pool/main/n/negative/gone.deb"} {
+		first := get(p)
+		calls := origin.Calls()
+		if second := get(p); second != first {
+			t.Errorf("Expected remembered status %d for %s, got %d", first, p, second)
+		}
+		if origin.Calls() != calls {
+			t.Errorf("Expected %s to be answered without the origin", p)
+		}
+	}
+
+	get("/dists/negative/main/binary-amd64/Packages")
+	calls := origin.Calls()
+	get("/dists/negative/main/binary-amd64/Packages")
+	if origin.Calls() == calls {
+		t.Errorf("Expected a zero TTL rule to disable negative caching for dists")
+	}
+}
+
+func TestByteAccountingCountsClientAndOriginBytes(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "accounted body", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+
+	var account *byteAccount
+	handler := NewByteAccountingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		account = byteAccountFrom(r.Context())
+		HandleRequest(config, true)(w, r)
+	}))
+
+	get := func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/pool/main/a/accounting/a.deb", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Unexpected response: %d", rec.Code)
+		}
+	}
+
+	get()
+	if got := account.client.Load(); got != int64(len("accounted body")) {
+		t.Errorf("Expected %d client bytes, got %d", len("accounted body"), got)
+	}
+	if got := account.origin.Load(); got != int64(len("accounted body")) {
+		t.Errorf("Expected %d origin bytes on a miss, got %d", len("accounted body"), got)
+	}
+
+	waitForCache(t, config, getCacheKey(config, "/pool/main/a/accounting/a.deb"))
+	get()
+	if got := account.origin.Load(); got != 0 {
+		t.Errorf("Expected no origin bytes on a hit, got %d", got)
+	}
+}
+
+func TestClientFetchEndsWithItsBody(t *testing.T) {
+	before := prefetchControl.liveFetches.Load()
+
+	body := newOriginBody(context.Background(), io.NopCloser(strings.NewReader("live body")), true, nil)
+	prefetchControl.liveFetches.Add(1)
+	if _, err := io.ReadAll(body); err != nil {
+		t.Fatalf("Failed to read the body: %v", err)
+	}
+	if got := prefetchControl.liveFetches.Load(); got != before {
+		t.Errorf("Expected a body read to its end to end the fetch, %d fetches live", got-before)
+	}
+	body.Close()
+	if got := prefetchControl.liveFetches.Load(); got != before {
+		t.Errorf("Expected closing a finished body not to count again, %d fetches live", got-before)
+	}
+
+	prefetchControl.liveFetches.Add(1)
+	newOriginBody(context.Background(), io.NopCloser(strings.NewReader("dropped")), true, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for prefetchControl.liveFetches.Load() != before && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	if got := prefetchControl.liveFetches.Load(); got != before {
+		t.Errorf("Expected a dropped body to end the fetch, %d fetches live", got-before)
+	}
+}
+
+func TestPrefetchYieldsToClientFetches(t *testing.T) {
+	release := make(chan struct{})
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/live/") {
+			<-release
+		}
+		return cannedResponse(req, http.StatusOK, "body", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := HandleRequest(config, true)
+
+	liveDone := make(chan struct{})
+	go func() {
+		defer close(liveDone)
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/pool/main/live/a.deb", nil))
+	}()
+	for prefetchControl.liveFetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	state := startWarmup(config, []string{"pool/main/prefetch/a.deb"}, 2, 1, 0, 1, nil)
+	time.Sleep(3 * prefetchYieldInterval)
+	if calls := origin.Calls(); calls != 1 {
+		t.Errorf("Expected the prefetch to wait for the client fetch, origin saw %d requests", calls)
+	}
+
+	close(release)
+	<-liveDone
+	deadline := time.Now().Add(5 * time.Second)
+	for !state.isWarm() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state.fetched.Load() != 1 {
+		t.Errorf("Expected the prefetch to complete after the client fetch")
+	}
+}
+
+func TestWarmupCountsOnlyCachedPaths(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		var headers http.Header
+		if strings.Contains(req.URL.Path, "/personal/") {
+			// Responses meant for a single client are passed through uncached.
+			headers = http.Header{"Set-Cookie": {"session=1"}}
+		}
+		return cannedResponse(req, http.StatusOK, "index", headers), nil
+	}}
+	config := newTestServerConfig(t, origin)
+
+	state := startWarmup(config, []string{"dists/personal/InRelease", "dists/shared/InRelease"}, 1, 1, 0, 1, nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for !state.isWarm() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !state.isWarm() {
+		t.Fatal("Expected the warm-up to end once every path was tried")
+	}
+	if fetched := state.fetched.Load(); fetched != 1 {
+		t.Errorf("Expected only the cached path to count, got %d", fetched)
+	}
+}
+
+func TestStaleWhileRefreshServesCachedCopy(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		headers := http.Header{}
+		headers.Set("Last-Modified", "Tue, 03 Jan 2006 15:04:05 GMT")
+		return cannedResponse(req, http.StatusOK, "new index", headers), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.StaleWhileRefresh = true
+
+	path := "/dists/stale/main/binary-amd64/Packages"
+	cacheKey := getCacheKey(config, path)
+	old := "old index"
+	if err := config.Cache.Put(cacheKey, strings.NewReader(old), int64(len(old)), time.Now()); err != nil {
+		t.Fatalf("Failed to seed cache: %v", err)
+	}
+	headers := http.Header{}
+	headers.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	if err := config.HeaderCache.PutHeaders(cacheKey, headers); err != nil {
+		t.Fatalf("Failed to seed headers: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	HandleRequest(config, true)(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != old {
+		t.Fatalf("Expected the stale copy, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if content, _, _, err := config.Cache.Get(cacheKey); err == nil {
+			data, _ := io.ReadAll(content)
+			content.Close()
+			if string(data) == "new index" {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected the background refresh to store the new version")
+}
+
+func TestOverloadShedsMissesButServesHits(t *testing.T) {
+	release := make(chan struct{})
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/slow/") {
+			<-release
+		}
+		return cannedResponse(req, http.StatusOK, "overload body", nil), nil
+	}}
+	limits := config.OverloadConfig{MaxOriginFetches: 1}
+	config := newTestServerConfig(t, origin)
+	handler := NewOverloadMiddleware(HandleRequest(config, true), limits)
+	t.Cleanup(func() { overload.Store(nil) })
+
+	get := func(p string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, p, nil))
+		return rec
+	}
+
+	hit := "/pool/main/o/overload/hit.deb"
+	get(hit)
+	waitForCache(t, config, getCacheKey(config, hit))
+
+	slowDone := make(chan struct{})
+	go func() {
+		defer close(slowDone)
+		get("/pool/main/o/overload/slow/a.deb")
+	}()
+	for prefetchControl.liveFetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if rec := get("/pool/main/o/overload/miss.deb"); rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the miss to be shed with Retry-After, got %d", rec.Code)
+	}
+	if rec := get(hit); rec.Code != http.StatusOK || rec.Body.String() != "overload body" {
+		t.Errorf("Expected the hit to be served while overloaded, got %d", rec.Code)
+	}
+
+	close(release)
+	<-slowDone
+}
+
+func TestTranslationIndexesAreTranscodable(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"dists/bookworm/main/i18n/Translation-en", true},
+		{"dists/bookworm/main/i18n/Translation-en.gz", true},
+		{"dists/bookworm/main/i18n/Translation-pt_BR.xz", true},
+		{"dists/bookworm/main/i18n/by-hash/SHA256/0123abcd", false},
+		{"dists/bookworm/main/i18n/Translation-en.diff/Index", false},
+		{"pool/main/i/i18nspector/i18nspector_0.27.2-1_all.deb", false},
+	}
+
+	for _, test := range tests {
+		if got := isTranscodable(test.path); got != test.expected {
+			t.Errorf("isTranscodable(%q) = %v, expected %v", test.path, got, test.expected)
+		}
+	}
+}
+
+func TestInvalidDebIsRejectedAndNotCached(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "<html>upstream error</html>", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.ValidateDebStructure = true
+
+	path := "/pool/main/b/broken/broken_1.0_amd64.deb"
+	rec := httptest.NewRecorder()
+	HandleRequest(config, true)(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("Expected 502 for a broken package, got %d", rec.Code)
+	}
+
+	pendingUpdates.Wait()
+	if content, _, _, err := config.Cache.Get(getCacheKey(config, path)); err == nil {
+		content.Close()
+		t.Errorf("Expected the broken package not to be cached")
+	}
+}
+
+func TestSetCookieResponsesAreNotCached(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		headers := http.Header{}
+		headers.Set("Set-Cookie", "session=secret")
+		return cannedResponse(req, http.StatusOK, "cookie body", headers), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := HandleRequest(config, true)
+
+	path := "/pool/main/c/cookie/cookie_1.0_amd64.deb"
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "cookie body" {
+		t.Fatalf("Unexpected response: %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Set-Cookie") != "" {
+		t.Errorf("Expected Set-Cookie not to be forwarded")
+	}
+	pendingUpdates.Wait()
+	if content, _, _, err := config.Cache.Get(getCacheKey(config, path)); err == nil {
+		content.Close()
+		t.Errorf("Expected the response with Set-Cookie not to be cached")
+	}
+
+	config.CacheSetCookieResponses = true
+	cachedPath := "/pool/main/c/cookie/cookie_2.0_amd64.deb"
+	HandleRequest(config, true)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, cachedPath, nil))
+	waitForCache(t, config, getCacheKey(config, cachedPath))
+	headers, err := config.HeaderCache.GetHeaders(getCacheKey(config, cachedPath))
+	if err != nil {
+		t.Fatalf("Expected cached headers: %v", err)
+	}
+	if headers.Get("Set-Cookie") != "" {
+		t.Errorf("Expected Set-Cookie to be stripped from the header cache")
+	}
+}
+
+func TestCacheBypassHeaderRefetchesForTrustedClients(t *testing.T) {
+	var version int32
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "version "+strconv.Itoa(int(atomic.LoadInt32(&version))), nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.CacheBypassHeader = defaultCacheBypassHeader
+	config.CacheBypassToken = "debug-token"
+	config.CacheBypassNetworks, _ = utils.ParseNetworks([]string{"10.0.0.0/8"})
+	handler := HandleRequest(config, false)
+
+	path := "/pool/main/b/bypassheader/a.deb"
+	get := func(remoteAddr, value string) string {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteAddr
+		if value != "" {
+			req.Header.Set(defaultCacheBypassHeader, value)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		pendingUpdates.Wait()
+		return rec.Body.String()
+	}
+
+	get("192.0.2.1:1234", "")
+	atomic.StoreInt32(&version, 1)
+
+	if body := get("192.0.2.1:1234", "1"); body != "version 0" {
+		t.Errorf("Expected an untrusted client to get the cached copy, got %q", body)
+	}
+	if body := get("10.1.2.3:1234", "1"); body != "version 1" {
+		t.Errorf("Expected a trusted network to refetch, got %q", body)
+	}
+	atomic.StoreInt32(&version, 2)
+	if body := get("192.0.2.1:1234", "debug-token"); body != "version 2" {
+		t.Errorf("Expected the token to refetch, got %q", body)
+	}
+	if body := get("192.0.2.1:1234", ""); body != "version 2" {
+		t.Errorf("Expected the refetched copy to be cached, got %q", body)
+	}
+}
+
+func TestOriginHostOverridesHostHeader(t *testing.T) {
+	var hosts []string
+	var mu sync.Mutex
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		hosts = append(hosts, req.Host+" "+req.URL.Host)
+		mu.Unlock()
+		return cannedResponse(req, http.StatusOK, "virtual host", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.OriginHost = "mirror.example.org"
+
+	HandleRequest(config, true)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/pool/main/v/vhost/a.deb", nil))
+
+	mu.Lock()
+	defer mu.Unlock()
+	upstream, _ := url.Parse(config.UpstreamURL)
+	if len(hosts) != 1 || hosts[0] != "mirror.example.org "+upstream.Host {
+		t.Errorf("Expected Host mirror.example.org sent to %s, got %v", upstream.Host, hosts)
+	}
+}
+
+func TestSuiteOriginsRouteMatchingSuites(t *testing.T) {
+	var fetched []string
+	var mu sync.Mutex
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		fetched = append(fetched, req.Host+" "+req.URL.Host+req.URL.Path)
+		mu.Unlock()
+		return cannedResponse(req, http.StatusOK, "suite", nil), nil
+	}}
+	rules := []config.SuiteOrigin{{Suite: "*-security", URL: "security.example.org/debian-security", Paths: []string{"pool/updates/**"}}}
+	config := newTestServerConfig(t, origin)
+	config.OriginHost = "mirror.example.org"
+	config.SuiteOrigins = buildSuiteOrigins(rules, "http", "")
+
+	for _, path := range []string{"/dists/bookworm-security/InRelease", "/pool/updates/main/s/suite/a.deb", "/dists/bookworm/InRelease"} {
+		HandleRequest(config, true)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	pendingUpdates.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	upstream, _ := url.Parse(config.UpstreamURL)
+	expected := []string{
+		"security.example.org security.example.org/debian-security/dists/bookworm-security/InRelease",
+		"security.example.org security.example.org/debian-security/pool/updates/main/s/suite/a.deb",
+		"mirror.example.org " + upstream.Host + upstream.Path + "dists/bookworm/InRelease",
+	}
+	if strings.Join(fetched, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected fetches %v, got %v", expected, fetched)
+	}
+}
+
+func TestPathFilterAnswersUnmirroredPathsWithNotFound(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "mirrored", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.IncludePaths = []string{"dists/filtered/main/**", "pool/main/**"}
+	config.ExcludePaths = []string{"pool/main/x/**"}
+
+	cases := map[string]int{
+		"/dists/filtered/InRelease":                         http.StatusOK,
+		"/dists/filtered/main/binary-amd64/Packages.gz":     http.StatusOK,
+		"/pool/main/f/filtered/a.deb":                       http.StatusOK,
+		"/dists/filtered/non-free/binary-amd64/Packages.gz": http.StatusNotFound,
+		"/dists/other/InRelease":                            http.StatusNotFound,
+		"/pool/main/x/excluded/a.deb":                       http.StatusNotFound,
+		"/pool/non-free/f/filtered/a.deb":                   http.StatusNotFound,
+	}
+	for path, expected := range cases {
+		calls := origin.Calls()
+		w := httptest.NewRecorder()
+		HandleRequest(config, true)(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, path, w.Code)
+		}
+		if expected == http.StatusNotFound && origin.Calls() != calls {
+			t.Errorf("Expected no origin request for %s", path)
+		}
+	}
+	pendingUpdates.Wait()
+}
+
+func TestImportTreeSeedsCacheForRevalidation(t *testing.T) {
+	var ifModifiedSince []string
+	var mu sync.Mutex
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		ifModifiedSince = append(ifModifiedSince, req.Header.Get("If-Modified-Since"))
+		mu.Unlock()
+		return cannedResponse(req, http.StatusNotModified, "", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+
+	root := t.TempDir()
+	mtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		"dists/imported/InRelease":     "imported release",
+		"pool/main/i/imported/a_1.deb": "imported package",
+	}
+	for name, content := range files {
+		filePath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filePath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := ImportTree(config, root)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if result.Files != 2 || result.Linked != 2 || result.Failed != 0 {
+		t.Errorf("Expected 2 files imported by hardlink, got %+v", result)
+	}
+
+	headers, err := config.HeaderCache.GetHeaders(getCacheKey(config, "/pool/main/i/imported/a_1.deb"))
+	if err != nil || headers.Get("Last-Modified") != mtime.Format(http.TimeFormat) || headers.Get("Content-Type") == "" {
+		t.Errorf("Expected Last-Modified from the mtime and a Content-Type, got %v (%v)", headers, err)
+	}
+
+	w := httptest.NewRecorder()
+	HandleRequest(config, true)(w, httptest.NewRequest(http.MethodGet, "/dists/imported/InRelease", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "imported release" {
+		t.Errorf("Expected the imported InRelease, got %d %q", w.Code, w.Body.String())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ifModifiedSince) != 1 || ifModifiedSince[0] != mtime.Format(http.TimeFormat) {
+		t.Errorf("Expected one revalidation with If-Modified-Since from the mtime, got %v", ifModifiedSince)
+	}
+}
+
+func TestSelfTestReportsEachStage(t *testing.T) {
+	healthy := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "canary", nil), nil
+	}}
+	broken := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusNotFound, "", nil), nil
+	}}
+
+	healthyConfig := newTestServerConfig(t, healthy)
+	healthyConfig.LocalPath = "/selftest-healthy/"
+	brokenConfig := newTestServerConfig(t, broken)
+	brokenConfig.LocalPath = "/selftest-broken/"
+	registerSelfTest(healthyConfig, "/dists/stable/Release", nil)
+	registerSelfTest(brokenConfig, "/dists/stable/Release", nil)
+	defer func() {
+		selfTests.Lock()
+		delete(selfTests.targets, healthyConfig.LocalPath)
+		delete(selfTests.targets, brokenConfig.LocalPath)
+		selfTests.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	HandleSelfTest(w, httptest.NewRequest(http.MethodGet, "/admin/selftest", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when a repository fails, got %d", w.Code)
+	}
+
+	var reports []selfTestReport
+	if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil {
+		t.Fatalf("Failed to parse report: %v", err)
+	}
+	byRepository := make(map[string]selfTestReport)
+	for _, report := range reports {
+		byRepository[report.Repository] = report
+	}
+
+	healthyReport := byRepository[healthyConfig.LocalPath]
+	if !healthyReport.OK || len(healthyReport.Stages) != 3 {
+		t.Errorf("Expected all three stages to pass for the healthy origin, got %+v", healthyReport)
+	}
+	brokenReport := byRepository[brokenConfig.LocalPath]
+	if brokenReport.OK || len(brokenReport.Stages) != 1 || brokenReport.Stages[0].Name != "origin" {
+		t.Errorf("Expected only the failed origin stage for the broken origin, got %+v", brokenReport)
+	}
+
+	key := selfTestKeyPrefix + getCacheKey(healthyConfig, "/dists/stable/Release")
+	if content, _, _, err := healthyConfig.Cache.Get(key); err == nil {
+		content.Close()
+		t.Errorf("Expected the self-test copy to be removed")
+	}
+}
+
+func TestPoolIfModifiedSinceAnsweredFromCacheEntry(t *testing.T) {
+	published := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		headers := http.Header{"Last-Modified": {published.Format(http.TimeFormat)}}
+		return cannedResponse(req, http.StatusOK, "package", headers), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	const requestPath = "/pool/main/i/ims/ims_1.0_amd64.deb"
+
+	HandleRequest(config, false)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, requestPath, nil))
+	waitForCache(t, config, getCacheKey(config, requestPath))
+	pendingUpdates.Wait()
+
+	// Without headers the regular hit path cannot answer, the pool fast path can.
+	headerless := config
+	headerless.HeaderCache = &storage.NoopHeaderCache{}
+
+	req := httptest.NewRequest(http.MethodGet, requestPath, nil)
+	req.Header.Set("If-Modified-Since", published.Format(http.TimeFormat))
+	w := httptest.NewRecorder()
+	HandleRequest(headerless, false)(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for an unchanged pool file, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, requestPath, nil)
+	req.Header.Set("If-Modified-Since", published.Add(-time.Hour).Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	HandleRequest(config, false)(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "package" {
+		t.Errorf("Expected the full body for an older If-Modified-Since, got %d %q", w.Code, w.Body.String())
+	}
+
+	if origin.Calls() != 1 {
+		t.Errorf("Expected a single origin fetch, got %d", origin.Calls())
+	}
+}
+
+func TestRejectedRedirectAnswersBadGateway(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		headers := http.Header{"Location": {"http://elsewhere.invalid/file"}}
+		return cannedResponse(req, http.StatusFound, "", headers), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.Client.CheckRedirect = utils.RedirectPolicy(0, true, nil)
+
+	w := httptest.NewRecorder()
+	HandleRequest(config, true)(w, httptest.NewRequest(http.MethodGet, "/pool/main/r/redirect/a.deb", nil))
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for a redirect to another host, got %d", w.Code)
+	}
+	if origin.Calls() != 1 {
+		t.Errorf("Expected the redirect not to be followed, got %d origin calls", origin.Calls())
+	}
+}
+
+func TestManifestDecidesWhatIsCached(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "content", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+
+	manifestPath := path.Join(t.TempDir(), "manifest")
+	if err := os.WriteFile(manifestPath, []byte("# curated\npool/main/c/curated/**\n\n"), 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	if err := LoadManifest(manifestPath); err != nil {
+		t.Fatalf("Failed to load manifest: %v", err)
+	}
+	t.Cleanup(func() { LoadManifest("") })
+
+	fetch := func(requestPath string) {
+		w := httptest.NewRecorder()
+		HandleRequest(config, true)(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+		if w.Code != http.StatusOK || w.Body.String() != "content" {
+			t.Errorf("Expected %s to be served, got %d %q", requestPath, w.Code, w.Body.String())
+		}
+		pendingUpdates.Wait()
+	}
+	isCached := func(requestPath string) bool {
+		content, _, _, err := config.Cache.Get(getCacheKey(config, requestPath))
+		if err != nil {
+			return false
+		}
+		content.Close()
+		return true
+	}
+
+	fetch("/pool/main/c/curated/a.deb")
+	fetch("/pool/main/o/other/a.deb")
+	if !isCached("/pool/main/c/curated/a.deb") || isCached("/pool/main/o/other/a.deb") {
+		t.Errorf("Expected only the path listed in the manifest to be cached")
+	}
+
+	if err := os.WriteFile(manifestPath, []byte("pool/main/o/other/**\n"), 0644); err != nil {
+		t.Fatalf("Failed to rewrite manifest: %v", err)
+	}
+	w := httptest.NewRecorder()
+	HandleManifest(w, httptest.NewRequest(http.MethodPost, "/admin/manifest/reload", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the reload to succeed, got %d", w.Code)
+	}
+
+	fetch("/pool/main/o/other/b.deb")
+	if !isCached("/pool/main/o/other/b.deb") {
+		t.Errorf("Expected the reloaded manifest to allow caching the new path")
+	}
+}
+
+// stalledBody never delivers a byte; it fails once the request is cancelled.
+type stalledBody struct {
+	ctx context.Context
+}
+
+func (b stalledBody) Read(p []byte) (int, error) {
+	<-b.ctx.Done()
+	return 0, b.ctx.Err()
+}
+
+func (b stalledBody) Close() error {
+	return nil
+}
+
+func TestMinThroughputAbortsStalledTransfers(t *testing.T) {
+	window := throughputWindow
+	throughputWindow = 50 * time.Millisecond
+	t.Cleanup(func() { throughputWindow = window })
+
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		resp := cannedResponse(req, http.StatusOK, "", nil)
+		resp.Body = stalledBody{ctx: req.Context()}
+		if strings.Contains(req.URL.Path, "sized") {
+			resp.ContentLength = 10
+			resp.Header.Set("Content-Length", "10")
+		} else {
+			resp.ContentLength = -1
+			resp.Header.Del("Content-Length")
+		}
+		return resp, nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.MinThroughput = 1000
+
+	for _, requestPath := range []string{"/pool/main/t/throughput/sized.deb", "/pool/main/t/throughput/unsized.deb"} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			HandleRequest(config, true)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, requestPath, nil))
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the stalled transfer of %s to be aborted", requestPath)
+		}
+		pendingUpdates.Wait()
+
+		if content, _, _, err := config.Cache.Get(getCacheKey(config, requestPath)); err == nil {
+			content.Close()
+			t.Errorf("Expected the aborted %s not to be cached", requestPath)
+		}
+	}
+}
+
+func TestMinThroughputIgnoresSlowClients(t *testing.T) {
+	window := throughputWindow
+	throughputWindow = 50 * time.Millisecond
+	t.Cleanup(func() { throughputWindow = window })
+
+	for _, contentLength := range []int64{10, -1} {
+		ctx, cancel := context.WithCancel(context.Background())
+		body := newThroughputBody(io.NopCloser(strings.NewReader("0123456789")), "origin", contentLength, 1000, cancel)
+
+		// The origin answers every read at once, while the client takes
+		// several windows between them.
+		buf := make([]byte, 2)
+		for {
+			if _, err := body.Read(buf); err != nil {
+				break
+			}
+			time.Sleep(2 * throughputWindow)
+		}
+		body.Close()
+
+		if ctx.Err() != nil {
+			t.Errorf("Expected the transfer with length %d not to be aborted for the client's pace", contentLength)
+		}
+		cancel()
+	}
+}
+
+func TestEntryReportsOriginDateAndFetchTime(t *testing.T) {
+	originDate := "Mon, 01 Jan 2024 10:00:00 GMT"
+	lastModified := "Sun, 31 Dec 2023 08:00:00 GMT"
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		headers := http.Header{"Date": {originDate}, "Last-Modified": {lastModified}}
+		return cannedResponse(req, http.StatusOK, "entry", headers), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	const requestPath = "/pool/main/e/entry/a.deb"
+
+	HandleRequest(config, true)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, requestPath, nil))
+	key := getCacheKey(config, requestPath)
+	waitForCache(t, config, key)
+	pendingUpdates.Wait()
+
+	handler := HandleEntry(config.Cache, config.HeaderCache)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/admin/entry?key="+url.QueryEscape(key), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	var info entryInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to parse entry: %v", err)
+	}
+	if info.OriginDate != originDate || info.LastModified != lastModified || info.FetchedAt == "" || info.Size != int64(len("entry")) {
+		t.Errorf("Unexpected entry info: %+v", info)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/admin/entry?key=missing/file", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown key, got %d", w.Code)
+	}
+}
+
+// fullDiskCache fails every write with ENOSPC while full is set.
+type fullDiskCache struct {
+	storage.Cache
+	full atomic.Bool
+	puts atomic.Int32
+}
+
+func (c *fullDiskCache) Put(key string, content io.Reader, contentLength int64, lastModified time.Time) error {
+	c.puts.Add(1)
+	if c.full.Load() {
+		return &os.PathError{Op: "write", Path: key, Err: syscall.ENOSPC}
+	}
+	return c.Cache.Put(key, content, contentLength, lastModified)
+}
+
+func TestDiskFullSwitchesToPassThroughUntilSpaceIsFreed(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "package", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	cache := &fullDiskCache{Cache: config.Cache}
+	cache.full.Store(true)
+	config.Cache = cache
+	config.DiskFullRetryInterval = time.Hour
+	t.Cleanup(func() {
+		diskFull.since.Store(0)
+		diskFull.nextProbe.Store(0)
+	})
+	handler := HandleRequest(config, true)
+
+	get := func(requestPath string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+		pendingUpdates.Wait()
+		if w.Code != http.StatusOK || w.Body.String() != "package" {
+			t.Fatalf("Expected the package for %s, got %d %q", requestPath, w.Code, w.Body.String())
+		}
+	}
+
+	get("/pool/main/f/full/a.deb")
+	if _, ok := CachePassThroughSince(); !ok {
+		t.Fatal("Expected pass-through after ENOSPC")
+	}
+
+	puts := cache.puts.Load()
+	get("/pool/main/f/full/b.deb")
+	if cache.puts.Load() != puts {
+		t.Error("Expected no cache write while the disk is full")
+	}
+
+	cache.full.Store(false)
+	CacheSpaceFreed()
+	get("/pool/main/f/full/c.deb")
+	waitForCache(t, config, getCacheKey(config, "/pool/main/f/full/c.deb"))
+	if _, ok := CachePassThroughSince(); ok {
+		t.Error("Expected caching to resume once a write succeeded")
+	}
+}
+
+func TestLocalOriginServesFilesWithConditionalAndRangeSupport(t *testing.T) {
+	root := t.TempDir()
+	release := filepath.Join(root, "dists", "stable", "Release")
+	if err := os.MkdirAll(filepath.Dir(release), 0755); err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	if err := os.WriteFile(release, []byte("Suite: stable\n"), 0644); err != nil {
+		t.Fatalf("Failed to write Release: %v", err)
+	}
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(release, modified, modified); err != nil {
+		t.Fatalf("Failed to set mtime: %v", err)
+	}
+	handler := NewLocalOriginHandler(root)
+
+	serve := func(requestPath string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, requestPath, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("/dists/stable/Release", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "Suite: stable\n" {
+		t.Fatalf("Expected the Release file, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Last-Modified"); got != modified.Format(http.TimeFormat) {
+		t.Errorf("Expected Last-Modified from the file, got %q", got)
+	}
+	if got := w.Header().Get("Content-Length"); got != "14" {
+		t.Errorf("Expected Content-Length 14, got %q", got)
+	}
+
+	w = serve("/dists/stable/Release", map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for an unchanged file, got %d", w.Code)
+	}
+
+	w = serve("/dists/stable/Release", map[string]string{"Range": "bytes=0-4"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "Suite" {
+		t.Errorf("Expected the requested range, got %d %q", w.Code, w.Body.String())
+	}
+
+	for _, requestPath := range []string{"/dists/stable", "/dists/stable/missing", "/../../etc/passwd"} {
+		if w := serve(requestPath, nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", requestPath, w.Code)
+		}
+	}
+}
+
+func TestRetryBudgetFollowsRecentSuccesses(t *testing.T) {
+	budget := &retryBudget{ratio: 0.5}
+	now := time.Unix(1700000000, 0)
+
+	if budget.withdraw(now) {
+		t.Fatal("Expected no retry without successes")
+	}
+	for i := 0; i < 4; i++ {
+		budget.deposit(now)
+	}
+	if !budget.withdraw(now) || !budget.withdraw(now.Add(time.Second)) {
+		t.Fatal("Expected two retries for four successes")
+	}
+	if budget.withdraw(now.Add(2 * time.Second)) {
+		t.Error("Expected the third retry to be refused")
+	}
+	if budget.withdraw(now.Add(retryBudgetWindow * time.Second)) {
+		t.Error("Expected successes outside the window not to count")
+	}
+	if got := budget.suppressed.Load(); got != 3 {
+		t.Errorf("Expected 3 suppressed retries, got %d", got)
+	}
+
+	floor := &retryBudget{ratio: 0.5, minPerSecond: 1}
+	for i := 0; i < retryBudgetWindow; i++ {
+		if !floor.withdraw(now) {
+			t.Fatalf("Expected retry %d to be allowed by the minimum", i+1)
+		}
+	}
+	if floor.withdraw(now) {
+		t.Error("Expected the minimum to be exhausted")
+	}
+}
+
+func TestBufferBudgetShedsPackagesButAdmitsIndexes(t *testing.T) {
+	large := strings.Repeat("x", 2*bufferBudgetExemptSize)
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, large, nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := HandleRequest(config, true)
+
+	SetBufferBudget(3 * bufferBudgetExemptSize)
+	t.Cleanup(func() { SetBufferBudget(0) })
+
+	// Another download holds most of the budget.
+	release, ok := inflightBuffers.reserve(2*bufferBudgetExemptSize, true)
+	if !ok {
+		t.Fatal("Expected the first reservation to fit")
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/pool/main/b/budget/a.deb", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After for a package over budget, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/dists/budget/main/Contents-amd64", nil))
+	pendingUpdates.Wait()
+	if w.Code != http.StatusOK || w.Body.Len() != len(large) {
+		t.Errorf("Expected the index to be admitted, got %d", w.Code)
+	}
+
+	release()
+	release()
+	if used := inflightBuffers.inUse(); used != 0 {
+		t.Errorf("Expected the budget to be returned exactly once, %d bytes still in use", used)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/pool/main/b/budget/a.deb", nil))
+	pendingUpdates.Wait()
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the package once the budget is free, got %d", w.Code)
+	}
+}
+
+func TestMaxWaitersShedsExcessWaitersOnly(t *testing.T) {
+	release := make(chan struct{})
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		<-release
+		return cannedResponse(req, http.StatusOK, "viral package", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.MaxWaiters = 2
+	handler := HandleRequest(config, true)
+	requestPath := "/pool/main/v/viral/a.deb"
+	cacheKey := getCacheKey(config, requestPath)
+
+	waiters := func() int32 {
+		requestLock.Lock()
+		defer requestLock.Unlock()
+		if req, ok := requestLock.inProgress[cacheKey]; ok {
+			return atomic.LoadInt32(&req.waiters)
+		}
+		return -1
+	}
+
+	codes := make(chan int, 3)
+	get := func() {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+		codes <- w.Code
+	}
+	go get()
+	for waiters() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go get()
+	go get()
+	for waiters() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	shed := singleFlightStats.shed.Load()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After beyond the waiter cap, got %d", w.Code)
+	}
+	if singleFlightStats.shed.Load() != shed+1 {
+		t.Errorf("Expected the shed waiter to be counted")
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("Expected the leader and admitted waiters to be served, got %d", code)
+		}
+	}
+	pendingUpdates.Wait()
+	if origin.Calls() != 1 {
+		t.Errorf("Expected a single origin fetch, got %d", origin.Calls())
+	}
+}
+
+func TestTraceContextIsPropagatedToOrigin(t *testing.T) {
+	var traceparents, tracestates []string
+	var mu sync.Mutex
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		traceparents = append(traceparents, req.Header.Get("traceparent"))
+		tracestates = append(tracestates, req.Header.Get("tracestate"))
+		mu.Unlock()
+		return cannedResponse(req, http.StatusOK, "traced", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := HandleRequest(config, true)
+
+	const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	r := httptest.NewRequest(http.MethodGet, "/pool/main/t/traced/a.deb", nil)
+	r.Header.Set("traceparent", incoming)
+	r.Header.Set("tracestate", "vendor=value")
+	handler(httptest.NewRecorder(), r)
+
+	r = httptest.NewRequest(http.MethodGet, "/pool/main/t/traced/b.deb", nil)
+	r.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	handler(httptest.NewRecorder(), r)
+	pendingUpdates.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(traceparents) != 2 {
+		t.Fatalf("Expected 2 origin requests, got %d", len(traceparents))
+	}
+	tc, ok := parseTraceParent(traceparents[0])
+	if !ok || !strings.HasPrefix(traceparents[0], "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.HasSuffix(traceparents[0], "-00f067aa0ba902b7-01") || tc.flags != 1 {
+		t.Errorf("Expected a new span in the client's trace, got %q", traceparents[0])
+	}
+	if tracestates[0] != "vendor=value" {
+		t.Errorf("Expected tracestate to be passed on, got %q", tracestates[0])
+	}
+	if traceparents[1] != "" {
+		t.Errorf("Expected an invalid traceparent not to be propagated, got %q", traceparents[1])
+	}
+}
+
+func TestTracingExportsSpansOfRequest(t *testing.T) {
+	var exported []map[string]any
+	var mu sync.Mutex
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]any `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Collector received invalid JSON: %v", err)
+		}
+		mu.Lock()
+		for _, resource := range payload.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				exported = append(exported, scope.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer collector.Close()
+	SetTraceExporter(collector.URL, "test", nil)
+	defer SetTraceExporter("", "", nil)
+
+	var originTraceparent string
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		originTraceparent = req.Header.Get("traceparent")
+		return cannedResponse(req, http.StatusOK, "spanned", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := NewByteAccountingMiddleware(NewTracingMiddleware(HandleRequest(config, true)))
+
+	r := httptest.NewRequest(http.MethodGet, "/pool/main/s/spanned/a.deb", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	pendingUpdates.Wait()
+	if err := FlushTraces(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	byName := make(map[string]map[string]any)
+	for _, s := range exported {
+		if s["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Expected span %v in the client's trace, got trace %v", s["name"], s["traceId"])
+		}
+		byName[s["name"].(string)] = s
+	}
+	for _, name := range []string{"GET", "cache lookup", "origin fetch", "cache write"} {
+		if byName[name] == nil {
+			t.Fatalf("Expected a %q span, got %v", name, exported)
+		}
+	}
+	root := byName["GET"]
+	if root["parentSpanId"] != "00f067aa0ba902b7" {
+		t.Errorf("Expected the root span to continue the incoming trace, got parent %v", root["parentSpanId"])
+	}
+	fetch := byName["origin fetch"]
+	if fetch["parentSpanId"] != root["spanId"] {
+		t.Errorf("Expected the origin fetch to be a child of the root span")
+	}
+	if !strings.Contains(originTraceparent, "-"+fetch["spanId"].(string)+"-") {
+		t.Errorf("Expected the origin request to carry the fetch span, got %q", originTraceparent)
+	}
+}
+
+func TestContentDispositionForBinaryPackages(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "package", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := HandleRequest(config, true)
+
+	get := func(requestPath string) string {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+		pendingUpdates.Wait()
+		return w.Header().Get("Content-Disposition")
+	}
+
+	if disposition := get("/pool/main/d/disposition/off_1.0_amd64.deb"); disposition != "" {
+		t.Errorf("Expected no Content-Disposition by default, got %q", disposition)
+	}
+
+	config.ContentDisposition = true
+	handler = HandleRequest(config, true)
+	for _, name := range []string{"pkg_1.0_amd64.deb", "pkg-udeb_1.0_amd64.udeb", "pkg-dbgsym_1.0_amd64.ddeb"} {
+		expected := `attachment; filename=` + name
+		if disposition := get("/pool/main/d/disposition/" + name); disposition != expected {
+			t.Errorf("Expected %q for %s, got %q", expected, name, disposition)
+		}
+	}
+	if disposition := get("/dists/disposition/main/binary-amd64/Packages"); disposition != "" {
+		t.Errorf("Expected no Content-Disposition for indexes, got %q", disposition)
+	}
+}
+
+func TestOriginSetOrdersHealthyOriginsByLatency(t *testing.T) {
+	delays := map[string]time.Duration{"primary.invalid": 30 * time.Millisecond, "fast.invalid": 0, "down.invalid": 0}
+	var mu sync.Mutex
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		delay := delays[req.URL.Host]
+		mu.Unlock()
+		time.Sleep(delay)
+		if req.URL.Host == "down.invalid" {
+			return cannedResponse(req, http.StatusBadGateway, "", nil), nil
+		}
+		return cannedResponse(req, http.StatusOK, "", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	urls := []string{"http://primary.invalid/debian/", "http://down.invalid/debian/", "http://fast.invalid/debian/"}
+
+	static := newOriginSet(urls, OriginOrderStatic)
+	static.probe(config)
+	if base := static.base(""); base != urls[0] {
+		t.Errorf("Expected static order to keep the healthy primary, got %s", base)
+	}
+
+	latency := newOriginSet(urls, OriginOrderLatency)
+	latency.probe(config)
+	if base := latency.base(""); base != urls[2] {
+		t.Errorf("Expected latency order to pick the fastest healthy mirror, got %s", base)
+	}
+
+	mu.Lock()
+	delays["primary.invalid"] = 0
+	delays["fast.invalid"] = 200 * time.Millisecond
+	mu.Unlock()
+	for i := 0; i < 3; i++ {
+		latency.probe(config)
+	}
+	if base := latency.base(""); base != urls[0] {
+		t.Errorf("Expected re-measuring to switch back to the primary, got %s", base)
+	}
+
+	config.Origins = latency
+	w := httptest.NewRecorder()
+	HandleRequest(config, true)(w, httptest.NewRequest(http.MethodGet, "/pool/main/o/origins/a.deb", nil))
+	pendingUpdates.Wait()
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the file from the selected origin, got %d", w.Code)
+	}
+}
+
+func TestFailedFetchMovesOnToTheNextOrigin(t *testing.T) {
+	var mu sync.Mutex
+	var hosts []string
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		hosts = append(hosts, req.URL.Host)
+		mu.Unlock()
+		switch req.URL.Host {
+		case "broken.invalid":
+			return nil, errors.New("connection refused")
+		case "failing.invalid":
+			return cannedResponse(req, http.StatusServiceUnavailable, "", nil), nil
+		}
+		return cannedResponse(req, http.StatusOK, "from "+req.URL.Host, nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	urls := []string{"http://broken.invalid/debian/", "http://failing.invalid/debian/", "http://mirror.invalid/debian/"}
+	config.UpstreamURL = urls[0]
+	config.Origins = newOriginSet(urls, OriginOrderStatic)
+
+	w := httptest.NewRecorder()
+	HandleRequest(config, true)(w, httptest.NewRequest(http.MethodGet, "/pool/main/f/failover/a.deb", nil))
+	pendingUpdates.Wait()
+	if w.Code != http.StatusOK || w.Body.String() != "from mirror.invalid" {
+		t.Errorf("Expected the file from the working mirror, got %d %q", w.Code, w.Body.String())
+	}
+	if strings.Join(hosts, " ") != "broken.invalid failing.invalid mirror.invalid" {
+		t.Errorf("Expected the origins to be tried in order, got %v", hosts)
+	}
+
+	if next := config.Origins.failover(urls[1] + "pool/a.deb"); strings.Join(next, " ") != urls[2]+"pool/a.deb "+urls[0]+"pool/a.deb" {
+		t.Errorf("Expected the origins after the failed one, then those before it, got %v", next)
+	}
+	if next := config.Origins.failover("http://elsewhere.invalid/pool/a.deb"); next != nil {
+		t.Errorf("Expected no failover for a URL of no origin, got %v", next)
+	}
+}
+
+func TestTenantsHaveSeparateCachesButShareOriginFetches(t *testing.T) {
+	tenants := config.TenantConfig{Header: "X-Tenant", PathPrefix: true, Names: []string{"team-a", "team-b"}}
+	release := make(chan struct{})
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		<-release
+		return cannedResponse(req, http.StatusOK, "shared package", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := NewTenantMiddleware(HandleRequest(config, true), tenants)
+	requestPath := "/pool/main/t/tenant/a.deb"
+	cacheKey := getCacheKey(config, requestPath)
+
+	waiters := func() int32 {
+		requestLock.Lock()
+		defer requestLock.Unlock()
+		if req, ok := requestLock.inProgress[cacheKey]; ok {
+			return atomic.LoadInt32(&req.waiters)
+		}
+		return -1
+	}
+
+	codes := make(chan int, 2)
+	get := func(tenant string) {
+		req := httptest.NewRequest(http.MethodGet, requestPath, nil)
+		req.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		codes <- w.Code
+	}
+	go get("team-a")
+	for waiters() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go get("team-b")
+	for waiters() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("Expected both tenants to be served, got %d", code)
+		}
+	}
+	pendingUpdates.Wait()
+	if origin.Calls() != 1 {
+		t.Errorf("Expected a single origin fetch for both tenants, got %d", origin.Calls())
+	}
+
+	for _, key := range []string{"@team-a/" + cacheKey, "@team-b/" + cacheKey} {
+		content, _, _, err := config.Cache.Get(key)
+		if err != nil {
+			t.Fatalf("Expected %s to be cached: %v", key, err)
+		}
+		content.Close()
+	}
+	if _, _, _, err := config.Cache.Get(cacheKey); err == nil {
+		t.Errorf("Expected nothing in the shared namespace")
+	}
+
+	// Purging one tenant's entry leaves the other's in place.
+	if err := config.Cache.Delete("@team-a/" + cacheKey); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/team-b"+requestPath, nil))
+	if w.Code != http.StatusOK || w.Body.String() != "shared package" {
+		t.Errorf("Expected team-b to be served from its cache through the path prefix, got %d", w.Code)
+	}
+	if origin.Calls() != 1 {
+		t.Errorf("Expected no further origin fetch, got %d", origin.Calls())
+	}
+
+	// A first segment that is no known tenant is part of a shared request.
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+	pendingUpdates.Wait()
+	if w.Code != http.StatusOK || origin.Calls() != 2 {
+		t.Errorf("Expected a shared request to be fetched for the shared namespace, got %d after %d fetches", w.Code, origin.Calls())
+	}
+	if content, _, _, err := config.Cache.Get(cacheKey); err != nil {
+		t.Errorf("Expected the shared request to be cached unsalted: %v", err)
+	} else {
+		content.Close()
+	}
+
+	req := httptest.NewRequest(http.MethodGet, requestPath, nil)
+	for _, tenant := range []string{"../etc", "team-c"} {
+		req.Header.Set("X-Tenant", tenant)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for the unknown tenant %q, got %d", tenant, w.Code)
+		}
+	}
+	if origin.Calls() != 2 {
+		t.Errorf("Expected no fetch for unknown tenants, got %d fetches", origin.Calls())
+	}
+}
+
+func TestWarmupChecksTheTenantsCache(t *testing.T) {
+	tenants := config.TenantConfig{Header: "X-Tenant", Names: []string{"team-a", "team-b"}}
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "index", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	state := &warmupState{required: 1, retryAfter: 5}
+	const requestPath = "/dists/stable/Release"
+	cacheKey := getCacheKey(config, requestPath)
+	if err := config.Cache.Put("@team-a/"+cacheKey, strings.NewReader("index"), 5, time.Now()); err != nil {
+		t.Fatalf("Failed to seed the tenant's cache: %v", err)
+	}
+
+	var tenant *http.Request
+	handler := NewTenantMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = r
+	}), tenants)
+	req := httptest.NewRequest(http.MethodGet, requestPath, nil)
+	req.Header.Set("X-Tenant", "team-a")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if w := httptest.NewRecorder(); rejectWhileWarming(w, tenant, config, state) {
+		t.Errorf("Expected metadata in the tenant's cache to be served while warming up, got %d", w.Code)
+	}
+
+	req.Header.Set("X-Tenant", "team-b")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if w := httptest.NewRecorder(); !rejectWhileWarming(w, tenant, config, state) || w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected metadata missing from the tenant's cache to be rejected while warming up, got %d", w.Code)
+	}
+}
+
+func TestCaptivePortalPagesAreRejectedAndNotCached(t *testing.T) {
+	portal := "<!DOCTYPE html><html><body>Please log in</body></html>"
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		headers := make(http.Header)
+		if strings.HasSuffix(req.URL.Path, "Packages") || strings.HasSuffix(req.URL.Path, "/") {
+			headers.Set("Content-Type", "text/html; charset=utf-8")
+		} else {
+			headers.Set("Content-Type", "application/octet-stream")
+		}
+		return cannedResponse(req, http.StatusOK, "\n  "+portal, headers), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.RejectCaptivePortals = true
+	handler := HandleRequest(config, true)
+
+	for _, requestPath := range []string{"/dists/portal/main/binary-amd64/Packages", "/pool/main/p/portal/a.deb"} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+		if w.Code != http.StatusBadGateway {
+			t.Errorf("Expected 502 for a portal page served as %s, got %d", requestPath, w.Code)
+		}
+		pendingUpdates.Wait()
+		if _, _, _, err := config.Cache.Get(getCacheKey(config, requestPath)); err == nil {
+			t.Errorf("Expected the portal page for %s not to be cached", requestPath)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/dists/portal/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected directory listings to pass, got %d", w.Code)
+	}
+
+	config.RejectCaptivePortals = false
+	handler = HandleRequest(config, true)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/pool/main/p/portal/b.deb", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected HTML to pass with the check disabled, got %d", w.Code)
+	}
+	pendingUpdates.Wait()
+}
+
+func TestFutureOriginLastModifiedIsClampedToLocalClock(t *testing.T) {
+	future := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	nearFuture := time.Now().Add(30 * time.Second).UTC().Truncate(time.Second)
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		headers := make(http.Header)
+		if strings.HasSuffix(req.URL.Path, "near.deb") {
+			headers.Set("Last-Modified", nearFuture.Format(http.TimeFormat))
+		} else {
+			headers.Set("Last-Modified", future.Format(http.TimeFormat))
+		}
+		return cannedResponse(req, http.StatusOK, "skewed package", headers), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.ClockSkewTolerance = time.Minute
+	handler := HandleRequest(config, true)
+
+	requestPath := "/pool/main/s/skew/far.deb"
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+	pendingUpdates.Wait()
+	if w.Header().Get("Last-Modified") != future.Format(http.TimeFormat) {
+		t.Errorf("Expected the origin Last-Modified to be passed on, got %q", w.Header().Get("Last-Modified"))
+	}
+
+	content, _, lastModified, err := config.Cache.Get(getCacheKey(config, requestPath))
+	if err != nil {
+		t.Fatalf("Expected the package to be cached: %v", err)
+	}
+	content.Close()
+	if lastModified.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Expected the stored modification time to be clamped, got %v", lastModified)
+	}
+
+	// The client revalidates with the origin's timestamp and still gets 304.
+	req := httptest.NewRequest(http.MethodGet, requestPath, nil)
+	req.Header.Set("If-Modified-Since", future.Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for the origin's own Last-Modified, got %d", w.Code)
+	}
+
+	nearPath := "/pool/main/s/skew/near.deb"
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, nearPath, nil))
+	pendingUpdates.Wait()
+	content, _, lastModified, err = config.Cache.Get(getCacheKey(config, nearPath))
+	if err != nil {
+		t.Fatalf("Expected the package to be cached: %v", err)
+	}
+	content.Close()
+	if !lastModified.Equal(nearFuture) {
+		t.Errorf("Expected a timestamp within the tolerance to be kept, got %v want %v", lastModified, nearFuture)
+	}
+}
+
+func TestIndexesAreVerifiedAgainstTheReleaseChecksum(t *testing.T) {
+	index := "Package: verified\n"
+	sum := sha256.Sum256([]byte(index))
+	release := "Suite: verified\nMD5Sum:\n 00000000000000000000000000000000 18 main/binary-amd64/Packages\n" +
+		" 00000000000000000000000000000000 18 main/binary-amd64/Packages.gz\n" +
+		"SHA256:\n " + hex.EncodeToString(sum[:]) + " 18 main/binary-amd64/Packages\n"
+	bodies := map[string]string{
+		"/debian/dists/verified/InRelease":                     release,
+		"/debian/dists/verified/main/binary-amd64/Packages":    "Package: tampered\n",
+		"/debian/dists/verified/main/binary-amd64/Packages.gz": "weakly listed",
+	}
+	var mu sync.Mutex
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return cannedResponse(req, http.StatusOK, bodies[req.URL.Path], nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.VerifyIndexChecksums = true
+	handler := HandleRequest(config, true)
+
+	get := func(requestPath string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+		pendingUpdates.Wait()
+		return w
+	}
+
+	get("/dists/verified/InRelease")
+	indexPath := "/dists/verified/main/binary-amd64/Packages"
+	if w := get(indexPath); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for an index not matching its checksum, got %d", w.Code)
+	}
+	if _, _, _, err := config.Cache.Get(getCacheKey(config, indexPath)); err == nil {
+		t.Error("Expected the mismatching index not to be cached")
+	}
+
+	mu.Lock()
+	bodies["/debian/dists/verified/main/binary-amd64/Packages"] = index
+	mu.Unlock()
+	if w := get(indexPath); w.Code != http.StatusOK || w.Body.String() != index {
+		t.Errorf("Expected the matching index to be served, got %d", w.Code)
+	}
+	if content, _, _, err := config.Cache.Get(getCacheKey(config, indexPath)); err != nil {
+		t.Error("Expected the matching index to be cached")
+	} else {
+		content.Close()
+	}
+
+	// Packages.gz is listed with MD5 only.
+	weakPath := "/dists/verified/main/binary-amd64/Packages.gz"
+	config.MinimumChecksum = "SHA256"
+	handler = HandleRequest(config, true)
+	if w := get(weakPath); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for an index listed only with MD5, got %d", w.Code)
+	}
+}
+
+func TestSuiteBatchRefreshRefetchesOnlyChangedIndexes(t *testing.T) {
+	releaseFor := func(indexes map[string]string) string {
+		release := "Suite: batch\nSHA256:\n"
+		for _, name := range []string{"main/binary-amd64/Packages", "main/source/Sources"} {
+			sum := sha256.Sum256([]byte(indexes[name]))
+			release += " " + hex.EncodeToString(sum[:]) + " " + strconv.Itoa(len(indexes[name])) + " " + name + "\n"
+		}
+		return release
+	}
+	indexes := map[string]string{
+		"main/binary-amd64/Packages": "Package: one\n",
+		"main/source/Sources":        "Package: src\n",
+	}
+	var mu sync.Mutex
+	fetches := make(map[string]int)
+	release := releaseFor(indexes)
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches[req.URL.Path]++
+		if strings.HasSuffix(req.URL.Path, "/InRelease") {
+			return cannedResponse(req, http.StatusOK, release, nil), nil
+		}
+		relPath := strings.TrimPrefix(req.URL.Path, "/debian/dists/batch/")
+		return cannedResponse(req, http.StatusOK, indexes[relPath], nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.SuiteBatchRefresh = true
+	handler := HandleRequest(config, true)
+
+	get := func(requestPath string) {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, requestPath, nil))
+		// The batch adds cache writes of its own, so it has to finish first.
+		suiteBatches.wg.Wait()
+		pendingUpdates.Wait()
+	}
+	get("/dists/batch/InRelease")
+	get("/dists/batch/main/binary-amd64/Packages")
+	get("/dists/batch/main/source/Sources")
+
+	// A new publish changes Packages but keeps its size.
+	mu.Lock()
+	indexes["main/binary-amd64/Packages"] = "Package: two\n"
+	release = releaseFor(indexes)
+	mu.Unlock()
+	releaseKey := getCacheKey(config, "/dists/batch/InRelease")
+	if err := config.Cache.Delete(releaseKey); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	get("/dists/batch/InRelease")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := fetches["/debian/dists/batch/main/binary-amd64/Packages"]; n != 2 {
+		t.Errorf("Expected the changed Packages to be fetched again by the batch, got %d fetches", n)
+	}
+	if n := fetches["/debian/dists/batch/main/source/Sources"]; n != 1 {
+		t.Errorf("Expected the unchanged Sources not to be fetched again, got %d fetches", n)
+	}
+	content, _, _, err := config.Cache.Get(getCacheKey(config, "/dists/batch/main/binary-amd64/Packages"))
+	if err != nil {
+		t.Fatalf("Expected Packages to be cached: %v", err)
+	}
+	body, _ := io.ReadAll(content)
+	content.Close()
+	if string(body) != "Package: two\n" {
+		t.Errorf("Expected the refreshed Packages in the cache, got %q", body)
+	}
+	if fresh, _ := config.ValidationCache.Get("validation:" + getCacheKey(config, "/dists/batch/main/source/Sources")); !fresh {
+		t.Error("Expected the unchanged Sources to be marked as validated")
+	}
+}
+
+func TestBackgroundPoolBoundsWorkAndDropsOverflow(t *testing.T) {
+	SetBackgroundPool(1, 1)
+	defer SetBackgroundPool(0, 0)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var ran atomic.Int32
+	if !runInBackground("blocker", func() { close(started); <-release; ran.Add(1) }) {
+		t.Fatal("Expected the first task to be accepted")
+	}
+	<-started
+	if !runInBackground("queued", func() { ran.Add(1) }) {
+		t.Fatal("Expected the second task to be queued")
+	}
+	if runInBackground("overflow", func() { ran.Add(1) }) {
+		t.Error("Expected the third task to be dropped with the queue full")
+	}
+
+	queued, busy, dropped := backgroundStats()
+	if queued != 1 || busy != 1 || dropped != 1 {
+		t.Errorf("Expected 1 queued, 1 busy and 1 dropped, got %d, %d and %d", queued, busy, dropped)
+	}
+	w := httptest.NewRecorder()
+	HandleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "background_queue_depth 1") {
+		t.Errorf("Expected the queue depth in the metrics, got:\n%s", w.Body.String())
+	}
+
+	close(release)
+	for ran.Load() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPurgeByAge(t *testing.T) {
+	config := newTestServerConfig(t, &fakeOrigin{})
+	// As set up by main, headers are removed with their entries.
+	cache, err := storage.NewLRUCacheWithOptions(storage.LRUCacheOptions{
+		BasePath:     t.TempDir(),
+		MaxSizeBytes: 1024 * 1024,
+		OnRemove:     func(key string) { config.HeaderCache.DeleteHeaders(key) },
+	})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	config.Cache = cache
+	for _, key := range []string{"debian/pool/read.deb", "debian/pool/unread.deb"} {
+		if err := config.Cache.Put(key, strings.NewReader("package"), int64(len("package")), time.Now()); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := config.HeaderCache.PutHeaders(key, http.Header{"Content-Type": {"application/octet-stream"}}); err != nil {
+			t.Fatalf("PutHeaders failed: %v", err)
+		}
+	}
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	cache.RecordAccess("debian/pool/read.deb")
+	// Reads the proxy makes for itself are not client requests.
+	content, _, _, err := config.Cache.Get("debian/pool/unread.deb")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	content.Close()
+
+	handler := HandlePurge(config.Cache, config.HeaderCache)
+	purge := func(body string) (int, purgeResult) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/admin/purge", strings.NewReader(body)))
+		var result purgeResult
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatalf("Failed to parse purge result: %v", err)
+			}
+		}
+		return w.Code, result
+	}
+
+	if code, _ := purge(`{}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without criteria, got %d", code)
+	}
+	if code, _ := purge(`{"olderThan": "a month"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid duration, got %d", code)
+	}
+
+	accessed := fmt.Sprintf(`{"accessedBefore": %q`, cutoff.Format(time.RFC3339Nano))
+	if code, result := purge(accessed + `, "dryRun": true}`); code != http.StatusOK || result.Purged != 1 {
+		t.Fatalf("Expected a dry run to count 1 entry, got %d %+v", code, result)
+	}
+	if _, ok := config.Cache.(storage.EntryTimesLister).EntryTimes()["debian/pool/unread.deb"]; !ok {
+		t.Fatal("A dry run removed an entry")
+	}
+
+	if code, result := purge(accessed + `}`); code != http.StatusOK || result.Purged != 1 {
+		t.Fatalf("Expected 1 entry purged by access time, got %d %+v", code, result)
+	}
+	if _, _, _, err := config.Cache.Get("debian/pool/unread.deb"); err == nil {
+		t.Error("Entry not read since the cutoff is still cached")
+	}
+	if _, err := config.HeaderCache.GetHeaders("debian/pool/unread.deb"); !errors.Is(err, storage.ErrHeadersNotFound) {
+		t.Errorf("Headers of the purged entry are still cached: %v", err)
+	}
+
+	if code, result := purge(`{"olderThan": "1h"}`); code != http.StatusOK || result.Purged != 0 {
+		t.Errorf("Expected no entry fetched over an hour ago, got %d %+v", code, result)
+	}
+	if code, result := purge(`{"olderThan": "0s"}`); code != http.StatusOK || result.Purged != 1 {
+		t.Errorf("Expected the remaining entry purged by age, got %d %+v", code, result)
+	}
+}
+
+func TestStickyRedirectsPinSuiteToResolvedMirror(t *testing.T) {
+	var mu sync.Mutex
+	hosts := make(map[string]string)
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		hosts[path.Base(req.URL.Path)] = req.URL.Host
+		mu.Unlock()
+		if req.URL.Host == "origin.invalid" && strings.HasSuffix(req.URL.Path, "/InRelease") {
+			headers := http.Header{"Location": {"http://mirror1.invalid" + req.URL.Path}}
+			return cannedResponse(req, http.StatusFound, "", headers), nil
+		}
+		return cannedResponse(req, http.StatusOK, "content", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.StickyRedirectWindow = time.Minute
+	t.Cleanup(func() {
+		stickyRedirects.Lock()
+		stickyRedirects.suites = make(map[string]stickyRedirect)
+		stickyRedirects.Unlock()
+	})
+
+	for _, requestPath := range []string{
+		"/dists/sticky/InRelease",
+		"/dists/sticky/main/binary-amd64/Packages",
+		"/pool/main/s/sticky/a.deb",
+	} {
+		w := httptest.NewRecorder()
+		HandleRequest(config, true)(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, got %d", requestPath, w.Code)
+		}
+	}
+	pendingUpdates.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if hosts["InRelease"] != "mirror1.invalid" {
+		t.Errorf("InRelease was last fetched from %s, not the mirror it was redirected to", hosts["InRelease"])
+	}
+	if hosts["Packages"] != "mirror1.invalid" {
+		t.Errorf("Packages was fetched from %s, not the mirror the suite is pinned to", hosts["Packages"])
+	}
+	if hosts["a.deb"] != "origin.invalid" {
+		t.Errorf("Pool file was fetched from %s, pinning applies only to suite files", hosts["a.deb"])
+	}
+}
+
+func TestEarlyHintsPreloadIndexesOfCachedRelease(t *testing.T) {
+	release := "Suite: stable\nSHA256:\n" +
+		" 0000000000000000000000000000000000000000000000000000000000000001 10 main/binary-amd64/Packages.xz\n" +
+		" 0000000000000000000000000000000000000000000000000000000000000002 20 main/binary-amd64/Packages.gz\n" +
+		" 0000000000000000000000000000000000000000000000000000000000000003 30 main/i18n/Translation-en.xz\n"
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, release, nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.EarlyHints = true
+	server := httptest.NewServer(HandleRequest(config, true))
+	defer server.Close()
+
+	get := func(server *httptest.Server) (hints []string, resp *http.Response) {
+		t.Helper()
+		trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = append(hints, header.Values("Link")...)
+			}
+			return nil
+		}}
+		req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, server.URL+"/dists/stable/InRelease", nil)
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		pendingUpdates.Wait()
+		if resp.StatusCode != http.StatusOK || string(body) != release {
+			t.Fatalf("Expected the Release, got %d %q", resp.StatusCode, body)
+		}
+		return hints, resp
+	}
+
+	if hints, _ := get(server); len(hints) != 0 {
+		t.Errorf("Expected no early hints for a Release that is not cached yet, got %q", hints)
+	}
+	hints, resp := get(server)
+	expected := []string{
+		"</dists/stable/main/binary-amd64/Packages.xz>; rel=preload; as=fetch",
+		"</dists/stable/main/i18n/Translation-en.xz>; rel=preload; as=fetch",
+	}
+	if strings.Join(hints, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected preload links for the indexes apt fetches next, got %q", hints)
+	}
+	if links := resp.Header.Values("Link"); len(links) != 0 {
+		t.Errorf("Expected the preload links only on the 103, got %q on the final response", links)
+	}
+
+	config.EarlyHintPaths = []string{"*/binary-*/Packages.gz"}
+	configured := httptest.NewServer(HandleRequest(config, true))
+	defer configured.Close()
+	if hints, _ := get(configured); len(hints) != 1 || hints[0] != "</dists/stable/main/binary-amd64/Packages.gz>; rel=preload; as=fetch" {
+		t.Errorf("Expected the configured paths to be preloaded, got %q", hints)
+	}
+}
+
+func TestAdminAuthAcceptsTokenOrBasicAuth(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("admin"))
+	})
+	both := NewAdminAuthMiddleware(next, config.AdminConfig{Token: "secret", Username: "ops", Password: "hunter2"})
+	tokenOnly := NewAdminAuthMiddleware(next, config.AdminConfig{Token: "secret"})
+	open := NewAdminAuthMiddleware(next, config.AdminConfig{})
+
+	tests := []struct {
+		name          string
+		handler       http.Handler
+		authorize     func(*http.Request)
+		status        int
+		authenticated string // Expected WWW-Authenticate scheme, if any
+	}{
+		{"open without credentials", open, func(*http.Request) {}, http.StatusOK, ""},
+		{"token", both, func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, http.StatusOK, ""},
+		{"basic auth", both, func(r *http.Request) { r.SetBasicAuth("ops", "hunter2") }, http.StatusOK, ""},
+		{"no credentials with basic auth", both, func(*http.Request) {}, http.StatusUnauthorized, "Basic"},
+		{"no credentials with a token", tokenOnly, func(*http.Request) {}, http.StatusUnauthorized, "Bearer"},
+		{"wrong token", both, func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, http.StatusForbidden, ""},
+		{"wrong password", both, func(r *http.Request) { r.SetBasicAuth("ops", "guess") }, http.StatusForbidden, ""},
+		{"wrong username", both, func(r *http.Request) { r.SetBasicAuth("root", "hunter2") }, http.StatusForbidden, ""},
+		{"basic auth without configured credentials", tokenOnly, func(r *http.Request) { r.SetBasicAuth("ops", "secret") }, http.StatusForbidden, ""},
+		{"unknown scheme", both, func(r *http.Request) { r.Header.Set("Authorization", "Digest secret") }, http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/admin/inflight", nil)
+		test.authorize(req)
+		w := httptest.NewRecorder()
+		test.handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+		}
+		if (w.Code == http.StatusOK) != (w.Body.String() == "admin") {
+			t.Errorf("%s: expected the admin route to be reached only when authorized, got %q", test.name, w.Body.String())
+		}
+		if challenge := w.Header().Get("WWW-Authenticate"); !strings.HasPrefix(challenge, test.authenticated) || (test.authenticated == "") != (challenge == "") {
+			t.Errorf("%s: expected a %q challenge, got %q", test.name, test.authenticated, challenge)
+		}
+	}
+}
+
+func TestRobotsAndFaviconAreAnsweredLocally(t *testing.T) {
+	serve := func(handler http.HandlerFunc, method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	if w := serve(HandleRobots(""), http.MethodGet, "/robots.txt"); w.Code != http.StatusOK || w.Body.String() != DefaultRobotsTxt || w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("Expected the default robots.txt, got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	custom := "User-agent: *\nAllow: /debian/\n"
+	if w := serve(HandleRobots(custom), http.MethodGet, "/robots.txt"); w.Body.String() != custom || w.Header().Get("Cache-Control") != "public, max-age=86400" {
+		t.Errorf("Expected the configured robots.txt, got %q %v", w.Body.String(), w.Header())
+	}
+	if w := serve(HandleRobots(custom), http.MethodHead, "/robots.txt"); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("Expected HEAD to get no body, got %d %q", w.Code, w.Body.String())
+	}
+	if w := serve(HandleRobots(""), http.MethodPost, "/robots.txt"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", w.Code)
+	}
+
+	for status, expected := range map[int]int{0: http.StatusNoContent, http.StatusNotFound: http.StatusNotFound, http.StatusOK: http.StatusNoContent} {
+		w := serve(HandleFavicon(status), http.MethodGet, "/favicon.ico")
+		if w.Code != expected || w.Body.Len() != 0 || w.Header().Get("Cache-Control") != "public, max-age=86400" {
+			t.Errorf("Favicon status %d: expected an empty %d, got %d %q", status, expected, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestClosedRepositoryHandlerDropsItsSelfTest(t *testing.T) {
+	base := newTestServerConfig(t, &fakeOrigin{})
+	globalConfig := config.DefaultConfig()
+	repo := config.Repository{URL: base.UpstreamURL, Path: "/reloaded/", Enabled: true, SelfTestPath: "dists/stable/InRelease"}
+	handler := NewRepositoryHandler(base.UpstreamURL, base.Cache, base.HeaderCache, base.ValidationCache, base.Client, "/reloaded/", repo, &globalConfig).(*RepositoryHandler)
+
+	registered := func() bool {
+		selfTests.Lock()
+		defer selfTests.Unlock()
+		_, ok := selfTests.targets["/reloaded/"]
+		return ok
+	}
+	if !registered() {
+		t.Fatal("Self-test of the repository was not registered")
+	}
+	replacement := NewRepositoryHandler(base.UpstreamURL, base.Cache, base.HeaderCache, base.ValidationCache, base.Client, "/reloaded/", repo, &globalConfig).(*RepositoryHandler)
+	handler.Close()
+	handler.Close()
+	if !registered() {
+		t.Error("Closing a replaced repository dropped the self-test of its replacement")
+	}
+	replacement.Close()
+	if registered() {
+		t.Error("Self-test of a closed repository is still registered")
+	}
+}
+
+func TestClosedRepositoryHandlerStopsItsWarmup(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var fetched []string
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		fetched = append(fetched, req.URL.Path)
+		mu.Unlock()
+		<-release
+		return cannedResponse(req, http.StatusOK, "index", nil), nil
+	}}
+	base := newTestServerConfig(t, origin)
+	globalConfig := config.DefaultConfig()
+	globalConfig.Server.PrefetchWorkers = 1
+	repo := config.Repository{URL: base.UpstreamURL, Path: "/warming/", Enabled: true,
+		WarmupPaths: []string{"dists/first/InRelease", "dists/second/InRelease"}}
+	handler := NewRepositoryHandler(base.UpstreamURL, base.Cache, base.HeaderCache, base.ValidationCache, base.Client, "/warming/", repo, &globalConfig).(*RepositoryHandler)
+
+	for origin.Calls() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	handler.Close()
+	close(release)
+	pendingUpdates.Wait()
+	time.Sleep(3 * prefetchYieldInterval)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fetched) != 1 {
+		t.Errorf("Expected the warm-up to stop after the fetch in progress, origin saw %v", fetched)
+	}
+}
+
+func TestSuiteStatsBreakDownTrafficBySuite(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/Release") {
+			return nil, errors.New("connection refused")
+		}
+		return cannedResponse(req, http.StatusOK, "release", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.LocalPath = "/debian/"
+	t.Cleanup(func() {
+		suiteStats.Lock()
+		suiteStats.suites = make(map[string]*suiteCounters)
+		suiteStats.Unlock()
+	})
+	if err := config.Cache.Put("debian/dists/idle/InRelease", strings.NewReader("idle"), 4, time.Now()); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	handler := NewByteAccountingMiddleware(NewSuiteStatsMiddleware(HandleRequest(config, true)))
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debian/dists/busy/InRelease", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		pendingUpdates.Wait()
+	}
+	// A failed fetch is a miss and a refused method an error, neither a hit.
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/debian/dists/broken/Release", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/debian/dists/broken/InRelease", nil))
+
+	w := httptest.NewRecorder()
+	HandleSuiteStats(config.Cache)(w, httptest.NewRequest(http.MethodGet, "/admin/suites", nil))
+	var suites []suiteSnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &suites); err != nil {
+		t.Fatalf("Failed to parse suite stats: %v", err)
+	}
+	if len(suites) != 3 {
+		t.Fatalf("Expected 3 suites, got %+v", suites)
+	}
+	broken, busy, idle := suites[0], suites[1], suites[2]
+	if broken.Suite != "debian/dists/broken" || broken.Requests != 2 || broken.Misses != 1 || broken.Errors != 1 || broken.Hits+broken.Revalidated != 0 || broken.HitRatio != 0 {
+		t.Errorf("Unexpected stats for the broken suite: %+v", broken)
+	}
+	if busy.Suite != "debian/dists/busy" || busy.Requests != 3 || busy.Misses != 1 || busy.Hits+busy.Revalidated != 2 || busy.Entries != 1 {
+		t.Errorf("Unexpected stats for the busy suite: %+v", busy)
+	}
+	if busy.ClientBytes != 3*int64(len("release")) || busy.OriginBytes != int64(len("release")) {
+		t.Errorf("Unexpected byte counts for the busy suite: %+v", busy)
+	}
+	if idle.Suite != "debian/dists/idle" || idle.Requests != 0 || idle.Entries != 1 {
+		t.Errorf("Unexpected stats for the idle suite: %+v", idle)
+	}
+}
+
+func TestOriginRateLimitBacksOffAndServesStale(t *testing.T) {
+	var limited atomic.Bool
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if limited.Load() {
+			return cannedResponse(req, http.StatusTooManyRequests, "slow down", http.Header{"Retry-After": {"120"}}), nil
+		}
+		return cannedResponse(req, http.StatusOK, "release", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.RateLimitBackoff = time.Minute
+	t.Cleanup(func() {
+		originRateLimits.Lock()
+		originRateLimits.origins = make(map[string]*originRateLimit)
+		originRateLimits.Unlock()
+	})
+
+	handler := HandleRequest(config, true)
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dists/limited/InRelease", nil))
+	pendingUpdates.Wait()
+
+	// Forget the validation so the next request revalidates.
+	config.ValidationCache = storage.NewMemoryValidationCache(time.Minute)
+	handler = HandleRequest(config, true)
+	limited.Store(true)
+	calls := origin.Calls()
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/dists/limited/InRelease", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "release" {
+		t.Fatalf("Expected the cached copy while rate limited, got %d %q", w.Code, w.Body.String())
+	}
+	if origin.Calls() != calls+1 {
+		t.Fatalf("Expected one revalidation request, got %d", origin.Calls()-calls)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/dists/limited/main/binary-amd64/Packages", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 for an uncached file during the back-off, got %d", w.Code)
+	}
+	if retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After")); retryAfter < 110 || retryAfter > 120 {
+		t.Errorf("Expected the origin's Retry-After to be passed on, got %q", w.Header().Get("Retry-After"))
+	}
+	if origin.Calls() != calls+1 {
+		t.Errorf("Origin was contacted during its back-off")
+	}
+
+	if got := parseRetryAfter(time.Unix(1000, 0).UTC().Format(http.TimeFormat), time.Unix(940, 0)); got != time.Minute {
+		t.Errorf("Expected an HTTP date Retry-After to give 1m, got %v", got)
+	}
+}
+
+func TestAggregatePackagesMergesCachedComponents(t *testing.T) {
+	config := newTestServerConfig(t, &fakeOrigin{})
+	put := func(key string, content []byte) {
+		if err := config.Cache.Put(key, bytes.NewReader(content), int64(len(content)), time.Now()); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("Package: a\nVersion: 1\n\n"))
+	gz.Close()
+	mainSum := sha256.Sum256(compressed.Bytes())
+	contrib := []byte("Package: b\nVersion: 2\n")
+	contribSum := sha256.Sum256(contrib)
+
+	suite := "debian/dists/merged"
+	put(suite+"/Release", []byte(fmt.Sprintf("Components: main contrib\nSHA256:\n %x %d main/binary-amd64/Packages.gz\n %x %d contrib/binary-amd64/Packages\n",
+		mainSum, compressed.Len(), contribSum, len(contrib))))
+	put(suite+"/main/binary-amd64/Packages.gz", compressed.Bytes())
+	put(suite+"/contrib/binary-amd64/Packages", contrib)
+
+	handler := HandleAggregatePackages(config.Cache)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/aggregate/Packages?"+query, nil))
+		return w
+	}
+
+	w := get("suite=" + suite + "&arch=amd64")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if want := "Package: a\nVersion: 1\n\nPackage: b\nVersion: 2\n"; w.Body.String() != want {
+		t.Errorf("Expected %q, got %q", want, w.Body.String())
+	}
+	if w.Header().Get("X-Aggregate-Authoritative") != "false" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Aggregate is not marked as non-authoritative: %v", w.Header())
+	}
+
+	if w := get("suite=" + suite + "&arch=amd64&components=%20main%20,%20contrib"); w.Code != http.StatusOK || w.Header().Get("X-Aggregate-Components") != "main, contrib" {
+		t.Errorf("Expected the listed components to be trimmed, got %d %q", w.Code, w.Header().Get("X-Aggregate-Components"))
+	}
+	if w := get("suite=" + suite + "&arch=amd64&components=main,non-free"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an uncached component, got %d", w.Code)
+	}
+	if w := get("suite=" + suite + "&arch=../x"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid architecture, got %d", w.Code)
+	}
+
+	put(suite+"/non-free/binary-amd64/Packages", []byte("Package: c\nVersion: 1\n"))
+	if w := get("suite=" + suite + "&arch=amd64&components=non-free"); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for an index the Release does not list, got %d", w.Code)
+	}
+	if w := get("suite=debian/dists/unreleased&arch=amd64&components=main"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a suite without a cached Release, got %d", w.Code)
+	}
+
+	put(suite+"/contrib/binary-amd64/Packages", []byte("Package: b\nVersion: 3\n"))
+	if w := get("suite=" + suite + "&arch=amd64"); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for an index not matching the Release, got %d", w.Code)
+	}
+}
+
+func TestCacheFillStoresPushedFiles(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusInternalServerError, "", nil), nil
+	}}
+	base := newTestServerConfig(t, origin)
+	globalConfig := config.DefaultConfig()
+	globalConfig.Server.CacheFill = true
+	globalConfig.Admin.Token = "secret"
+	repo := config.Repository{URL: base.UpstreamURL, Path: "/pushed/", Enabled: true}
+	handler := NewRepositoryHandler(base.UpstreamURL, base.Cache, base.HeaderCache, base.ValidationCache, base.Client, "/pushed/", repo, &globalConfig)
+
+	body := "Origin: CI\nSuite: builds\n"
+	sum := sha256.Sum256([]byte(body))
+	put := func(token, checksum, content string) int {
+		req := httptest.NewRequest(http.MethodPut, "/dists/builds/InRelease", strings.NewReader(content))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set("X-Checksum-Sha256", checksum)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := put("wrong", hex.EncodeToString(sum[:]), body); code != http.StatusForbidden {
+		t.Errorf("Expected 403 with a wrong token, got %d", code)
+	}
+	if code := put("secret", hex.EncodeToString(sum[:]), body+"tampered"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a body not matching its checksum, got %d", code)
+	}
+	if code := put("secret", hex.EncodeToString(sum[:]), body); code != http.StatusCreated {
+		t.Fatalf("Expected 201 for a new file, got %d", code)
+	}
+	if code := put("secret", hex.EncodeToString(sum[:]), body); code != http.StatusNoContent {
+		t.Errorf("Expected 204 when replacing a file, got %d", code)
+	}
+
+	// A frequently changing file is served without revalidation even once
+	// its validation has expired.
+	base.ValidationCache.Put("validation:pushed/dists/builds/InRelease", time.Now().Add(-time.Hour))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dists/builds/InRelease", nil))
+	if w.Code != http.StatusOK || w.Body.String() != body || w.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected the pushed file, got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if w.Header().Get(pushedHeader) != "" {
+		t.Errorf("Private header %s was sent to the client", pushedHeader)
+	}
+	if origin.Calls() != 0 {
+		t.Errorf("Origin was contacted %d times for a pushed file", origin.Calls())
+	}
+}
+
+func TestCacheFillHonorsTheAllowlist(t *testing.T) {
+	base := newTestServerConfig(t, &fakeOrigin{})
+	globalConfig := config.DefaultConfig()
+	globalConfig.Server.CacheFill = true
+	globalConfig.Admin.Token = "secret"
+	globalConfig.Cache.Allowlist = []string{"pool/**"}
+	repo := config.Repository{URL: base.UpstreamURL, Path: "/allowed/", Enabled: true}
+	handler := NewRepositoryHandler(base.UpstreamURL, base.Cache, base.HeaderCache, base.ValidationCache, base.Client, "/allowed/", repo, &globalConfig)
+
+	for path, want := range map[string]int{
+		"/pool/main/a/a_1.0_amd64.deb": http.StatusCreated,
+		"/dists/builds/InRelease":      http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader("content"))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("Expected %d for a fill of %s, got %d", want, path, w.Code)
+		}
+	}
+	if content, _, _, err := base.Cache.Get("allowed/dists/builds/InRelease"); err == nil {
+		content.Close()
+		t.Error("Expected the path outside the allowlist not to be cached")
+	}
+}
+
+// memoryOnlyCache hides the FilePutter of the cache it wraps.
+type memoryOnlyCache struct {
+	storage.Cache
+}
+
+func TestCacheFillLeavesPassThroughAndBoundsBufferedBodies(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "proxied "+req.Method, nil), nil
+	}}
+	base := newTestServerConfig(t, origin)
+	globalConfig := config.DefaultConfig()
+	globalConfig.Server.CacheFill = true
+	globalConfig.Admin.Token = "secret"
+	repo := config.Repository{URL: base.UpstreamURL, Path: "/pushed/", Enabled: true,
+		PassThrough: []config.PassThrough{{Path: "api/**", Methods: []string{"PUT"}}}}
+	cache := &memoryOnlyCache{Cache: base.Cache}
+	handler := NewRepositoryHandler(base.UpstreamURL, cache, base.HeaderCache, base.ValidationCache, base.Client, "/pushed/", repo, &globalConfig)
+
+	put := func(target string, contentLength int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, target, strings.NewReader("body"))
+		req.ContentLength = contentLength
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := put("/api/upload", 4); w.Code != http.StatusOK || w.Body.String() != "proxied PUT" {
+		t.Errorf("Expected the PUT to be passed through, got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := put("/pool/main/b/big/big.deb", maxBufferedFill+1); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a body too large to buffer, got %d", w.Code)
+	}
+	if w := put("/pool/main/s/small/small.deb", 4); w.Code != http.StatusCreated {
+		t.Errorf("Expected a small body to be filled, got %d", w.Code)
+	}
+}
+
+func TestDuplicateSingleValuedHeadersAreCollapsed(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "package", http.Header{
+			"Content-Type":  {"application/vnd.debian.binary-package", "text/plain"},
+			"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT", "Tue, 03 Jan 2006 15:04:05 GMT"},
+			"Etag":          {`"first"`, `"second"`},
+		}), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := HandleRequest(config, true)
+
+	for _, served := range []string{"from the origin", "from the cache"} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/pool/main/h/hello/hello_1.0_amd64.deb", nil))
+		pendingUpdates.Wait()
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the package %s, got %d", served, w.Code)
+		}
+		for name, want := range map[string]string{
+			"Content-Type":  "application/vnd.debian.binary-package",
+			"Last-Modified": "Mon, 02 Jan 2006 15:04:05 GMT",
+			"Etag":          `"first"`,
+		} {
+			if got := w.Header().Values(name); len(got) != 1 || got[0] != want {
+				t.Errorf("Expected a single %s %q %s, got %q", name, want, served, got)
+			}
+		}
+	}
+
+	headers, err := config.HeaderCache.GetHeaders(getCacheKey(config, "/pool/main/h/hello/hello_1.0_amd64.deb"))
+	if err != nil {
+		t.Fatalf("Failed to read cached headers: %v", err)
+	}
+	if got := headers.Values("Last-Modified"); len(got) != 1 {
+		t.Errorf("Expected a single Last-Modified to be cached, got %q", got)
+	}
+}
+
+func TestClientCacheControlIsHonored(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("If-Modified-Since") != "" {
+			return cannedResponse(req, http.StatusNotModified, "", nil), nil
+		}
+		return cannedResponse(req, http.StatusOK, "Suite: stable\n", http.Header{"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}}), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.HonorClientCacheControl = true
+	handler := HandleRequest(config, true)
+	get := func(path, cacheControl string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if cacheControl != "" {
+			req.Header.Set("Cache-Control", cacheControl)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		pendingUpdates.Wait()
+		return w
+	}
+
+	if w := get("/dists/stable/InRelease", "only-if-cached"); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 for an uncached only-if-cached request, got %d", w.Code)
+	}
+	if origin.Calls() != 0 {
+		t.Fatalf("Expected only-if-cached not to reach the origin, got %d calls", origin.Calls())
+	}
+
+	if w := get("/dists/stable/InRelease", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected the InRelease, got %d", w.Code)
+	}
+	if w := get("/dists/stable/InRelease", "max-age=0"); w.Code != http.StatusOK || origin.Calls() != 1 {
+		t.Errorf("Expected max-age=0 to be served from the still valid copy, got %d with %d origin calls", w.Code, origin.Calls())
+	}
+	if w := get("/dists/stable/InRelease", "no-cache"); w.Code != http.StatusOK || origin.Calls() != 2 {
+		t.Errorf("Expected no-cache to revalidate with the origin, got %d with %d origin calls", w.Code, origin.Calls())
+	}
+
+	config.ValidationCache.Put("validation:"+getCacheKey(config, "/dists/stable/InRelease"), time.Now().Add(-time.Hour))
+	if w := get("/dists/stable/InRelease", "max-stale, only-if-cached"); w.Code != http.StatusOK || w.Body.String() != "Suite: stable\n" || origin.Calls() != 2 {
+		t.Errorf("Expected only-if-cached to serve the cached copy without revalidation, got %d %q with %d origin calls", w.Code, w.Body.String(), origin.Calls())
+	}
+}
+
+func TestHitRatioWindowForgetsOldRequests(t *testing.T) {
+	window := &hitWindow{width: time.Second}
+	start := time.Unix(1700000000, 0)
+
+	for i := 0; i < 10; i++ {
+		window.record(start, false)
+	}
+	now := start.Add(30 * time.Second)
+	for i := 0; i < 3; i++ {
+		window.record(now, true)
+	}
+	window.record(now, false)
+	if hits, misses := window.totals(now); hits != 3 || misses != 11 {
+		t.Errorf("Expected 3 hits and 11 misses within the window, got %d and %d", hits, misses)
+	}
+
+	// A minute later the misses of the first slot have left the window.
+	later := start.Add(hitWindowSlots * time.Second)
+	if hits, misses := window.totals(later); hits != 3 || misses != 1 {
+		t.Errorf("Expected 3 hits and 1 miss once the oldest slot expired, got %d and %d", hits, misses)
+	}
+	window.record(later, true)
+	if hits, misses := window.totals(later); hits != 4 || misses != 1 {
+		t.Errorf("Expected the reused slot to start over, got %d hits and %d misses", hits, misses)
+	}
+}
+
+func TestWindowedHitRatioCountsTranscodedRequestsOnce(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("Package: hello\n"))
+	gz.Close()
+
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, compressed.String(), nil), nil
+	}}
+	base := newTestServerConfig(t, origin)
+	globalConfig := config.DefaultConfig()
+	globalConfig.Cache.CanonicalCompression = CompressionGzip
+	repo := config.Repository{URL: base.UpstreamURL, Path: "/hits/", Enabled: true}
+	repository := NewRepositoryHandler(base.UpstreamURL, base.Cache, base.HeaderCache, base.ValidationCache, base.Client, "/hits/", repo, &globalConfig).(*RepositoryHandler)
+	t.Cleanup(repository.Close)
+	handler := NewByteAccountingMiddleware(repository)
+
+	SetHitRatioWindow(time.Minute)
+	t.Cleanup(func() { SetHitRatioWindow(0) })
+
+	// The uncompressed index is served from the canonical .gz, which is
+	// fetched by a second pass through HandleRequest on the first request.
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dists/stable/main/binary-amd64/Packages", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the transcoded index, got %d", w.Code)
+		}
+		pendingUpdates.Wait()
+	}
+
+	w := httptest.NewRecorder()
+	HandleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{metricsPrefix + "window_requests 2\n", metricsPrefix + "window_hit_ratio 0.5\n"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %q in the metrics, got:\n%s", want, w.Body.String())
+		}
+	}
+}
+
+func TestWindowedHitRatioDropsWhileTheOriginIsDown(t *testing.T) {
+	var down atomic.Bool
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if down.Load() {
+			return nil, errors.New("connection refused")
+		}
+		return cannedResponse(req, http.StatusOK, "package", nil), nil
+	}}
+	base := newTestServerConfig(t, origin)
+	globalConfig := config.DefaultConfig()
+	repo := config.Repository{URL: base.UpstreamURL, Path: "/outage/", Enabled: true}
+	repository := NewRepositoryHandler(base.UpstreamURL, base.Cache, base.HeaderCache, base.ValidationCache, base.Client, "/outage/", repo, &globalConfig).(*RepositoryHandler)
+	t.Cleanup(repository.Close)
+	handler := NewByteAccountingMiddleware(repository)
+
+	SetHitRatioWindow(time.Minute)
+	t.Cleanup(func() { SetHitRatioWindow(0) })
+
+	for _, step := range []struct {
+		path   string
+		down   bool
+		status int
+	}{
+		{"/pool/main/a/a_1.0_amd64.deb", false, http.StatusOK},
+		{"/pool/main/a/a_1.0_amd64.deb", false, http.StatusOK},
+		{"/pool/main/b/b_1.0_amd64.deb", true, http.StatusGatewayTimeout},
+		{"/pool/main/c/c_1.0_amd64.deb", true, http.StatusGatewayTimeout},
+	} {
+		down.Store(step.down)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, step.path, nil))
+		if w.Code != step.status {
+			t.Fatalf("Expected %d for %s, got %d", step.status, step.path, w.Code)
+		}
+		pendingUpdates.Wait()
+	}
+
+	ratio, requests, _ := WindowedHitRatio()
+	if requests != 4 || ratio != 0.25 {
+		t.Errorf("Expected the failed fetches to count as misses, got a ratio of %v over %d requests", ratio, requests)
+	}
+}
+
+func TestBrokenOffDownloadIsResumedWithRange(t *testing.T) {
+	const body = "0123456789abcdef"
+	var ranges []string
+	var mu sync.Mutex
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		headers := http.Header{"Accept-Ranges": {"bytes"}, "Etag": {`"v1"`}}
+		rangeHeader := req.Header.Get("Range")
+		if rangeHeader == "" {
+			resp := cannedResponse(req, http.StatusOK, body, headers)
+			// The connection drops after the first six bytes.
+			resp.Body = io.NopCloser(io.MultiReader(strings.NewReader(body[:6]), iotest.ErrReader(io.ErrUnexpectedEOF)))
+			return resp, nil
+		}
+		mu.Lock()
+		ranges = append(ranges, rangeHeader+" "+req.Header.Get("If-Range"))
+		mu.Unlock()
+		headers.Set("Content-Range", fmt.Sprintf("bytes 6-%d/%d", len(body)-1, len(body)))
+		return cannedResponse(req, http.StatusPartialContent, body[6:], headers), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.StreamToDiskThreshold = 4
+	config.ResumeAttempts = 2
+	handler := HandleRequest(config, false)
+
+	path := "/pool/main/r/resumed/resumed_1.0_amd64.deb"
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Fatalf("Expected the complete file, got %d %q", rec.Code, rec.Body.String())
+	}
+	if len(ranges) != 1 || ranges[0] != `bytes=6- "v1"` {
+		t.Errorf("Expected one request for the rest of the same version, got %q", ranges)
+	}
+
+	content, size, _, err := config.Cache.Get(getCacheKey(config, path))
+	if err != nil {
+		t.Fatalf("Expected the resumed file to be cached: %v", err)
+	}
+	content.Close()
+	if size != int64(len(body)) {
+		t.Errorf("Expected %d cached bytes, got %d", len(body), size)
+	}
+}
+
+func TestResumeBacksOffAndSpendsRetryBudget(t *testing.T) {
+	const body = "0123456789abcdef"
+	var mu sync.Mutex
+	var attempts []time.Time
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		headers := http.Header{"Accept-Ranges": {"bytes"}, "Etag": {`"v1"`}}
+		if req.Header.Get("Range") != "" {
+			mu.Lock()
+			attempts = append(attempts, time.Now())
+			mu.Unlock()
+			headers.Set("Content-Range", fmt.Sprintf("bytes 6-%d/%d", len(body)-1, len(body)))
+			resp := cannedResponse(req, http.StatusPartialContent, body[6:], headers)
+			resp.Body = io.NopCloser(iotest.ErrReader(io.ErrUnexpectedEOF))
+			return resp, nil
+		}
+		resp := cannedResponse(req, http.StatusOK, body, headers)
+		resp.Body = io.NopCloser(io.MultiReader(strings.NewReader(body[:6]), iotest.ErrReader(io.ErrUnexpectedEOF)))
+		return resp, nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.StreamToDiskThreshold = 4
+	config.ResumeAttempts = 2
+	handler := HandleRequest(config, false)
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/pool/main/r/resumed/backoff_1.0_amd64.deb", nil))
+	pendingUpdates.Wait()
+	if len(attempts) != 2 {
+		t.Fatalf("Expected two attempts to resume, got %d", len(attempts))
+	}
+	if gap := attempts[1].Sub(attempts[0]); gap < resumeBackoff {
+		t.Errorf("Expected the second attempt to wait %v, it came after %v", resumeBackoff, gap)
+	}
+
+	SetRetryBudget(0.01, 0)
+	t.Cleanup(func() { SetRetryBudget(0, 0) })
+	attempts = nil
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/pool/main/r/resumed/budget_1.0_amd64.deb", nil))
+	pendingUpdates.Wait()
+	if len(attempts) != 0 {
+		t.Errorf("Expected no attempt to resume without retry budget, got %d", len(attempts))
+	}
+}
+
+func TestDisableRevalidationServesReleaseFromCache(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "Suite: snapshot\n", http.Header{"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}}), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.DisableRevalidation = true
+	handler := HandleRelease(config)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/dists/snapshot/InRelease", nil))
+		pendingUpdates.Wait()
+		if w.Code != http.StatusOK || w.Body.String() != "Suite: snapshot\n" {
+			t.Fatalf("Expected the InRelease, got %d %q", w.Code, w.Body.String())
+		}
+		// Without revalidation disabled, the expired validation would send
+		// the next request to the origin.
+		config.ValidationCache.Put("validation:"+getCacheKey(config, "/dists/snapshot/InRelease"), time.Now().Add(-time.Hour))
+	}
+	if origin.Calls() != 1 {
+		t.Errorf("Expected only the miss to reach the origin, got %d calls", origin.Calls())
+	}
+}
+
+func TestResponseHeadersAreAddedToEveryResponse(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "package", http.Header{"Content-Type": {"application/vnd.debian.binary-package"}}), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.DownstreamCacheHeaders = true
+	config.ResponseHeaders = map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "no-transform",
+	}
+	handler := HandleRequest(config, true)
+
+	for _, served := range []string{"from the origin", "from the cache"} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/pool/main/h/hello/hello_1.0_amd64.deb", nil))
+		pendingUpdates.Wait()
+		if w.Code != http.StatusOK || w.Body.String() != "package" {
+			t.Fatalf("Expected the package %s, got %d %q", served, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("Expected the configured header on the response %s, got %q", served, got)
+		}
+		if got := w.Header().Values("Cache-Control"); len(got) != 1 || got[0] != "no-transform" {
+			t.Errorf("Expected the configured Cache-Control to replace the computed one %s, got %q", served, got)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/vnd.debian.binary-package" {
+			t.Errorf("Expected the origin's Content-Type to be kept %s, got %q", served, got)
+		}
+	}
+	if origin.Calls() != 1 {
+		t.Errorf("Expected the second request to be served from the cache, origin was called %d times", origin.Calls())
+	}
+}
+
+func TestEventsAreStreamedToSubscribers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(HandleEvents))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	PublishEvent(Event{Type: EventFetch, Key: "debian/dists/stable/InRelease", Size: 42})
+
+	reader := bufio.NewReader(resp.Body)
+	var message []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read the stream: %v", err)
+		}
+		if line == "\n" {
+			break
+		}
+		message = append(message, strings.TrimSuffix(line, "\n"))
+	}
+	if len(message) != 2 || message[0] != "event: fetch" {
+		t.Fatalf("Expected a fetch event, got %q", message)
+	}
+	var event Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(message[1], "data: ")), &event); err != nil {
+		t.Fatalf("Failed to parse event data %q: %v", message[1], err)
+	}
+	if event.Key != "debian/dists/stable/InRelease" || event.Size != 42 || event.Time.IsZero() {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	resp.Body.Close()
+	server.Close()
+
+	// A subscriber that does not keep up is dropped.
+	events, ok := subscribeEvents()
+	if !ok {
+		t.Fatal("Expected to be able to subscribe")
+	}
+	for i := 0; i <= eventBacklog; i++ {
+		PublishEvent(Event{Type: EventEvict, Key: strconv.Itoa(i)})
+	}
+	received := 0
+	for range events {
+		received++
+	}
+	if received != eventBacklog {
+		t.Errorf("Expected the %d events before the subscriber was dropped, got %d", eventBacklog, received)
+	}
+
+	for i := 0; i < maxEventSubscribers; i++ {
+		events, ok := subscribeEvents()
+		if !ok {
+			t.Fatalf("Expected subscriber %d to be accepted", i+1)
+		}
+		defer unsubscribeEvents(events)
+	}
+	w := httptest.NewRecorder()
+	HandleEvents(w, httptest.NewRequest(http.MethodGet, "/admin/events", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 beyond %d subscribers, got %d", maxEventSubscribers, w.Code)
+	}
+}
+
+func TestPassThroughProxiesConfiguredMethodsUncached(t *testing.T) {
+	var seen []string
+	var mu sync.Mutex
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		seen = append(seen, req.Method+" "+req.URL.String()+" "+req.Header.Get("Content-Type")+" "+string(body))
+		mu.Unlock()
+		return cannedResponse(req, http.StatusOK, `{"results": []}`, http.Header{"Content-Type": {"application/json"}}), nil
+	}}
+	rules := []config.PassThrough{{Path: "api/*"}, {Path: "metadata/**", Methods: []string{"PUT", "DELETE"}}}
+	config := newTestServerConfig(t, origin)
+	config.PassThrough = rules
+	handler := HandleRequest(config, true)
+
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		pendingUpdates.Wait()
+		return w
+	}
+
+	w := send(http.MethodPost, "/api/search", `{"q": "hello"}`)
+	if w.Code != http.StatusOK || w.Body.String() != `{"results": []}` || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected the origin's response, got %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	if want := `POST http://origin.invalid/debian/api/search application/json {"q": "hello"}`; len(seen) != 1 || seen[0] != want {
+		t.Errorf("Expected the origin to get %q, got %q", want, seen)
+	}
+	if w := send(http.MethodDelete, "/metadata/ppa/key", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected a configured DELETE to be proxied, got %d", w.Code)
+	}
+	if _, _, _, err := config.Cache.Get(getCacheKey(config, "/api/search")); err == nil {
+		t.Errorf("Expected the pass-through response not to be cached")
+	}
+
+	for _, rejected := range []struct{ method, target string }{
+		{http.MethodPut, "/api/search"},             // Only POST by default
+		{http.MethodPost, "/api/search/deeper"},     // Outside the glob
+		{http.MethodPost, "/metadata/ppa/key"},      // Not among the listed methods
+		{http.MethodPost, "/pool/main/h/hello.deb"}, // No rule
+	} {
+		if w := send(rejected.method, rejected.target, "{}"); w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Expected 405 for %s %s, got %d", rejected.method, rejected.target, w.Code)
+		}
+	}
+	if origin.Calls() != 2 {
+		t.Errorf("Expected only the allowed requests to reach the origin, got %d calls", origin.Calls())
+	}
+}
+
+func TestMetricLabelsBucketPaths(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if strings.Contains(req.URL.Path, "/down/") {
+			return nil, errors.New("connection refused")
+		}
+		return cannedResponse(req, http.StatusOK, "content", nil), nil
+	}}
+	labels := config.MetricLabelConfig{
+		MaxValues: 2,
+		Rules: []config.MetricLabelRule{
+			{Label: "area", Pattern: "/dists/", Value: "dists"},
+			{Label: "area", Pattern: "/pool/", Value: "pool"},
+			{Label: "arch", Pattern: `_([a-z0-9]+)\.deb$`, Value: "$1"},
+		},
+	}
+	config := newTestServerConfig(t, origin)
+	handler := NewByteAccountingMiddleware(NewMetricLabelsMiddleware(HandleRequest(config, true), labels))
+	t.Cleanup(func() { metricLabels.Store(nil) })
+
+	for _, path := range []string{
+		"/dists/stable/InRelease",
+		"/pool/main/a/a_1.0_amd64.deb",
+		"/pool/main/a/a_1.0_amd64.deb",
+		"/pool/main/b/b_1.0_arm64.deb",
+		"/pool/main/c/c_1.0_riscv64.deb",
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		pendingUpdates.Wait()
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, got %d", path, w.Code)
+		}
+	}
+	// A failed fetch is no hit, though it read nothing from the origin.
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/dists/down/InRelease", nil))
+
+	w := httptest.NewRecorder()
+	HandleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`go_apt_cache_labeled_requests_total{area="dists",arch="none"} 2`,
+		`go_apt_cache_labeled_hits_total{area="dists",arch="none"} 0`,
+		`go_apt_cache_labeled_requests_total{area="pool",arch="amd64"} 2`,
+		`go_apt_cache_labeled_hits_total{area="pool",arch="amd64"} 1`,
+		// arch allows two values, amd64 and none, so arm64 is other.
+		`go_apt_cache_labeled_requests_total{area="pool",arch="other"} 2`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("Expected %q in the metrics, got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "a_1.0") || strings.Contains(body, "InRelease") {
+		t.Errorf("Expected no paths in the metrics, got:\n%s", body)
+	}
+}
+
+func TestErrorPagesAreServedToBrowsers(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "package", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.HonorClientCacheControl = true
+	page := filepath.Join(t.TempDir(), "504.html")
+	if err := os.WriteFile(page, []byte(`<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Message}}: {{.Path}}</p>`), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := LoadErrorPages(map[string]string{"504": page}); err != nil {
+		t.Fatalf("LoadErrorPages failed: %v", err)
+	}
+	t.Cleanup(func() { LoadErrorPages(nil) })
+	handler := HandleRequest(config, true)
+
+	request := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/pool/main/<b>.deb", nil)
+		req.Header.Set("Cache-Control", "only-if-cached")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	w := request("text/html,application/xhtml+xml,*/*;q=0.8")
+	if w.Code != http.StatusGatewayTimeout || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("Expected an HTML 504 for a browser, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if want := "<h1>504 Gateway Timeout</h1><p>Not cached: /pool/main/&lt;b&gt;.deb</p>"; w.Body.String() != want {
+		t.Errorf("Expected the rendered template %q, got %q", want, w.Body.String())
+	}
+	if w.Header().Get("Vary") != "Accept" {
+		t.Errorf("Expected Vary: Accept on the error page, got %q", w.Header().Get("Vary"))
+	}
+
+	for _, accept := range []string{"", "*/*", "text/html;q=0"} {
+		w := request(accept)
+		if w.Code != http.StatusGatewayTimeout || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") || w.Body.String() != "Not cached\n" {
+			t.Errorf("Expected a plain text 504 for Accept %q, got %d %q %q", accept, w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/pool/main/h/hello/hello_1.0_amd64.deb", nil)
+	req.Header.Set("Accept", "text/html")
+	handler(w, req)
+	pendingUpdates.Wait()
+	if w.Code != http.StatusOK || w.Body.String() != "package" {
+		t.Errorf("Expected successful responses to be left alone, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestOrphanPoolFilesAreCollected(t *testing.T) {
+	config := newTestServerConfig(t, &fakeOrigin{})
+	put := func(key string, content []byte) {
+		if err := config.Cache.Put(key, bytes.NewReader(content), int64(len(content)), time.Now()); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := config.HeaderCache.PutHeaders(key, http.Header{"Content-Type": {"application/octet-stream"}}); err != nil {
+			t.Fatalf("PutHeaders failed: %v", err)
+		}
+	}
+
+	var packages bytes.Buffer
+	gz := gzip.NewWriter(&packages)
+	io.WriteString(gz, "Package: kept\nFilename: pool/main/k/kept/kept_1.0_amd64.deb\n\nPackage: other\nFilename: pool/main/o/other/other_2.0_amd64.deb\n")
+	gz.Close()
+	sum := sha256.Sum256(packages.Bytes())
+	release := fmt.Sprintf("Suite: stable\nSHA256:\n %s %d main/binary-amd64/Packages.gz\n", hex.EncodeToString(sum[:]), packages.Len())
+
+	put("debian/dists/stable/Release", []byte(release))
+	put("debian/dists/stable/main/binary-amd64/Packages.gz", packages.Bytes())
+	put("debian/pool/main/k/kept/kept_1.0_amd64.deb", []byte("kept"))
+	put("debian/pool/main/o/other/other_2.0_amd64.deb", []byte("other"))
+	put("debian/pool/main/k/kept/kept_0.9_amd64.deb", []byte("superseded"))
+	put("debian/pool/main/p/pushed/pushed_1.0_amd64.deb", []byte("pushed"))
+	if err := config.HeaderCache.PutHeaders("debian/pool/main/p/pushed/pushed_1.0_amd64.deb", http.Header{pushedHeader: {"1"}}); err != nil {
+		t.Fatalf("PutHeaders failed: %v", err)
+	}
+	// Nothing of this archive's indexes is cached.
+	put("ubuntu/pool/main/u/unknown_1.0_amd64.deb", []byte("unknown"))
+
+	result, err := CollectOrphanPoolFiles(config.Cache, config.HeaderCache, time.Hour, time.Hour)
+	if err != nil || result.Deleted != 0 {
+		t.Fatalf("Expected files within the grace period to be kept, got %+v, %v", result, err)
+	}
+	result, err = CollectOrphanPoolFiles(config.Cache, config.HeaderCache, 0, time.Nanosecond)
+	if err != nil || result.Deleted != 0 || result.Skipped != 2 {
+		t.Fatalf("Expected archives without a fresh Release to be skipped, got %+v, %v", result, err)
+	}
+
+	result, err = CollectOrphanPoolFiles(config.Cache, config.HeaderCache, 0, time.Hour)
+	if err != nil {
+		t.Fatalf("CollectOrphanPoolFiles failed: %v", err)
+	}
+	if result.Deleted != 1 || result.Reclaimed != int64(len("superseded")) || result.Archives != 1 || result.Skipped != 1 {
+		t.Errorf("Expected the superseded file to be collected, got %+v", result)
+	}
+	for key, want := range map[string]bool{
+		"debian/pool/main/k/kept/kept_1.0_amd64.deb":     true,
+		"debian/pool/main/o/other/other_2.0_amd64.deb":   true,
+		"debian/pool/main/k/kept/kept_0.9_amd64.deb":     false,
+		"debian/pool/main/p/pushed/pushed_1.0_amd64.deb": true,
+		"ubuntu/pool/main/u/unknown_1.0_amd64.deb":       true,
+	} {
+		content, _, _, err := config.Cache.Get(key)
+		if err == nil {
+			content.Close()
+		}
+		if (err == nil) != want {
+			t.Errorf("Expected %s to be cached: %v", key, want)
+		}
+	}
+	if deleted, reclaimed, lastRun := PoolGCStats(); deleted < 1 || reclaimed < int64(len("superseded")) || lastRun.IsZero() {
+		t.Errorf("Expected the collection in the stats, got %d files, %d bytes, %v", deleted, reclaimed, lastRun)
+	}
+}
+
+func TestPoolFilesOfUncachedIndexesAreKept(t *testing.T) {
+	config := newTestServerConfig(t, &fakeOrigin{})
+	put := func(key string, content []byte) {
+		if err := config.Cache.Put(key, bytes.NewReader(content), int64(len(content)), time.Now()); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		if err := config.HeaderCache.PutHeaders(key, http.Header{"Content-Type": {"application/octet-stream"}}); err != nil {
+			t.Fatalf("PutHeaders failed: %v", err)
+		}
+	}
+	entry := func(content []byte, relPath string) string {
+		sum := sha256.Sum256(content)
+		return fmt.Sprintf(" %s %d %s\n", hex.EncodeToString(sum[:]), len(content), relPath)
+	}
+
+	current := []byte("Package: kept\nFilename: pool/main/k/kept/kept_1.0_amd64.deb\n")
+	var packages bytes.Buffer
+	gz := gzip.NewWriter(&packages)
+	gz.Write(current)
+	gz.Close()
+	release := "Suite: stable\nSHA256:\n" +
+		entry(packages.Bytes(), "main/binary-amd64/Packages.gz") +
+		entry(current, "main/binary-amd64/Packages") +
+		entry([]byte("not cached"), "main/binary-i386/Packages.gz") +
+		entry([]byte("not cached"), "main/source/Sources.gz")
+
+	put("debian/dists/stable/Release", []byte(release))
+	put("debian/dists/stable/main/binary-amd64/Packages.gz", packages.Bytes())
+	// An uncompressed copy from before the last publish.
+	put("debian/dists/stable/main/binary-amd64/Packages", []byte("Package: kept\nFilename: pool/main/k/kept/kept_0.9_amd64.deb\n"))
+	want := map[string]bool{
+		"debian/pool/main/k/kept/kept_1.0_amd64.deb": true,
+		"debian/pool/main/k/kept/kept_0.9_amd64.deb": true,  // Referenced by the outdated copy
+		"debian/pool/main/o/old/old_1.0_amd64.deb":   false, // Unreferenced
+		"debian/pool/main/o/old/old_1.0_all.deb":     false, // Unreferenced by the amd64 index
+		"debian/pool/main/o/old/old_1.0_i386.deb":    true,  // Its index is not cached
+		"debian/pool/main/o/old/old_1.0.dsc":         true,  // No Sources index is cached
+	}
+	for key := range want {
+		put(key, []byte(key))
+	}
+
+	result, err := CollectOrphanPoolFiles(config.Cache, config.HeaderCache, 0, time.Hour)
+	if err != nil || result.Deleted != 2 {
+		t.Fatalf("Expected two files to be collected, got %+v, %v", result, err)
+	}
+	for key, kept := range want {
+		content, _, _, err := config.Cache.Get(key)
+		if err == nil {
+			content.Close()
+		}
+		if (err == nil) != kept {
+			t.Errorf("Expected %s to be cached: %v", key, kept)
+		}
+	}
+}
+
+func TestSignatureProbe404sAreNotNegativeCachedForLong(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		if path.Base(req.URL.Path) == "InRelease" {
+			return cannedResponse(req, http.StatusOK, "Suite: probe\n", nil), nil
+		}
+		return cannedResponse(req, http.StatusNotFound, "not found", nil), nil
+	}}
+	rules := []config.NegativeCacheRule{{Path: "dists/**", TTL: 3600}}
+	config := newTestServerConfig(t, origin)
+	config.NegativeCacheRules = rules
+	handler := HandleRequest(config, true)
+
+	get := func(requestPath string) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+		pendingUpdates.Wait()
+		return w.Code
+	}
+	signature := "/dists/probe/Release.gpg"
+	signatureKey := getCacheKey(config, signature)
+
+	if code := get(signature); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for Release.gpg, got %d", code)
+	}
+	negativeCache.Lock()
+	entry, remembered := negativeCache.entries[signatureKey]
+	negativeCache.Unlock()
+	if !remembered || time.Until(entry.until) > signatureProbeNegativeTTL {
+		t.Errorf("Expected the 404 to be remembered for at most %v, got %v", signatureProbeNegativeTTL, time.Until(entry.until))
+	}
+
+	if code := get("/dists/probe/InRelease"); code != http.StatusOK {
+		t.Fatalf("Expected InRelease, got %d", code)
+	}
+	if _, ok := lookupNegative(signatureKey); ok {
+		t.Error("Expected fetching InRelease to forget the Release.gpg 404")
+	}
+
+	calls := atomic.LoadInt32(&origin.calls)
+	if code := get(signature); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for Release.gpg, got %d", code)
+	}
+	if atomic.LoadInt32(&origin.calls) != calls+1 {
+		t.Error("Expected the probe to reach the origin")
+	}
+	if _, ok := lookupNegative(signatureKey); ok {
+		t.Error("Expected no negative entry while InRelease is fresh")
+	}
+}
+
+func TestAdmissionPolicyServesRejectedFilesWithoutCaching(t *testing.T) {
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, "admission", nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	cache, err := storage.NewLRUCacheWithOptions(storage.LRUCacheOptions{
+		BasePath:     t.TempDir(),
+		MaxSizeBytes: 1024 * 1024,
+		MaxEntries:   1,
+		Admission:    true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	config.Cache = cache
+	config.CacheAdmission = true
+	handler := HandleRequest(config, true)
+
+	get := func(requestPath string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+		pendingUpdates.Wait()
+		if w.Code != http.StatusOK || w.Body.String() != "admission" {
+			t.Fatalf("Expected the file for %s, got %d %q", requestPath, w.Code, w.Body.String())
+		}
+	}
+
+	popular := "/pool/main/a/admission/popular.deb"
+	for i := 0; i < 4; i++ {
+		get(popular)
+	}
+	rejected := admissionStats.rejected.Load()
+
+	once := "/pool/main/a/admission/once.deb"
+	get(once)
+	if content, _, _, err := config.Cache.Get(getCacheKey(config, once)); err == nil {
+		content.Close()
+		t.Error("Expected the file requested once not to be cached")
+	}
+	if admissionStats.rejected.Load() != rejected+1 {
+		t.Error("Expected the rejection to be counted")
+	}
+	if content, _, _, err := config.Cache.Get(getCacheKey(config, popular)); err != nil {
+		t.Error("Expected the popular file to stay cached")
+	} else {
+		content.Close()
+	}
+}
+
+// stalledClient is a client that does not read its response until released.
+type stalledClient struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func (c *stalledClient) Write(p []byte) (int, error) {
+	<-c.release
+	return c.ResponseRecorder.Write(p)
+}
+
+func TestSlowClientDoesNotHoldUpCaching(t *testing.T) {
+	body := strings.Repeat("slow client ", 10000)
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, body, nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	handler := HandleRequest(config, true)
+	const requestPath = "/pool/main/s/slow/client.deb"
+
+	client := &stalledClient{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler(client, httptest.NewRequest(http.MethodGet, requestPath, nil))
+	}()
+
+	waitForCache(t, config, getCacheKey(config, requestPath))
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+	if w.Code != http.StatusOK || w.Body.String() != body {
+		t.Errorf("Expected the cached file while the first client stalls, got %d (%d bytes)", w.Code, w.Body.Len())
+	}
+
+	close(client.release)
+	<-done
+	pendingUpdates.Wait()
+	if client.Body.String() != body {
+		t.Errorf("Expected the slow client to receive the whole file, got %d bytes", client.Body.Len())
+	}
+	if calls := atomic.LoadInt32(&origin.calls); calls != 1 {
+		t.Errorf("Expected one upstream fetch, got %d", calls)
+	}
+}
+
+// blockedClient is a stalledClient that reports when a write first blocks.
+type blockedClient struct {
+	stalledClient
+	blocked chan struct{}
+	once    sync.Once
+}
+
+func (c *blockedClient) Write(p []byte) (int, error) {
+	c.once.Do(func() { close(c.blocked) })
+	return c.stalledClient.Write(p)
+}
+
+func TestSuiteLockIsNotHeldWhileStreaming(t *testing.T) {
+	body := strings.Repeat("Package: example\n", 1000)
+	origin := &fakeOrigin{respond: func(req *http.Request) (*http.Response, error) {
+		return cannedResponse(req, http.StatusOK, body, nil), nil
+	}}
+	config := newTestServerConfig(t, origin)
+	config.SuiteLock = true
+	handler := HandleRequest(config, true)
+	const requestPath = "/dists/stable/main/binary-amd64/Packages"
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, requestPath, nil))
+	pendingUpdates.Wait()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the index to be fetched, got %d", w.Code)
+	}
+
+	client := &blockedClient{
+		stalledClient: stalledClient{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})},
+		blocked:       make(chan struct{}),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler(client, httptest.NewRequest(http.MethodGet, requestPath, nil))
+	}()
+	<-client.blocked
+
+	locked := make(chan struct{})
+	go func() {
+		lockSuiteForRefresh(getCacheKey(config, requestPath))()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected a Release refresh not to wait for a client streaming an index")
+	}
+
+	close(client.release)
+	<-done
+	<-locked
+	if client.Body.String() != body {
+		t.Errorf("Expected the stalled client to receive the whole index, got %d bytes", client.Body.Len())
+	}
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hitWindowSlots is the number of slots the hit ratio window is divided
+// into. Requests leave the window one slot at a time.
+const hitWindowSlots = 60
+
+// hitWindow counts how repository requests were served within a sliding
+// window, so a sudden drop in the hit ratio, such as after a cache wipe or a
+// large publish, shows before the lifetime ratio moves.
+type hitWindow struct {
+	width time.Duration // Of one slot
+
+	mu    sync.Mutex
+	slots [hitWindowSlots]hitSlot
+}
+
+type hitSlot struct {
+	index  int64 // Slot number since the epoch
+	hits   int64 // Served from the cache, revalidated or not
+	misses int64
+}
+
+// hitRatioWindow is the active window, nil when the windowed ratio is off.
+var hitRatioWindow atomic.Pointer[hitWindow]
+
+// SetHitRatioWindow makes the hit ratio reported by /metrics cover the given
+// window. Zero turns the windowed ratio off.
+func SetHitRatioWindow(window time.Duration) {
+	if window <= 0 {
+		hitRatioWindow.Store(nil)
+		return
+	}
+	width := window / hitWindowSlots
+	if width <= 0 {
+		width = 1
+	}
+	hitRatioWindow.Store(&hitWindow{width: width})
+}
+
+// slot returns the counters of the slot now falls in, clearing them if they
+// still hold an older slot. The caller must hold w.mu.
+func (w *hitWindow) slot(now time.Time) *hitSlot {
+	index := now.UnixNano() / int64(w.width)
+	s := &w.slots[index%hitWindowSlots]
+	if s.index != index {
+		*s = hitSlot{index: index}
+	}
+	return s
+}
+
+func (w *hitWindow) record(now time.Time, hit bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if hit {
+		w.slot(now).hits++
+	} else {
+		w.slot(now).misses++
+	}
+}
+
+// totals returns the hits and misses counted within the window before now.
+func (w *hitWindow) totals(now time.Time) (hits, misses int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	current := now.UnixNano() / int64(w.width)
+	for _, s := range w.slots {
+		if s.index > current-hitWindowSlots {
+			hits += s.hits
+			misses += s.misses
+		}
+	}
+	return hits, misses
+}
+
+// recordHit counts a finished repository request in the hit ratio window by
+// how its byte account says it was served. Requests without an account,
+// such as warm-up prefetches, and requests refused without asking the
+// origin are not counted.
+func recordHit(r *http.Request) {
+	w := hitRatioWindow.Load()
+	if w == nil {
+		return
+	}
+	account := byteAccountFrom(r.Context())
+	if account == nil {
+		return
+	}
+	switch account.outcome() {
+	case "hit", "revalidated":
+		w.record(time.Now(), true)
+	case "miss":
+		w.record(time.Now(), false)
+	}
+}
+
+// WindowedHitRatio returns the share of the requests within the window that
+// were served from the cache, the number of those requests and the length of
+// the window. The window is zero when the windowed ratio is off.
+func WindowedHitRatio() (ratio float64, requests int64, window time.Duration) {
+	w := hitRatioWindow.Load()
+	if w == nil {
+		return 0, 0, 0
+	}
+	hits, misses := w.totals(time.Now())
+	requests = hits + misses
+	if requests > 0 {
+		ratio = float64(hits) / float64(requests)
+	}
+	return ratio, requests, w.width * hitWindowSlots
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// isImmutablePath reports whether the remote path addresses content that can
+// never change once published: by-hash indexes, pdiff patches and any
+// configured snapshot trees.
+func isImmutablePath(config ServerConfig, remotePath string) bool {
+	if strings.Contains("/"+remotePath, "/by-hash/") || utils.IsPdiffPatch(remotePath) {
+		return true
+	}
+	return utils.MatchAnyPathPattern(config.ImmutablePaths, remotePath)
+}
+
+// handleImmutableHit serves an immutable file straight from the cache without
+// consulting the header cache or scheduling any revalidation. It returns false
+// when the file is not cached so the caller can fall back to a cache miss.
+func handleImmutableHit(w http.ResponseWriter, r *http.Request, config ServerConfig, cacheKey string) bool {
+	content, size, lastModified, err := lookupCache(r, config, cacheKey)
+	if err != nil {
+		config.ImmutableCache.Delete(cacheKey)
+		return false
+	}
+	defer content.Close()
+
+	entry, exists := config.ImmutableCache.Get(cacheKey)
+	if !exists || entry.Size != size {
+		entry = storage.ImmutableEntry{
+			Size:         size,
+			LastModified: lastModified,
+			ContentType:  "application/octet-stream",
+		}
+		if cachedHeaders, headerErr := config.HeaderCache.GetHeaders(cacheKey); headerErr == nil {
+			if contentType := cachedHeaders.Get("Content-Type"); contentType != "" {
+				entry.ContentType = contentType
+			}
+		}
+		config.ImmutableCache.Put(cacheKey, entry)
+	}
+
+	logging.Debug("Immutable fast path: serving %s", cacheKey)
+
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	w.Header().Set("Content-Type", entry.ContentType)
+	setContentDisposition(w, config, r.URL.Path)
+	w.Header().Set("Last-Modified", entry.LastModified.UTC().Format(http.TimeFormat))
+
+	if checkAndHandleIfModifiedSince(w, r, "", entry.LastModified, config) {
+		return true
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		if _, err := io.Copy(w, content); err != nil {
+			logging.Error("Error streaming immutable response: %v", err)
+		}
+	}
+	return true
+}
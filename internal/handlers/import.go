@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// ImportResult summarizes an ImportTree run.
+type ImportResult struct {
+	Files   int
+	Bytes   int64
+	Linked  int // Files hardlinked into the cache rather than copied
+	Skipped int // Files outside the mirrored subset or not cacheable
+	Failed  int
+}
+
+// ImportTree seeds the repository's cache from an existing mirror tree, such
+// as one kept by apt-mirror or debmirror, whose root corresponds to the
+// repository's upstream URL. Each file is hardlinked into the cache when the
+// cache supports it and is on the same filesystem, and copied otherwise. Its
+// headers carry the Content-Type for its extension and a Last-Modified taken
+// from its mtime, so the first request for it revalidates against the origin
+// with If-Modified-Since like any other cached entry.
+func ImportTree(config ServerConfig, root string) (ImportResult, error) {
+	var result ImportResult
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return result, err
+	}
+	if !info.IsDir() {
+		return result, fmt.Errorf("%s is not a directory", root)
+	}
+
+	err = filepath.WalkDir(root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			logging.Warning("Import: Cannot read %s: %v", filePath, err)
+			result.Failed++
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		remotePath := filepath.ToSlash(rel)
+		if !isPathMirrored(config, remotePath) || !isCacheAllowed(config, remotePath) {
+			result.Skipped++
+			return nil
+		}
+
+		linked, size, err := importFile(config, filePath, remotePath)
+		if err != nil {
+			logging.Warning("Import: Failed to import %s: %v", remotePath, err)
+			result.Failed++
+			return nil
+		}
+		result.Files++
+		result.Bytes += size
+		if linked {
+			result.Linked++
+		}
+		return nil
+	})
+	return result, err
+}
+
+// importFile stores one file under the cache key of remotePath and reports
+// whether it was hardlinked.
+func importFile(config ServerConfig, filePath, remotePath string) (bool, int64, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, 0, err
+	}
+	lastModified := info.ModTime().UTC().Truncate(time.Second)
+	cacheKey := getCacheKey(config, remotePath)
+
+	headers := make(http.Header)
+	if contentType, ok := utils.LookupContentType(remotePath); ok {
+		headers.Set("Content-Type", contentType)
+	}
+	headers.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	headers.Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	linked := false
+	if putter, ok := config.Cache.(storage.FilePutter); ok {
+		linked, err = putFileLinked(putter, cacheKey, filePath, info.ModTime())
+	} else {
+		err = putFileCopied(config.Cache, cacheKey, filePath, info.Size(), info.ModTime())
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	if err := config.HeaderCache.PutHeaders(cacheKey, headers); err != nil {
+		config.Cache.Delete(cacheKey)
+		return false, 0, fmt.Errorf("storing headers: %w", err)
+	}
+	return linked, info.Size(), nil
+}
+
+// putFileLinked hands the cache a hardlink to the file in place of a temporary
+// file, falling back to a copy when the link cannot be made, e.g. because the
+// tree is on another filesystem.
+func putFileLinked(putter storage.FilePutter, cacheKey, filePath string, lastModified time.Time) (bool, error) {
+	temp, err := putter.CreateTemp()
+	if err != nil {
+		return false, err
+	}
+	tempPath := temp.Name()
+	temp.Close()
+
+	linked := false
+	if err := os.Remove(tempPath); err == nil && os.Link(filePath, tempPath) == nil {
+		linked = true
+	} else if err := copyFile(filePath, tempPath); err != nil {
+		os.Remove(tempPath)
+		return false, err
+	}
+	return linked, putter.PutFile(cacheKey, tempPath, lastModified)
+}
+
+func putFileCopied(cache storage.Cache, cacheKey, filePath string, size int64, lastModified time.Time) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return cache.Put(cacheKey, file, size, lastModified)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+const (
+	// latencySamples is the size of the rolling window kept per origin.
+	latencySamples = 100
+	// minLatencySamples is how many samples an origin needs before its
+	// timeout adapts; until then the static client timeout applies.
+	minLatencySamples = 10
+)
+
+// originLatency keeps the most recent time-to-headers samples of one origin.
+type originLatency struct {
+	mu      sync.Mutex
+	samples [latencySamples]time.Duration
+	next    int
+	count   int
+}
+
+func (o *originLatency) record(d time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.samples[o.next] = d
+	o.next = (o.next + 1) % latencySamples
+	if o.count < latencySamples {
+		o.count++
+	}
+}
+
+// p95 returns the 95th percentile of the window, or false while there are
+// too few samples for a meaningful estimate.
+func (o *originLatency) p95() (time.Duration, bool) {
+	o.mu.Lock()
+	if o.count < minLatencySamples {
+		o.mu.Unlock()
+		return 0, false
+	}
+	sorted := make([]time.Duration, o.count)
+	copy(sorted, o.samples[:o.count])
+	o.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)*95-1)/100], true
+}
+
+var originLatencies = struct {
+	sync.Mutex
+	origins map[string]*originLatency
+}{origins: make(map[string]*originLatency)}
+
+func latencyFor(origin string) *originLatency {
+	originLatencies.Lock()
+	defer originLatencies.Unlock()
+
+	latency, exists := originLatencies.origins[origin]
+	if !exists {
+		latency = &originLatency{}
+		originLatencies.origins[origin] = latency
+	}
+	return latency
+}
+
+// adaptiveTimeout derives how long to wait for response headers from the
+// origin's observed latency, bounded by the configured minimum and maximum.
+func adaptiveTimeout(config ServerConfig, origin string) (time.Duration, bool) {
+	p95, ok := latencyFor(origin).p95()
+	if !ok {
+		return 0, false
+	}
+
+	timeout := time.Duration(float64(p95) * config.AdaptiveTimeoutFactor)
+	if timeout < config.AdaptiveTimeoutMin {
+		timeout = config.AdaptiveTimeoutMin
+	}
+	if config.AdaptiveTimeoutMax > 0 && timeout > config.AdaptiveTimeoutMax {
+		timeout = config.AdaptiveTimeoutMax
+	}
+	return timeout, true
+}
+
+// cancelOnClose releases the request context once the body has been read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// doUpstream sends an upstream request like doOrigin. If the request goes to
+// one of a repository's origins and fails, or is answered with a server
+// error, it is sent to the other origins in turn, in their preferred order,
+// until one answers. Requests with a body are sent only once.
+func doUpstream(config ServerConfig, client *http.Client, req *http.Request) (*http.Response, error) {
+	var alternates []string
+	if req.Body == nil || req.Body == http.NoBody {
+		alternates = config.Origins.failover(req.URL.String())
+	}
+	resp, err := doOrigin(config, client, req)
+	for _, alternate := range alternates {
+		if err == nil && resp.StatusCode < http.StatusInternalServerError || req.Context().Err() != nil {
+			break
+		}
+		target, parseErr := url.Parse(alternate)
+		if parseErr != nil {
+			break
+		}
+		if err != nil {
+			logging.Warning("Origins: Fetching %s failed, trying %s: %v", req.URL, alternate, err)
+		} else {
+			logging.Warning("Origins: %s answered %d, trying %s", req.URL, resp.StatusCode, alternate)
+			resp.Body.Close()
+		}
+		next := req.Clone(req.Context())
+		next.URL = target
+		next.Host = ""
+		resp, err = doOrigin(config, client, next)
+	}
+	return resp, err
+}
+
+// doOrigin sends an upstream request and records how long the origin took
+// to answer with headers. With adaptive timeouts enabled, the request is
+// abandoned if the headers take longer than the origin's recent latency
+// suggests. The deadline covers only the headers, so large bodies are never
+// cut short by it. With a minimum throughput set, the body is abandoned
+// instead if it arrives more slowly than that.
+func doOrigin(config ServerConfig, client *http.Client, req *http.Request) (*http.Response, error) {
+	requested := req.URL
+	if target := stickyTarget(config, req.URL); target != nil {
+		req.URL = target
+		req.Host = ""
+	}
+	origin := req.URL.Host
+	// A failed attempt still counts as a miss, so an origin outage shows in
+	// the hit ratios.
+	if account := byteAccountFrom(req.Context()); account != nil {
+		account.attempted.Store(true)
+	}
+	if err := admitToRateLimitedOrigin(config, origin); err != nil {
+		return nil, err
+	}
+	if config.OriginHost != "" && isPrimaryOrigin(config, req.URL) {
+		// Connect to the URL's address but present the configured virtual host.
+		req.Host = config.OriginHost
+	}
+
+	ctx, fetchSpan := startSpan(req.Context(), "origin fetch", spanKindClient)
+	if fetchSpan != nil {
+		req = req.WithContext(ctx)
+		fetchSpan.set("http.request.method", req.Method)
+		fetchSpan.set("server.address", origin)
+		fetchSpan.set("url.path", req.URL.Path)
+	}
+	propagateTraceContext(req, fetchSpan)
+
+	live := !isPrefetch(req.Context())
+	if live {
+		prefetchControl.liveFetches.Add(1)
+	} else {
+		waitForPrefetchTurn(req.Context())
+	}
+	start := time.Now()
+
+	if !config.AdaptiveTimeout && config.MinThroughput <= 0 {
+		resp, err := client.Do(req)
+		if limitErr := observeRateLimit(config, origin, resp, err); limitErr != nil {
+			resp.Body.Close()
+			resp, err = nil, limitErr
+		}
+		if err != nil {
+			if live {
+				prefetchControl.liveFetches.Add(-1)
+			}
+			fetchSpan.fail(err)
+			fetchSpan.finish()
+			return nil, err
+		}
+		latencyFor(origin).record(time.Since(start))
+		if resp.StatusCode < http.StatusInternalServerError {
+			recordOriginSuccess()
+		}
+		fetchSpan.set("http.response.status_code", resp.StatusCode)
+		recordStickyRedirect(config, requested, resp)
+		resp.Body = newOriginBody(req.Context(), resp.Body, live, fetchSpan)
+		return resp, nil
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	if config.AdaptiveTimeout {
+		if timeout, ok := adaptiveTimeout(config, origin); ok {
+			timer := time.AfterFunc(timeout, func() {
+				logging.Warning("Upstream %s did not answer within the adaptive timeout of %v", origin, timeout)
+				cancel()
+			})
+			defer timer.Stop()
+		}
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if limitErr := observeRateLimit(config, origin, resp, err); limitErr != nil {
+		resp.Body.Close()
+		resp, err = nil, limitErr
+	}
+	if err != nil {
+		cancel()
+		if live {
+			prefetchControl.liveFetches.Add(-1)
+		}
+		fetchSpan.fail(err)
+		fetchSpan.finish()
+		return nil, err
+	}
+	latencyFor(origin).record(time.Since(start))
+	if resp.StatusCode < http.StatusInternalServerError {
+		recordOriginSuccess()
+	}
+	fetchSpan.set("http.response.status_code", resp.StatusCode)
+	recordStickyRedirect(config, requested, resp)
+	// The throughput is measured below the origin body, so its prefetch
+	// yielding and bandwidth limit do not count against the origin.
+	body := resp.Body
+	if config.MinThroughput > 0 {
+		body = newThroughputBody(body, origin, resp.ContentLength, config.MinThroughput, cancel)
+	}
+	body = newOriginBody(req.Context(), body, live, fetchSpan)
+	resp.Body = &cancelOnClose{ReadCloser: body, cancel: cancel}
+	return resp, nil
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// localOrigin serves a repository straight from a local directory, such as
+// one published by reprepro or aptly. Nothing is cached since the files are
+// already on disk: Last-Modified and the size come from the file, and
+// http.ServeContent answers conditional and range requests.
+type localOrigin struct {
+	root string
+}
+
+// NewLocalOriginHandler returns a handler serving the repository in root.
+// It warns when root has no dists directory, since apt clients would find
+// nothing to install from it.
+func NewLocalOriginHandler(root string) http.Handler {
+	if info, err := os.Stat(filepath.Join(root, "dists")); err != nil || !info.IsDir() {
+		logging.Warning("Local repository %s has no dists directory, it does not look like an apt repository", root)
+	}
+	return &localOrigin{root: root}
+}
+
+func (o *localOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Cleaning the rooted path keeps requests inside the repository.
+	name := path.Clean("/" + r.URL.Path)
+	file, err := os.Open(filepath.Join(o.root, filepath.FromSlash(name)))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Error("Local repository: Failed to open %s: %v", name, err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	contentType, ok := utils.LookupContentType(name)
+	if !ok {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, path.Base(name), info.ModTime(), file)
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// cacheManifest lists the path globs a curated mirror caches. Everything
+// else is passed through without being stored.
+type cacheManifest struct {
+	path     string
+	patterns []string
+	loaded   time.Time
+}
+
+// manifest is the active manifest, nil when none is configured.
+var manifest atomic.Pointer[cacheManifest]
+
+// readManifest parses a manifest file: one glob per line, relative to the
+// repository like the allowlist. Blank lines and lines starting with # are
+// ignored.
+func readManifest(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.TrimPrefix(line, "/"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// LoadManifest reads the manifest at path and makes it the one deciding what
+// is cached. An empty path removes the manifest. On error the previous
+// manifest stays in effect.
+func LoadManifest(path string) error {
+	if path == "" {
+		manifest.Store(nil)
+		return nil
+	}
+
+	patterns, err := readManifest(path)
+	if err != nil {
+		return fmt.Errorf("failed to load manifest %s: %w", path, err)
+	}
+	manifest.Store(&cacheManifest{path: path, patterns: patterns, loaded: time.Now()})
+	logging.Info("Loaded manifest %s with %d patterns", path, len(patterns))
+	return nil
+}
+
+// ReloadManifest reads the active manifest's file again. It does nothing
+// when no manifest is configured.
+func ReloadManifest() error {
+	current := manifest.Load()
+	if current == nil {
+		return nil
+	}
+	return LoadManifest(current.path)
+}
+
+// inManifest reports whether the remote path may be cached under the
+// manifest. Without a manifest every path may.
+func inManifest(remotePath string) bool {
+	current := manifest.Load()
+	if current == nil {
+		return true
+	}
+	return utils.MatchAnyPathPattern(current.patterns, remotePath)
+}
+
+type manifestStatus struct {
+	Path     string `json:"path"`
+	Patterns int    `json:"patterns"`
+	Loaded   string `json:"loaded"`
+}
+
+// HandleManifest shows the active manifest on GET /admin/manifest and reloads
+// it from disk on POST /admin/manifest/reload.
+func HandleManifest(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/manifest"), "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+	case action == "reload" && r.Method == http.MethodPost:
+		if manifest.Load() == nil {
+			http.Error(w, "No manifest configured", http.StatusNotFound)
+			return
+		}
+		if err := ReloadManifest(); err != nil {
+			logging.Error("Manifest reload failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case action == "reload" || action == "":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	current := manifest.Load()
+	if current == nil {
+		writeJSON(w, http.StatusOK, nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, manifestStatus{
+		Path:     current.path,
+		Patterns: len(current.patterns),
+		Loaded:   current.loaded.UTC().Format(time.RFC3339),
+	})
+}
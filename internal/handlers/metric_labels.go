@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/config"
+)
+
+// maxLabelSeries bounds the label combinations counted. Requests with further
+// combinations are counted with every label "other".
+const maxLabelSeries = 1024
+
+// maxLabelValueLength bounds a label value derived from a path.
+const maxLabelValueLength = 64
+
+const (
+	labelNone  = "none"  // No rule of the label matched
+	labelOther = "other" // The label or the series ran out of values
+)
+
+type labelRule struct {
+	pattern *regexp.Regexp
+	value   string
+}
+
+type labelCounters struct {
+	requests    atomic.Int64
+	hits        atomic.Int64 // Served from the cache, revalidated or not
+	clientBytes atomic.Int64
+	originBytes atomic.Int64
+}
+
+// metricLabeler counts requests by the labels its rules derive from their
+// paths.
+type metricLabeler struct {
+	names     []string // Label names in the order they are written
+	rules     map[string][]labelRule
+	maxValues int
+
+	mu     sync.RWMutex
+	values map[string]map[string]bool // Values seen per label
+	series map[string]*labelCounters  // By the values joined with "\x00"
+}
+
+// metricLabels is the active labeler, nil when metric labels are off.
+var metricLabels atomic.Pointer[metricLabeler]
+
+func newMetricLabeler(cfg config.MetricLabelConfig) *metricLabeler {
+	l := &metricLabeler{
+		rules:     make(map[string][]labelRule),
+		maxValues: cfg.MaxValues,
+		values:    make(map[string]map[string]bool),
+		series:    make(map[string]*labelCounters),
+	}
+	if l.maxValues == 0 {
+		l.maxValues = config.DefaultMetricLabelMaxValues
+	}
+	for _, rule := range cfg.Rules {
+		if _, ok := l.rules[rule.Label]; !ok {
+			l.names = append(l.names, rule.Label)
+			l.values[rule.Label] = make(map[string]bool)
+		}
+		// The configuration has been validated.
+		l.rules[rule.Label] = append(l.rules[rule.Label], labelRule{pattern: regexp.MustCompile(rule.Pattern), value: rule.Value})
+	}
+	return l
+}
+
+// labelValue derives the value of a label from a request path.
+func (l *metricLabeler) labelValue(name, path string) string {
+	for _, rule := range l.rules[name] {
+		match := rule.pattern.FindStringSubmatchIndex(path)
+		if match == nil {
+			continue
+		}
+		value := string(rule.pattern.ExpandString(nil, rule.value, path, match))
+		return sanitizeLabelValue(value)
+	}
+	return labelNone
+}
+
+// sanitizeLabelValue keeps letters, digits and . _ - of a label value derived
+// from a path, so it never needs escaping.
+func sanitizeLabelValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, value)
+	if len(value) > maxLabelValueLength {
+		value = value[:maxLabelValueLength]
+	}
+	if value == "" {
+		return labelNone
+	}
+	return value
+}
+
+// countersFor returns the counters of the series a path falls in, admitting
+// new label values and series while their bounds allow.
+func (l *metricLabeler) countersFor(path string) *labelCounters {
+	values := make([]string, len(l.names))
+	for i, name := range l.names {
+		values[i] = l.labelValue(name, path)
+	}
+	key := strings.Join(values, "\x00")
+
+	l.mu.RLock()
+	counters, ok := l.series[key]
+	l.mu.RUnlock()
+	if ok {
+		return counters
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, name := range l.names {
+		seen := l.values[name]
+		if !seen[values[i]] {
+			if len(seen) >= l.maxValues {
+				values[i] = labelOther
+				continue
+			}
+			seen[values[i]] = true
+		}
+	}
+	key = strings.Join(values, "\x00")
+	if counters, ok := l.series[key]; ok {
+		return counters
+	}
+	if len(l.series) >= maxLabelSeries {
+		for i := range values {
+			values[i] = labelOther
+		}
+		key = strings.Join(values, "\x00")
+		if counters, ok := l.series[key]; ok {
+			return counters
+		}
+	}
+	counters = &labelCounters{}
+	l.series[key] = counters
+	return counters
+}
+
+// NewMetricLabelsMiddleware counts each request, whether it was served from
+// the cache and the bytes it moved, by the labels the configured rules derive
+// from its path. It relies on the byte account attached by
+// ByteAccountingMiddleware.
+func NewMetricLabelsMiddleware(next http.Handler, cfg config.MetricLabelConfig) http.Handler {
+	labeler := newMetricLabeler(cfg)
+	metricLabels.Store(labeler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		account := byteAccountFrom(r.Context())
+		if account == nil {
+			return
+		}
+		counters := labeler.countersFor(r.URL.Path)
+		counters.requests.Add(1)
+		if outcome := account.outcome(); outcome == "hit" || outcome == "revalidated" {
+			counters.hits.Add(1)
+		}
+		counters.clientBytes.Add(account.client.Load())
+		counters.originBytes.Add(account.origin.Load())
+	})
+}
+
+// writeLabeledMetrics writes the per-label request counters, one series per
+// label combination seen, ordered so the output is stable.
+func writeLabeledMetrics(w io.Writer) {
+	l := metricLabels.Load()
+	if l == nil {
+		return
+	}
+	l.mu.RLock()
+	keys := make([]string, 0, len(l.series))
+	series := make(map[string]*labelCounters, len(l.series))
+	for key, counters := range l.series {
+		keys = append(keys, key)
+		series[key] = counters
+	}
+	l.mu.RUnlock()
+	sort.Strings(keys)
+
+	metrics := []struct {
+		name, help string
+		value      func(*labelCounters) int64
+	}{
+		{"labeled_requests_total", "Requests by the labels derived from their path.",
+			func(c *labelCounters) int64 { return c.requests.Load() }},
+		{"labeled_hits_total", "Requests served from the cache, revalidated or not, by the labels derived from their path.",
+			func(c *labelCounters) int64 { return c.hits.Load() }},
+		{"labeled_client_bytes_total", "Bytes of response bodies sent to clients by the labels derived from their path.",
+			func(c *labelCounters) int64 { return c.clientBytes.Load() }},
+		{"labeled_origin_bytes_total", "Bytes of response bodies read from origins by the labels derived from their path.",
+			func(c *labelCounters) int64 { return c.originBytes.Load() }},
+	}
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s%s %s\n", metricsPrefix, metric.name, metric.help)
+		fmt.Fprintf(w, "# TYPE %s%s counter\n", metricsPrefix, metric.name)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s{%s} %d\n", metricsPrefix, metric.name, l.labelPairs(key), metric.value(series[key]))
+		}
+	}
+}
+
+// labelPairs formats the label values of a series key as name="value" pairs.
+func (l *metricLabeler) labelPairs(key string) string {
+	values := strings.Split(key, "\x00")
+	pairs := make([]string, len(l.names))
+	for i, name := range l.names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, values[i])
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const metricsPrefix = "go_apt_cache_"
+
+// singleFlightStats counts how requests for the same path were collapsed by
+// acquireLock.
+var singleFlightStats struct {
+	leaders   atomic.Int64 // Requests that fetched from upstream on behalf of others
+	waiters   atomic.Int64 // Requests that waited for a leader
+	waitNanos atomic.Int64 // Total time waiters spent waiting
+	refetches atomic.Int64 // Waiters that fetched themselves because the leader did not cache
+	shed      atomic.Int64 // Waiters turned away by the waiter cap
+}
+
+func recordLeader() {
+	singleFlightStats.leaders.Add(1)
+}
+
+func recordWaiter(waited time.Duration) {
+	singleFlightStats.waiters.Add(1)
+	singleFlightStats.waitNanos.Add(int64(waited))
+}
+
+func recordWaiterRefetch() {
+	singleFlightStats.refetches.Add(1)
+}
+
+func recordWaiterShed() {
+	singleFlightStats.shed.Add(1)
+}
+
+type singleFlightSnapshot struct {
+	Leaders            int64   `json:"leaders"`
+	Waiters            int64   `json:"waiters"`
+	AverageWaitSeconds float64 `json:"averageWaitSeconds"`
+	Refetches          int64   `json:"refetches"`
+	Shed               int64   `json:"shed"`
+}
+
+func snapshotSingleFlight() singleFlightSnapshot {
+	snapshot := singleFlightSnapshot{
+		Leaders:   singleFlightStats.leaders.Load(),
+		Waiters:   singleFlightStats.waiters.Load(),
+		Refetches: singleFlightStats.refetches.Load(),
+		Shed:      singleFlightStats.shed.Load(),
+	}
+	if snapshot.Waiters > 0 {
+		waited := time.Duration(singleFlightStats.waitNanos.Load())
+		snapshot.AverageWaitSeconds = waited.Seconds() / float64(snapshot.Waiters)
+	}
+	return snapshot
+}
+
+// HandleSingleFlightStats reports how effectively concurrent requests for the
+// same path are collapsed into one upstream fetch.
+func HandleSingleFlightStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, snapshotSingleFlight())
+}
+
+// HandleMetrics exposes the server's counters in the Prometheus text format.
+func HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeMetric(w, "singleflight_leaders_total", "counter",
+		"Requests that fetched a path from upstream on behalf of concurrent requests.",
+		singleFlightStats.leaders.Load())
+	writeMetric(w, "singleflight_waiters_total", "counter",
+		"Requests that waited for a concurrent fetch of the same path.",
+		singleFlightStats.waiters.Load())
+	writeMetric(w, "singleflight_wait_seconds_total", "counter",
+		"Total time requests spent waiting for a concurrent fetch.",
+		time.Duration(singleFlightStats.waitNanos.Load()).Seconds())
+	writeMetric(w, "singleflight_refetches_total", "counter",
+		"Waiters that fetched from upstream themselves because the leader did not cache the file.",
+		singleFlightStats.refetches.Load())
+	writeMetric(w, "singleflight_shed_total", "counter",
+		"Waiters rejected because too many requests were already waiting.",
+		singleFlightStats.shed.Load())
+	var shed int64
+	if c := overload.Load(); c != nil {
+		shed = c.shed.Load()
+	}
+	writeMetric(w, "overload_shed_total", "counter",
+		"Requests rejected by the overload controller.",
+		shed)
+	writeMetric(w, "retries_suppressed_total", "counter",
+		"Refetches refused because the retry budget was exhausted.",
+		retriesSuppressed())
+	writeMetric(w, "trace_spans_dropped_total", "counter",
+		"Spans dropped because the export queue was full or the collector failed.",
+		spansDropped())
+	writeMetric(w, "captive_portal_rejections_total", "counter",
+		"Origin responses rejected because they were HTML pages in place of apt files.",
+		captivePortalRejections.Load())
+	writeMetric(w, "clock_skew_clamps_total", "counter",
+		"Origin Last-Modified times clamped because they lay too far ahead of the local clock.",
+		clockSkewClamps.Load())
+	writeMetric(w, "index_checksum_failures_total", "counter",
+		"Fetched indexes rejected for not matching, or lacking a strong enough, checksum in their Release.",
+		checksumFailures.Load())
+	queued, busy, dropped := backgroundStats()
+	writeMetric(w, "background_queue_depth", "gauge",
+		"Background tasks waiting for a worker.",
+		queued)
+	writeMetric(w, "background_workers_busy", "gauge",
+		"Background workers running a task.",
+		busy)
+	writeMetric(w, "background_tasks_dropped_total", "counter",
+		"Background tasks dropped because the queue was full.",
+		dropped)
+	writeMetric(w, "origin_rate_limited_total", "counter",
+		"Origin responses with status 429 Too Many Requests.",
+		rateLimitedResponses.Load())
+	writeMetric(w, "resumed_downloads_total", "counter",
+		"Range requests that continued a download after the origin broke it off.",
+		resumedDownloads.Load())
+	if ratio, requests, window := WindowedHitRatio(); window > 0 {
+		writeMetric(w, "window_requests", "gauge",
+			fmt.Sprintf("Repository requests in the last %v.", window),
+			requests)
+		if requests > 0 {
+			writeMetric(w, "window_hit_ratio", "gauge",
+				fmt.Sprintf("Share of the repository requests in the last %v served from the cache, revalidated or not.", window),
+				ratio)
+		}
+	}
+	deleted, reclaimed, _ := PoolGCStats()
+	writeMetric(w, "pool_gc_deleted_total", "counter",
+		"Cached pool files removed because no cached index referenced them.",
+		deleted)
+	writeMetric(w, "pool_gc_reclaimed_bytes_total", "counter",
+		"Bytes freed by removing unreferenced pool files.",
+		reclaimed)
+	writeMetric(w, "buffered_bytes", "gauge",
+		"Bytes reserved by cache misses buffering their response in memory.",
+		inflightBuffers.inUse())
+	writeMetric(w, "buffer_budget_shed_total", "counter",
+		"Package fetches rejected because the buffer budget was exhausted.",
+		inflightBuffers.shed.Load())
+	writeMetric(w, "cache_admissions_total", "counter",
+		"Fetched pool files the admission policy let into the cache.",
+		admissionStats.admitted.Load())
+	writeMetric(w, "cache_admission_rejections_total", "counter",
+		"Fetched pool files the admission policy served without caching.",
+		admissionStats.rejected.Load())
+	var passThrough int
+	if _, ok := CachePassThroughSince(); ok {
+		passThrough = 1
+	}
+	writeMetric(w, "cache_passthrough", "gauge",
+		"Whether cache misses are proxied without caching because the cache disk is full.",
+		passThrough)
+	writeMetric(w, "cache_disk_full_total", "counter",
+		"Times the cache switched to pass-through because its disk was full.",
+		diskFull.events.Load())
+	writeMetric(w, "client_bytes_total", "counter",
+		"Bytes of response bodies sent to clients.",
+		byteStats.client.Load())
+	writeMetric(w, "origin_bytes_total", "counter",
+		"Bytes of response bodies read from upstream origins.",
+		byteStats.origin.Load())
+	writeLabeledMetrics(w)
+}
+
+func writeMetric(w io.Writer, name, metricType, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n", metricsPrefix, name, help)
+	fmt.Fprintf(w, "# TYPE %s%s %s\n", metricsPrefix, name, metricType)
+	fmt.Fprintf(w, "%s%s %v\n", metricsPrefix, name, value)
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"net"
 	"net/http"
 	"strings"
@@ -41,11 +42,22 @@ func (lm *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		statusCode:     http.StatusOK,
 	}
 
+	r, account := withByteAccount(r)
 	lm.next.ServeHTTP(lrw, r)
 
 	duration := time.Since(start)
 	now := time.Now().Format("2006-01-02 15:04:05")
-	logging.Info("%s %s %s %s %d %d %s",
+	fields := logging.Fields{
+		"remote":       r.RemoteAddr,
+		"method":       r.Method,
+		"path":         r.URL.Path,
+		"status":       lrw.statusCode,
+		"cache":        account.cacheStatus(),
+		"bytes":        lrw.bytesWritten,
+		"origin_bytes": account.origin.Load(),
+		"duration_ms":  duration.Milliseconds(),
+	}
+	logging.InfoFields(fields, "%s %s %s %s %d %d %s origin=%d",
 		now,
 		r.RemoteAddr,
 		r.Method,
@@ -53,6 +65,7 @@ func (lm *LoggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		lrw.statusCode,
 		lrw.bytesWritten,
 		duration,
+		account.origin.Load(),
 	)
 }
 
@@ -73,6 +86,11 @@ func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
+
 type ReverseProxyMiddleware struct {
 	next   http.Handler
 	config *config.Config
@@ -106,6 +124,70 @@ func (m *ReverseProxyMiddleware) GetConfig() *config.Config {
 	return m.config
 }
 
+// AdminAuthMiddleware requires the configured bearer token or basic auth
+// credentials on admin routes. Requests without credentials get 401, requests
+// with wrong ones 403.
+type AdminAuthMiddleware struct {
+	next   http.Handler
+	config config.AdminConfig
+}
+
+func NewAdminAuthMiddleware(next http.Handler, cfg config.AdminConfig) http.Handler {
+	return &AdminAuthMiddleware{
+		next:   next,
+		config: cfg,
+	}
+}
+
+func (m *AdminAuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.config.Token == "" && m.config.Username == "" {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		if m.config.Username != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="go-apt-cache admin"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-apt-cache admin"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !m.authorized(r, authorization) {
+		logging.Warning("Rejected admin request from %s to %s", r.RemoteAddr, r.URL.Path)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	m.next.ServeHTTP(w, r)
+}
+
+func (m *AdminAuthMiddleware) authorized(r *http.Request, authorization string) bool {
+	if m.config.Token != "" {
+		if token, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+			return secureEqual(token, m.config.Token)
+		}
+	}
+
+	if m.config.Username != "" {
+		if username, password, ok := r.BasicAuth(); ok {
+			// Evaluate both comparisons so timing does not reveal which failed.
+			userOK := secureEqual(username, m.config.Username)
+			passwordOK := secureEqual(password, m.config.Password)
+			return userOK && passwordOK
+		}
+	}
+
+	return false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
 func CreateMiddlewareChain(cfg *config.Config) MiddlewareChain {
 	var middlewares []Middleware
 
@@ -113,9 +195,37 @@ func CreateMiddlewareChain(cfg *config.Config) MiddlewareChain {
 		return NewReverseProxyMiddleware(next, cfg)
 	})
 
+	middlewares = append(middlewares, NewByteAccountingMiddleware)
+
+	if cfg.Server.Tenants.Enabled() {
+		middlewares = append(middlewares, func(next http.Handler) http.Handler {
+			return NewTenantMiddleware(next, cfg.Server.Tenants)
+		})
+	}
+
+	if cfg.Server.SuiteStats {
+		middlewares = append(middlewares, NewSuiteStatsMiddleware)
+	}
+
+	if cfg.Server.MetricLabels.Enabled() {
+		middlewares = append(middlewares, func(next http.Handler) http.Handler {
+			return NewMetricLabelsMiddleware(next, cfg.Server.MetricLabels)
+		})
+	}
+
+	if cfg.Server.Tracing.Endpoint != "" {
+		middlewares = append(middlewares, NewTracingMiddleware)
+	}
+
 	if cfg.Server.LogRequests {
 		middlewares = append(middlewares, NewLoggingMiddleware)
 	}
 
+	if cfg.Server.Overload.Enabled() {
+		middlewares = append(middlewares, func(next http.Handler) http.Handler {
+			return NewOverloadMiddleware(next, cfg.Server.Overload)
+		})
+	}
+
 	return Chain(middlewares...)
 }
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// negativeSweepThreshold is the number of entries above which expired ones
+// are purged when a new one is added.
+const negativeSweepThreshold = 10000
+
+type negativeEntry struct {
+	status int
+	until  time.Time
+}
+
+// negativeCache remembers error responses from the origin so that repeated
+// requests for missing files are answered without contacting it.
+var negativeCache = struct {
+	sync.Mutex
+	entries map[string]negativeEntry
+}{entries: make(map[string]negativeEntry)}
+
+// negativeTTL returns how long an upstream error for the path should be
+// remembered according to the first matching rule. Rules without a status
+// apply to 404.
+func negativeTTL(config ServerConfig, remotePath string, status int) (time.Duration, bool) {
+	for _, rule := range config.NegativeCacheRules {
+		ruleStatus := rule.Status
+		if ruleStatus == 0 {
+			ruleStatus = http.StatusNotFound
+		}
+		if ruleStatus != status || !utils.MatchPathPattern(rule.Path, remotePath) {
+			continue
+		}
+		if rule.TTL <= 0 {
+			return 0, false
+		}
+		return time.Duration(rule.TTL) * time.Second, true
+	}
+	return 0, false
+}
+
+func rememberNegative(cacheKey string, status int, ttl time.Duration) {
+	negativeCache.Lock()
+	defer negativeCache.Unlock()
+
+	now := time.Now()
+	if len(negativeCache.entries) >= negativeSweepThreshold {
+		for key, entry := range negativeCache.entries {
+			if now.After(entry.until) {
+				delete(negativeCache.entries, key)
+			}
+		}
+	}
+	negativeCache.entries[cacheKey] = negativeEntry{status: status, until: now.Add(ttl)}
+}
+
+// lookupNegative returns the remembered upstream status for the cache key,
+// if it has not expired yet.
+func lookupNegative(cacheKey string) (int, bool) {
+	negativeCache.Lock()
+	defer negativeCache.Unlock()
+
+	entry, exists := negativeCache.entries[cacheKey]
+	if !exists {
+		return 0, false
+	}
+	if time.Now().After(entry.until) {
+		delete(negativeCache.entries, cacheKey)
+		return 0, false
+	}
+	return entry.status, true
+}
+
+func forgetNegative(cacheKey string) {
+	negativeCache.Lock()
+	defer negativeCache.Unlock()
+
+	delete(negativeCache.entries, cacheKey)
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/config"
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// Orders in which a repository's origins are preferred.
+const (
+	OriginOrderStatic  = "static"  // Configuration order, the repository URL first
+	OriginOrderLatency = "latency" // Lowest measured latency first
+)
+
+// originProbeTimeout bounds a single probe; an origin that does not answer
+// within it counts as down.
+const originProbeTimeout = 10 * time.Second
+
+// originSet is a repository's URL together with mirrors serving the same
+// content. Each origin is probed periodically, and fetches go to the first
+// healthy origin in the configured order: configuration order, or ascending
+// smoothed probe latency. A fetch that fails moves on to the next origin in
+// that order.
+type originSet struct {
+	order string
+
+	mu       sync.RWMutex
+	origins  []probedOrigin
+	selected string
+}
+
+type probedOrigin struct {
+	url     string // With a trailing slash
+	healthy bool
+	probed  bool
+	latency time.Duration // Exponentially smoothed time to response headers
+}
+
+// buildOriginSet combines the repository URL with its mirrors. Mirrors with
+// an invalid URL, which config validation rejects, are skipped.
+func buildOriginSet(upstreamURL string, repo config.Repository, globalConfig *config.Config) *originSet {
+	urls := []string{upstreamURL}
+	for _, mirror := range repo.Mirrors {
+		mirrorURL, err := utils.NormalizeOriginURL(mirror, globalConfig.Server.DefaultOriginScheme, globalConfig.Server.DefaultOriginPort)
+		if err != nil {
+			logging.Error("Skipping mirror %s of %s: %v", mirror, repo.Path, err)
+			continue
+		}
+		urls = append(urls, mirrorURL+"/")
+	}
+	return newOriginSet(urls, repo.OriginOrder)
+}
+
+func originProbeInterval(globalConfig *config.Config) time.Duration {
+	if globalConfig.Server.OriginProbeInterval <= 0 {
+		return config.DefaultOriginProbeInterval * time.Second
+	}
+	return time.Duration(globalConfig.Server.OriginProbeInterval) * time.Second
+}
+
+func newOriginSet(urls []string, order string) *originSet {
+	s := &originSet{order: order, selected: urls[0]}
+	for _, u := range urls {
+		// Until probed, every origin is presumed healthy.
+		s.origins = append(s.origins, probedOrigin{url: u, healthy: true})
+	}
+	return s
+}
+
+// base returns the URL of the origin to fetch from, or fallback without a set.
+func (s *originSet) base(fallback string) string {
+	if s == nil {
+		return fallback
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.selected
+}
+
+// probe sends a HEAD request for the repository root to every origin and
+// selects the origin to use from the results. Any answer below 500 counts as
+// healthy, since mirrors differ in whether they allow directory listings.
+func (s *originSet) probe(config ServerConfig) {
+	client := getClient(config)
+	results := make([]probedOrigin, len(s.origins))
+
+	var wg sync.WaitGroup
+	for i := range s.origins {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.mu.RLock()
+			origin := s.origins[i]
+			s.mu.RUnlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), originProbeTimeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, origin.url, nil)
+			if err != nil {
+				results[i] = origin
+				results[i].healthy = false
+				return
+			}
+			req.Header.Set("User-Agent", defaultUserAgent)
+
+			start := time.Now()
+			resp, err := client.Do(req)
+			elapsed := time.Since(start)
+			if err == nil {
+				resp.Body.Close()
+			}
+			results[i] = origin.withProbe(elapsed, err == nil && resp.StatusCode < http.StatusInternalServerError)
+		}(i)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.origins = results
+	if selected := s.choose(); selected != s.selected {
+		logging.Info("Origins: Switching from %s to %s", s.selected, selected)
+		s.selected = selected
+	}
+}
+
+// withProbe folds a probe result into the origin's state.
+func (o probedOrigin) withProbe(latency time.Duration, healthy bool) probedOrigin {
+	o.healthy = healthy
+	if !healthy {
+		return o
+	}
+	if o.probed {
+		// Weigh the new sample at a quarter so a single slow probe does
+		// not reorder the origins.
+		o.latency = (3*o.latency + latency) / 4
+	} else {
+		o.latency = latency
+	}
+	o.probed = true
+	return o
+}
+
+// choose returns the preferred healthy origin, or the repository URL when
+// none is healthy. The caller must hold s.mu.
+func (s *originSet) choose() string {
+	return s.ordered()[0]
+}
+
+// ordered returns the origin URLs in the order they are preferred in: the
+// healthy ones first, in configuration order or, by latency, the probed ones
+// fastest first, then the rest in configuration order. The caller must hold
+// s.mu.
+func (s *originSet) ordered() []string {
+	origins := make([]probedOrigin, len(s.origins))
+	copy(origins, s.origins)
+	sort.SliceStable(origins, func(i, j int) bool {
+		a, b := origins[i], origins[j]
+		if a.healthy != b.healthy {
+			return a.healthy
+		}
+		if !a.healthy || s.order != OriginOrderLatency {
+			return false
+		}
+		if a.probed != b.probed {
+			return a.probed
+		}
+		return a.latency < b.latency
+	})
+	urls := make([]string, len(origins))
+	for i, origin := range origins {
+		urls[i] = origin.url
+	}
+	return urls
+}
+
+// failover returns the URLs to try, in turn, after fetching rawURL from one
+// of the origins failed: the same path at each origin after that one in the
+// preferred order, then at those before it. It returns nil if rawURL belongs
+// to no origin of the set.
+func (s *originSet) failover(rawURL string) []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	urls := s.ordered()
+	s.mu.RUnlock()
+
+	for i, base := range urls {
+		rest, ok := strings.CutPrefix(rawURL, base)
+		if !ok {
+			continue
+		}
+		next := make([]string, 0, len(urls)-1)
+		for _, other := range urls[i+1:] {
+			next = append(next, other+rest)
+		}
+		for _, other := range urls[:i] {
+			next = append(next, other+rest)
+		}
+		return next
+	}
+	return nil
+}
+
+// startOriginProbes probes the origins now and then every interval until
+// stop is closed.
+func startOriginProbes(config ServerConfig, s *originSet, interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		for {
+			s.probe(config)
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/config"
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// overloadController sheds load when the server is saturated. While any
+// limit is reached, requests that need the origin are answered with 503;
+// cache hits and requests joining a fetch already in flight are still
+// served, since they cost little. Only above the hard request limit is every
+// request shed.
+type overloadController struct {
+	limits   config.OverloadConfig
+	requests atomic.Int64
+	shed     atomic.Int64
+}
+
+// overload is the active controller, nil when no limit is configured.
+var overload atomic.Pointer[overloadController]
+
+// overloadExempt lists routes that are never counted or shed, so operators
+// can still look at a saturated server.
+var overloadExempt = []string{"/admin/", "/metrics", "/status"}
+
+func (c *overloadController) saturated() bool {
+	if c.limits.MaxRequests > 0 && c.requests.Load() > int64(c.limits.MaxRequests) {
+		return true
+	}
+	if c.limits.MaxOriginFetches > 0 && prefetchControl.liveFetches.Load() >= int32(c.limits.MaxOriginFetches) {
+		return true
+	}
+	return c.limits.MaxGoroutines > 0 && runtime.NumGoroutine() >= c.limits.MaxGoroutines
+}
+
+func (c *overloadController) reject(w http.ResponseWriter, r *http.Request, reason string) {
+	c.shed.Add(1)
+	logging.Warning("Overloaded, shedding %s: %s", r.URL.Path, reason)
+
+	retryAfter := c.limits.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = waiterRetryAfter
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+}
+
+// shedOriginRequest answers 503 if the server is saturated and the request
+// would start new origin work for cacheKey. It returns true if the request
+// was rejected.
+func shedOriginRequest(w http.ResponseWriter, r *http.Request, cacheKey string) bool {
+	c := overload.Load()
+	if c == nil || !c.saturated() {
+		return false
+	}
+	if cacheKey != "" && isInflight(cacheKey) {
+		return false
+	}
+	c.reject(w, r, "origin request")
+	return true
+}
+
+type OverloadMiddleware struct {
+	next       http.Handler
+	controller *overloadController
+}
+
+// NewOverloadMiddleware installs an overload controller with the given limits
+// and counts the requests passing through it.
+func NewOverloadMiddleware(next http.Handler, limits config.OverloadConfig) http.Handler {
+	controller := &overloadController{limits: limits}
+	overload.Store(controller)
+	return &OverloadMiddleware{next: next, controller: controller}
+}
+
+func (m *OverloadMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, prefix := range overloadExempt {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			m.next.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	requests := m.controller.requests.Add(1)
+	defer m.controller.requests.Add(-1)
+
+	if hard := m.controller.limits.HardMaxRequests; hard > 0 && requests > int64(hard) {
+		m.controller.reject(w, r, "hard request limit")
+		return
+	}
+
+	m.next.ServeHTTP(w, r)
+}
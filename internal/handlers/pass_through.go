@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// maxPassThroughBody bounds the request body proxied for a pass-through
+// request.
+const maxPassThroughBody = 10 << 20
+
+// passThroughHeaders are the request headers forwarded to the origin with a
+// pass-through request, besides the body's length.
+var passThroughHeaders = []string{"Content-Type", "Content-Encoding", "Accept", "Accept-Language"}
+
+// isPassThrough reports whether a request with a method other than GET or
+// HEAD may be proxied to the origin for its path.
+func isPassThrough(config ServerConfig, r *http.Request) bool {
+	remotePath := strings.TrimPrefix(getRemotePath(config, r.URL.Path), "/")
+	for _, rule := range config.PassThrough {
+		if !utils.MatchPathPattern(strings.Trim(rule.Path, "/"), remotePath) {
+			continue
+		}
+		if len(rule.Methods) == 0 {
+			return r.Method == http.MethodPost
+		}
+		for _, method := range rule.Methods {
+			if r.Method == method {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handlePassThrough proxies a request with its method and body to the origin
+// and relays the response without caching either.
+func handlePassThrough(w http.ResponseWriter, r *http.Request, config ServerConfig) {
+	if shedOriginRequest(w, r, "") {
+		return
+	}
+	if r.ContentLength > maxPassThroughBody {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	remotePath := strings.TrimPrefix(getRemotePath(config, r.URL.Path), "/")
+	fullURL := strings.TrimSuffix(upstreamBase(config, remotePath), "/") + "/" + remotePath + upstreamQuery(r)
+	logging.Debug("Pass-through %s request: %s → %s", r.Method, r.URL.Path, fullURL)
+
+	req, err := http.NewRequestWithContext(upstreamContext(r), r.Method, fullURL, http.MaxBytesReader(w, r.Body, maxPassThroughBody))
+	if err != nil {
+		http.Error(w, "Error creating request to upstream", http.StatusInternalServerError)
+		logging.Error("Error creating request to upstream: %v", err)
+		return
+	}
+	req.ContentLength = r.ContentLength
+	req.Header.Set("User-Agent", defaultUserAgent)
+	for _, name := range passThroughHeaders {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	resp, err := doUpstream(config, getClient(config), req)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		upstreamError(w, err)
+		logging.Error("Error in pass-through request to upstream: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	filterAndSetHeaders(w, resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logging.Debug("Pass-through response for %s broke off: %v", r.URL.Path, err)
+	}
+}
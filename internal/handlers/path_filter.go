@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"path"
+	"strings"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// isPathMirrored reports whether a remote path is part of the mirrored subset
+// of the repository. Excluded paths never are. With include rules, a path must
+// match one of them, except that directories, and the Release files directly
+// in a suite directory, are kept as long as an include rule reaches inside
+// them: including "dists/bookworm/main/**" keeps dists/bookworm/InRelease,
+// without which apt cannot use the suite at all.
+func isPathMirrored(config ServerConfig, remotePath string) bool {
+	remotePath = strings.TrimPrefix(remotePath, "/")
+	if utils.MatchAnyPathPattern(config.ExcludePaths, remotePath) {
+		return false
+	}
+	if len(config.IncludePaths) == 0 || utils.MatchAnyPathPattern(config.IncludePaths, remotePath) {
+		return true
+	}
+
+	dir := ""
+	if remotePath == "" || strings.HasSuffix(remotePath, "/") {
+		dir = remotePath
+	} else if suite, ok := utils.SuitePrefix(remotePath); ok && path.Dir(remotePath) == suite {
+		dir = suite
+	} else {
+		return false
+	}
+	for _, pattern := range config.IncludePaths {
+		if utils.MatchPathPatternPrefix(pattern, dir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,426 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// Totals of the pool collections since startup, for /metrics and /status.
+var (
+	poolGCDeleted   atomic.Int64
+	poolGCReclaimed atomic.Int64
+	poolGCLastRun   atomic.Int64 // Unix seconds, zero before the first run
+)
+
+// PoolGCResult summarizes one collection of orphaned pool files.
+type PoolGCResult struct {
+	Archives     int   // Archive roots whose pool was collected
+	Skipped      int   // Archive roots left alone, see CollectOrphanPoolFiles
+	Referenced   int   // Pool paths the cached indexes reference
+	Deleted      int   // Pool files removed
+	Reclaimed    int64 // Bytes removed
+	FailedDelete int
+}
+
+// PoolGCStats returns the pool files removed and the bytes reclaimed by
+// collections since startup, and when the last one ran. The time is zero
+// before the first collection.
+func PoolGCStats() (deleted, reclaimed int64, lastRun time.Time) {
+	if unix := poolGCLastRun.Load(); unix > 0 {
+		lastRun = time.Unix(unix, 0)
+	}
+	return poolGCDeleted.Load(), poolGCReclaimed.Load(), lastRun
+}
+
+// poolIndex is a cached Packages or Sources index.
+type poolIndex struct {
+	key         string
+	sources     bool
+	compression string // Extension, "" for uncompressed
+}
+
+// poolArchive collects what the cache holds of one archive, the tree above
+// its dists and pool directories.
+type poolArchive struct {
+	suites     map[string]bool // Suite directories with cached files
+	indexes    []poolIndex
+	components map[string]bool // Components the suites' indexes belong to
+	covered    map[string]bool // Index directories, such as "main/binary-amd64", see findIndexes
+	pool       []string
+	unsafe     string // Why the pool must not be collected, "" if it may
+}
+
+// CollectOrphanPoolFiles removes cached pool files that none of the cached
+// Packages or Sources indexes of their archive reference any more, such as
+// superseded package versions, once they were fetched longer than grace ago.
+// An archive's pool is only collected when the Release of every suite with
+// cached files is cached and was fetched within maxIndexAge, and every cached
+// index listed in it can be read; otherwise an index that is missing or out
+// of date could make files that are still in use look orphaned. For the same
+// reason a pool file is only removed if every such suite listing an index
+// for its component and architecture, or for sources, has a copy of that
+// index matching its Release cached. Outdated copies still cached keep the
+// files they reference. Indexes the standard library cannot decompress, such
+// as .xz, make their archive be skipped, so collecting needs clients to
+// fetch another variant or canonicalCompression. Files being fetched are
+// never removed.
+func CollectOrphanPoolFiles(cache storage.Cache, headerCache storage.HeaderCache, grace, maxIndexAge time.Duration) (PoolGCResult, error) {
+	var result PoolGCResult
+	lister, ok := cache.(storage.KeyLister)
+	timesLister, timed := cache.(storage.EntryTimesLister)
+	if !ok || !timed {
+		return result, fmt.Errorf("the cache cannot list its entries")
+	}
+	keys, err := lister.Keys()
+	if err != nil {
+		return result, fmt.Errorf("listing cached entries: %w", err)
+	}
+	times := timesLister.EntryTimes()
+	cached := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		cached[key] = true
+	}
+	now := time.Now()
+	defer poolGCLastRun.Store(now.Unix())
+
+	archives := make(map[string]*poolArchive)
+	archive := func(root string) *poolArchive {
+		a := archives[root]
+		if a == nil {
+			a = &poolArchive{suites: make(map[string]bool), components: make(map[string]bool), covered: make(map[string]bool)}
+			archives[root] = a
+		}
+		return a
+	}
+	for _, key := range keys {
+		if root, ok := archiveRoot(key, "/pool/"); ok {
+			archive(root).pool = append(archive(root).pool, key)
+		} else if root, ok := archiveRoot(key, "/dists/"); ok {
+			if suiteDir, ok := utils.SuitePrefix(key); ok {
+				archive(root).suites[suiteDir] = true
+			}
+		}
+	}
+
+	for root, a := range archives {
+		if len(a.pool) == 0 {
+			continue
+		}
+		a.findIndexes(cache, headerCache, times, cached, now, maxIndexAge)
+		referenced := make(map[string]bool)
+		if a.unsafe == "" {
+			for _, index := range a.indexes {
+				if err := collectIndexReferences(cache, index, root, referenced); err != nil {
+					a.unsafe = fmt.Sprintf("cannot read %s: %v", index.key, err)
+					break
+				}
+			}
+		}
+		if a.unsafe != "" {
+			logging.Debug("Pool GC: Skipping %s: %s", archiveName(root), a.unsafe)
+			result.Skipped++
+			continue
+		}
+		result.Archives++
+		result.Referenced += len(referenced)
+
+		for _, key := range a.pool {
+			if referenced[key] || !a.covers(root, key) || isInflight(key) {
+				continue
+			}
+			// A pushed file has no origin to fetch it from again.
+			if headers, err := headerCache.GetHeaders(key); err == nil && isPushed(headers) {
+				continue
+			}
+			fetched, known := entryFetchTime(headerCache, key, times[key])
+			if !known || now.Sub(fetched) < grace {
+				continue
+			}
+			size := cachedSize(cache, key)
+			// A client may have started fetching the file since.
+			if isInflight(key) {
+				continue
+			}
+			// The cache's OnRemove removes the headers.
+			if err := cache.Delete(key); err != nil {
+				logging.Warning("Pool GC: Cannot remove %s: %v", key, err)
+				result.FailedDelete++
+				continue
+			}
+			result.Deleted++
+			result.Reclaimed += size
+		}
+	}
+
+	poolGCDeleted.Add(int64(result.Deleted))
+	poolGCReclaimed.Add(result.Reclaimed)
+	return result, nil
+}
+
+// archiveRoot returns the part of a cache key above the given directory,
+// such as "debian" for "debian/pool/main/...", including a tenant prefix.
+func archiveRoot(key, dir string) (string, bool) {
+	i := strings.Index("/"+key, dir)
+	if i < 0 {
+		return "", false
+	}
+	return strings.TrimPrefix(("/" + key)[:i], "/"), true
+}
+
+// cachedSize returns the size of a cached entry, zero if it is gone.
+func cachedSize(cache storage.Cache, key string) int64 {
+	content, size, _, err := cache.Get(key)
+	if err != nil {
+		return 0
+	}
+	content.Close()
+	return size
+}
+
+func archiveName(root string) string {
+	if root == "" {
+		return "the top-level archive"
+	}
+	return root
+}
+
+// findIndexes checks that the Release of every suite of the archive is
+// cached and fresh and collects the cached indexes it lists, directly or by
+// hash, whether or not they still match it. An index directory is covered if
+// every suite listing indexes in it has one matching its Release cached. It
+// sets a.unsafe if the archive must not be collected.
+func (a *poolArchive) findIndexes(cache storage.Cache, headerCache storage.HeaderCache, times map[string]storage.EntryTimes, cached map[string]bool, now time.Time, maxIndexAge time.Duration) {
+	if len(a.suites) == 0 {
+		a.unsafe = "no suite is cached"
+		return
+	}
+
+	listed := make(map[string]bool)
+	missing := make(map[string]bool)
+	matching := 0
+	for suiteDir := range a.suites {
+		release := cachedRelease(cache, suiteDir)
+		if release == nil {
+			a.unsafe = "the Release of " + suiteDir + " is not cached"
+			return
+		}
+		fetched, ok := releaseFetchTime(headerCache, times, cached, suiteDir)
+		if !ok || now.Sub(fetched) > maxIndexAge {
+			a.unsafe = "the Release of " + suiteDir + " is not fresh"
+			return
+		}
+
+		suiteListed := make(map[string]bool)
+		current := make(map[string]bool) // Index directories with a matching copy cached
+		for name, file := range release.Files {
+			base := path.Base(name)
+			ext := path.Ext(base)
+			if ext != ".gz" && ext != ".bz2" && ext != ".xz" && ext != ".lzma" && ext != ".zst" {
+				ext = ""
+			}
+			stem := strings.TrimSuffix(base, ext)
+			if stem != "Packages" && stem != "Sources" {
+				continue
+			}
+			dir := path.Dir(name)
+			if component, ok := indexComponent(dir); ok {
+				a.components[component] = true
+			}
+			suiteListed[dir] = true
+			for _, key := range indexCopies(suiteDir, name, file, release.AcquireByHash) {
+				if !cached[key] {
+					continue
+				}
+				if ext != "" && ext != ".gz" && ext != ".bz2" {
+					a.unsafe = "cannot decompress " + key
+					return
+				}
+				// An outdated copy is read too, as clients that fetched
+				// it may still install the files it references.
+				if matches, _ := cachedIndexMatches(cache, key, file); matches {
+					current[dir] = true
+					matching++
+				}
+				a.indexes = append(a.indexes, poolIndex{key: key, sources: stem == "Sources", compression: ext})
+			}
+		}
+		for dir := range suiteListed {
+			listed[dir] = true
+			if !current[dir] {
+				missing[dir] = true
+			}
+		}
+	}
+	if matching == 0 {
+		a.unsafe = "no index matching its Release is cached"
+		return
+	}
+	for dir := range listed {
+		if !missing[dir] {
+			a.covered[dir] = true
+		}
+	}
+}
+
+// indexComponent returns the component of an index directory listed in a
+// Release, such as "main" for "main/binary-amd64".
+func indexComponent(dir string) (string, bool) {
+	for _, marker := range []string{"/debian-installer/", "/binary-", "/source"} {
+		if i := strings.Index(dir, marker); i > 0 {
+			return dir[:i], true
+		}
+	}
+	return "", false
+}
+
+// covers reports whether the index directory a pool file would be listed in
+// is covered, see findIndexes. Binary packages are placed by the architecture
+// in their file name; architecture independent ones are listed for every
+// architecture, so one covered architecture of their component suffices.
+// Other files are sources.
+func (a *poolArchive) covers(root, key string) bool {
+	rel := strings.TrimPrefix(strings.TrimPrefix(key, root), "/")
+	rel = strings.TrimPrefix(rel, "pool/")
+	component := ""
+	for c := range a.components {
+		if len(c) > len(component) && strings.HasPrefix(rel, c+"/") {
+			component = c
+		}
+	}
+	if component == "" {
+		return false
+	}
+
+	base := path.Base(rel)
+	switch ext := path.Ext(base); ext {
+	case ".deb", ".udeb", ".ddeb":
+		dir := component + "/binary-"
+		if ext == ".udeb" {
+			dir = component + "/debian-installer/binary-"
+		}
+		stem := strings.TrimSuffix(base, ext)
+		arch := stem[strings.LastIndex(stem, "_")+1:]
+		if arch != "all" {
+			return a.covered[dir+arch]
+		}
+		for covered := range a.covered {
+			if strings.HasPrefix(covered, dir) {
+				return true
+			}
+		}
+		return false
+	default:
+		return a.covered[component+"/source"]
+	}
+}
+
+// releaseFetchTime returns when the Release of a suite, the one cachedRelease
+// reads, was fetched.
+func releaseFetchTime(headerCache storage.HeaderCache, times map[string]storage.EntryTimes, cached map[string]bool, suiteDir string) (time.Time, bool) {
+	for _, name := range []string{"InRelease", "Release"} {
+		key := path.Join(suiteDir, name)
+		if cached[key] {
+			return entryFetchTime(headerCache, key, times[key])
+		}
+	}
+	return time.Time{}, false
+}
+
+// indexCopies returns the cache keys an index listed in a Release may be
+// cached under: its own path and, if the suite supports it, its by-hash
+// paths.
+func indexCopies(suiteDir, name string, file *utils.ReleaseFile, byHash bool) []string {
+	copies := []string{path.Join(suiteDir, name)}
+	if !byHash {
+		return copies
+	}
+	dir := path.Dir(name)
+	for algorithm, hash := range file.Hashes {
+		if algorithm == "MD5Sum" {
+			continue
+		}
+		copies = append(copies, path.Join(suiteDir, dir, "by-hash", algorithm, hash))
+	}
+	return copies
+}
+
+// collectIndexReferences adds the cache keys of the pool files a cached index
+// references to referenced.
+func collectIndexReferences(cache storage.Cache, index poolIndex, root string, referenced map[string]bool) error {
+	content, _, _, err := cache.Get(index.key)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	var reader io.Reader = content
+	switch index.compression {
+	case ".gz":
+		gz, err := gzip.NewReader(content)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	case ".bz2":
+		reader = bzip2.NewReader(content)
+	}
+	return scanIndexReferences(reader, index.sources, func(file string) {
+		referenced[path.Join(root, file)] = true
+	})
+}
+
+// scanIndexReferences calls add with the path of every file a Packages index
+// (its Filename fields) or a Sources index (the files of each Directory)
+// references, relative to the archive root. It reads the index line by line
+// rather than parsing it whole, as indexes can be large.
+func scanIndexReferences(r io.Reader, sources bool, add func(string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var directory, field string
+	var files []string
+	flush := func() {
+		for _, file := range files {
+			add(path.Join(directory, file))
+		}
+		directory, field, files = "", "", files[:0]
+	}
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if sources && (field == "files" || strings.HasPrefix(field, "checksums-")) {
+				if parts := strings.Fields(line); len(parts) == 3 {
+					files = append(files, parts[2])
+				}
+			}
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		field = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		switch {
+		case !sources && field == "filename":
+			add(value)
+		case sources && field == "directory":
+			directory = value
+		}
+	}
+	flush()
+	return scanner.Err()
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// prefetchYieldInterval is how often a yielding prefetch checks whether it
+// may continue.
+const prefetchYieldInterval = 100 * time.Millisecond
+
+// prefetchControl lets background prefetching yield to client traffic. While
+// any upstream fetch made for a client is running, or while an operator has
+// paused prefetching, prefetch workers neither start new fetches nor read
+// from the ones in progress.
+var prefetchControl struct {
+	paused      atomic.Bool
+	liveFetches atomic.Int32
+}
+
+type prefetchKey struct{}
+
+func withPrefetch(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), prefetchKey{}, true))
+}
+
+func isPrefetch(ctx context.Context) bool {
+	prefetch, _ := ctx.Value(prefetchKey{}).(bool)
+	return prefetch
+}
+
+// waitForPrefetchTurn blocks while prefetching is paused or client fetches
+// are in progress.
+func waitForPrefetchTurn(ctx context.Context) {
+	for prefetchControl.paused.Load() || prefetchControl.liveFetches.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(prefetchYieldInterval):
+		}
+	}
+}
+
+// bandwidthLimiter is a token bucket shared by every upstream fetch, live or
+// prefetch, that caps the combined origin bandwidth. A rate of zero means
+// unlimited.
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	tokens float64
+	last   time.Time
+}
+
+var originBandwidth bandwidthLimiter
+
+// SetOriginBandwidthLimit caps the bytes per second read from all origins
+// together. Zero removes the cap.
+func SetOriginBandwidthLimit(bytesPerSecond int64) {
+	originBandwidth.mu.Lock()
+	defer originBandwidth.mu.Unlock()
+
+	originBandwidth.rate = float64(bytesPerSecond)
+	originBandwidth.tokens = float64(bytesPerSecond)
+	originBandwidth.last = time.Now()
+}
+
+// take consumes n bytes from the bucket and sleeps for as long as the bucket
+// is in debt. The bucket holds at most one second worth of bytes.
+func (l *bandwidthLimiter) take(ctx context.Context, n int) {
+	l.mu.Lock()
+	if l.rate <= 0 || n <= 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+	}
+}
+
+type prefetchStatus struct {
+	Paused      bool  `json:"paused"`
+	LiveFetches int32 `json:"liveFetches"`
+}
+
+// HandlePrefetch reports whether prefetching is paused on GET and pauses or
+// resumes it on POST to /admin/prefetch/pause and /admin/prefetch/resume.
+func HandlePrefetch(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/prefetch"), "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+	case action == "pause" && r.Method == http.MethodPost:
+		prefetchControl.paused.Store(true)
+	case action == "resume" && r.Method == http.MethodPost:
+		prefetchControl.paused.Store(false)
+	case action == "pause" || action == "resume" || action == "":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, prefetchStatus{
+		Paused:      prefetchControl.paused.Load(),
+		LiveFetches: prefetchControl.liveFetches.Load(),
+	})
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+)
+
+// maxPurgeRequestSize bounds the JSON body of a purge request.
+const maxPurgeRequestSize = 4 << 10
+
+type purgeRequest struct {
+	OlderThan      string `json:"olderThan,omitempty"`      // Duration such as "720h": purge entries fetched longer ago
+	AccessedBefore string `json:"accessedBefore,omitempty"` // RFC 3339 time: purge entries not read since
+	DryRun         bool   `json:"dryRun,omitempty"`         // Only count the entries that would be purged
+}
+
+type purgeResult struct {
+	Purged int      `json:"purged"`
+	Failed []string `json:"failed,omitempty"` // Keys that could not be removed
+	DryRun bool     `json:"dryRun,omitempty"`
+}
+
+// HandlePurge removes the cached entries selected by age: those fetched
+// longer than olderThan ago, those no client requested since accessedBefore,
+// or, when both are given, those matching both. Their headers are removed by
+// the cache's OnRemove. Entries being fetched are left alone. The response
+// counts the removed entries.
+func HandlePurge(cache storage.Cache, headerCache storage.HeaderCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		lister, ok := cache.(storage.EntryTimesLister)
+		if !ok {
+			http.Error(w, "Cache does not track entry times", http.StatusNotImplemented)
+			return
+		}
+
+		var req purgeRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPurgeRequestSize)).Decode(&req); err != nil {
+			http.Error(w, "Invalid purge request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.OlderThan == "" && req.AccessedBefore == "" {
+			http.Error(w, "Either olderThan or accessedBefore is required", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		var fetchedBefore, accessedBefore time.Time
+		if req.OlderThan != "" {
+			age, err := time.ParseDuration(req.OlderThan)
+			if err != nil || age < 0 {
+				http.Error(w, "Invalid olderThan duration", http.StatusBadRequest)
+				return
+			}
+			fetchedBefore = now.Add(-age)
+		}
+		if req.AccessedBefore != "" {
+			var err error
+			if accessedBefore, err = time.Parse(time.RFC3339, req.AccessedBefore); err != nil {
+				http.Error(w, "Invalid accessedBefore time, RFC 3339 expected", http.StatusBadRequest)
+				return
+			}
+		}
+
+		entries := lister.EntryTimes()
+		keys := make([]string, 0, len(entries))
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		result := purgeResult{DryRun: req.DryRun}
+		for _, key := range keys {
+			times := entries[key]
+			if !accessedBefore.IsZero() && !times.Accessed.Before(accessedBefore) {
+				continue
+			}
+			if !fetchedBefore.IsZero() {
+				fetched, ok := entryFetchTime(headerCache, key, times)
+				if !ok || !fetched.Before(fetchedBefore) {
+					continue
+				}
+			}
+			if isInflight(key) {
+				continue
+			}
+			if req.DryRun {
+				result.Purged++
+				continue
+			}
+
+			if err := cache.Delete(key); err != nil {
+				logging.Warning("Purge: Cannot remove %s: %v", key, err)
+				result.Failed = append(result.Failed, key)
+				continue
+			}
+			result.Purged++
+		}
+
+		if !req.DryRun {
+			logging.Info("Purge: Removed %d entries (olderThan=%q, accessedBefore=%q)", result.Purged, req.OlderThan, req.AccessedBefore)
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// entryFetchTime returns when an entry's content was fetched. Entries found
+// at startup have no write time in the cache, so the fetch time recorded in
+// their headers is used instead; it is unknown if there is none.
+func entryFetchTime(headerCache storage.HeaderCache, key string, times storage.EntryTimes) (time.Time, bool) {
+	if !times.Stored.IsZero() {
+		return times.Stored, true
+	}
+	headers, err := headerCache.GetHeaders(key)
+	if err != nil {
+		if !errors.Is(err, storage.ErrHeadersNotFound) {
+			logging.Warning("Purge: Cannot read headers of %s: %v", key, err)
+		}
+		return time.Time{}, false
+	}
+	fetched, err := time.Parse(http.TimeFormat, headers.Get(fetchedAtHeader))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return fetched, true
+}
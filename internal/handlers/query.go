@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+const (
+	QueryStringReject = "reject"
+	QueryStringStrip  = "strip"
+	QueryStringAllow  = "allow"
+)
+
+// handleQueryString applies the configured query string mode to the request.
+// In strip mode the query is removed so the request is cached and fetched by
+// path alone. In allow mode the query is kept, and forwarded upstream, only if
+// every key is allowed for the path. It returns false if the request was
+// rejected.
+func handleQueryString(w http.ResponseWriter, r *http.Request, config ServerConfig) bool {
+	if r.URL.RawQuery == "" {
+		return true
+	}
+
+	switch config.QueryStringMode {
+	case QueryStringStrip:
+		logging.Debug("Stripping query string from %s", r.URL.Path)
+		r.URL.RawQuery = ""
+		return true
+	case QueryStringAllow:
+		if queryAllowed(config, r) {
+			return true
+		}
+	}
+
+	http.Error(w, "Query parameters are not allowed", http.StatusForbidden)
+	return false
+}
+
+func queryAllowed(config ServerConfig, r *http.Request) bool {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return false
+	}
+
+	remotePath := getRemotePath(config, r.URL.Path)
+	for _, rule := range config.QueryStringRules {
+		if !utils.MatchPathPattern(rule.Path, remotePath) {
+			continue
+		}
+		allowed := make(map[string]bool, len(rule.Keys))
+		for _, key := range rule.Keys {
+			allowed[key] = true
+		}
+		ok := true
+		for key := range values {
+			if !allowed[key] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamQuery returns the query string to append to upstream URLs. Only
+// queries accepted by handleQueryString are still present on the request.
+func upstreamQuery(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return ""
+	}
+	return "?" + r.URL.RawQuery
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// errOriginRateLimited is returned, wrapped in a rateLimitError, for requests
+// to an origin that answered 429 Too Many Requests and is being left alone.
+var errOriginRateLimited = errors.New("origin is rate limiting")
+
+type rateLimitError struct {
+	origin string
+	until  time.Time
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("%s: %s until %s", errOriginRateLimited, e.origin, e.until.UTC().Format(time.RFC3339))
+}
+
+func (e *rateLimitError) Unwrap() error {
+	return errOriginRateLimited
+}
+
+// retryAfter returns the whole seconds until the origin may be asked again,
+// at least one.
+func (e *rateLimitError) retryAfter() int {
+	seconds := int(time.Until(e.until).Seconds() + 0.999)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// rateLimitProbeRetry is how long requests wait for the single request that
+// checks whether a rate-limiting origin has recovered.
+const rateLimitProbeRetry = time.Second
+
+// originRateLimits tracks the origins that answered 429, by host. While an
+// origin's back-off lasts, no requests are sent to it. Once it has passed,
+// requests go out one at a time until one is answered with anything but 429,
+// which lifts the limit.
+var originRateLimits = struct {
+	sync.Mutex
+	origins map[string]*originRateLimit
+}{origins: make(map[string]*originRateLimit)}
+
+// rateLimitedResponses counts 429 responses from origins.
+var rateLimitedResponses atomic.Int64
+
+type originRateLimit struct {
+	until   time.Time
+	probing bool // A request checking whether the origin has recovered is running
+}
+
+// admitToRateLimitedOrigin returns a rateLimitError if no request may be
+// sent to origin now. A nil error for an origin that was rate limiting
+// makes the request the one that checks for recovery; it must be followed by
+// observeRateLimit.
+func admitToRateLimitedOrigin(config ServerConfig, origin string) error {
+	if config.RateLimitBackoff <= 0 {
+		return nil
+	}
+	originRateLimits.Lock()
+	defer originRateLimits.Unlock()
+
+	limit, ok := originRateLimits.origins[origin]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(limit.until) {
+		return &rateLimitError{origin: origin, until: limit.until}
+	}
+	if limit.probing {
+		return &rateLimitError{origin: origin, until: now.Add(rateLimitProbeRetry)}
+	}
+	limit.probing = true
+	return nil
+}
+
+// observeRateLimit records the outcome of a request to origin. A 429 starts
+// or extends the origin's back-off for as long as its Retry-After asks, or
+// the configured back-off without one, and is returned as a rateLimitError.
+// Any other response lifts the limit.
+func observeRateLimit(config ServerConfig, origin string, resp *http.Response, err error) error {
+	if config.RateLimitBackoff <= 0 {
+		return nil
+	}
+	originRateLimits.Lock()
+	defer originRateLimits.Unlock()
+
+	limit, limited := originRateLimits.origins[origin]
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		if limited {
+			if err != nil {
+				limit.probing = false
+			} else {
+				delete(originRateLimits.origins, origin)
+				logging.Info("Origin %s is no longer rate limiting", origin)
+			}
+		}
+		return nil
+	}
+
+	rateLimitedResponses.Add(1)
+	backoff := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if backoff <= 0 {
+		backoff = config.RateLimitBackoff
+	}
+	if config.MaxRateLimitBackoff > 0 && backoff > config.MaxRateLimitBackoff {
+		backoff = config.MaxRateLimitBackoff
+	}
+	if !limited {
+		limit = &originRateLimit{}
+		originRateLimits.origins[origin] = limit
+	}
+	limit.until = time.Now().Add(backoff)
+	limit.probing = false
+	logging.Warning("Origin %s answered 429, backing off for %v", origin, backoff)
+	return &rateLimitError{origin: origin, until: limit.until}
+}
+
+// parseRetryAfter returns the delay a Retry-After header asks for, given in
+// seconds or as an HTTP date, or zero if it is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+var suiteLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.RWMutex
+}{locks: make(map[string]*sync.RWMutex)}
+
+// suiteLockFor returns the consistency lock of the suite the cache key
+// belongs to, or nil if the key is not under a dists/<suite>/ directory.
+func suiteLockFor(cacheKey string) *sync.RWMutex {
+	suite, ok := utils.SuitePrefix(cacheKey)
+	if !ok {
+		return nil
+	}
+
+	suiteLocks.Lock()
+	defer suiteLocks.Unlock()
+
+	mu, exists := suiteLocks.locks[suite]
+	if !exists {
+		mu = &sync.RWMutex{}
+		suiteLocks.locks[suite] = mu
+	}
+	return mu
+}
+
+// lockSuiteForRead holds off Release refreshes of the key's suite while its
+// metadata is served. The returned function releases the lock.
+func lockSuiteForRead(cacheKey string) func() {
+	mu := suiteLockFor(cacheKey)
+	if mu == nil {
+		return func() {}
+	}
+	mu.RLock()
+	return mu.RUnlock
+}
+
+// lockSuiteFileForRead takes the read lock of the key's suite when the
+// consistency lock applies to the requested file, a suite file other than
+// the Release itself. The returned function releases the lock.
+func lockSuiteFileForRead(config ServerConfig, r *http.Request, cacheKey string) func() {
+	if !config.SuiteLock || utils.GetFilePatternType(r.URL.Path) != utils.TypeFrequentlyChanging || utils.IsReleaseFile(r.URL.Path) {
+		return func() {}
+	}
+	return lockSuiteForRead(cacheKey)
+}
+
+// lookupSuiteFile opens a cached entry like lookupCache, under the suite's
+// read lock where lockSuiteFileForRead takes it. The lock is only held until
+// the file is open, not while it is sent: a Release refresh removing the
+// entry meanwhile does not affect the open file.
+func lookupSuiteFile(r *http.Request, config ServerConfig, cacheKey string) (io.ReadCloser, int64, time.Time, error) {
+	defer lockSuiteFileForRead(config, r, cacheKey)()
+	return lookupCache(r, config, cacheKey)
+}
+
+// lockSuiteForRefresh excludes all metadata readers of the key's suite while
+// its Release and indexes are swapped. The returned function releases the lock.
+func lockSuiteForRefresh(cacheKey string) func() {
+	mu := suiteLockFor(cacheKey)
+	if mu == nil {
+		return func() {}
+	}
+	mu.Lock()
+	return mu.Unlock
+}
+
+// invalidateStaleIndexes drops every cached index whose size or checksum no
+// longer matches the one declared in a freshly fetched Release file and
+// returns their keys. It runs before the new Release is sent to the client,
+// so a client never sees a new Release together with an index it does not
+// describe. An index republished with the same size is caught by its
+// checksum; only if the Release cannot be parsed strictly are sizes alone
+// compared.
+func invalidateStaleIndexes(config ServerConfig, releaseKey string, releaseBody []byte) []string {
+	suiteDir := path.Dir(releaseKey)
+	var invalidated []string
+
+	for relPath, file := range releaseIndexFiles(releaseKey, releaseBody) {
+		indexKey := suiteDir + "/" + relPath
+
+		var matches, cached bool
+		if len(file.Hashes) > 0 {
+			matches, cached = cachedIndexMatches(config.Cache, indexKey, file)
+		} else if content, size, _, err := config.Cache.Get(indexKey); err == nil {
+			content.Close()
+			matches, cached = size == file.Size, true
+		}
+		if !cached || matches {
+			continue
+		}
+
+		if err := config.Cache.Delete(indexKey); err != nil {
+			logging.Error("Release: Failed to invalidate %s: %v", indexKey, err)
+			continue
+		}
+		config.ValidationCache.Put(fmt.Sprintf("validation:%s", indexKey), time.Time{})
+		invalidated = append(invalidated, indexKey)
+		logging.Debug("Release: Invalidated %s, it does not match the Release", indexKey)
+	}
+
+	if len(invalidated) > 0 && config.LogRequests {
+		logging.Info("Release: Invalidated %d stale indexes for %s", len(invalidated), releaseKey)
+	}
+	return invalidated
+}
+
+// releaseIndexFiles returns the files a Release lists with their sizes and
+// checksums, or with their sizes only if it does not parse strictly.
+func releaseIndexFiles(releaseKey string, releaseBody []byte) map[string]*utils.ReleaseFile {
+	release, err := utils.ParseRelease(releaseBody)
+	if err == nil {
+		return release.Files
+	}
+	logging.Warning("Release: Comparing only the sizes of the indexes of %s: %v", releaseKey, err)
+	files := make(map[string]*utils.ReleaseFile)
+	for relPath, size := range utils.ParseReleaseFileSizes(releaseBody) {
+		files[relPath] = &utils.ReleaseFile{Size: size}
+	}
+	return files
+}
+
+func isInReleaseFile(p string) bool {
+	return path.Base(p) == "InRelease"
+}
+
+// rememberMissingInRelease negatively caches a 404 for InRelease for the
+// configured TTL, so the fallback to Release and Release.gpg does not hit the
+// origin for InRelease on every apt run, and drops any copy cached while the
+// origin still served it. Only the InRelease key is affected, so the Release
+// fallback is fetched as usual.
+func rememberMissingInRelease(config ServerConfig, cacheKey string) {
+	if config.InReleaseNotFoundTTL <= 0 {
+		return
+	}
+
+	rememberNegative(cacheKey, http.StatusNotFound, config.InReleaseNotFoundTTL)
+
+	if err := config.Cache.Delete(cacheKey); err != nil {
+		logging.Error("Release: Failed to drop cached %s: %v", cacheKey, err)
+	}
+	config.ValidationCache.Put(fmt.Sprintf("validation:%s", cacheKey), time.Time{})
+	logging.Debug("Release: Origin has no %s, falling back to Release for %v", cacheKey, config.InReleaseNotFoundTTL)
+}
+
+// invalidateReleaseSignature drops the cached Release.gpg next to a freshly
+// fetched Release, so apt never gets an old detached signature for a new
+// Release.
+func invalidateReleaseSignature(config ServerConfig, releaseKey string) {
+	if path.Base(releaseKey) != "Release" {
+		return
+	}
+
+	signatureKey := path.Dir(releaseKey) + "/Release.gpg"
+	if err := config.Cache.Delete(signatureKey); err != nil {
+		logging.Error("Release: Failed to invalidate %s: %v", signatureKey, err)
+		return
+	}
+	config.ValidationCache.Put(fmt.Sprintf("validation:%s", signatureKey), time.Time{})
+}
+
+// signatureProbeNegativeTTL caps how long a 404 for a suite's Release or
+// Release.gpg is remembered. apt probes for the signing form it does not use,
+// so these 404s are expected and should not outlive the next publish.
+const signatureProbeNegativeTTL = 30 * time.Second
+
+// isSignatureFallbackFile reports whether the path names the Release or
+// Release.gpg that apt falls back to when a suite has no InRelease.
+func isSignatureFallbackFile(p string) bool {
+	base := path.Base(p)
+	return base == "Release" || base == "Release.gpg"
+}
+
+// signatureProbeTTL adjusts the negative TTL of a 404 for Release or
+// Release.gpg. While the suite's InRelease is cached and fresh, apt has no use
+// for the fallback files, so the 404 is passed on without being remembered;
+// otherwise it is remembered for at most signatureProbeNegativeTTL.
+func signatureProbeTTL(config ServerConfig, cacheKey string, ttl time.Duration) (time.Duration, bool) {
+	inReleaseKey := path.Dir(cacheKey) + "/InRelease"
+	if fresh, _ := config.ValidationCache.Get(fmt.Sprintf("validation:%s", inReleaseKey)); fresh {
+		if content, _, _, err := config.Cache.Get(inReleaseKey); err == nil {
+			content.Close()
+			logging.Debug("Release: Not remembering the 404 for %s, the suite has a fresh InRelease", cacheKey)
+			return 0, false
+		}
+	}
+	return min(ttl, signatureProbeNegativeTTL), true
+}
+
+// forgetSignatureProbes drops remembered 404s for the signing files that a
+// freshly fetched Release file supersedes: Release and Release.gpg for an
+// InRelease, Release.gpg for a Release.
+func forgetSignatureProbes(releaseKey string) {
+	suiteDir := path.Dir(releaseKey)
+	forgetNegative(suiteDir + "/Release.gpg")
+	if isInReleaseFile(releaseKey) {
+		forgetNegative(suiteDir + "/Release")
+	}
+}
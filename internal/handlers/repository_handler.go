@@ -3,6 +3,7 @@ package handlers
 import (
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/yolkispalkis/go-apt-cache/internal/config"
@@ -11,7 +12,11 @@ import (
 )
 
 type RepositoryHandler struct {
-	config ServerConfig
+	config    ServerConfig
+	warmup    *warmupState
+	stop      chan struct{} // Closed to stop the origin probes and the warm-up
+	closeOnce sync.Once
+	fill      http.Handler // Authenticated cache fill, nil when disabled
 }
 
 func NewRepositoryHandler(
@@ -21,6 +26,7 @@ func NewRepositoryHandler(
 	validationCache storage.ValidationCache,
 	client *http.Client,
 	localPath string,
+	repo config.Repository,
 	globalConfig *config.Config,
 ) http.Handler {
 	config := NewRepositoryServerConfig(
@@ -33,13 +39,60 @@ func NewRepositoryHandler(
 	)
 
 	config.LocalPath = localPath
+	stop := make(chan struct{})
+	config.OriginHost = repo.OriginHost
+	config.SuiteOrigins = buildSuiteOrigins(repo.SuiteOrigins, globalConfig.Server.DefaultOriginScheme, globalConfig.Server.DefaultOriginPort)
+	if len(repo.Mirrors) > 0 {
+		config.Origins = buildOriginSet(upstreamURL, repo, globalConfig)
+		startOriginProbes(config, config.Origins, originProbeInterval(globalConfig), stop)
+	}
+	config.IncludePaths = repo.Include
+	config.ExcludePaths = repo.Exclude
+	config.PassThrough = repo.PassThrough
 	config.ValidationCache.SetTTL(time.Duration(globalConfig.Cache.ValidationCacheTTL) * time.Second)
 
+	if repo.SelfTestPath != "" {
+		registerSelfTest(config, "/"+strings.TrimPrefix(repo.SelfTestPath, "/"), stop)
+	}
+
+	retryAfter := globalConfig.Server.WarmupRetryAfter
+	if retryAfter <= 0 {
+		retryAfter = waiterRetryAfter
+	}
+
+	var fill http.Handler
+	if globalConfig.Server.CacheFill {
+		fill = NewAdminAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handleCacheFill(w, r, config)
+		}), globalConfig.Admin)
+	}
+
 	return &RepositoryHandler{
 		config: config,
+		stop:   stop,
+		fill:   fill,
+		warmup: startWarmup(
+			config,
+			repo.WarmupPaths,
+			globalConfig.Server.PrefetchWorkers,
+			globalConfig.Server.WarmupThreshold,
+			time.Duration(globalConfig.Server.WarmupMaxWait)*time.Second,
+			retryAfter,
+			stop,
+		),
 	}
 }
 
+// Close stops the repository's origin probes and warm-up and removes its
+// self-test, once a configuration reload has replaced or removed it.
+// Requests it is still serving complete normally.
+func (rh *RepositoryHandler) Close() {
+	rh.closeOnce.Do(func() {
+		close(rh.stop)
+		unregisterSelfTest(rh.config.LocalPath, rh.stop)
+	})
+}
+
 func (rh *RepositoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	requestPath := r.URL.Path
 	if requestPath == "" {
@@ -57,6 +110,20 @@ func (rh *RepositoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	logging.Info("Repository: %s, Path: %s, Cache key: %s", repoName, requestPath, cacheKey)
 
+	// A PUT the repository passes through to the origin is no cache fill.
+	if r.Method == http.MethodPut && rh.fill != nil && !isPassThrough(rh.config, r) {
+		rh.fill.ServeHTTP(w, r)
+		return
+	}
+
+	if rejectWhileWarming(w, r, rh.config, rh.warmup) {
+		logging.Info("Repository: %s is warming up, rejected %s", repoName, requestPath)
+		return
+	}
+
+	// Counted here rather than in HandleRequest, which transcoding calls
+	// again for the canonical variant of the same request.
+	defer recordHit(r)
 	handler := HandleRequest(rh.config, true)
 	handler(w, r)
 }
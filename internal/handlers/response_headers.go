@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// withResponseHeaders returns w wrapped so that config.ResponseHeaders are
+// set on the final response just before its status is sent, after the
+// handler has set the cached or origin headers, so configured values replace
+// those. Informational responses such as 103 Early Hints go out unchanged.
+func withResponseHeaders(w http.ResponseWriter, config ServerConfig) http.ResponseWriter {
+	if len(config.ResponseHeaders) == 0 {
+		return w
+	}
+	return &responseHeaderWriter{ResponseWriter: w, headers: config.ResponseHeaders}
+}
+
+type responseHeaderWriter struct {
+	http.ResponseWriter
+	headers map[string]string
+	applied bool
+}
+
+func (hw *responseHeaderWriter) apply() {
+	if hw.applied {
+		return
+	}
+	hw.applied = true
+	for name, value := range hw.headers {
+		hw.ResponseWriter.Header().Set(name, value)
+	}
+}
+
+func (hw *responseHeaderWriter) WriteHeader(status int) {
+	if status >= http.StatusOK {
+		hw.apply()
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *responseHeaderWriter) Write(b []byte) (int, error) {
+	hw.apply()
+	return hw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (hw *responseHeaderWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// resumeBackoff is the pause before the second attempt to resume a download;
+// it doubles with every further attempt.
+const resumeBackoff = 250 * time.Millisecond
+
+// resumedDownloads counts Range requests that continued a download cut
+// short.
+var resumedDownloads atomic.Int64
+
+// resumeValidator returns the If-Range value that makes the origin send the
+// rest of the same file, or "" if the response carries no validator it can be
+// resumed with. Weak ETags are not allowed in If-Range.
+func resumeValidator(headers http.Header) string {
+	if etag := headers.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return headers.Get("Last-Modified")
+}
+
+// downloadResumable copies the body of resp to out. If the body breaks off
+// and the origin supports ranges, the rest is requested from where it broke
+// off, up to config.ResumeAttempts times, and appended, so a flaky link does
+// not throw away what has been downloaded. Attempts spend retry budget and
+// back off after the first. If-Range makes sure the pieces
+// belong to the same version of the file; everything written to out, such as
+// a checksum verifier, sees the file as one. The requests for the rest are
+// made with ctx rather than the context of the original request, which
+// abandoning a stalled body may have canceled.
+func downloadResumable(ctx context.Context, config ServerConfig, out io.Writer, resp *http.Response) (int64, error) {
+	written, err := io.Copy(out, resp.Body)
+	if err == nil || config.ResumeAttempts <= 0 || resp.ContentLength <= 0 || resp.Request == nil {
+		return written, err
+	}
+	validator := resumeValidator(resp.Header)
+	if resp.Header.Get("Accept-Ranges") != "bytes" || validator == "" {
+		return written, err
+	}
+
+	for attempt := 1; err != nil && attempt <= config.ResumeAttempts && written < resp.ContentLength; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(resumeBackoff << (attempt - 2)):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if !allowRetry() {
+			logging.Warning("Retry budget exhausted, not resuming %s at byte %d", resp.Request.URL, written)
+			break
+		}
+		logging.Warning("Resuming %s at byte %d of %d (attempt %d) after: %v", resp.Request.URL, written, resp.ContentLength, attempt, err)
+
+		req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, resp.Request.URL.String(), nil)
+		if reqErr != nil {
+			return written, reqErr
+		}
+		req.Header.Set("User-Agent", defaultUserAgent)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+		req.Header.Set("If-Range", validator)
+
+		part, partErr := doUpstream(config, getClient(config), req)
+		if partErr != nil {
+			err = partErr
+			continue
+		}
+		if !resumesAt(part, written, resp.ContentLength) {
+			part.Body.Close()
+			// The file changed or the origin ignored the range; what has
+			// been downloaded cannot be completed.
+			return written, fmt.Errorf("origin did not resume at byte %d (status %d): %w", written, part.StatusCode, err)
+		}
+		resumedDownloads.Add(1)
+		n, copyErr := io.Copy(out, part.Body)
+		part.Body.Close()
+		written += n
+		err = copyErr
+	}
+	return written, err
+}
+
+// resumesAt reports whether part is the rest of a file of the given size
+// from offset on.
+func resumesAt(part *http.Response, offset, size int64) bool {
+	if part.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	var first, last, total int64
+	contentRange := part.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &first, &last, &total); err != nil {
+		return false
+	}
+	return first == offset && last == size-1 && total == size
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// retryBudgetWindow is the number of seconds over which successes and
+// retries are counted.
+const retryBudgetWindow = 10
+
+// retryBudget bounds how many failed fetches are retried. Within the window,
+// retries may make up ratio of the successful origin requests plus
+// minPerSecond retries per second, so a struggling origin that answers
+// little gets few retries instead of one from every waiting client.
+type retryBudget struct {
+	ratio        float64
+	minPerSecond int
+
+	mu         sync.Mutex
+	slots      [retryBudgetWindow]retrySlot
+	suppressed atomic.Int64
+}
+
+type retrySlot struct {
+	second    int64
+	successes int
+	retries   int
+}
+
+// retries is the active budget, nil when retries are not limited.
+var retries atomic.Pointer[retryBudget]
+
+// SetRetryBudget limits retries to ratio of the successful origin requests
+// plus minPerSecond per second. A ratio of zero removes the limit.
+func SetRetryBudget(ratio float64, minPerSecond int) {
+	if ratio <= 0 {
+		retries.Store(nil)
+		return
+	}
+	retries.Store(&retryBudget{ratio: ratio, minPerSecond: minPerSecond})
+}
+
+// slot returns the counters of the current second, clearing them if they
+// still hold an older second. The caller must hold b.mu.
+func (b *retryBudget) slot(now time.Time) *retrySlot {
+	second := now.Unix()
+	s := &b.slots[second%retryBudgetWindow]
+	if s.second != second {
+		*s = retrySlot{second: second}
+	}
+	return s
+}
+
+func (b *retryBudget) deposit(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.slot(now).successes++
+}
+
+func (b *retryBudget) withdraw(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var successes, spent int
+	for _, s := range b.slots {
+		if s.second > now.Unix()-retryBudgetWindow {
+			successes += s.successes
+			spent += s.retries
+		}
+	}
+	allowed := float64(b.minPerSecond*retryBudgetWindow) + b.ratio*float64(successes)
+	if float64(spent+1) > allowed {
+		b.suppressed.Add(1)
+		return false
+	}
+	b.slot(now).retries++
+	return true
+}
+
+// recordOriginSuccess earns retry budget for an origin request that was
+// answered without a server error.
+func recordOriginSuccess() {
+	if b := retries.Load(); b != nil {
+		b.deposit(time.Now())
+	}
+}
+
+// allowRetry reports whether a failed fetch may be retried, spending budget
+// if so.
+func allowRetry() bool {
+	b := retries.Load()
+	return b == nil || b.withdraw(time.Now())
+}
+
+func retriesSuppressed() int64 {
+	if b := retries.Load(); b != nil {
+		return b.suppressed.Load()
+	}
+	return 0
+}
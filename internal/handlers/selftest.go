@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// selfTestKeyPrefix keeps the self-test's copy of the canary apart from the
+// entry clients are served, so a failed test never corrupts it.
+const selfTestKeyPrefix = ".selftest/"
+
+// selfTests holds the canary path of every repository that configures one.
+var selfTests = struct {
+	sync.Mutex
+	targets map[string]selfTestTarget
+}{targets: make(map[string]selfTestTarget)}
+
+type selfTestTarget struct {
+	config ServerConfig
+	path   string
+	owner  <-chan struct{} // Stop channel of the registering handler
+}
+
+func registerSelfTest(config ServerConfig, path string, owner <-chan struct{}) {
+	selfTests.Lock()
+	defer selfTests.Unlock()
+	selfTests.targets[config.LocalPath] = selfTestTarget{config: config, path: path, owner: owner}
+}
+
+// unregisterSelfTest removes the self-test of a repository unless a handler
+// replacing the owner has registered its own meanwhile.
+func unregisterSelfTest(localPath string, owner <-chan struct{}) {
+	selfTests.Lock()
+	defer selfTests.Unlock()
+	if selfTests.targets[localPath].owner == owner {
+		delete(selfTests.targets, localPath)
+	}
+}
+
+type selfTestStage struct {
+	Name    string  `json:"name"`
+	OK      bool    `json:"ok"`
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type selfTestReport struct {
+	Repository string          `json:"repository"`
+	Path       string          `json:"path"`
+	OK         bool            `json:"ok"`
+	Stages     []selfTestStage `json:"stages"`
+}
+
+// runStage times fn and appends its outcome to the report. It returns false
+// once a stage has failed, so later stages that depend on it are skipped.
+func (report *selfTestReport) runStage(name string, fn func() error) bool {
+	start := time.Now()
+	err := fn()
+	stage := selfTestStage{Name: name, OK: err == nil, Seconds: time.Since(start).Seconds()}
+	if err != nil {
+		stage.Error = err.Error()
+	}
+	report.Stages = append(report.Stages, stage)
+	return err == nil
+}
+
+// runSelfTest fetches the canary from the origin, bypassing the cache,
+// stores it under a key of its own and reads it back.
+func runSelfTest(target selfTestTarget, r *http.Request) selfTestReport {
+	config := target.config
+	report := selfTestReport{Repository: config.LocalPath, Path: target.path}
+
+	var body []byte
+	var lastModified time.Time
+	ok := report.runStage("origin", func() error {
+		remotePath := getRemotePath(config, target.path)
+		upstreamURL := upstreamBase(config, remotePath) + remotePath
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, upstreamURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", defaultUserAgent)
+
+		resp, err := doUpstream(config, getClient(config), req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("origin answered %s", resp.Status)
+		}
+		body, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if len(body) == 0 {
+			return fmt.Errorf("origin sent an empty body")
+		}
+		lastModified = upstreamLastModified(config, resp.Header)
+		return nil
+	})
+
+	key := selfTestKeyPrefix + getCacheKey(config, target.path)
+	defer config.Cache.Delete(key)
+
+	ok = ok && report.runStage("cacheWrite", func() error {
+		return config.Cache.Put(key, bytes.NewReader(body), int64(len(body)), lastModified)
+	})
+
+	ok = ok && report.runStage("cacheRead", func() error {
+		content, _, _, err := config.Cache.Get(key)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+
+		hash := sha256.New()
+		if _, err := io.Copy(hash, content); err != nil {
+			return err
+		}
+		if want := sha256.Sum256(body); !bytes.Equal(hash.Sum(nil), want[:]) {
+			return fmt.Errorf("cached content does not match what the origin sent")
+		}
+		return nil
+	})
+
+	report.OK = ok
+	return report
+}
+
+// HandleSelfTest fetches every repository's canary path end to end and
+// reports the timing and outcome of each stage. It answers 503 if any stage
+// failed, so it can be used directly as a health check.
+func HandleSelfTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	selfTests.Lock()
+	targets := make([]selfTestTarget, 0, len(selfTests.targets))
+	for _, target := range selfTests.targets {
+		targets = append(targets, target)
+	}
+	selfTests.Unlock()
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].config.LocalPath < targets[j].config.LocalPath
+	})
+
+	status := http.StatusOK
+	reports := make([]selfTestReport, 0, len(targets))
+	for _, target := range targets {
+		report := runSelfTest(target, r)
+		if !report.OK {
+			status = http.StatusServiceUnavailable
+		}
+		reports = append(reports, report)
+	}
+
+	writeJSON(w, status, reports)
+}
@@ -1,21 +1,80 @@
 package handlers
 
 import (
+	"net"
 	"net/http"
+	"regexp"
+	"time"
 
 	"github.com/yolkispalkis/go-apt-cache/internal/config"
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
 	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
 )
 
 type ServerConfig struct {
-	UpstreamURL     string
-	LocalPath       string
-	Cache           storage.Cache
-	HeaderCache     storage.HeaderCache
-	ValidationCache storage.ValidationCache
-	Client          *http.Client
-	LogRequests     bool
-	Config          *config.Config // Keep the global config for access to other settings
+	UpstreamURL             string
+	LocalPath               string
+	Cache                   storage.Cache
+	HeaderCache             storage.HeaderCache
+	ValidationCache         storage.ValidationCache
+	Client                  *http.Client // Used for all upstream requests, set a custom Transport to fake the origin in tests
+	LogRequests             bool
+	CacheAllowlist          []string // Path globs that may be stored in the cache
+	ImmutableCache          storage.ImmutableCache
+	ImmutablePaths          []string      // Extra path globs served through the immutable fast path
+	SlowRequestThreshold    time.Duration // Upstream fetches slower than this are logged, zero disables
+	DownstreamCacheHeaders  bool          // Emit Age and Cache-Control on cache hits
+	DownstreamMaxAge        time.Duration // max-age advertised for rarely changing files
+	SniffContentType        bool          // Sniff content when neither upstream nor extension gives a type
+	ContentDisposition      bool          // Suggest file names for .deb, .dsc and tarball downloads
+	SuiteLock               bool          // Serialize Release refreshes against reads of the same suite
+	SuiteBatchRefresh       bool          // Refresh a suite's cached indexes in one pass when its Release changes
+	MaxWaiters              int           // Requests allowed to wait on one in-flight fetch, zero is unlimited
+	HopByHopHeaders         []string      // Extra headers stripped before caching, on top of the RFC 7230 set
+	QueryStringMode         string        // One of QueryStringReject, QueryStringStrip or QueryStringAllow
+	QueryStringRules        []config.QueryStringRule
+	ResponseHeaders         map[string]string
+	InReleaseNotFoundTTL    time.Duration // How long an InRelease 404 is remembered, zero disables
+	CanonicalCompression    string        // CompressionGzip to serve uncompressed indexes from the gzip variant, otherwise every requested variant is stored
+	AdaptiveTimeout         bool          // Bound the wait for upstream headers by the origin's observed latency
+	AdaptiveTimeoutFactor   float64       // Multiplier applied to the origin's P95 latency
+	AdaptiveTimeoutMin      time.Duration
+	AdaptiveTimeoutMax      time.Duration
+	BypassUserAgents        []*regexp.Regexp // Clients whose requests always revalidate or bypass the cache
+	BypassMode              string           // BypassRevalidate (default) or BypassPassThrough
+	CacheBypassHeader       string           // Request header that forces a fresh fetch, defaultCacheBypassHeader if empty
+	CacheBypassToken        string           // Header value accepted from any client
+	CacheBypassNetworks     []*net.IPNet     // Clients allowed to send "1" as the header value
+	OriginHost              string           // Host header for origin requests, the upstream URL's host if empty
+	SuiteOrigins            []suiteOrigin    // Origins other than UpstreamURL for some suites, see upstreamBase
+	Origins                 *originSet       // UpstreamURL and its mirrors, nil without mirrors
+	IncludePaths            []string         // Path globs served, everything if empty, see isPathMirrored
+	ExcludePaths            []string         // Path globs never served
+	StreamToDiskThreshold   int64            // Responses larger than this are written to disk instead of memory, zero disables
+	StreamToDiskTee         bool             // Serve streamed responses while downloading instead of from the stored file
+	EarlyHints              bool             // Send 103 Early Hints preloading indexes listed in cached Release files
+	EarlyHintPaths          []string         // Globs relative to the suite directory, defaultEarlyHintPaths if empty
+	PassThrough             []config.PassThrough
+	NegativeCacheRules      []config.NegativeCacheRule
+	StaleWhileRefresh       bool           // Serve the cached copy while a newer upstream version is fetched in the background
+	DisableRevalidation     bool           // Serve every cached copy without asking the origin, for frozen snapshots
+	HonorClientCacheControl bool           // Revalidate on request no-cache and answer only-if-cached from the cache alone
+	ValidateDebStructure    bool           // Reject packages that are not complete ar archives with control and data members
+	RejectCaptivePortals    bool           // Reject HTML pages sent in place of apt files, see looksLikeCaptivePortal
+	VerifyIndexChecksums    bool           // Check fetched indexes against the checksums in their suite's cached Release
+	MinimumChecksum         string         // Weakest checksum algorithm accepted by the check, any if empty
+	CacheSetCookieResponses bool           // Cache responses carrying Set-Cookie, with the cookie stripped
+	MinThroughput           int64          // Bytes per second an upstream body must sustain, zero disables
+	ClientWriteTimeout      time.Duration  // Longest a single write to a client may take, zero leaves only the server's write timeout
+	ClockSkewTolerance      time.Duration  // How far an origin Last-Modified may lie in the future before it is clamped, see clampToLocalClock
+	RateLimitBackoff        time.Duration  // Back-off after an origin answers 429 without Retry-After, zero forwards 429s, see observeRateLimit
+	MaxRateLimitBackoff     time.Duration  // Cap on the back-off a Retry-After can ask for, zero is unlimited
+	StickyRedirectWindow    time.Duration  // How long a suite's files follow the mirror its Release was redirected to, see stickyTarget
+	CacheAdmission          bool           // Let the cache's admission policy decide whether pool files are stored
+	DiskFullRetryInterval   time.Duration  // How often to retry caching after the disk filled up, zero keeps caching regardless
+	ResumeAttempts          int            // Range requests made to complete a large download that broke off, zero disables
+	Config                  *config.Config // Keep the global config for access to other settings
 }
 
 func NewServerConfig() ServerConfig {
@@ -41,13 +100,144 @@ func NewRepositoryServerConfig(
 	client *http.Client,
 	globalConfig *config.Config,
 ) ServerConfig {
+	// Left nil when the fast path is off, which is what HandleRequest checks.
+	var immutableCache storage.ImmutableCache
+	if globalConfig.Cache.ImmutableFastPath {
+		maxEntries := globalConfig.Cache.ImmutableEntries
+		if maxEntries <= 0 {
+			maxEntries = config.DefaultImmutableEntries
+		}
+		immutableCache = storage.NewMemoryImmutableCache(maxEntries)
+	}
+
+	downstreamMaxAge := time.Duration(globalConfig.Server.DownstreamMaxAge) * time.Second
+	if downstreamMaxAge <= 0 {
+		downstreamMaxAge = config.DefaultDownstreamMaxAge * time.Second
+	}
+
+	inReleaseNotFoundTTL := time.Duration(globalConfig.Cache.InReleaseNotFoundTTL) * time.Second
+	if inReleaseNotFoundTTL <= 0 {
+		inReleaseNotFoundTTL = config.DefaultInReleaseNotFoundTTL * time.Second
+	}
+
+	diskFullRetryInterval := time.Duration(globalConfig.Cache.DiskFullRetryInterval) * time.Second
+	if globalConfig.Cache.DiskFullRetryInterval == 0 {
+		diskFullRetryInterval = config.DefaultDiskFullRetryInterval * time.Second
+	} else if diskFullRetryInterval < 0 {
+		diskFullRetryInterval = 0
+	}
+
+	resumeAttempts := globalConfig.Cache.ResumeAttempts
+	if resumeAttempts == 0 {
+		resumeAttempts = config.DefaultResumeAttempts
+	} else if resumeAttempts < 0 {
+		resumeAttempts = 0
+	}
+
+	adaptiveTimeoutFactor := globalConfig.Server.AdaptiveTimeoutFactor
+	if adaptiveTimeoutFactor <= 0 {
+		adaptiveTimeoutFactor = config.DefaultAdaptiveTimeoutFactor
+	}
+	adaptiveTimeoutMin := globalConfig.Server.AdaptiveTimeoutMin
+	if adaptiveTimeoutMin <= 0 {
+		adaptiveTimeoutMin = config.DefaultAdaptiveTimeoutMin
+	}
+	adaptiveTimeoutMax := globalConfig.Server.AdaptiveTimeoutMax
+	if adaptiveTimeoutMax <= 0 {
+		adaptiveTimeoutMax = globalConfig.Server.Timeout
+	}
+
+	var streamToDiskThreshold int64
+	if globalConfig.Cache.StreamToDiskThreshold != "" {
+		if size, err := utils.ParseSize(globalConfig.Cache.StreamToDiskThreshold); err == nil {
+			streamToDiskThreshold = size
+		} else {
+			logging.Warning("Invalid streamToDiskThreshold '%s', streaming to disk disabled", globalConfig.Cache.StreamToDiskThreshold)
+		}
+	}
+
+	var minimumChecksum string
+	if globalConfig.Cache.MinimumChecksum != "" {
+		if algorithm, err := utils.ParseChecksumAlgorithm(globalConfig.Cache.MinimumChecksum); err == nil {
+			minimumChecksum = algorithm
+		} else {
+			logging.Warning("Invalid minimumChecksum '%s', any checksum is accepted", globalConfig.Cache.MinimumChecksum)
+		}
+	}
+
+	var minThroughput int64
+	if globalConfig.Server.MinThroughput != "" {
+		if size, err := utils.ParseSize(globalConfig.Server.MinThroughput); err == nil {
+			minThroughput = size
+		} else {
+			logging.Warning("Invalid minThroughput '%s', throughput limit disabled", globalConfig.Server.MinThroughput)
+		}
+	}
+
+	cacheBypassHeader := globalConfig.Server.CacheBypassHeader
+	if cacheBypassHeader == "" {
+		cacheBypassHeader = defaultCacheBypassHeader
+	}
+	cacheBypassNetworks, err := utils.ParseNetworks(globalConfig.Server.CacheBypassNetworks)
+	if err != nil {
+		logging.Warning("Invalid cacheBypassNetworks, cache bypass limited to the token: %v", err)
+	}
+
 	return ServerConfig{
-		UpstreamURL:     upstreamURL,
-		Cache:           cache,
-		HeaderCache:     headerCache,
-		ValidationCache: validationCache,
-		Client:          client,
-		LogRequests:     true,
-		Config:          globalConfig,
+		UpstreamURL:             upstreamURL,
+		Cache:                   cache,
+		HeaderCache:             headerCache,
+		ValidationCache:         validationCache,
+		Client:                  client,
+		LogRequests:             true,
+		CacheAllowlist:          globalConfig.Cache.Allowlist,
+		ImmutableCache:          immutableCache,
+		ImmutablePaths:          globalConfig.Cache.ImmutablePaths,
+		SlowRequestThreshold:    time.Duration(globalConfig.Server.SlowRequestThreshold) * time.Second,
+		DownstreamCacheHeaders:  globalConfig.Server.DownstreamCacheHeaders,
+		DownstreamMaxAge:        downstreamMaxAge,
+		SniffContentType:        globalConfig.Server.SniffContentType,
+		ContentDisposition:      globalConfig.Server.ContentDisposition,
+		ResponseHeaders:         globalConfig.Server.ResponseHeaders,
+		SuiteLock:               globalConfig.Cache.SuiteConsistencyLock,
+		SuiteBatchRefresh:       globalConfig.Cache.SuiteBatchRefresh,
+		MaxWaiters:              globalConfig.Server.MaxWaiters,
+		HopByHopHeaders:         globalConfig.Server.HopByHopHeaders,
+		QueryStringMode:         globalConfig.Server.QueryStringMode,
+		QueryStringRules:        globalConfig.Server.QueryStringRules,
+		InReleaseNotFoundTTL:    inReleaseNotFoundTTL,
+		CanonicalCompression:    globalConfig.Cache.CanonicalCompression,
+		AdaptiveTimeout:         globalConfig.Server.AdaptiveTimeout,
+		AdaptiveTimeoutFactor:   adaptiveTimeoutFactor,
+		AdaptiveTimeoutMin:      time.Duration(adaptiveTimeoutMin) * time.Second,
+		AdaptiveTimeoutMax:      time.Duration(adaptiveTimeoutMax) * time.Second,
+		BypassUserAgents:        compileUserAgentPatterns(globalConfig.Server.BypassUserAgents),
+		BypassMode:              globalConfig.Server.BypassMode,
+		CacheBypassHeader:       cacheBypassHeader,
+		CacheBypassToken:        globalConfig.Server.CacheBypassToken,
+		CacheBypassNetworks:     cacheBypassNetworks,
+		StreamToDiskThreshold:   streamToDiskThreshold,
+		StreamToDiskTee:         globalConfig.Cache.StreamToDiskTee,
+		EarlyHints:              globalConfig.Server.EarlyHints,
+		EarlyHintPaths:          globalConfig.Server.EarlyHintPaths,
+		NegativeCacheRules:      globalConfig.Cache.NegativeCacheRules,
+		StaleWhileRefresh:       globalConfig.Cache.StaleWhileRefresh,
+		DisableRevalidation:     globalConfig.Cache.DisableRevalidation,
+		HonorClientCacheControl: globalConfig.Cache.HonorClientCacheControl,
+		ValidateDebStructure:    globalConfig.Cache.ValidateDebStructure,
+		RejectCaptivePortals:    globalConfig.Cache.RejectCaptivePortals,
+		VerifyIndexChecksums:    globalConfig.Cache.VerifyIndexChecksums,
+		MinimumChecksum:         minimumChecksum,
+		CacheSetCookieResponses: globalConfig.Cache.CacheSetCookieResponses,
+		MinThroughput:           minThroughput,
+		ClientWriteTimeout:      time.Duration(globalConfig.Server.ClientWriteTimeout) * time.Second,
+		ClockSkewTolerance:      time.Duration(globalConfig.Server.ClockSkewTolerance) * time.Second,
+		RateLimitBackoff:        time.Duration(globalConfig.Server.RateLimitBackoff) * time.Second,
+		MaxRateLimitBackoff:     time.Duration(globalConfig.Server.MaxRateLimitBackoff) * time.Second,
+		StickyRedirectWindow:    time.Duration(globalConfig.Server.StickyRedirectWindow) * time.Second,
+		CacheAdmission:          globalConfig.Cache.Admission != "",
+		DiskFullRetryInterval:   diskFullRetryInterval,
+		ResumeAttempts:          resumeAttempts,
+		Config:                  globalConfig,
 	}
 }
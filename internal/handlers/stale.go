@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// refreshInBackground fetches a newer version of the cached file without a
+// client waiting for it, so the stale copy can be served meanwhile. Nothing
+// is started if the file is already being fetched.
+func refreshInBackground(config ServerConfig, r *http.Request, cacheKey string) {
+	if req, _ := joinInflight(cacheKey, 0); req != nil {
+		atomic.AddInt32(&req.waiters, -1)
+		return
+	}
+
+	// The refresh outlives the client request, so it gets a context of its
+	// own rather than one that is cancelled when the client leaves.
+	refresh := r.Clone(context.Background())
+	refresh.Method = http.MethodGet
+	refresh.Header = make(http.Header)
+
+	runInBackground("refresh of "+cacheKey, func() {
+		discard := &discardResponseWriter{header: make(http.Header)}
+		handleCacheMiss(discard, refresh, config, cacheKey)
+		if discard.status != http.StatusOK {
+			logging.Warning("Background refresh of %s failed (status %d)", cacheKey, discard.status)
+		}
+	})
+}
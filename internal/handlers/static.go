@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+const DefaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+// HandleRobots answers /robots.txt locally so crawlers never cause origin
+// fetches. An empty content serves DefaultRobotsTxt.
+func HandleRobots(content string) http.HandlerFunc {
+	if content == "" {
+		content = DefaultRobotsTxt
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write([]byte(content))
+		}
+	}
+}
+
+// HandleFavicon answers /favicon.ico locally with an empty response of the
+// given status, 204 unless 404 is configured.
+func HandleFavicon(status int) http.HandlerFunc {
+	if status != http.StatusNotFound {
+		status = http.StatusNoContent
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.WriteHeader(status)
+	}
+}
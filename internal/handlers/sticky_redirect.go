@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// stickyRedirects pins suites whose Release the origin redirected to another
+// mirror, so the rest of the suite's files are fetched from that mirror as
+// well. Entries are keyed by the suite's URL as requested, e.g.
+// "http://deb.example.org/debian/dists/stable", and map to the suite's URL on
+// the mirror.
+var stickyRedirects = struct {
+	sync.Mutex
+	suites map[string]stickyRedirect
+}{suites: make(map[string]stickyRedirect)}
+
+type stickyRedirect struct {
+	target  string
+	expires time.Time
+}
+
+// splitSuiteURL splits u into the URL of its suite directory and the path
+// below it, which starts with a slash.
+func splitSuiteURL(u *url.URL) (suiteURL, rest string, ok bool) {
+	p := strings.TrimPrefix(u.Path, "/")
+	prefix, ok := utils.SuitePrefix(p)
+	if !ok {
+		return "", "", false
+	}
+	return u.Scheme + "://" + u.Host + "/" + prefix, strings.TrimPrefix(p, prefix), true
+}
+
+// stickyTarget returns the URL on the mirror a suite is pinned to that u
+// should be fetched from instead, or nil if the suite is not pinned. Release
+// and InRelease are always requested as configured, so each of them resolves
+// the redirect again.
+func stickyTarget(config ServerConfig, u *url.URL) *url.URL {
+	if config.StickyRedirectWindow <= 0 || utils.IsReleaseFile(u.Path) {
+		return nil
+	}
+	suiteURL, rest, ok := splitSuiteURL(u)
+	if !ok {
+		return nil
+	}
+
+	stickyRedirects.Lock()
+	pin, ok := stickyRedirects.suites[suiteURL]
+	if ok && time.Now().After(pin.expires) {
+		delete(stickyRedirects.suites, suiteURL)
+		ok = false
+	}
+	stickyRedirects.Unlock()
+	if !ok {
+		return nil
+	}
+
+	target, err := url.Parse(pin.target + rest)
+	if err != nil {
+		return nil
+	}
+	target.RawQuery = u.RawQuery
+	return target
+}
+
+// recordStickyRedirect pins the suite of a Release or InRelease request to
+// the mirror the origin redirected it to, for the configured window. A
+// Release served without a redirect removes the pin.
+func recordStickyRedirect(config ServerConfig, requested *url.URL, resp *http.Response) {
+	if config.StickyRedirectWindow <= 0 || !utils.IsReleaseFile(requested.Path) || resp.Request == nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		return
+	}
+	suiteURL, rest, ok := splitSuiteURL(requested)
+	if !ok {
+		return
+	}
+
+	final := resp.Request.URL
+	if final.Host == requested.Host && final.Path == requested.Path {
+		stickyRedirects.Lock()
+		delete(stickyRedirects.suites, suiteURL)
+		stickyRedirects.Unlock()
+		return
+	}
+	targetURL, targetRest, ok := splitSuiteURL(final)
+	if !ok || targetRest != rest {
+		logging.Debug("Sticky redirects: %s was redirected to %s, which is not laid out like a suite", requested, final)
+		return
+	}
+
+	stickyRedirects.Lock()
+	previous := stickyRedirects.suites[suiteURL]
+	stickyRedirects.suites[suiteURL] = stickyRedirect{target: targetURL, expires: time.Now().Add(config.StickyRedirectWindow)}
+	stickyRedirects.Unlock()
+	if previous.target != targetURL {
+		logging.Info("Sticky redirects: Fetching %s from %s for %v", suiteURL, targetURL, config.StickyRedirectWindow)
+	}
+}
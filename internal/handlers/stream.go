@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// upstreamLastModified returns the upstream Last-Modified, clamped by
+// clampToLocalClock, or the current time when the origin sent none or an
+// unparsable one.
+func upstreamLastModified(config ServerConfig, headers http.Header) time.Time {
+	if lastModifiedHeader := headers.Get("Last-Modified"); lastModifiedHeader != "" {
+		if parsedTime, err := time.Parse(http.TimeFormat, lastModifiedHeader); err == nil {
+			return clampToLocalClock(config, parsedTime)
+		}
+	}
+	return time.Now()
+}
+
+// shouldStreamToDisk reports whether a response is large enough to bypass the
+// in-memory buffer, and returns the cache that can adopt the file.
+func shouldStreamToDisk(config ServerConfig, resp *http.Response) (storage.FilePutter, bool) {
+	if config.StreamToDiskThreshold <= 0 || resp.StatusCode != http.StatusOK || resp.ContentLength <= config.StreamToDiskThreshold {
+		return nil, false
+	}
+	putter, ok := config.Cache.(storage.FilePutter)
+	return putter, ok
+}
+
+// clientTee forwards writes to the client until the first failure and then
+// silently drops them, so a client going away does not abort the download
+// into the cache.
+type clientTee struct {
+	w      io.Writer
+	failed bool
+}
+
+func (t *clientTee) Write(p []byte) (int, error) {
+	if !t.failed {
+		if _, err := t.w.Write(p); err != nil {
+			t.failed = true
+		}
+	}
+	return len(p), nil
+}
+
+// streamToDisk downloads a large response into a temporary file on the
+// cache's filesystem, syncs it and moves it into the cache, keeping memory use
+// flat. Without tee the client is then served from the cached file, which
+// gives it range and conditional request support on the very first request;
+// with tee the client receives the body while it is being downloaded.
+func streamToDisk(w http.ResponseWriter, r *http.Request, config ServerConfig, cacheKey string, resp *http.Response, putter storage.FilePutter, verifier *utils.ChecksumVerifier) (int64, error) {
+	file, err := putter.CreateTemp()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tempPath := file.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			file.Close()
+			os.Remove(tempPath)
+		}
+	}()
+
+	var out io.Writer = file
+	var tee *clientTee
+	if config.StreamToDiskTee {
+		filterAndSetHeaders(w, resp.Header)
+		setContentDisposition(w, config, r.URL.Path)
+		w.WriteHeader(resp.StatusCode)
+		tee = &clientTee{w: clientWriter(w, config)}
+		out = io.MultiWriter(file, tee)
+	}
+	if verifier != nil {
+		out = io.MultiWriter(out, verifier)
+	}
+
+	written, err := downloadResumable(upstreamContext(r), config, out, resp)
+	if err != nil {
+		return written, fmt.Errorf("failed to download body: %w", err)
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return written, fmt.Errorf("incomplete body: expected %d bytes, got %d", resp.ContentLength, written)
+	}
+	if verifier != nil {
+		if err := verifier.Verify(); err != nil {
+			checksumFailures.Add(1)
+			return written, fmt.Errorf("invalid index: %w", err)
+		}
+	}
+	if config.ValidateDebStructure && utils.IsDebPackage(getRemotePath(config, r.URL.Path)) {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return written, fmt.Errorf("failed to rewind file: %w", err)
+		}
+		if err := utils.ValidateDebStructure(bufio.NewReader(file)); err != nil {
+			return written, fmt.Errorf("invalid package: %w", err)
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return written, fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return written, fmt.Errorf("failed to close file: %w", err)
+	}
+
+	committed = true
+	writeSpan := startCacheWriteSpan(r, cacheKey, written)
+	err = putter.PutFile(cacheKey, tempPath, upstreamLastModified(config, resp.Header))
+	writeSpan.fail(err)
+	writeSpan.finish()
+	if err != nil {
+		return written, fmt.Errorf("failed to store file: %w", err)
+	}
+	headers := withOriginDate(withFetchTime(stripHopByHopHeaders(resp.Header, config.HopByHopHeaders)))
+	if err := config.HeaderCache.PutHeaders(cacheKey, headers); err != nil {
+		logging.Error("Stream: Error storing headers for %s: %v", cacheKey, err)
+	}
+	config.ValidationCache.Put(fmt.Sprintf("validation:%s", cacheKey), time.Now())
+
+	if config.LogRequests {
+		logging.Info("Cache: Streamed %s to disk (%d bytes)", cacheKey, written)
+	}
+	PublishEvent(Event{Type: EventFetch, Key: cacheKey, Size: written})
+
+	if tee == nil {
+		content, _, lastModified, err := config.Cache.Get(cacheKey)
+		if err != nil || !handleCacheHit(w, r, config, content, lastModified, cacheKey) {
+			return written, fmt.Errorf("failed to serve %s from the cache after storing it", cacheKey)
+		}
+	}
+	return written, nil
+}
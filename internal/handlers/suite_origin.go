@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/config"
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// suiteOrigin routes the suites matching a pattern, and optionally further
+// paths, to an origin other than the repository's own.
+type suiteOrigin struct {
+	suite string   // Glob matched against the suite name, e.g. "*-security"
+	paths []string // Globs relative to the repository, e.g. "pool/updates/**"
+	url   string   // Origin URL with a trailing slash
+}
+
+// buildSuiteOrigins normalizes the configured suite origins. Rules with an
+// invalid URL, which config validation rejects, are skipped.
+func buildSuiteOrigins(rules []config.SuiteOrigin, defaultScheme, defaultPort string) []suiteOrigin {
+	var origins []suiteOrigin
+	for _, rule := range rules {
+		originURL, err := utils.NormalizeOriginURL(rule.URL, defaultScheme, defaultPort)
+		if err != nil {
+			logging.Error("Skipping origin for suites %s: %v", rule.Suite, err)
+			continue
+		}
+		origins = append(origins, suiteOrigin{suite: rule.Suite, paths: rule.Paths, url: originURL + "/"})
+	}
+	return origins
+}
+
+// upstreamBase returns the origin URL, with a trailing slash, that the remote
+// path is fetched from: that of the first suite origin whose suite pattern
+// matches the suite under dists/, or whose path globs match the path, and
+// otherwise the repository's upstream URL, or the mirror of it selected by
+// probing.
+func upstreamBase(config ServerConfig, remotePath string) string {
+	if len(config.SuiteOrigins) == 0 {
+		return config.Origins.base(config.UpstreamURL)
+	}
+
+	remotePath = strings.TrimPrefix(remotePath, "/")
+	suite := ""
+	if prefix, ok := utils.SuitePrefix(remotePath); ok {
+		suite = path.Base(prefix)
+	}
+	for _, origin := range config.SuiteOrigins {
+		if suite != "" && origin.suite != "" {
+			if matched, _ := path.Match(origin.suite, suite); matched {
+				return origin.url
+			}
+		}
+		if utils.MatchAnyPathPattern(origin.paths, remotePath) {
+			return origin.url
+		}
+	}
+	return config.Origins.base(config.UpstreamURL)
+}
+
+// isPrimaryOrigin reports whether u points at the repository's own upstream
+// URL rather than a suite origin or mirror, which OriginHost does not apply
+// to.
+func isPrimaryOrigin(config ServerConfig, u *url.URL) bool {
+	return strings.HasPrefix(u.String(), config.UpstreamURL)
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// suiteBatches keeps a single batch refresh running per suite.
+var suiteBatches = struct {
+	sync.Mutex
+	running map[string]bool
+	wg      sync.WaitGroup // Batches still running, for tests
+}{running: make(map[string]bool)}
+
+// refreshSuiteIndexes brings the cached indexes of a suite in line with its
+// freshly fetched Release in one background pass, instead of leaving each of
+// them to be revalidated against the origin when it is next requested.
+// Cached indexes that still match their Release checksum are marked as
+// validated without an origin request; those that do not, and those in
+// invalidated, are fetched again. The Release is parsed before returning, so
+// releaseBody may be reused afterwards.
+func refreshSuiteIndexes(config ServerConfig, r *http.Request, releaseKey string, releaseBody []byte, invalidated []string) {
+	release, err := utils.ParseRelease(releaseBody)
+	if err != nil {
+		logging.Warning("Suite refresh: Cannot parse %s: %v", releaseKey, err)
+		return
+	}
+	suiteDir := path.Dir(releaseKey)
+
+	suiteBatches.Lock()
+	if suiteBatches.running[suiteDir] {
+		suiteBatches.Unlock()
+		logging.Debug("Suite refresh: %s is already being refreshed", suiteDir)
+		return
+	}
+	suiteBatches.running[suiteDir] = true
+	suiteBatches.wg.Add(1)
+	suiteBatches.Unlock()
+
+	// The batch outlives the client request, so it gets a context of its own.
+	base := r.Clone(context.Background())
+	base.Method = http.MethodGet
+	base.Header = make(http.Header)
+
+	finish := func() {
+		suiteBatches.Lock()
+		delete(suiteBatches.running, suiteDir)
+		suiteBatches.Unlock()
+		suiteBatches.wg.Done()
+	}
+	queued := runInBackground("refresh of suite "+suiteDir, func() {
+		defer finish()
+
+		// The new Release must be in the cache before indexes are checked
+		// against it, and it is stored once its fetch releases the lock.
+		if req, _ := joinInflight(releaseKey, 0); req != nil {
+			<-req.done
+			atomic.AddInt32(&req.waiters, -1)
+		}
+
+		refetch := make(map[string]bool, len(invalidated))
+		for _, key := range invalidated {
+			refetch[key] = true
+		}
+
+		relPaths := make([]string, 0, len(release.Files))
+		for relPath := range release.Files {
+			relPaths = append(relPaths, relPath)
+		}
+		sort.Strings(relPaths)
+
+		validated, fetched, failed := 0, 0, 0
+		for _, relPath := range relPaths {
+			indexKey := suiteDir + "/" + relPath
+			if !refetch[indexKey] {
+				matches, cached := cachedIndexMatches(config.Cache, indexKey, release.Files[relPath])
+				if !cached {
+					continue
+				}
+				if matches {
+					config.ValidationCache.Put(fmt.Sprintf("validation:%s", indexKey), time.Now())
+					validated++
+					continue
+				}
+			}
+			if isInflight(indexKey) {
+				continue
+			}
+
+			fetch := base.Clone(base.Context())
+			fetch.URL.Path = path.Dir(base.URL.Path) + "/" + relPath
+			fetch.URL.RawPath = ""
+			discard := &discardResponseWriter{header: make(http.Header)}
+			handleCacheMiss(discard, fetch, config, indexKey)
+			if discard.status == http.StatusOK {
+				fetched++
+			} else {
+				failed++
+				logging.Warning("Suite refresh: Fetching %s failed (status %d)", indexKey, discard.status)
+			}
+		}
+
+		if validated+fetched+failed > 0 {
+			logging.Info("Suite refresh: %s has %d indexes unchanged, %d fetched again, %d failed", suiteDir, validated, fetched, failed)
+		}
+	})
+	if !queued {
+		finish()
+	}
+}
+
+// cachedIndexMatches reports whether the index cached under indexKey matches
+// the strongest checksum its Release lists, and whether it is cached at all.
+func cachedIndexMatches(cache storage.Cache, indexKey string, file *utils.ReleaseFile) (matches, cached bool) {
+	content, size, _, err := cache.Get(indexKey)
+	if err != nil {
+		return false, false
+	}
+	defer content.Close()
+
+	if size != file.Size {
+		return false, true
+	}
+	algorithm, sum, err := utils.SelectChecksum(file.Hashes, "")
+	if err != nil {
+		return false, true
+	}
+	verifier, err := utils.NewChecksumVerifier(algorithm, sum)
+	if err != nil {
+		return false, true
+	}
+	if _, err := io.Copy(verifier, content); err != nil {
+		return false, true
+	}
+	return verifier.Verify() == nil, true
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/storage"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// maxTrackedSuites bounds the suites traffic is broken down by. Requests for
+// further suites, such as made-up ones, are counted under otherSuites.
+const maxTrackedSuites = 256
+
+const otherSuites = "other"
+
+type suiteCounters struct {
+	requests    atomic.Int64
+	hits        atomic.Int64 // Served without contacting the origin
+	revalidated atomic.Int64 // Served after the origin confirmed the cached copy
+	misses      atomic.Int64 // The origin was asked, even if it failed
+	errors      atomic.Int64 // Refused without asking the origin
+	clientBytes atomic.Int64
+	originBytes atomic.Int64
+}
+
+// suiteStats counts requests by the suite directory in their path, e.g.
+// "debian/dists/bookworm".
+var suiteStats = struct {
+	sync.RWMutex
+	suites map[string]*suiteCounters
+}{suites: make(map[string]*suiteCounters)}
+
+func suiteCountersFor(suite string) *suiteCounters {
+	suiteStats.RLock()
+	counters, ok := suiteStats.suites[suite]
+	suiteStats.RUnlock()
+	if ok {
+		return counters
+	}
+
+	suiteStats.Lock()
+	defer suiteStats.Unlock()
+	if counters, ok := suiteStats.suites[suite]; ok {
+		return counters
+	}
+	if len(suiteStats.suites) >= maxTrackedSuites {
+		suite = otherSuites
+		if counters, ok := suiteStats.suites[suite]; ok {
+			return counters
+		}
+	}
+	counters = &suiteCounters{}
+	suiteStats.suites[suite] = counters
+	return counters
+}
+
+// NewSuiteStatsMiddleware counts each request below a suite directory, with
+// how it was served and the bytes it moved, by suite. It relies on the byte
+// account attached by ByteAccountingMiddleware.
+func NewSuiteStatsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		suite, ok := utils.SuitePrefix(r.URL.Path)
+		account := byteAccountFrom(r.Context())
+		if !ok || account == nil {
+			return
+		}
+		counters := suiteCountersFor(suite)
+		counters.requests.Add(1)
+		switch account.outcome() {
+		case "hit":
+			counters.hits.Add(1)
+		case "revalidated":
+			counters.revalidated.Add(1)
+		case "miss":
+			counters.misses.Add(1)
+		default:
+			counters.errors.Add(1)
+		}
+		counters.clientBytes.Add(account.client.Load())
+		counters.originBytes.Add(account.origin.Load())
+	})
+}
+
+type suiteSnapshot struct {
+	Suite       string  `json:"suite"`
+	Requests    int64   `json:"requests"`
+	Hits        int64   `json:"hits"`
+	Revalidated int64   `json:"revalidated"`
+	Misses      int64   `json:"misses"`
+	Errors      int64   `json:"errors"`
+	HitRatio    float64 `json:"hitRatio"` // Share of requests other than errors served from the cache, revalidated or not
+	ClientBytes int64   `json:"clientBytes"`
+	OriginBytes int64   `json:"originBytes"`
+	Entries     int     `json:"entries"` // Cached entries below the suite directory
+}
+
+// HandleSuiteStats reports the hit ratio, traffic and cached entries of each
+// suite, ordered by suite. Suites with cached entries but no requests since
+// startup are listed too, so idle suites stand out.
+func HandleSuiteStats(cache storage.Cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		snapshots := make(map[string]*suiteSnapshot)
+		suiteStats.RLock()
+		for suite, counters := range suiteStats.suites {
+			snapshot := &suiteSnapshot{
+				Suite:       suite,
+				Requests:    counters.requests.Load(),
+				Hits:        counters.hits.Load(),
+				Revalidated: counters.revalidated.Load(),
+				Misses:      counters.misses.Load(),
+				Errors:      counters.errors.Load(),
+				ClientBytes: counters.clientBytes.Load(),
+				OriginBytes: counters.originBytes.Load(),
+			}
+			if served := snapshot.Requests - snapshot.Errors; served > 0 {
+				snapshot.HitRatio = float64(snapshot.Hits+snapshot.Revalidated) / float64(served)
+			}
+			snapshots[suite] = snapshot
+		}
+		suiteStats.RUnlock()
+
+		if lister, ok := cache.(storage.KeyLister); ok {
+			keys, err := lister.Keys()
+			if err != nil {
+				http.Error(w, "Failed to list cache entries", http.StatusInternalServerError)
+				return
+			}
+			for _, key := range keys {
+				// Entries of all tenants count towards the suite.
+				suite, ok := utils.SuitePrefix(fetchKey(key))
+				if !ok {
+					continue
+				}
+				snapshot := snapshots[suite]
+				if snapshot == nil {
+					snapshot = &suiteSnapshot{Suite: suite}
+					snapshots[suite] = snapshot
+				}
+				snapshot.Entries++
+			}
+		}
+
+		result := make([]*suiteSnapshot, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			result = append(result, snapshot)
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].Suite < result[j].Suite })
+		writeJSON(w, http.StatusOK, result)
+	}
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/config"
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+type tenantContextKey struct{}
+
+// maxTenantLength bounds tenant names, which end up in cache paths on disk.
+const maxTenantLength = 64
+
+// tenantExempt lists routes that serve no repository content, so they belong
+// to no tenant and their paths never start with one.
+var tenantExempt = []string{"/admin/", "/metrics", "/status", "/robots.txt", "/favicon.ico"}
+
+// TenantMiddleware reads the tenant of each request from a header or from the
+// first path segment and stores it in the request context. Cache keys of
+// requests with a tenant are salted with it, so every tenant has its own
+// cache namespace while origin fetches are still shared. Only the configured
+// tenants are accepted, so clients cannot make up namespaces that each take
+// copies of the cached files.
+type TenantMiddleware struct {
+	next   http.Handler
+	config config.TenantConfig
+	names  map[string]bool // The known tenants
+}
+
+func NewTenantMiddleware(next http.Handler, cfg config.TenantConfig) http.Handler {
+	names := make(map[string]bool, len(cfg.Names))
+	for _, name := range cfg.Names {
+		names[name] = true
+	}
+	return &TenantMiddleware{next: next, config: cfg, names: names}
+}
+
+func (m *TenantMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, prefix := range tenantExempt {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			m.next.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	var tenant string
+	if m.config.Header != "" {
+		tenant = r.Header.Get(m.config.Header)
+	}
+	if tenant == "" && m.config.PathPrefix {
+		// Only known tenants are taken from the path; any other first
+		// segment is a repository served from the shared namespace.
+		rest := strings.TrimPrefix(r.URL.Path, "/")
+		segment, remainder, _ := strings.Cut(rest, "/")
+		if m.names[segment] {
+			tenant = segment
+			r = r.Clone(r.Context())
+			r.URL.Path = "/" + remainder
+			r.URL.RawPath = ""
+		}
+	}
+	if tenant == "" {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+	if !m.names[tenant] || !validTenant(tenant) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	m.next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant)))
+}
+
+// validTenant accepts names made of letters, digits, dots, dashes and
+// underscores, which are safe to use as a directory name.
+func validTenant(tenant string) bool {
+	if len(tenant) > maxTenantLength || tenant == "." || tenant == ".." {
+		return false
+	}
+	for _, c := range tenant {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.' || c == '-' || c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// tenantCacheKey salts cacheKey with the tenant of r, if it has one.
+func tenantCacheKey(r *http.Request, cacheKey string) string {
+	tenant, _ := r.Context().Value(tenantContextKey{}).(string)
+	if tenant == "" {
+		return cacheKey
+	}
+	return "@" + tenant + "/" + cacheKey
+}
+
+// fetchKey returns the unsalted key of cacheKey. Origin fetches are coalesced
+// by it, so tenants asking for the same file share one fetch.
+func fetchKey(cacheKey string) string {
+	if !strings.HasPrefix(cacheKey, "@") {
+		return cacheKey
+	}
+	if _, rest, ok := strings.Cut(cacheKey, "/"); ok {
+		return rest
+	}
+	return cacheKey
+}
+
+// adoptEntry copies the entry another tenant's request just fetched from
+// fromKey to toKey, so a waiter is served from its own namespace without
+// going to the origin again.
+func adoptEntry(config ServerConfig, fromKey, toKey string) {
+	if existing, _, _, err := config.Cache.Get(toKey); err == nil {
+		existing.Close()
+		return
+	}
+	content, size, lastModified, err := config.Cache.Get(fromKey)
+	if err != nil {
+		return
+	}
+	defer content.Close()
+
+	if headers, err := config.HeaderCache.GetHeaders(fromKey); err == nil {
+		if err := config.HeaderCache.PutHeaders(toKey, headers); err != nil {
+			logging.Error("Error copying headers of %s to %s: %v", fromKey, toKey, err)
+			return
+		}
+	}
+	err = config.Cache.Put(toKey, content, size, lastModified)
+	noteCacheWrite(config, toKey, err)
+	if err != nil {
+		logging.Error("Error copying %s to %s: %v", fromKey, toKey, err)
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// throughputWindow is the slack given to every transfer on top of its
+// length-derived deadline, and the interval at which transfers of unknown
+// length are checked. It is a variable so tests can shorten it.
+var throughputWindow = 10 * time.Second
+
+// throughputBody aborts an upstream body that the origin delivers more slowly
+// than the configured minimum throughput. Only the time spent waiting in the
+// origin's reads counts, so a slow client or the bandwidth limit pausing
+// between reads never gets the transfer aborted. With a known length the
+// transfer gets a deadline proportional to its size, so large files get more
+// time than small indexes; without one, every window of waiting must deliver
+// its share of bytes.
+type throughputBody struct {
+	io.ReadCloser
+	read      atomic.Int64
+	waited    atomic.Int64 // Nanoseconds spent in finished reads
+	readStart atomic.Int64 // Unix nanoseconds the read in progress began, zero between reads
+	mu        sync.Mutex
+	timer     *time.Timer
+}
+
+func newThroughputBody(body io.ReadCloser, origin string, contentLength, minThroughput int64, cancel context.CancelFunc) *throughputBody {
+	b := &throughputBody{ReadCloser: body}
+
+	abort := func(reason string) {
+		logging.Warning("Upstream %s is slower than %d bytes/s (%s), aborting the transfer", origin, minThroughput, reason)
+		cancel()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The timers fire in wall time, and are reset for whatever waiting time
+	// the check still lacks.
+	if contentLength > 0 {
+		deadline := throughputWindow + time.Duration(float64(contentLength)/float64(minThroughput)*float64(time.Second))
+		b.timer = time.AfterFunc(deadline, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.timer == nil {
+				return
+			}
+			if waited := b.waitedFor(); waited < deadline {
+				b.timer.Reset(deadline - waited)
+				return
+			}
+			abort("deadline of " + deadline.Round(time.Second).String() + " exceeded")
+		})
+		return b
+	}
+
+	share := int64(float64(minThroughput) * throughputWindow.Seconds())
+	var checked int64
+	var checkedAt time.Duration
+	b.timer = time.AfterFunc(throughputWindow, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.timer == nil {
+			return
+		}
+		waited := b.waitedFor()
+		if waited-checkedAt < throughputWindow {
+			b.timer.Reset(throughputWindow - (waited - checkedAt))
+			return
+		}
+		read := b.read.Load()
+		if read-checked < share {
+			abort("stalled")
+			return
+		}
+		checked, checkedAt = read, waited
+		b.timer.Reset(throughputWindow)
+	})
+	return b
+}
+
+// waitedFor returns the time spent waiting in the origin's reads so far,
+// including the read in progress.
+func (b *throughputBody) waitedFor() time.Duration {
+	waited := b.waited.Load()
+	if start := b.readStart.Load(); start != 0 {
+		waited += time.Now().UnixNano() - start
+	}
+	return time.Duration(waited)
+}
+
+func (b *throughputBody) Read(p []byte) (int, error) {
+	start := time.Now()
+	b.readStart.Store(start.UnixNano())
+	n, err := b.ReadCloser.Read(p)
+	b.waited.Add(int64(time.Since(start)))
+	b.readStart.Store(0)
+	b.read.Add(int64(n))
+	if err != nil {
+		// The transfer is over, however it ended.
+		b.stop()
+	}
+	return n, err
+}
+
+func (b *throughputBody) Close() error {
+	b.stop()
+	return b.ReadCloser.Close()
+}
+
+func (b *throughputBody) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// traceContext is a W3C trace context (https://www.w3.org/TR/trace-context/)
+// received from a client, which origin requests made on its behalf continue.
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte // The client's span, the parent of origin requests
+	flags   byte
+	state   string // tracestate, passed on unchanged
+}
+
+type traceContextKey struct{}
+
+// withTraceContext carries the trace context of the client request r, if it
+// has a valid one, in ctx, unless ctx already has one, such as that of a span.
+func withTraceContext(ctx context.Context, r *http.Request) context.Context {
+	if _, ok := traceContextFrom(ctx); ok {
+		return ctx
+	}
+	tc, ok := parseTraceParent(r.Header.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+	tc.state = strings.Join(r.Header.Values("tracestate"), ",")
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+func traceContextFrom(ctx context.Context) (traceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(traceContext)
+	return tc, ok
+}
+
+// parseTraceParent parses a traceparent header. Versions after 00 are parsed
+// by their version 00 prefix, as the specification requires.
+func parseTraceParent(value string) (traceContext, bool) {
+	var tc traceContext
+	value = strings.TrimSpace(value)
+	if len(value) < 55 || (len(value) > 55 && (value[:2] == "00" || value[55] != '-')) {
+		return tc, false
+	}
+	version, traceID, spanID, flags := value[:2], value[3:35], value[36:52], value[53:55]
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' || version == "ff" || !isLowerHex(version) {
+		return tc, false
+	}
+	if !isLowerHex(traceID) || !isLowerHex(spanID) || !isLowerHex(flags) {
+		return tc, false
+	}
+
+	hex.Decode(tc.traceID[:], []byte(traceID))
+	hex.Decode(tc.spanID[:], []byte(spanID))
+	var flagByte [1]byte
+	hex.Decode(flagByte[:], []byte(flags))
+	tc.flags = flagByte[0]
+	if tc.traceID == [16]byte{} || tc.spanID == [8]byte{} {
+		return tc, false
+	}
+	return tc, true
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= '0' && s[i] <= '9' || s[i] >= 'a' && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// newSpanID returns a random, non-zero span ID.
+func newSpanID() [8]byte {
+	var id [8]byte
+	for id == ([8]byte{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// propagateTraceContext sets the trace context headers of an origin request
+// made on behalf of a traced client request. Each origin request is a new
+// span, a child of the client's, so origin logs can be correlated with it:
+// fetchSpan if tracing is on, otherwise one with just a fresh ID.
+func propagateTraceContext(req *http.Request, fetchSpan *span) {
+	tc, ok := traceContextFrom(req.Context())
+	if !ok {
+		return
+	}
+	spanID := newSpanID()
+	if fetchSpan != nil {
+		spanID = fetchSpan.tc.spanID
+	}
+	req.Header.Set("traceparent", "00-"+hex.EncodeToString(tc.traceID[:])+"-"+hex.EncodeToString(spanID[:])+"-"+hex.EncodeToString([]byte{tc.flags}))
+	if tc.state != "" {
+		req.Header.Set("tracestate", tc.state)
+	}
+}
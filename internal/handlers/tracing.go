@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// Span kinds as numbered by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+const (
+	spanBatchSize     = 256
+	spanQueueSize     = 4096
+	spanFlushInterval = 5 * time.Second
+)
+
+// span is an OpenTelemetry span, exported over OTLP/HTTP when it ends. All
+// methods accept a nil span, which startSpan returns while tracing is off, so
+// instrumented code needs no checks of its own.
+type span struct {
+	tc     traceContext // The span's own context: its trace, span ID and flags
+	parent [8]byte      // Zero for a root span
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+
+	mu     sync.Mutex
+	attrs  map[string]any // Values are strings, int64s or bools
+	errMsg string
+}
+
+// startSpan starts a span as a child of the span or incoming trace context
+// in ctx, or as the root of a new trace, and returns ctx carrying it. It
+// returns a nil span while no exporter is configured.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if spanExporters.Load() == nil {
+		return ctx, nil
+	}
+
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]any)}
+	if parent, ok := traceContextFrom(ctx); ok {
+		s.tc = traceContext{traceID: parent.traceID, flags: parent.flags, state: parent.state}
+		s.parent = parent.spanID
+	} else {
+		for s.tc.traceID == ([16]byte{}) {
+			rand.Read(s.tc.traceID[:])
+		}
+		s.tc.flags = 1 // Sampled
+	}
+	s.tc.spanID = newSpanID()
+	return context.WithValue(ctx, traceContextKey{}, s.tc), s
+}
+
+// set records an attribute of the span.
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	switch v := value.(type) {
+	case int:
+		value = int64(v)
+	case int32:
+		value = int64(v)
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// fail marks the span as failed with err.
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// finish ends the span and queues it for export if its trace is sampled.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if s.tc.flags&1 == 0 {
+		return
+	}
+	if exporter := spanExporters.Load(); exporter != nil {
+		exporter.enqueue(s)
+	}
+}
+
+// spanExporter sends finished spans in batches to an OTLP/HTTP endpoint,
+// encoded as JSON. Spans are dropped rather than block requests when the
+// collector cannot keep up.
+type spanExporter struct {
+	endpoint    string
+	serviceName string
+	headers     map[string]string
+	client      *http.Client
+
+	queue   chan *span
+	flushes chan chan struct{}
+	stop    chan struct{}
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+var spanExporters atomic.Pointer[spanExporter]
+
+// SetTraceExporter enables tracing, exporting spans to the OTLP/HTTP traces
+// endpoint, e.g. "http://localhost:4318/v1/traces". An empty endpoint
+// disables it.
+func SetTraceExporter(endpoint, serviceName string, headers map[string]string) {
+	var e *spanExporter
+	if endpoint != "" {
+		e = &spanExporter{
+			endpoint:    endpoint,
+			serviceName: serviceName,
+			headers:     headers,
+			client:      &http.Client{Timeout: 10 * time.Second},
+			queue:       make(chan *span, spanQueueSize),
+			flushes:     make(chan chan struct{}),
+			stop:        make(chan struct{}),
+		}
+		go e.run()
+	}
+	if previous := spanExporters.Swap(e); previous != nil {
+		close(previous.stop)
+	}
+}
+
+// FlushTraces exports the spans that have ended so far, waiting until done
+// or until ctx expires.
+func FlushTraces(ctx context.Context) error {
+	e := spanExporters.Load()
+	if e == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case e.flushes <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *spanExporter) enqueue(s *span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *spanExporter) run() {
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			e.failed.Add(int64(len(batch)))
+			logging.Warning("Tracing: Failed to export %d spans: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= spanBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case <-e.stop:
+			send()
+			return
+		case done := <-e.flushes:
+			for drained := false; !drained; {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					drained = true
+				}
+			}
+			send()
+			close(done)
+		}
+	}
+}
+
+// OTLP JSON encoding of an export request, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding.
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            map[string]any  `json:"status,omitempty"`
+}
+
+func otlpAttributes(attrs map[string]any) []otlpAttribute {
+	encoded := make([]otlpAttribute, 0, len(attrs))
+	for key, value := range attrs {
+		var v map[string]any
+		switch value := value.(type) {
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		encoded = append(encoded, otlpAttribute{Key: key, Value: v})
+	}
+	return encoded
+}
+
+func (e *spanExporter) export(spans []*span) error {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.tc.traceID[:]),
+			SpanID:            hex.EncodeToString(s.tc.spanID[:]),
+			TraceState:        s.tc.state,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+		}
+		if s.errMsg != "" {
+			o.Status = map[string]any{"code": 2, "message": s.errMsg}
+		}
+		s.mu.Unlock()
+		if s.parent != ([8]byte{}) {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		encoded = append(encoded, o)
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": e.serviceName}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/yolkispalkis/go-apt-cache"},
+				"spans": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+func spansDropped() int64 {
+	if e := spanExporters.Load(); e != nil {
+		return e.dropped.Load() + e.failed.Load()
+	}
+	return 0
+}
+
+// TracingMiddleware starts the root span of each request, which the cache,
+// single-flight and origin spans of the request are children of.
+type TracingMiddleware struct {
+	next http.Handler
+}
+
+func NewTracingMiddleware(next http.Handler) http.Handler {
+	return &TracingMiddleware{next: next}
+}
+
+func (m *TracingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, root := startSpan(withTraceContext(r.Context(), r), r.Method, spanKindServer)
+	if root == nil {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+	defer root.finish()
+
+	r = r.WithContext(ctx)
+	lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	m.next.ServeHTTP(lrw, r)
+
+	root.set("http.request.method", r.Method)
+	root.set("url.path", r.URL.Path)
+	root.set("http.response.status_code", lrw.statusCode)
+	root.set("http.response.body.size", lrw.bytesWritten)
+	if account := byteAccountFrom(r.Context()); account != nil {
+		root.set("cache.status", account.cacheStatus())
+	}
+}
+
+// lookupCache reads an entry from the cache for the request r, recorded as a
+// span of the request.
+func lookupCache(r *http.Request, config ServerConfig, cacheKey string) (io.ReadCloser, int64, time.Time, error) {
+	_, lookupSpan := startSpan(r.Context(), "cache lookup", spanKindInternal)
+	defer lookupSpan.finish()
+
+	content, size, lastModified, err := config.Cache.Get(cacheKey)
+	lookupSpan.set("cache.key", cacheKey)
+	lookupSpan.set("cache.hit", err == nil)
+	if err == nil {
+		lookupSpan.set("cache.entry.size", size)
+	}
+	return content, size, lastModified, err
+}
+
+// startCacheWriteSpan starts the span of storing size bytes under cacheKey
+// for the request r.
+func startCacheWriteSpan(r *http.Request, cacheKey string, size int64) *span {
+	_, writeSpan := startSpan(r.Context(), "cache write", spanKindInternal)
+	writeSpan.set("cache.key", cacheKey)
+	writeSpan.set("cache.entry.size", size)
+	return writeSpan
+}
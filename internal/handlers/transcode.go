@@ -0,0 +1,327 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gz"
+)
+
+// compressionSuffixes are the index variants apt may request. Only the
+// uncompressed variant is produced by transcoding, by decompressing a gzip
+// canonical file; compressed variants are served as the origin published
+// them, as recompressed bytes would not match the hashes in the Release.
+var compressionSuffixes = []string{".gz", ".xz", ".bz2", ".lzma"}
+
+// decompressedSizeHeader records the uncompressed length of a gzip canonical
+// index, so ranges of the decompressed variant can be answered with their
+// total. Like fetchedAtHeader it is never sent to clients; it is dropped
+// whenever a new copy of the index is stored with fresh headers.
+const decompressedSizeHeader = "X-Cache-Decompressed-Size"
+
+// transcodableIndexes are the base names of index files stored in a single
+// canonical compression when a policy is configured.
+var transcodableIndexes = []string{"Packages", "Sources", "Translation-", "Contents-"}
+
+// splitCompression splits a compression suffix off the path, returning an
+// empty suffix for uncompressed files.
+func splitCompression(p string) (string, string) {
+	for _, suffix := range compressionSuffixes {
+		if strings.HasSuffix(p, suffix) {
+			return strings.TrimSuffix(p, suffix), suffix
+		}
+	}
+	return p, ""
+}
+
+func compressionSuffix(format string) string {
+	if format == CompressionGzip {
+		return ".gz"
+	}
+	return ""
+}
+
+func isTranscodable(remotePath string) bool {
+	if strings.Contains("/"+remotePath, "/by-hash/") {
+		return false
+	}
+	if _, ok := utils.SuitePrefix(remotePath); !ok {
+		return false
+	}
+
+	base, _ := splitCompression(path.Base(remotePath))
+	for _, index := range transcodableIndexes {
+		if base == index || (strings.HasSuffix(index, "-") && strings.HasPrefix(base, index)) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalVariant returns the path of the canonical file a request for
+// requestPath is served from by decompressing it, if it is.
+func canonicalVariant(config ServerConfig, requestPath string) (string, bool) {
+	if config.CanonicalCompression != CompressionGzip || !isTranscodable(getRemotePath(config, requestPath)) {
+		return "", false
+	}
+	base, suffix := splitCompression(requestPath)
+	if suffix != "" {
+		return "", false
+	}
+	return base + compressionSuffix(config.CanonicalCompression), true
+}
+
+// discardResponseWriter swallows the response of an internal request, keeping
+// only its status.
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponseWriter) Write(p []byte) (int, error) {
+	if d.status == 0 {
+		d.status = http.StatusOK
+	}
+	return len(p), nil
+}
+
+func (d *discardResponseWriter) WriteHeader(status int) {
+	if d.status == 0 {
+		d.status = status
+	}
+}
+
+// handleTranscoded serves the uncompressed variant of an index from its gzip
+// canonical file. The canonical file goes through the regular request flow,
+// so it is validated, fetched and cached like any other index, and is then
+// decompressed for the client. It returns false when the request is not
+// eligible or the canonical file is unavailable, in which case the caller
+// handles the requested variant as usual.
+func handleTranscoded(w http.ResponseWriter, r *http.Request, config ServerConfig) bool {
+	canonicalPath, ok := canonicalVariant(config, r.URL.Path)
+	if !ok {
+		return false
+	}
+	canonicalKey := tenantCacheKey(r, getCacheKey(config, canonicalPath))
+
+	canonical := r.Clone(r.Context())
+	canonical.Method = http.MethodGet
+	canonical.URL.Path = canonicalPath
+	canonical.URL.RawPath = ""
+	// The client's headers still apply, such as those selecting a tenant,
+	// but not the ones that could make the response anything but the whole
+	// canonical file.
+	canonical.Header = r.Header.Clone()
+	for _, name := range []string{"Range", "If-Range", "If-Modified-Since", "If-None-Match", "If-Match", "If-Unmodified-Since"} {
+		canonical.Header.Del(name)
+	}
+
+	discard := &discardResponseWriter{header: make(http.Header)}
+	HandleRequest(config, true)(discard, canonical)
+	if discard.status != http.StatusOK {
+		logging.Debug("Transcode: Canonical %s unavailable (status %d), serving %s as is", canonicalPath, discard.status, r.URL.Path)
+		return false
+	}
+
+	// The leader stores the canonical file in the background; wait for it.
+	if req, _ := joinInflight(canonicalKey, 0); req != nil {
+		select {
+		case <-req.done:
+		case <-r.Context().Done():
+		}
+		atomic.AddInt32(&req.waiters, -1)
+	}
+
+	content, _, lastModified, err := config.Cache.Get(canonicalKey)
+	if err != nil {
+		return false
+	}
+	defer content.Close()
+
+	cachedHeaders, err := config.HeaderCache.GetHeaders(canonicalKey)
+	if err != nil {
+		return false
+	}
+
+	gz, err := gzip.NewReader(content)
+	if err != nil {
+		logging.Error("Transcode: Cached %s is not valid gzip: %v", canonicalKey, err)
+		return false
+	}
+	defer gz.Close()
+
+	setDownstreamCacheHeaders(w, r, config, cachedHeaders)
+
+	lastModifiedStr := cachedHeaders.Get("Last-Modified")
+	if checkAndHandleIfModifiedSince(w, r, lastModifiedStr, lastModified, config) {
+		return true
+	}
+	if lastModifiedStr != "" {
+		w.Header().Set("Last-Modified", lastModifiedStr)
+	}
+	if contentType, ok := utils.LookupContentType(r.URL.Path); ok {
+		w.Header().Set("Content-Type", contentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	if config.LogRequests {
+		logging.Info("Transcode: Serving %s from %s", r.URL.Path, canonicalKey)
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && ifRangeMatches(r, lastModifiedStr) {
+		size, err := decompressedSize(config, canonicalKey, cachedHeaders)
+		if err != nil {
+			logging.Error("Transcode: Cannot determine the decompressed size of %s: %v", canonicalKey, err)
+		} else if start, length, ok := parseSingleRange(rangeHeader, size); ok {
+			serveDecompressedRange(w, r, gz, start, length, size)
+			return true
+		} else if length < 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "Requested Range Not Satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return true
+		}
+	}
+	if size, err := strconv.ParseInt(cachedHeaders.Get(decompressedSizeHeader), 10, 64); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return true
+	}
+
+	if _, err := io.Copy(w, gz); err != nil {
+		logging.Error("Transcode: Error streaming %s: %v", r.URL.Path, err)
+	}
+	return true
+}
+
+// serveDecompressedRange answers a range of decompressed content by
+// decompressing and discarding everything before start.
+func serveDecompressedRange(w http.ResponseWriter, r *http.Request, reader io.Reader, start, length, size int64) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.CopyN(io.Discard, reader, start); err != nil {
+		logging.Error("Transcode: Error skipping to offset %d of %s: %v", start, r.URL.Path, err)
+		return
+	}
+	if _, err := io.CopyN(w, reader, length); err != nil {
+		logging.Error("Transcode: Error streaming range of %s: %v", r.URL.Path, err)
+	}
+}
+
+// decompressedSize returns the uncompressed length of the gzip canonical
+// index cached under canonicalKey. It is computed by decompressing the index
+// once and then kept in the entry's headers, unless the headers changed
+// meanwhile: then a new copy of the index was stored, which the size may not
+// belong to.
+func decompressedSize(config ServerConfig, canonicalKey string, cachedHeaders http.Header) (int64, error) {
+	if size, err := strconv.ParseInt(cachedHeaders.Get(decompressedSizeHeader), 10, 64); err == nil {
+		return size, nil
+	}
+
+	content, _, _, err := config.Cache.Get(canonicalKey)
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+	gz, err := gzip.NewReader(content)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	size, err := io.Copy(io.Discard, gz)
+	if err != nil {
+		return 0, err
+	}
+
+	current, err := config.HeaderCache.GetHeaders(canonicalKey)
+	if err != nil {
+		return 0, err
+	}
+	if !maps.EqualFunc(current, cachedHeaders, slices.Equal[[]string]) {
+		return 0, fmt.Errorf("%s was replaced while its size was measured", canonicalKey)
+	}
+	stamped := cachedHeaders.Clone()
+	stamped.Set(decompressedSizeHeader, strconv.FormatInt(size, 10))
+	if err := config.HeaderCache.PutHeaders(canonicalKey, stamped); err != nil {
+		logging.Error("Transcode: Error storing the decompressed size of %s: %v", canonicalKey, err)
+	}
+	return size, nil
+}
+
+// ifRangeMatches reports whether a Range header applies: without If-Range it
+// always does, otherwise only if If-Range names the current Last-Modified.
+func ifRangeMatches(r *http.Request, lastModified string) bool {
+	ifRange := r.Header.Get("If-Range")
+	return ifRange == "" || (lastModified != "" && ifRange == lastModified)
+}
+
+// parseSingleRange parses a Range header holding one byte range against
+// content of the given size. It returns ok if the range can be served, and a
+// negative length if it lies entirely beyond the content. Other headers,
+// including multiple ranges, are not supported and leave both zero, so the
+// full content is sent.
+func parseSingleRange(header string, size int64) (start, length int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		if size == 0 {
+			return 0, -1, false
+		}
+		suffix = min(suffix, size)
+		return size - suffix, suffix, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, -1, false
+	}
+	return start, end - start + 1, true
+}
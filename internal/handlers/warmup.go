@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// warmupState tracks the background fetch of a repository's critical
+// metadata after startup. While it is warming, metadata requests that are not
+// cached yet are answered with 503 so that a crowd of cold clients does not
+// stampede the origin.
+type warmupState struct {
+	warm       atomic.Bool
+	fetched    atomic.Int32
+	required   int32
+	retryAfter int
+}
+
+func (s *warmupState) isWarm() bool {
+	return s == nil || s.warm.Load()
+}
+
+// startWarmup prefetches the given paths through the regular request flow
+// with the given number of workers. The repository is considered warm once
+// the threshold fraction of them has been cached, once every path has been
+// tried, or after maxWait, whichever comes first. Closing stop ends the
+// warm-up: no further path is fetched, though a fetch in progress completes
+// so its result is cached. It returns nil when there is nothing to warm.
+func startWarmup(config ServerConfig, paths []string, workers int, threshold float64, maxWait time.Duration, retryAfter int, stop <-chan struct{}) *warmupState {
+	if len(paths) == 0 {
+		return nil
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if threshold <= 0 || threshold > 1 {
+		threshold = 1
+	}
+
+	required := int32(float64(len(paths))*threshold + 0.5)
+	if required < 1 {
+		required = 1
+	}
+	state := &warmupState{required: required, retryAfter: retryAfter}
+
+	if maxWait > 0 {
+		time.AfterFunc(maxWait, func() {
+			if !state.warm.Swap(true) {
+				logging.Warning("Warm-up of %s did not finish within %v, serving normally", config.LocalPath, maxWait)
+			}
+		})
+	}
+
+	// The context ends prefetches waiting for their turn once stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		cancel()
+	}()
+
+	queue := make(chan string)
+	go func() {
+		defer close(queue)
+		for _, p := range paths {
+			if state.warm.Load() {
+				return
+			}
+			select {
+			case queue <- p:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	handler := HandleRequest(config, true)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				state.prefetch(ctx, config, handler, p, len(paths))
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+		select {
+		case <-stop:
+			logging.Info("Warm-up of %s stopped", config.LocalPath)
+			return
+		default:
+		}
+		if !state.warm.Swap(true) {
+			logging.Warning("Warm-up of %s fetched only %d of %d paths, serving normally", config.LocalPath, state.fetched.Load(), len(paths))
+		}
+	}()
+
+	return state
+}
+
+func (s *warmupState) prefetch(ctx context.Context, config ServerConfig, handler http.HandlerFunc, p string, total int) {
+	if ctx.Err() != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/"+strings.TrimPrefix(p, "/"), nil)
+	if err != nil {
+		logging.Warning("Warm-up: Invalid path %s: %v", p, err)
+		return
+	}
+
+	// Prefetches yield to client fetches, so wait for a quiet moment before
+	// even checking the cache.
+	req = withPrefetch(req)
+	waitForPrefetchTurn(req.Context())
+	if ctx.Err() != nil {
+		return
+	}
+
+	discard := &discardResponseWriter{header: make(http.Header)}
+	handler(discard, req)
+	event := Event{Type: EventWarm, Key: p, Repository: config.LocalPath, Status: discard.status, Total: total}
+	cached := discard.status == http.StatusOK && warmedUp(config, req.URL.Path)
+	if !cached {
+		if discard.status == http.StatusOK {
+			logging.Warning("Warm-up: %s was fetched but not cached", p)
+		} else {
+			logging.Warning("Warm-up: Failed to fetch %s (status %d)", p, discard.status)
+		}
+		event.Fetched = s.fetched.Load()
+		event.Warm = s.isWarm()
+		PublishEvent(event)
+		return
+	}
+
+	event.Fetched = s.fetched.Add(1)
+	if event.Fetched >= s.required && !s.warm.Swap(true) {
+		logging.Info("Warm-up of %s complete (%d of %d paths)", config.LocalPath, s.fetched.Load(), total)
+	}
+	event.Warm = s.isWarm()
+	PublishEvent(event)
+}
+
+// warmedUp reports whether the file a warm-up request was just answered for
+// is in the cache, itself or as the canonical file it is decompressed from.
+// A fresh copy is written in the background once the response is complete,
+// so a fetch still holding the key is waited for first. Responses that are
+// passed through without being stored do not count.
+func warmedUp(config ServerConfig, requestPath string) bool {
+	keys := []string{getCacheKey(config, requestPath)}
+	if canonicalPath, ok := canonicalVariant(config, requestPath); ok {
+		keys = append(keys, getCacheKey(config, canonicalPath))
+	}
+	for _, key := range keys {
+		if req, _ := joinInflight(key, 0); req != nil {
+			<-req.done
+			atomic.AddInt32(&req.waiters, -1)
+		}
+		if content, _, _, err := config.Cache.Get(key); err == nil {
+			content.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// rejectWhileWarming answers 503 for metadata that is not cached yet while
+// the repository is warming up. It returns true if the request was rejected.
+func rejectWhileWarming(w http.ResponseWriter, r *http.Request, config ServerConfig, state *warmupState) bool {
+	if state.isWarm() || utils.GetFilePatternType(r.URL.Path) != utils.TypeFrequentlyChanging {
+		return false
+	}
+
+	if content, _, _, err := config.Cache.Get(tenantCacheKey(r, getCacheKey(config, r.URL.Path))); err == nil {
+		content.Close()
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(state.retryAfter))
+	http.Error(w, "Service Unavailable: cache is warming up", http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Fields are structured values attached to a log line. The text format
+// ignores them, since its message already carries the same information; the
+// JSON format adds them to the line's object.
+type Fields map[string]interface{}
+
+// formatLine renders one log line without the trailing newline.
+func formatLine(format string, now time.Time, level LogLevel, message string, fields Fields) string {
+	if format != FormatJSON {
+		return fmt.Sprintf("[%s] [%s] %s", now.Format("2006-01-02 15:04:05"), level.String(), message)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"ts":`)
+	writeJSONValue(&buf, now.UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(&buf, message)
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if key != "ts" && key != "level" && key != "msg" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.WriteByte(',')
+		writeJSONValue(&buf, key)
+		buf.WriteByte(':')
+		writeJSONValue(&buf, fields[key])
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+func writeJSONValue(buf *bytes.Buffer, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(data)
+}
@@ -52,6 +52,12 @@ type LogConfig struct {
 	DisableTerminal bool
 	MaxSize         string
 	Level           LogLevel
+	Format          string // FormatText (default) or FormatJSON
+	// Output is an additional destination for log lines, such as a syslog
+	// connection or a rotating file writer. Writes to it are serialized, so
+	// it need not be safe for concurrent use, but they hold up logging, so
+	// it must not block. It is closed with the logger if it is an io.Closer.
+	Output io.Writer
 }
 
 type LogLevel int
@@ -131,6 +137,10 @@ func NewLogger(config LogConfig) (*Logger, error) {
 		writers = append(writers, logger.fileWriter)
 	}
 
+	if config.Output != nil {
+		writers = append(writers, config.Output)
+	}
+
 	var writer io.Writer
 	if len(writers) > 0 {
 		writer = io.MultiWriter(writers...)
@@ -172,18 +182,23 @@ func (l *Logger) setupFileWriter() error {
 	return nil
 }
 
+// rotateLogFile is called while a line is being written, so the caller
+// already holds l.mu.
 func (l *Logger) rotateLogFile() error {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-
 	if l.file != nil {
 		l.file.Close()
 	}
 
-	backupName := fmt.Sprintf("%s.%s", l.config.FilePath, time.Now().Format("20060102-150405"))
+	// Rotations within the same second get a counter so no backup is
+	// overwritten.
+	stamp := time.Now().Format("20060102-150405")
+	backupName := fmt.Sprintf("%s.%s", l.config.FilePath, stamp)
+	for i := 1; fileExists(backupName); i++ {
+		backupName = fmt.Sprintf("%s.%s.%d", l.config.FilePath, stamp, i)
+	}
 	if err := os.Rename(l.config.FilePath, backupName); err != nil {
 		if !os.IsNotExist(err) {
-			Error("Failed to rotate log file: %v", err)
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file: %v\n", err)
 		}
 	}
 
@@ -215,10 +230,18 @@ func (l *Logger) rotateLogFile() error {
 	return nil
 }
 
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
 func (l *Logger) Close() error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if closer, ok := l.config.Output.(io.Closer); ok {
+		closer.Close()
+	}
 	if l.file != nil {
 		return l.file.Close()
 	}
@@ -226,6 +249,10 @@ func (l *Logger) Close() error {
 }
 
 func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
+	l.logFields(level, nil, format, args...)
+}
+
+func (l *Logger) logFields(level LogLevel, fields Fields, format string, args ...interface{}) {
 	if level < l.config.Level {
 		return
 	}
@@ -233,16 +260,13 @@ func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	now := time.Now().Format("2006-01-02 15:04:05")
-	prefix := fmt.Sprintf("[%s] [%s] ", now, level.String())
-
 	var message string
 	if format == "" {
 		message = fmt.Sprint(args...)
 	} else {
 		message = fmt.Sprintf(format, args...)
 	}
-	l.logger.Output(2, prefix+message)
+	l.logger.Output(2, formatLine(l.config.Format, time.Now(), level, message, fields))
 }
 
 func (l *Logger) Debug(format string, args ...interface{}) {
@@ -253,6 +277,12 @@ func (l *Logger) Info(format string, args ...interface{}) {
 	l.log(INFO, format, args...)
 }
 
+// InfoFields logs at INFO level with structured fields, which the JSON
+// format emits alongside the message.
+func (l *Logger) InfoFields(fields Fields, format string, args ...interface{}) {
+	l.logFields(INFO, fields, format, args...)
+}
+
 func (l *Logger) Warning(format string, args ...interface{}) {
 	l.log(WARNING, format, args...)
 }
@@ -309,6 +339,12 @@ func Info(format string, args ...interface{}) {
 	}
 }
 
+func InfoFields(fields Fields, format string, args ...interface{}) {
+	if DefaultLogger != nil {
+		DefaultLogger.InfoFields(fields, format, args...)
+	}
+}
+
 func Warning(format string, args ...interface{}) {
 	if DefaultLogger != nil {
 		DefaultLogger.Warning(format, args...)
@@ -0,0 +1,207 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoggerWritesToOutput(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := NewLogger(LogConfig{DisableTerminal: true, Level: INFO, Output: &out})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			logger.Info("line %d", i)
+		}(i)
+	}
+	wg.Wait()
+	logger.Debug("hidden")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 50 {
+		t.Fatalf("Expected 50 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "[INFO] line ") {
+			t.Errorf("Unexpected log line: %q", line)
+		}
+	}
+}
+
+func TestLoggerRotatesWithoutDeadlock(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := NewLogger(LogConfig{
+		FilePath:        dir + "/app.log",
+		DisableTerminal: true,
+		MaxSize:         "100B",
+		Level:           INFO,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer logger.Close()
+
+	for i := 0; i < 10; i++ {
+		logger.Info("a line long enough to fill the log file quickly %d", i)
+	}
+
+	files, err := filepath.Glob(dir + "/app.log*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("Expected the log to be rotated, got %v", files)
+	}
+	seen := make(map[string]bool)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		if len(data) > 100 {
+			t.Errorf("Expected %s to stay within the maximum size, got %d bytes", file, len(data))
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			seen[line[strings.Index(line, "[INFO]"):]] = true
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if line := fmt.Sprintf("[INFO] a line long enough to fill the log file quickly %d", i); !seen[line] {
+			t.Errorf("Expected %q to be kept across rotations", line)
+		}
+	}
+}
+
+func TestLoggerSendsToRemoteOutput(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+
+	output, err := NewRemoteOutput("tcp://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	logger, err := NewLogger(LogConfig{DisableTerminal: true, Level: INFO, Output: output})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	logger.Info("sent %s", "remotely")
+
+	select {
+	case line := <-received:
+		if !strings.Contains(line, "[INFO] sent remotely") {
+			t.Errorf("Unexpected line: %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the line to reach the remote output")
+	}
+
+	for _, address := range []string{"syslog.example:514", "http://syslog.example:514", "tcp://"} {
+		if _, err := NewRemoteOutput(address); err == nil {
+			t.Errorf("Expected %q to be rejected", address)
+		}
+	}
+}
+
+func TestRemoteOutputDoesNotBlockLogging(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	// The collector accepts the connection but never reads from it.
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	output, err := NewRemoteOutput("tcp://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	logger, err := NewLogger(LogConfig{DisableTerminal: true, Level: INFO, Output: output})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	defer func() {
+		if conn := <-accepted; conn != nil {
+			conn.Close()
+		}
+	}()
+
+	// Far more than the socket buffers hold.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		line := strings.Repeat("x", 64<<10)
+		for i := 0; i < 2*remoteQueueSize; i++ {
+			logger.Info("%s", line)
+		}
+		logger.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * remoteWriteTimeout):
+		t.Fatal("Expected logging to go on while the collector does not read")
+	}
+}
+
+func TestLoggerJSONFormat(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := NewLogger(LogConfig{DisableTerminal: true, Level: INFO, Format: FormatJSON, Output: &out})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	logger.Error("disk %q full", "/var/cache")
+	logger.InfoFields(Fields{"path": "/pool/a.deb", "status": 200, "msg": "ignored"}, "served")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d: %q", len(lines), out.String())
+	}
+
+	var errorLine, accessLine map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &errorLine); err != nil {
+		t.Fatalf("Error line is not JSON: %v", err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &accessLine); err != nil {
+		t.Fatalf("Access line is not JSON: %v", err)
+	}
+
+	if errorLine["level"] != "ERROR" || errorLine["msg"] != `disk "/var/cache" full` || errorLine["ts"] == nil {
+		t.Errorf("Unexpected error line: %v", errorLine)
+	}
+	if accessLine["msg"] != "served" || accessLine["path"] != "/pool/a.deb" || accessLine["status"] != float64(200) {
+		t.Errorf("Unexpected access line: %v", accessLine)
+	}
+}
@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// remoteDialTimeout bounds connecting to a remote log destination.
+	remoteDialTimeout = 5 * time.Second
+	// remoteWriteTimeout bounds sending a line, so a collector that stops
+	// reading does not hold up the queue for good.
+	remoteWriteTimeout = 5 * time.Second
+	// remoteQueueSize is the number of lines waiting to be sent. Further
+	// lines are dropped for the remote destination until it catches up.
+	remoteQueueSize = 1024
+	// remoteRedialMin and remoteRedialMax bound the wait before dialing
+	// again after a failed attempt. Lines logged meanwhile are dropped.
+	remoteRedialMin = time.Second
+	remoteRedialMax = time.Minute
+)
+
+// remoteWriter sends log lines to a syslog daemon or log shipper listening
+// for plain lines over TCP or UDP. Lines are queued and sent by a goroutine,
+// so logging never waits for the collector; while it is down or slow, lines
+// it cannot take are dropped for it but still reach the other outputs. A
+// connection that fails is dropped and dialed again, backing off while the
+// collector stays unreachable.
+type remoteWriter struct {
+	network string
+	address string
+	lines   chan []byte
+	stop    chan struct{}
+	done    chan struct{}
+	closing sync.Once
+}
+
+// NewRemoteOutput returns a writer for LogConfig.Output sending log lines to
+// a "tcp://host:port" or "udp://host:port" address. It connects right away
+// so a wrong address is noticed at startup.
+func NewRemoteOutput(address string) (io.WriteCloser, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log output %q: %w", address, err)
+	}
+	if (u.Scheme != "tcp" && u.Scheme != "udp") || u.Host == "" {
+		return nil, fmt.Errorf("invalid log output %q, expected tcp://host:port or udp://host:port", address)
+	}
+
+	w := &remoteWriter{
+		network: u.Scheme,
+		address: u.Host,
+		lines:   make(chan []byte, remoteQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	conn, err := w.dial()
+	if err != nil {
+		return nil, err
+	}
+	go w.run(conn)
+	return w, nil
+}
+
+func (w *remoteWriter) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(w.network, w.address, remoteDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to log output %s://%s: %w", w.network, w.address, err)
+	}
+	return conn, nil
+}
+
+// Write queues a line, or drops it if the queue is full. It never fails, so
+// the other outputs are written regardless.
+func (w *remoteWriter) Write(p []byte) (int, error) {
+	select {
+	case w.lines <- append([]byte(nil), p...):
+	default:
+	}
+	return len(p), nil
+}
+
+// Close sends the queued lines, waiting no longer than a write may take,
+// and closes the connection.
+func (w *remoteWriter) Close() error {
+	w.closing.Do(func() { close(w.stop) })
+	select {
+	case <-w.done:
+	case <-time.After(remoteWriteTimeout):
+	}
+	return nil
+}
+
+// run sends the queued lines over conn until the writer is closed.
+func (w *remoteWriter) run(conn net.Conn) {
+	defer close(w.done)
+	backoff := remoteRedialMin
+	var redialAt time.Time
+
+	send := func(line []byte) {
+		if conn == nil {
+			if time.Now().Before(redialAt) {
+				return
+			}
+			var err error
+			if conn, err = w.dial(); err != nil {
+				redialAt = time.Now().Add(backoff)
+				backoff = min(2*backoff, remoteRedialMax)
+				return
+			}
+			backoff = remoteRedialMin
+		}
+		conn.SetWriteDeadline(time.Now().Add(remoteWriteTimeout))
+		if _, err := conn.Write(line); err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+
+	for {
+		select {
+		case line := <-w.lines:
+			send(line)
+		case <-w.stop:
+			for {
+				select {
+				case line := <-w.lines:
+					send(line)
+				default:
+					if conn != nil {
+						conn.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
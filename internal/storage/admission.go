@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// Admitter is implemented by caches with an admission policy, which may
+// decline to store an entry that is likely worth less than the entries it
+// would evict.
+type Admitter interface {
+	Admit(key string, size int64) bool
+}
+
+// AccessRecorder is implemented by caches that keep track of client requests
+// for their entries, as opposed to reads made for the proxy's own use, such
+// as checking an index against its Release.
+type AccessRecorder interface {
+	// RecordAccess records a client request for key, whether or not the
+	// entry is cached.
+	RecordAccess(key string)
+}
+
+const (
+	sketchDepth      = 4
+	sketchMaxCount   = 15 // Counters saturate like the 4-bit counters of TinyLFU
+	sketchMinWidth   = 1 << 10
+	sketchMaxWidth   = 1 << 22
+	sketchSampleSize = 10 // Counts are halved every sampleSize*width additions
+)
+
+// frequencySketch is a count-min sketch estimating how often each key was
+// requested recently, the frequency filter of TinyLFU. Counts are halved
+// periodically so that old popularity fades.
+type frequencySketch struct {
+	mu        sync.Mutex
+	seed      maphash.Seed
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+// newFrequencySketch sizes a sketch for about the given number of entries.
+func newFrequencySketch(expectedEntries int) *frequencySketch {
+	width := sketchMinWidth
+	for width < expectedEntries && width < sketchMaxWidth {
+		width <<= 1
+	}
+
+	s := &frequencySketch{
+		seed:    maphash.MakeSeed(),
+		mask:    uint64(width - 1),
+		resetAt: sketchSampleSize * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *frequencySketch) indexes(key string) [sketchDepth]uint64 {
+	h := maphash.String(s.seed, key)
+	low, high := h&0xffffffff, h>>32|1
+	var indexes [sketchDepth]uint64
+	for i := range indexes {
+		indexes[i] = (low + uint64(i)*high) & s.mask
+	}
+	return indexes
+}
+
+func (s *frequencySketch) increment(key string) {
+	indexes := s.indexes(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, index := range indexes {
+		if s.rows[i][index] < sketchMaxCount {
+			s.rows[i][index]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *frequencySketch) estimate(key string) uint8 {
+	indexes := s.indexes(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	estimate := uint8(sketchMaxCount)
+	for i, index := range indexes {
+		estimate = min(estimate, s.rows[i][index])
+	}
+	return estimate
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// SweepResult counts what a consistency sweep removed.
+type SweepResult struct {
+	OrphanedHeaders int // Header entries without a cached body
+	OrphanedBodies  int // Cached bodies without headers, which cannot be served
+}
+
+// SweepOrphans reconciles a cache with its header cache: headers stored for
+// a key the cache does not hold are deleted, and so are cached bodies that
+// have no headers. Keys for which inUse returns true, such as those being
+// fetched right now, are left alone since their body and headers are
+// written one after the other. Both caches must implement KeyLister.
+func SweepOrphans(cache Cache, headerCache HeaderCache, inUse func(key string) bool) (SweepResult, error) {
+	var result SweepResult
+
+	cacheLister, ok := cache.(KeyLister)
+	if !ok {
+		return result, fmt.Errorf("cache cannot list its keys")
+	}
+	headerLister, ok := headerCache.(KeyLister)
+	if !ok {
+		return result, fmt.Errorf("header cache cannot list its keys")
+	}
+
+	bodyKeys, err := cacheLister.Keys()
+	if err != nil {
+		return result, fmt.Errorf("failed to list cached bodies: %w", err)
+	}
+	headerKeys, err := headerLister.Keys()
+	if err != nil {
+		return result, fmt.Errorf("failed to list cached headers: %w", err)
+	}
+
+	// Keys are compared by the path they are stored under: headers listed
+	// from disk carry that form, while the cache may know the original key.
+	bodies := make(map[string]bool, len(bodyKeys))
+	for _, key := range bodyKeys {
+		bodies[storedPath(key)] = true
+	}
+	headers := make(map[string]bool, len(headerKeys))
+	for _, key := range headerKeys {
+		headers[storedPath(key)] = true
+	}
+
+	for _, key := range headerKeys {
+		if bodies[storedPath(key)] || (inUse != nil && inUse(key)) {
+			continue
+		}
+		// The body may have been stored since the keys were listed.
+		if content, _, _, err := cache.Get(key); err == nil {
+			content.Close()
+			continue
+		}
+		if err := headerCache.DeleteHeaders(key); err != nil {
+			logging.Warning("Sweep: Failed to remove orphaned headers of %s: %v", key, err)
+			continue
+		}
+		logging.Debug("Sweep: Removed orphaned headers of %s", key)
+		result.OrphanedHeaders++
+	}
+
+	for _, key := range bodyKeys {
+		if headers[storedPath(key)] || (inUse != nil && inUse(key)) {
+			continue
+		}
+		if _, err := headerCache.GetHeaders(key); !errors.Is(err, ErrHeadersNotFound) {
+			continue
+		}
+		if err := cache.Delete(key); err != nil {
+			logging.Warning("Sweep: Failed to remove orphaned body of %s: %v", key, err)
+			continue
+		}
+		logging.Debug("Sweep: Removed orphaned body of %s", key)
+		result.OrphanedBodies++
+	}
+
+	return result, nil
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+	"github.com/yolkispalkis/go-apt-cache/internal/utils"
+)
+
+// blobDirectory holds the content-addressed blobs of a deduplicating cache.
+// Cache files are hard links to these blobs, so identical content stored
+// under several keys (e.g. an index and its by-hash twin) takes disk space
+// only once.
+const blobDirectory = ".blobs"
+
+// blobRef counts the cache entries linked to one blob.
+type blobRef struct {
+	refs int
+	size int64
+}
+
+func (c *LRUCache) blobPath(hash string) string {
+	return filepath.Join(c.basePath, blobDirectory, hash[:2], hash)
+}
+
+// retain adds a reference to the blob and returns the number of bytes the
+// reference adds to the cache size: the full size for entries that are not
+// deduplicated or for the first reference to a blob, zero otherwise. The
+// caller must hold the mutex.
+func (c *LRUCache) retain(hash string, size int64) int64 {
+	if hash == "" {
+		return size
+	}
+
+	ref, exists := c.blobs[hash]
+	if !exists {
+		ref = &blobRef{size: size}
+		c.blobs[hash] = ref
+	}
+	ref.refs++
+	if ref.refs == 1 {
+		return ref.size
+	}
+	return 0
+}
+
+// release drops the item's reference to its blob, removing the blob once no
+// entry refers to it any more. It returns the number of bytes freed. The
+// caller must hold the mutex.
+func (c *LRUCache) release(item *cacheItem) int64 {
+	if item.blob == "" {
+		return item.size
+	}
+
+	ref, exists := c.blobs[item.blob]
+	if !exists {
+		return 0
+	}
+	ref.refs--
+	if ref.refs > 0 {
+		return 0
+	}
+
+	delete(c.blobs, item.blob)
+	if err := c.removeFile(item.key, c.blobPath(item.blob), item.blob); err != nil && !os.IsNotExist(err) {
+		logging.Warning("failed to remove blob %s: %v", item.blob, err)
+	}
+	return ref.size
+}
+
+// linkBlob moves the freshly written temporary file into the blob store,
+// unless a blob with the same content already exists, and links the cache
+// file for key to it. The caller must hold the mutex.
+func (c *LRUCache) linkBlob(tempFilePath, filePath, hash string) error {
+	blobPath := c.blobPath(hash)
+
+	if _, exists := c.blobs[hash]; exists {
+		os.Remove(tempFilePath)
+	} else {
+		if err := utils.CreateDirectory(filepath.Dir(blobPath)); err != nil {
+			os.Remove(tempFilePath)
+			return err
+		}
+		if err := os.Rename(tempFilePath, blobPath); err != nil {
+			os.Remove(tempFilePath)
+			return err
+		}
+	}
+
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(blobPath, filePath)
+}
+
+type blobFile struct {
+	hash string
+	info os.FileInfo
+}
+
+// loadBlobIndex lists the blobs on disk by size, so cache files found at
+// startup can be matched to the blob they are linked to.
+func (c *LRUCache) loadBlobIndex() map[int64][]blobFile {
+	index := make(map[int64][]blobFile)
+
+	root := filepath.Join(c.basePath, blobDirectory)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		index[info.Size()] = append(index[info.Size()], blobFile{hash: info.Name(), info: info})
+		return nil
+	})
+	return index
+}
+
+// matchBlob returns the hash of the blob the cache file is linked to, or an
+// empty string if it is not a link to any blob.
+func matchBlob(index map[int64][]blobFile, info os.FileInfo) string {
+	for _, blob := range index[info.Size()] {
+		if os.SameFile(blob.info, info) {
+			return blob.hash
+		}
+	}
+	return ""
+}
+
+// removeUnreferencedBlobs deletes blobs no cache file links to, e.g. after a
+// crash between storing a blob and linking it.
+func (c *LRUCache) removeUnreferencedBlobs(index map[int64][]blobFile) {
+	for _, blobs := range index {
+		for _, blob := range blobs {
+			if _, exists := c.blobs[blob.hash]; exists {
+				continue
+			}
+			logging.Debug("Removing unreferenced blob: %s", blob.hash)
+			if err := os.Remove(c.blobPath(blob.hash)); err != nil && !os.IsNotExist(err) {
+				logging.Warning("failed to remove blob %s: %v", blob.hash, err)
+			}
+		}
+	}
+}
@@ -2,6 +2,8 @@ package storage
 
 import (
 	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -38,7 +40,9 @@ func (f *FileOperations) EnsureDirectoryExists(relativePath string) error {
 	return utils.CreateDirectory(dirPath)
 }
 
-func (f *FileOperations) getFilePath(key string, fileType FileType) string {
+// storedPath returns the slash-separated path, relative to the cache
+// directory, under which a key is stored. Distinct keys may share one.
+func storedPath(key string) string {
 	// Normalize path by removing multiple slashes and ensuring consistent format
 	normalizedKey := strings.Join(strings.FieldsFunc(key, func(r rune) bool {
 		return r == '/'
@@ -49,7 +53,11 @@ func (f *FileOperations) getFilePath(key string, fileType FileType) string {
 	for i, part := range parts {
 		parts[i] = utils.SafeFilename(part)
 	}
-	safePath := strings.Join(parts, string(os.PathSeparator))
+	return strings.Join(parts, "/")
+}
+
+func (f *FileOperations) getFilePath(key string, fileType FileType) string {
+	safePath := filepath.FromSlash(storedPath(key))
 
 	if fileType == CacheFile {
 		safePath += ".filecache"
@@ -137,23 +145,52 @@ func (f *FileOperations) DeleteCacheFile(key string) error {
 type LRUCacheOptions struct {
 	BasePath     string
 	MaxSizeBytes int64
+	MaxEntries   int // Zero means no limit on the number of entries
 	CleanOnStart bool
+	Dedup        bool // Store identical content once, see blobDirectory
+	// EvictionGracePeriod protects entries stored less than this long ago
+	// from eviction, whatever their LRU position.
+	EvictionGracePeriod time.Duration
+	// EvictionGuard, when set, is asked before evicting an entry and may
+	// protect it, e.g. while a fetch of the same key is in flight.
+	EvictionGuard func(key string) bool
+	// OnRemove, when set, is called after an entry has been evicted or
+	// deleted, so data kept elsewhere for it, such as its headers, goes with
+	// it. It is called once the cache is unlocked, so it may be slow, and is
+	// skipped for an evicted entry that was stored again in the meantime.
+	OnRemove func(key string)
+	// Admission enables a TinyLFU admission policy: Admit then declines new
+	// entries requested less often than the entries they would evict, as
+	// counted by RecordAccess.
+	Admission bool
 }
 
 type LRUCache struct {
 	basePath     string
 	maxSizeBytes int64
+	maxEntries   int
 	currentSize  int64
 	items        map[string]*list.Element
 	lruList      *list.List
 	mutex        sync.RWMutex
 	fileOps      *FileOperations
+	dedup        bool
+	blobs        map[string]*blobRef
+	gracePeriod  time.Duration
+	guard        func(key string) bool
+	onRemove     func(key string)
+	sketch       *frequencySketch             // Request frequencies for admission, nil when disabled
+	readers      map[string]int               // Open readers by key, tracked only while removals are deferred
+	deferred     map[string][]deferredRemoval // Files to remove once a key's readers are done
 }
 
 type cacheItem struct {
 	key          string
 	size         int64
 	lastModified time.Time
+	blob         string    // Hash of the blob the entry is linked to, empty when not deduplicated
+	stored       time.Time // When the entry was last written, zero for entries found at startup
+	accessed     time.Time // When a client last requested the entry or it was written, startup time for entries found then
 }
 
 func NewLRUCache(basePath string, maxSizeBytes int64) (*LRUCache, error) {
@@ -174,9 +211,26 @@ func NewLRUCacheWithOptions(options LRUCacheOptions) (*LRUCache, error) {
 	cache := &LRUCache{
 		basePath:     options.BasePath,
 		maxSizeBytes: options.MaxSizeBytes,
+		maxEntries:   options.MaxEntries,
 		items:        make(map[string]*list.Element),
 		lruList:      list.New(),
 		fileOps:      fileOps,
+		dedup:        options.Dedup,
+		blobs:        make(map[string]*blobRef),
+		gracePeriod:  options.EvictionGracePeriod,
+		guard:        options.EvictionGuard,
+		onRemove:     options.OnRemove,
+		readers:      make(map[string]int),
+		deferred:     make(map[string][]deferredRemoval),
+	}
+
+	if options.Admission {
+		// Without an entry limit, assume entries of 64KB on average.
+		expected := options.MaxEntries
+		if expected <= 0 {
+			expected = int(min(options.MaxSizeBytes/(64*1024), sketchMaxWidth))
+		}
+		cache.sketch = newFrequencySketch(expected)
 	}
 
 	if options.CleanOnStart {
@@ -185,6 +239,10 @@ func NewLRUCacheWithOptions(options LRUCacheOptions) (*LRUCache, error) {
 		}
 	}
 
+	if err := checkFormatVersion(options.BasePath); err != nil {
+		return nil, err
+	}
+
 	if err := cache.initialize(); err != nil {
 		return nil, fmt.Errorf("failed to initialize cache: %w", err)
 	}
@@ -198,6 +256,7 @@ func (c *LRUCache) Clean() error {
 
 	c.items = make(map[string]*list.Element)
 	c.lruList = list.New()
+	c.blobs = make(map[string]*blobRef)
 	c.currentSize = 0
 
 	entries, err := os.ReadDir(c.basePath)
@@ -248,13 +307,23 @@ func cleanDirectory(dirPath string) error {
 
 func (c *LRUCache) initialize() error {
 	logging.Debug("Initializing LRU cache from directory: %s", c.basePath)
-	return filepath.Walk(c.basePath, func(path string, info os.FileInfo, err error) error {
+
+	var blobIndex map[int64][]blobFile
+	if c.dedup {
+		blobIndex = c.loadBlobIndex()
+	}
+
+	started := time.Now()
+	err := filepath.Walk(c.basePath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			logging.Error("Error walking path %s: %v", path, err)
 			return err
 		}
 
 		if info.IsDir() {
+			if path == filepath.Join(c.basePath, quarantineDirectory) {
+				return filepath.SkipDir
+			}
 			logging.Debug("Skipping directory: %s", path)
 			return nil
 		}
@@ -264,11 +333,6 @@ func (c *LRUCache) initialize() error {
 			return nil
 		}
 
-		if !strings.HasSuffix(path, ".filecache") {
-			logging.Debug("Skipping non-cache file: %s", path)
-			return nil
-		}
-
 		if strings.HasSuffix(path, ".tmp") {
 			logging.Debug("Removing temporary file: %s", path)
 			if err := os.Remove(path); err != nil {
@@ -277,6 +341,11 @@ func (c *LRUCache) initialize() error {
 			return nil
 		}
 
+		if !strings.HasSuffix(path, ".filecache") {
+			logging.Debug("Skipping non-cache file: %s", path)
+			return nil
+		}
+
 		relPath, err := filepath.Rel(c.basePath, path)
 		if err != nil {
 			logging.Error("Error getting relative path for %s: %v", path, err)
@@ -294,15 +363,53 @@ func (c *LRUCache) initialize() error {
 			key:          key,
 			size:         info.Size(),
 			lastModified: info.ModTime(),
+			accessed:     started,
+		}
+		if c.dedup {
+			item.blob = matchBlob(blobIndex, info)
 		}
 		element := c.lruList.PushFront(item)
 		c.items[key] = element
-		c.currentSize += info.Size()
+		c.currentSize += c.retain(item.blob, info.Size())
 
 		logging.Debug("Added cache item: key=%s, size=%d bytes, lastModified=%v", key, info.Size(), info.ModTime())
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	if c.dedup {
+		c.removeUnreferencedBlobs(blobIndex)
+	}
+	return nil
+}
+
+// forget removes an entry from the index and drops its blob reference. The
+// caller must hold the mutex.
+func (c *LRUCache) forget(element *list.Element) int64 {
+	item := element.Value.(*cacheItem)
+	c.lruList.Remove(element)
+	delete(c.items, item.key)
+
+	freed := c.release(item)
+	c.currentSize -= freed
+	return freed
+}
+
+// RecordAccess counts a client request for key towards admission and, if
+// the entry is cached, makes it its last access for EntryTimes.
+func (c *LRUCache) RecordAccess(key string) {
+	if c.sketch != nil {
+		c.sketch.increment(key)
+	}
+
+	c.mutex.Lock()
+	if element, exists := c.items[key]; exists {
+		element.Value.(*cacheItem).accessed = time.Now()
+	}
+	c.mutex.Unlock()
 }
 
 func (c *LRUCache) Get(key string) (io.ReadCloser, int64, time.Time, error) {
@@ -319,9 +426,19 @@ func (c *LRUCache) Get(key string) (io.ReadCloser, int64, time.Time, error) {
 	c.mutex.Lock()
 	c.lruList.MoveToFront(element)
 	item := element.Value.(*cacheItem)
+	// The item may be replaced by a concurrent Put once the lock is released.
+	expectedSize := item.size
 	logging.Debug("LRUCache: Item last modified=%v", item.lastModified)
+	c.openReader(key)
 	c.mutex.Unlock()
 
+	opened := false
+	defer func() {
+		if !opened {
+			c.closeReader(key)
+		}
+	}()
+
 	filePath := c.fileOps.GetCacheFilePath(key)
 	logging.Debug("LRUCache: File path=%s", filePath)
 
@@ -329,9 +446,7 @@ func (c *LRUCache) Get(key string) (io.ReadCloser, int64, time.Time, error) {
 	if err != nil {
 		if os.IsNotExist(err) {
 			c.mutex.Lock()
-			c.lruList.Remove(element)
-			delete(c.items, key)
-			c.currentSize -= item.size
+			c.forget(element)
 			c.mutex.Unlock()
 		}
 		logging.Error("LRUCache: Failed to open file - %v", err)
@@ -342,9 +457,7 @@ func (c *LRUCache) Get(key string) (io.ReadCloser, int64, time.Time, error) {
 	if err != nil {
 		file.Close()
 		c.mutex.Lock()
-		c.lruList.Remove(element)
-		delete(c.items, item.key)
-		c.currentSize -= item.size
+		c.forget(element)
 		c.mutex.Unlock()
 		logging.Error("LRUCache: Failed to get file info - %v", err)
 		return nil, 0, time.Time{}, fmt.Errorf("failed to get file info: %w", err)
@@ -353,37 +466,36 @@ func (c *LRUCache) Get(key string) (io.ReadCloser, int64, time.Time, error) {
 	if info.Size() == 0 {
 		file.Close()
 		c.mutex.Lock()
-		c.lruList.Remove(element)
-		delete(c.items, key)
-		c.currentSize -= item.size
+		c.forget(element)
 		c.mutex.Unlock()
 		os.Remove(filePath)
 		return nil, 0, time.Time{}, fmt.Errorf("corrupted file in cache (zero size): %s", key)
 	}
 
-	if info.Size() != item.size {
-		if float64(info.Size())/float64(item.size) < 0.9 || float64(info.Size())/float64(item.size) > 1.1 {
+	if info.Size() != expectedSize {
+		if float64(info.Size())/float64(expectedSize) < 0.9 || float64(info.Size())/float64(expectedSize) > 1.1 {
 			file.Close()
 			c.mutex.Lock()
-			c.lruList.Remove(element)
-			delete(c.items, key)
-			c.currentSize -= item.size
+			c.forget(element)
 			c.mutex.Unlock()
 			os.Remove(filePath)
-			return nil, 0, time.Time{}, fmt.Errorf("corrupted file in cache (size mismatch): expected %d bytes, got %d bytes", item.size, info.Size())
+			return nil, 0, time.Time{}, fmt.Errorf("corrupted file in cache (size mismatch): expected %d bytes, got %d bytes", expectedSize, info.Size())
 		}
 
 		c.mutex.Lock()
-		c.currentSize = c.currentSize - item.size + info.Size()
+		if item.blob == "" {
+			c.currentSize = c.currentSize - item.size + info.Size()
+		}
 		item.size = info.Size()
 		c.mutex.Unlock()
 	}
 
-	return file, info.Size(), info.ModTime(), nil
+	opened = true
+	return c.trackedFile(key, file), info.Size(), info.ModTime(), nil
 }
 
 func (c *LRUCache) Put(key string, content io.Reader, contentLength int64, lastModified time.Time) error {
-	c.makeRoom(contentLength)
+	c.makeRoom(key, contentLength)
 
 	filePath := c.fileOps.GetCacheFilePath(key)
 
@@ -398,7 +510,13 @@ func (c *LRUCache) Put(key string, content io.Reader, contentLength int64, lastM
 		return fmt.Errorf("failed to create temporary file: %w", err)
 	}
 
-	written, err := io.Copy(file, content)
+	hasher := sha256.New()
+	var out io.Writer = file
+	if c.dedup {
+		out = io.MultiWriter(file, hasher)
+	}
+
+	written, err := io.Copy(out, content)
 	if err != nil {
 		file.Close()
 		os.Remove(tempFilePath)
@@ -437,81 +555,334 @@ func (c *LRUCache) Put(key string, content io.Reader, contentLength int64, lastM
 		logging.Warning("failed to set file modification time: %v", err)
 	}
 
-	if err := os.Rename(tempFilePath, filePath); err != nil {
-		os.Remove(tempFilePath)
-		return fmt.Errorf("failed to rename temporary file: %w", err)
+	blob := ""
+	if c.dedup {
+		blob = hex.EncodeToString(hasher.Sum(nil))
 	}
+	return c.commit(key, tempFilePath, filePath, blob, written, lastModified)
+}
 
+// commit moves a completely written temporary file into place as the entry
+// for key and records it in the index.
+func (c *LRUCache) commit(key, tempFilePath, filePath, blob string, written int64, lastModified time.Time) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	if blob != "" {
+		if err := c.linkBlob(tempFilePath, filePath, blob); err != nil {
+			return fmt.Errorf("failed to link blob: %w", err)
+		}
+	} else if err := os.Rename(tempFilePath, filePath); err != nil {
+		os.Remove(tempFilePath)
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+
+	// Reference the new content before dropping the old, so replacing an
+	// entry with identical content never removes the shared blob.
+	added := c.retain(blob, written)
+
 	if element, exists := c.items[key]; exists {
 		item := element.Value.(*cacheItem)
-		c.currentSize -= item.size
+		c.currentSize -= c.release(item)
 		item.size = written
 		item.lastModified = lastModified
+		item.blob = blob
+		item.stored = time.Now()
+		item.accessed = item.stored
 		c.lruList.MoveToFront(element)
 	} else {
+		now := time.Now()
 		item := &cacheItem{
 			key:          key,
 			size:         written,
 			lastModified: lastModified,
+			blob:         blob,
+			stored:       now,
+			accessed:     now,
 		}
 		element := c.lruList.PushFront(item)
 		c.items[key] = element
 	}
 
-	c.currentSize += written
+	c.currentSize += added
 
 	return nil
 }
 
-func (c *LRUCache) makeRoom(size int64) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+// streamingDirectory holds large objects while they are being downloaded.
+const streamingDirectory = ".streaming"
 
-	logging.Debug("Cache: Making room for %d bytes", size)
-	logging.Debug("Cache: Current size=%d bytes, Max size=%d bytes", c.currentSize, c.maxSizeBytes)
+// CreateTemp returns a new temporary file on the cache's filesystem, to be
+// filled and handed to PutFile. Leftovers are removed on the next startup.
+func (c *LRUCache) CreateTemp() (*os.File, error) {
+	dir := filepath.Join(c.basePath, streamingDirectory)
+	if err := utils.CreateDirectory(dir); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	return os.CreateTemp(dir, "stream-*.tmp")
+}
 
-	if c.lruList.Len() == 0 || size <= 0 {
-		return
+// PutFile moves a file created by CreateTemp into the cache as the entry for
+// key without copying its content.
+func (c *LRUCache) PutFile(key string, tempFilePath string, lastModified time.Time) error {
+	info, err := os.Stat(tempFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
 	}
 
-	if c.maxSizeBytes <= 0 {
-		return
+	c.makeRoom(key, info.Size())
+
+	filePath := c.fileOps.GetCacheFilePath(key)
+	if err := utils.CreateDirectory(filepath.Dir(filePath)); err != nil {
+		os.Remove(tempFilePath)
+		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	if c.currentSize+size <= c.maxSizeBytes {
-		logging.Debug("Cache: No need to free space")
-		return
+	if err := os.Chtimes(tempFilePath, lastModified, lastModified); err != nil {
+		logging.Warning("failed to set file modification time: %v", err)
+	}
+
+	blob := ""
+	if c.dedup {
+		if blob, err = hashFile(tempFilePath); err != nil {
+			os.Remove(tempFilePath)
+			return fmt.Errorf("failed to hash file: %w", err)
+		}
+	}
+	return c.commit(key, tempFilePath, filePath, blob, info.Size(), lastModified)
+}
+
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func (c *LRUCache) Delete(key string) error {
+	c.mutex.Lock()
+	if element, exists := c.items[key]; exists {
+		c.forget(element)
+	}
+	err := c.removeFile(key, c.fileOps.GetCacheFilePath(key), "")
+	c.mutex.Unlock()
+
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove file: %w", err)
+	}
+	if c.onRemove != nil {
+		c.onRemove(key)
+	}
+	return nil
+}
+
+// Keys lists the keys of all cached entries.
+func (c *LRUCache) Keys() ([]string, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	keys := make([]string, 0, len(c.items))
+	for key := range c.items {
+		keys = append(keys, key)
 	}
+	return keys, nil
+}
 
-	spaceToFree := (c.currentSize + size) - c.maxSizeBytes
-	spaceToFree += spaceToFree / 10
-	logging.Debug("Cache: Need to free %d bytes", spaceToFree)
+// EntryTimes returns when each cached entry was written and last requested
+// by a client.
+func (c *LRUCache) EntryTimes() map[string]EntryTimes {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 
-	freedSpace := int64(0)
+	times := make(map[string]EntryTimes, len(c.items))
+	for key, element := range c.items {
+		item := element.Value.(*cacheItem)
+		times[key] = EntryTimes{Stored: item.stored, Accessed: item.accessed}
+	}
+	return times
+}
 
-	for c.lruList.Len() > 0 && freedSpace < spaceToFree {
-		element := c.lruList.Back()
-		if element == nil {
+// makeRoom evicts least recently used entries until an entry of the given
+// size fits within both the byte and the entry count limits. The eviction
+// guard may be slow, so it is asked about a snapshot of the candidates with
+// the mutex released, and the ones it lets go are evicted afterwards. Guarded
+// entries are passed over in the next round.
+func (c *LRUCache) makeRoom(key string, size int64) {
+	guarded := make(map[string]bool)
+	var evicted []string
+	for {
+		c.mutex.Lock()
+		candidates := c.evictionCandidates(key, size, guarded, time.Now())
+		c.mutex.Unlock()
+		if len(candidates) == 0 {
 			break
 		}
+		candidates = c.unguarded(candidates, guarded)
+
+		c.mutex.Lock()
+		evicted = append(evicted, c.evictCandidates(candidates, time.Now())...)
+		c.mutex.Unlock()
+	}
+
+	c.mutex.RLock()
+	if bytes, entries := c.roomNeeded(key, size); bytes > 0 || entries > 0 {
+		logging.Warning("Cache: All entries are protected from eviction, exceeding the cache limits")
+	}
+	c.mutex.RUnlock()
+
+	c.notifyEvicted(evicted)
+}
+
+// unguarded returns the candidates the eviction guard lets go and adds the
+// others to guarded. It must be called without holding the mutex.
+func (c *LRUCache) unguarded(candidates []string, guarded map[string]bool) []string {
+	if c.guard == nil {
+		return candidates
+	}
+	var unguarded []string
+	for _, candidate := range candidates {
+		if c.guard(candidate) {
+			guarded[candidate] = true
+		} else {
+			unguarded = append(unguarded, candidate)
+		}
+	}
+	return unguarded
+}
+
+// notifyEvicted calls OnRemove for evicted entries, once the mutex has been
+// released, unless they have been stored again since.
+func (c *LRUCache) notifyEvicted(keys []string) {
+	if c.onRemove == nil {
+		return
+	}
+	for _, key := range keys {
+		c.mutex.RLock()
+		_, stored := c.items[key]
+		c.mutex.RUnlock()
+		if !stored {
+			c.onRemove(key)
+		}
+	}
+}
+
+// roomNeeded returns the bytes and the number of entries that must be freed
+// for an entry of the given size for key to fit. Freeing bytes frees a tenth
+// more than needed, so the next entries fit without evicting again. The
+// caller must hold the mutex.
+func (c *LRUCache) roomNeeded(key string, size int64) (bytes int64, entries int) {
+	if c.maxSizeBytes > 0 && size > 0 && c.lruList.Len() > 0 && c.currentSize+size > c.maxSizeBytes {
+		bytes = c.currentSize + size - c.maxSizeBytes
+		bytes += bytes / 10
+	}
+	if _, exists := c.items[key]; !exists && c.maxEntries > 0 && c.lruList.Len() >= c.maxEntries {
+		entries = c.lruList.Len() - c.maxEntries + 1
+	}
+	return bytes, entries
+}
 
+// evictionCandidates returns the keys of the least recently used entries
+// that would have to be evicted to make room, skipping entries within the
+// grace period and the ones in guarded. It returns none when there is
+// enough room or every entry is protected. The caller must hold the mutex.
+func (c *LRUCache) evictionCandidates(key string, size int64, guarded map[string]bool, now time.Time) []string {
+	bytes, entries := c.roomNeeded(key, size)
+	if bytes <= 0 && entries <= 0 {
+		return nil
+	}
+	logging.Debug("Cache: Need to free %d bytes and %d entries, current size=%d bytes, max size=%d bytes", bytes, entries, c.currentSize, c.maxSizeBytes)
+
+	var candidates []string
+	for element := c.lruList.Back(); element != nil && (bytes > 0 || entries > 0); element = element.Prev() {
 		item := element.Value.(*cacheItem)
-		logging.Debug("Cache: Evicting item=%s (size=%d bytes)", item.key, item.size)
+		if c.withinGracePeriod(item, now) || guarded[item.key] {
+			continue
+		}
+		candidates = append(candidates, item.key)
+		bytes -= item.size
+		entries--
+	}
+	return candidates
+}
 
-		c.lruList.Remove(element)
-		delete(c.items, item.key)
+// evictCandidates evicts the entries of the given keys unless they are gone
+// or were stored again within the grace period since they were picked. It
+// returns the keys evicted. The caller must hold the mutex.
+func (c *LRUCache) evictCandidates(candidates []string, now time.Time) []string {
+	var evicted []string
+	for _, candidate := range candidates {
+		element, exists := c.items[candidate]
+		if !exists || c.withinGracePeriod(element.Value.(*cacheItem), now) {
+			continue
+		}
+		c.evict(element)
+		evicted = append(evicted, candidate)
+	}
+	return evicted
+}
 
-		c.currentSize -= item.size
-		freedSpace += item.size
+// withinGracePeriod reports whether an entry was stored too recently to be
+// evicted.
+func (c *LRUCache) withinGracePeriod(item *cacheItem, now time.Time) bool {
+	return c.gracePeriod > 0 && now.Sub(item.stored) < c.gracePeriod
+}
+
+// Admit reports whether a new entry of the given size for key should be
+// stored. Without an admission policy, when the entry fits without evicting
+// anything, or when it replaces an existing entry it is always admitted.
+// Otherwise it must have been requested more often than each of the entries
+// that would be evicted to make room for it. Like makeRoom, it asks the
+// eviction guard about the victims with the mutex released.
+func (c *LRUCache) Admit(key string, size int64) bool {
+	if c.sketch == nil {
+		return true
+	}
 
-		if err := c.fileOps.DeleteCacheFile(item.key); err != nil && !os.IsNotExist(err) {
-			logging.Warning("failed to remove file %s: %v", item.key, err)
+	frequency := c.sketch.estimate(key)
+	guarded := make(map[string]bool)
+	for {
+		c.mutex.Lock()
+		if _, exists := c.items[key]; exists {
+			c.mutex.Unlock()
+			return true
+		}
+		candidates := c.evictionCandidates(key, size, guarded, time.Now())
+		c.mutex.Unlock()
+
+		unguarded := c.unguarded(candidates, guarded)
+		if len(unguarded) < len(candidates) {
+			// Guarded entries are passed over; pick the victims again.
+			continue
+		}
+		for _, victim := range candidates {
+			if c.sketch.estimate(victim) >= frequency {
+				logging.Debug("Cache: Not admitting %s, requested less often than %s", key, victim)
+				return false
+			}
 		}
+		return true
+	}
+}
+
+// evict removes an entry and its file. The caller must hold the mutex and
+// pass the entry's key to notifyEvicted once it has released it.
+func (c *LRUCache) evict(element *list.Element) int64 {
+	item := element.Value.(*cacheItem)
+	logging.Debug("Cache: Evicting item=%s (size=%d bytes)", item.key, item.size)
+
+	freed := c.forget(element)
+
+	if err := c.removeFile(item.key, c.fileOps.GetCacheFilePath(item.key), ""); err != nil && !os.IsNotExist(err) {
+		logging.Warning("failed to remove file %s: %v", item.key, err)
 	}
-	logging.Debug("Cache: Total freed space=%d bytes", freedSpace)
+	return freed
 }
 
 func (c *LRUCache) GetCacheStats() (int, int64, int64) {
@@ -524,6 +895,7 @@ type FileHeaderCache struct {
 	basePath string
 	fileOps  *FileOperations
 	mutex    sync.RWMutex
+	closed   bool
 }
 
 func NewFileHeaderCache(basePath string) (*FileHeaderCache, error) {
@@ -541,7 +913,7 @@ func (c *FileHeaderCache) GetHeaders(key string) (http.Header, error) {
 
 	data, err := os.ReadFile(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("header cache not found: %w", err)
+		return nil, fmt.Errorf("%w: %v", ErrHeadersNotFound, err)
 	}
 
 	var headers http.Header
@@ -555,6 +927,10 @@ func (c *FileHeaderCache) PutHeaders(key string, headers http.Header) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	if c.closed {
+		return fmt.Errorf("header cache is closed")
+	}
+
 	data, err := json.Marshal(headers)
 	if err != nil {
 		return fmt.Errorf("failed to marshal headers: %w", err)
@@ -580,6 +956,60 @@ func (c *FileHeaderCache) PutHeaders(key string, headers http.Header) error {
 	return nil
 }
 
+func (c *FileHeaderCache) DeleteHeaders(key string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	filePath := c.fileOps.GetFilePath(key + ".headercache")
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove header cache: %w", err)
+	}
+	return nil
+}
+
+// Keys lists the keys that have headers stored, skipping quarantined
+// entries. The tree is walked without the lock, as the walk can take long,
+// so headers written or removed meanwhile may or may not be listed.
+func (c *FileHeaderCache) Keys() ([]string, error) {
+	var keys []string
+	err := filepath.Walk(c.basePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed since its directory was read.
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			if path == filepath.Join(c.basePath, quarantineDirectory) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".headercache") {
+			return nil
+		}
+		relPath, err := filepath.Rel(c.basePath, path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, strings.TrimSuffix(filepath.ToSlash(relPath), ".headercache"))
+		return nil
+	})
+	return keys, err
+}
+
+// Close waits for in-progress header writes to finish and rejects any further
+// ones. Headers are written through to disk, so nothing else needs flushing.
+// It is safe to call Close more than once.
+func (c *FileHeaderCache) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	return nil
+}
+
 func CleanCacheDirectory(dirPath string) error {
 	entries, err := os.ReadDir(dirPath)
 	if err != nil {
@@ -6,6 +6,9 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -128,6 +131,79 @@ func TestFileHeaderCache(t *testing.T) {
 	t.Log("Header cache test passed")
 }
 
+func TestMemoryHeaderCacheEvictsColdHeaders(t *testing.T) {
+	tempDir := t.TempDir()
+	backing, err := NewFileHeaderCache(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create header cache: %v", err)
+	}
+	cache := NewMemoryHeaderCache(backing, 2)
+	if _, ok := cache.(KeyLister); !ok {
+		t.Error("Expected the memory layer to list the keys of a listable cache")
+	}
+	if _, ok := NewMemoryHeaderCache(NewNoopHeaderCache(), 2).(KeyLister); ok {
+		t.Error("Expected the memory layer not to list keys of a cache that cannot")
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := cache.PutHeaders(key, http.Header{"Etag": {key}}); err != nil {
+			t.Fatalf("Failed to store headers for %s: %v", key, err)
+		}
+	}
+	memory := cache.(listableMemoryHeaderCache)
+	if memory.Len() != 2 {
+		t.Fatalf("Expected 2 headers in memory, got %d", memory.Len())
+	}
+
+	// The evicted headers are read from the backing cache again.
+	headers, err := cache.GetHeaders("a")
+	if err != nil || headers.Get("Etag") != "a" {
+		t.Fatalf("Expected the evicted headers from the backing cache, got %v, %v", headers, err)
+	}
+	// Reading them made "b" the coldest, so it is the one that went.
+	os.Remove(filepath.Join(tempDir, "b.headercache"))
+	os.Remove(filepath.Join(tempDir, "c.headercache"))
+	if _, err := cache.GetHeaders("b"); err == nil {
+		t.Error("Expected the cold headers to have been evicted from memory")
+	}
+	if headers, err := cache.GetHeaders("c"); err != nil || headers.Get("Etag") != "c" {
+		t.Errorf("Expected the recent headers from memory, got %v, %v", headers, err)
+	}
+
+	// Changing returned headers does not change the cached ones.
+	headers.Set("Etag", "changed")
+	if headers, _ := cache.GetHeaders("a"); headers.Get("Etag") != "a" {
+		t.Errorf("Expected cached headers to be copied, got %q", headers.Get("Etag"))
+	}
+
+	if err := cache.DeleteHeaders("a"); err != nil {
+		t.Fatalf("Failed to delete headers: %v", err)
+	}
+	if _, err := cache.GetHeaders("a"); err == nil {
+		t.Error("Expected deleted headers to be gone")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := "concurrent/" + strconv.Itoa((i+j)%5)
+				if j%3 == 0 {
+					cache.PutHeaders(key, http.Header{"Etag": {key}})
+				} else if headers, err := cache.GetHeaders(key); err == nil && headers.Get("Etag") != key {
+					t.Errorf("Expected headers of %s, got %v", key, headers)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if memory.Len() > 2 {
+		t.Errorf("Expected at most 2 headers in memory, got %d", memory.Len())
+	}
+}
+
 func TestHierarchicalDirectoryStructure(t *testing.T) {
 	// Create a temporary directory for testing
 	tempDir, err := os.MkdirTemp("", "hierarchical-cache-test")
@@ -222,3 +298,443 @@ func TestHierarchicalDirectoryStructure(t *testing.T) {
 
 	t.Log("Hierarchical directory structure test passed")
 }
+
+func TestLRUCacheMaxEntries(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "max-entries-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache, err := NewLRUCacheWithOptions(LRUCacheOptions{
+		BasePath:     tempDir,
+		MaxSizeBytes: 1024 * 1024,
+		MaxEntries:   2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+
+	content := []byte("small")
+	for _, key := range []string{"a/one", "a/two", "a/three"} {
+		if err := cache.Put(key, bytes.NewReader(content), int64(len(content)), time.Now()); err != nil {
+			t.Fatalf("Failed to store %s: %v", key, err)
+		}
+	}
+
+	itemCount, _, _ := cache.GetCacheStats()
+	if itemCount != 2 {
+		t.Errorf("Expected 2 items, got %d", itemCount)
+	}
+
+	// The least recently used entry must be the one evicted
+	if _, _, _, err := cache.Get("a/one"); err == nil {
+		t.Errorf("Expected a/one to be evicted")
+	}
+	for _, key := range []string{"a/two", "a/three"} {
+		reader, _, _, err := cache.Get(key)
+		if err != nil {
+			t.Errorf("Expected %s to be cached: %v", key, err)
+			continue
+		}
+		reader.Close()
+	}
+
+	// Overwriting an existing key must not evict anything
+	if err := cache.Put("a/three", bytes.NewReader(content), int64(len(content)), time.Now()); err != nil {
+		t.Fatalf("Failed to overwrite a/three: %v", err)
+	}
+	if itemCount, _, _ := cache.GetCacheStats(); itemCount != 2 {
+		t.Errorf("Expected 2 items after overwrite, got %d", itemCount)
+	}
+}
+
+func TestLRUCacheDedupKeepsSharedBlobUntilLastReference(t *testing.T) {
+	tempDir := t.TempDir()
+
+	cache, err := NewLRUCacheWithOptions(LRUCacheOptions{
+		BasePath:     tempDir,
+		MaxSizeBytes: 1024 * 1024,
+		Dedup:        true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+
+	content := []byte("Package: hello\nVersion: 1.0\n")
+	keys := []string{
+		"debian/dists/stable/main/binary-amd64/Packages",
+		"debian/dists/stable/main/binary-amd64/by-hash/SHA256/abc",
+		"debian/dists/testing/main/binary-amd64/Packages",
+	}
+	for _, key := range keys {
+		if err := cache.Put(key, bytes.NewReader(content), int64(len(content)), time.Now()); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+
+	itemCount, currentSize, _ := cache.GetCacheStats()
+	if itemCount != 3 || currentSize != int64(len(content)) {
+		t.Errorf("Expected 3 entries sharing %d bytes, got %d entries and %d bytes", len(content), itemCount, currentSize)
+	}
+
+	for _, key := range keys[:2] {
+		if err := cache.Delete(key); err != nil {
+			t.Fatalf("Failed to delete %s: %v", key, err)
+		}
+	}
+
+	reader, _, _, err := cache.Get(keys[2])
+	if err != nil {
+		t.Fatalf("Expected the remaining entry to be servable: %v", err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("Unexpected content for remaining entry: %q (%v)", data, err)
+	}
+
+	if err := cache.Delete(keys[2]); err != nil {
+		t.Fatalf("Failed to delete %s: %v", keys[2], err)
+	}
+	if _, currentSize, _ := cache.GetCacheStats(); currentSize != 0 {
+		t.Errorf("Expected an empty cache, got %d bytes", currentSize)
+	}
+
+	blobs, _ := filepath.Glob(filepath.Join(tempDir, blobDirectory, "*", "*"))
+	if len(blobs) != 0 {
+		t.Errorf("Expected the blob to be removed with its last reference, found %v", blobs)
+	}
+}
+
+func TestLRUCacheQuarantinesOtherFormatVersion(t *testing.T) {
+	tempDir := t.TempDir()
+
+	legacy := filepath.Join(tempDir, "dists", "old", "Release.filecache")
+	if err := os.MkdirAll(filepath.Dir(legacy), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(legacy, []byte("old format"), 0644); err != nil {
+		t.Fatalf("Failed to write legacy entry: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, formatVersionFile), []byte("0\n"), 0644); err != nil {
+		t.Fatalf("Failed to write version marker: %v", err)
+	}
+
+	cache, err := NewLRUCache(tempDir, 1024*1024)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	if items, _, _ := cache.GetCacheStats(); items != 0 {
+		t.Errorf("Expected entries of another format to be ignored, got %d items", items)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("Expected the legacy entry to be moved out of the cache")
+	}
+	quarantined, _ := filepath.Glob(filepath.Join(tempDir, quarantineDirectory, "v0-*", "dists", "old", "Release.filecache"))
+	if len(quarantined) != 1 {
+		t.Errorf("Expected the legacy entry in quarantine, found %v", quarantined)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(tempDir, formatVersionFile))
+	if strings.TrimSpace(string(data)) != strconv.Itoa(FormatVersion) {
+		t.Errorf("Expected the marker to be updated to %d, got %q", FormatVersion, data)
+	}
+
+	if _, err := NewLRUCache(tempDir, 1024*1024); err != nil {
+		t.Fatalf("Failed to reopen cache: %v", err)
+	}
+}
+
+func TestLRUCacheEvictionGracePeriodProtectsNewEntries(t *testing.T) {
+	pinned := "pool/pinned.deb"
+	cache, err := NewLRUCacheWithOptions(LRUCacheOptions{
+		BasePath:            t.TempDir(),
+		MaxSizeBytes:        100,
+		EvictionGracePeriod: time.Hour,
+		EvictionGuard:       func(key string) bool { return key == pinned },
+	})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+
+	content := bytes.Repeat([]byte("x"), 60)
+	for _, key := range []string{"pool/first.deb", "pool/second.deb"} {
+		if err := cache.Put(key, bytes.NewReader(content), int64(len(content)), time.Now()); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+	if items, _, _ := cache.GetCacheStats(); items != 2 {
+		t.Fatalf("Expected both entries to survive within the grace period, got %d", items)
+	}
+
+	cache.gracePeriod = 0
+	if err := cache.Put(pinned, bytes.NewReader(content), int64(len(content)), time.Now()); err != nil {
+		t.Fatalf("Failed to put %s: %v", pinned, err)
+	}
+	if err := cache.Put("pool/third.deb", bytes.NewReader(content), int64(len(content)), time.Now()); err != nil {
+		t.Fatalf("Failed to put third entry: %v", err)
+	}
+	reader, _, _, err := cache.Get(pinned)
+	if err != nil {
+		t.Fatalf("Expected the guarded entry to survive eviction: %v", err)
+	}
+	reader.Close()
+}
+
+func TestEvictionGuardRunsWithTheCacheUnlocked(t *testing.T) {
+	var cache *LRUCache
+	cache, err := NewLRUCacheWithOptions(LRUCacheOptions{
+		BasePath:     t.TempDir(),
+		MaxSizeBytes: 30,
+		Admission:    true,
+		EvictionGuard: func(key string) bool {
+			// Deadlocks if the cache is still locked.
+			cache.GetCacheStats()
+			return key == "pool/a.deb"
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, key := range []string{"pool/a.deb", "pool/b.deb", "pool/c.deb", "pool/d.deb"} {
+			cache.Admit(key, 10)
+			cache.Put(key, strings.NewReader("0123456789"), 10, time.Now())
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The eviction guard was asked with the cache locked")
+	}
+
+	for key, kept := range map[string]bool{"pool/a.deb": true, "pool/b.deb": false, "pool/c.deb": true, "pool/d.deb": true} {
+		content, _, _, err := cache.Get(key)
+		if err == nil {
+			content.Close()
+		}
+		if (err == nil) != kept {
+			t.Errorf("Expected %s to be cached: %v", key, kept)
+		}
+	}
+}
+
+func TestOnRemoveRunsWithTheCacheUnlocked(t *testing.T) {
+	var cache *LRUCache
+	var removed []string
+	cache, err := NewLRUCacheWithOptions(LRUCacheOptions{
+		BasePath:     t.TempDir(),
+		MaxSizeBytes: 8,
+		OnRemove: func(key string) {
+			// Deadlocks if the cache is still locked.
+			cache.GetCacheStats()
+			removed = append(removed, key)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.Put("first", strings.NewReader("1234"), 4, time.Now())
+		cache.Put("second", strings.NewReader("5678"), 4, time.Now())
+		cache.Put("third", strings.NewReader("9abc"), 4, time.Now())
+		cache.Delete("third")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnRemove was called with the cache locked")
+	}
+	if len(removed) != 2 || removed[0] != "first" || removed[1] != "third" {
+		t.Errorf("Expected the evicted and the deleted entry to be reported, got %v", removed)
+	}
+}
+
+func TestSweepOrphansReconcilesBodiesAndHeaders(t *testing.T) {
+	dir := t.TempDir()
+	headerCache, err := NewFileHeaderCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create header cache: %v", err)
+	}
+	cache, err := NewLRUCacheWithOptions(LRUCacheOptions{
+		BasePath:     dir,
+		MaxSizeBytes: 1024,
+		OnRemove:     func(key string) { headerCache.DeleteHeaders(key) },
+	})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+
+	headers := http.Header{"Content-Type": {"application/octet-stream"}}
+	put := func(key string, withBody, withHeaders bool) {
+		if withBody {
+			if err := cache.Put(key, strings.NewReader("body"), 4, time.Now()); err != nil {
+				t.Fatalf("Failed to put %s: %v", key, err)
+			}
+		}
+		if withHeaders {
+			if err := headerCache.PutHeaders(key, headers); err != nil {
+				t.Fatalf("Failed to put headers of %s: %v", key, err)
+			}
+		}
+	}
+	put("debian/pool/complete.deb", true, true)
+	put("debian/pool/headers-only.deb", false, true)
+	put("debian/pool/body-only.deb", true, false)
+	put("debian/pool/in-flight.deb", true, false)
+
+	inUse := func(key string) bool { return key == "debian/pool/in-flight.deb" }
+	result, err := SweepOrphans(cache, headerCache, inUse)
+	if err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+	if result.OrphanedHeaders != 1 || result.OrphanedBodies != 1 {
+		t.Errorf("Expected one orphan of each kind, got %+v", result)
+	}
+
+	if _, err := headerCache.GetHeaders("debian/pool/headers-only.deb"); err == nil {
+		t.Errorf("Expected headers without a body to be removed")
+	}
+	for key, kept := range map[string]bool{
+		"debian/pool/complete.deb":  true,
+		"debian/pool/body-only.deb": false,
+		"debian/pool/in-flight.deb": true,
+	} {
+		content, _, _, err := cache.Get(key)
+		if err == nil {
+			content.Close()
+		}
+		if (err == nil) != kept {
+			t.Errorf("Expected %s kept=%v, got error %v", key, kept, err)
+		}
+	}
+
+	// Deleting a body removes its headers with it.
+	if err := cache.Delete("debian/pool/complete.deb"); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if _, err := headerCache.GetHeaders("debian/pool/complete.deb"); err == nil {
+		t.Errorf("Expected headers to be removed together with the body")
+	}
+}
+
+func TestLRUCacheAdmissionKeepsFrequentEntries(t *testing.T) {
+	cache, err := NewLRUCacheWithOptions(LRUCacheOptions{
+		BasePath:     t.TempDir(),
+		MaxSizeBytes: 1024 * 1024,
+		MaxEntries:   2,
+		Admission:    true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+
+	get := func(key string) {
+		cache.RecordAccess(key)
+		if reader, _, _, err := cache.Get(key); err == nil {
+			reader.Close()
+		}
+	}
+	content := []byte("popular")
+	for _, key := range []string{"pool/one", "pool/two"} {
+		get(key)
+		if !cache.Admit(key, int64(len(content))) {
+			t.Fatalf("Expected %s to be admitted while the cache has room", key)
+		}
+		if err := cache.Put(key, bytes.NewReader(content), int64(len(content)), time.Now()); err != nil {
+			t.Fatalf("Failed to store %s: %v", key, err)
+		}
+		get(key)
+		get(key)
+	}
+
+	get("pool/once")
+	if cache.Admit("pool/once", int64(len(content))) {
+		t.Error("Expected a file requested once not to evict popular files")
+	}
+	if !cache.Admit("pool/one", int64(len(content))) {
+		t.Error("Expected replacing a cached entry to be admitted")
+	}
+
+	// Reads that are not client requests do not count.
+	for i := 0; i < 5; i++ {
+		if reader, _, _, err := cache.Get("pool/one"); err == nil {
+			reader.Close()
+		}
+		cache.Get("pool/internal")
+	}
+	if cache.Admit("pool/internal", int64(len(content))) {
+		t.Error("Expected reads of the proxy's own not to count towards admission")
+	}
+
+	for i := 0; i < 5; i++ {
+		get("pool/rising")
+	}
+	if !cache.Admit("pool/rising", int64(len(content))) {
+		t.Error("Expected a file requested more often than the victim to be admitted")
+	}
+
+	var disabled LRUCache
+	if !disabled.Admit("pool/any", 1) {
+		t.Error("Expected everything to be admitted without an admission policy")
+	}
+}
+
+func TestLRUCacheEvictionDuringReadCompletesRead(t *testing.T) {
+	for _, deferred := range []bool{false, true} {
+		t.Run("deferRemoval="+strconv.FormatBool(deferred), func(t *testing.T) {
+			defer func(previous bool) { deferRemoval = previous }(deferRemoval)
+			deferRemoval = deferred
+
+			cache, err := NewLRUCache(t.TempDir(), 100)
+			if err != nil {
+				t.Fatalf("Failed to create cache: %v", err)
+			}
+
+			content := []byte(strings.Repeat("0123456789", 6))
+			if err := cache.Put("pool/read.deb", bytes.NewReader(content), int64(len(content)), time.Now()); err != nil {
+				t.Fatalf("Failed to put entry: %v", err)
+			}
+			reader, _, _, err := cache.Get("pool/read.deb")
+			if err != nil {
+				t.Fatalf("Failed to get entry: %v", err)
+			}
+			head := make([]byte, 10)
+			if _, err := io.ReadFull(reader, head); err != nil {
+				t.Fatalf("Failed to start reading: %v", err)
+			}
+
+			// Storing another entry evicts the one being read.
+			if err := cache.Put("pool/evictor.deb", bytes.NewReader(content), int64(len(content)), time.Now()); err != nil {
+				t.Fatalf("Failed to put evicting entry: %v", err)
+			}
+			if _, _, _, err := cache.Get("pool/read.deb"); err == nil {
+				t.Fatalf("Expected the entry to be evicted")
+			}
+
+			rest, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("Read failed after eviction: %v", err)
+			}
+			if got := string(head) + string(rest); got != string(content) {
+				t.Errorf("Expected the complete content after eviction, got %q", got)
+			}
+
+			filePath := cache.fileOps.GetCacheFilePath("pool/read.deb")
+			if _, err := os.Stat(filePath); deferred && err != nil {
+				t.Errorf("Expected the file to be kept while it is being read: %v", err)
+			}
+			reader.Close()
+			if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+				t.Errorf("Expected the file to be removed once the reader closed, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+)
+
+// MemoryHeaderCache keeps the most recently used headers of another
+// HeaderCache in memory, bounded by a number of entries. Reads that miss, such
+// as those for headers evicted as cold, go to the backing cache; writes and
+// deletes go through to it before the memory copy is updated. It is safe for
+// concurrent use.
+type MemoryHeaderCache struct {
+	backing    HeaderCache
+	maxEntries int
+
+	mutex   sync.Mutex
+	lruList *list.List
+	items   map[string]*list.Element
+	writes  uint64 // Counts writes and deletes, so a read can tell whether one raced with it
+}
+
+type memoryHeaderItem struct {
+	key     string
+	headers http.Header
+}
+
+// listableMemoryHeaderCache is a MemoryHeaderCache in front of a cache that
+// implements KeyLister, which it then implements as well.
+type listableMemoryHeaderCache struct {
+	*MemoryHeaderCache
+}
+
+func (c listableMemoryHeaderCache) Keys() ([]string, error) {
+	return c.backing.(KeyLister).Keys()
+}
+
+// NewMemoryHeaderCache returns backing with at most maxEntries of its headers
+// kept in memory. The result implements KeyLister if backing does.
+func NewMemoryHeaderCache(backing HeaderCache, maxEntries int) HeaderCache {
+	c := &MemoryHeaderCache{
+		backing:    backing,
+		maxEntries: maxEntries,
+		lruList:    list.New(),
+		items:      make(map[string]*list.Element),
+	}
+	if _, ok := backing.(KeyLister); ok {
+		return listableMemoryHeaderCache{c}
+	}
+	return c
+}
+
+func (c *MemoryHeaderCache) GetHeaders(key string) (http.Header, error) {
+	c.mutex.Lock()
+	if element, ok := c.items[key]; ok {
+		c.lruList.MoveToFront(element)
+		headers := element.Value.(*memoryHeaderItem).headers.Clone()
+		c.mutex.Unlock()
+		return headers, nil
+	}
+	writes := c.writes
+	c.mutex.Unlock()
+
+	headers, err := c.backing.GetHeaders(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// Headers written or deleted while the backing cache was read may be newer
+	// than those read, so they are not kept.
+	if c.writes == writes {
+		c.store(key, headers.Clone())
+	}
+	return headers, nil
+}
+
+func (c *MemoryHeaderCache) PutHeaders(key string, headers http.Header) error {
+	err := c.backing.PutHeaders(key, headers)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writes++
+	if err != nil {
+		c.remove(key)
+		return err
+	}
+	c.store(key, headers.Clone())
+	return nil
+}
+
+func (c *MemoryHeaderCache) DeleteHeaders(key string) error {
+	err := c.backing.DeleteHeaders(key)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writes++
+	c.remove(key)
+	return err
+}
+
+// Close drops the headers kept in memory and closes the backing cache.
+func (c *MemoryHeaderCache) Close() error {
+	c.mutex.Lock()
+	c.lruList.Init()
+	c.items = make(map[string]*list.Element)
+	c.mutex.Unlock()
+	return c.backing.Close()
+}
+
+// Len returns the number of headers kept in memory.
+func (c *MemoryHeaderCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lruList.Len()
+}
+
+// store keeps headers for key, evicting the least recently used headers
+// beyond maxEntries. The caller must hold the mutex.
+func (c *MemoryHeaderCache) store(key string, headers http.Header) {
+	if element, ok := c.items[key]; ok {
+		element.Value.(*memoryHeaderItem).headers = headers
+		c.lruList.MoveToFront(element)
+		return
+	}
+	c.items[key] = c.lruList.PushFront(&memoryHeaderItem{key: key, headers: headers})
+	for c.lruList.Len() > c.maxEntries {
+		oldest := c.lruList.Back()
+		c.lruList.Remove(oldest)
+		delete(c.items, oldest.Value.(*memoryHeaderItem).key)
+	}
+}
+
+// remove drops the headers kept for key. The caller must hold the mutex.
+func (c *MemoryHeaderCache) remove(key string) {
+	if element, ok := c.items[key]; ok {
+		c.lruList.Remove(element)
+		delete(c.items, key)
+	}
+}
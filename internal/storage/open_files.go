@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// deferRemoval is set where a file cannot be removed while it is open.
+// Elsewhere a file handed out by Get stays readable after its entry is
+// evicted, because an open descriptor survives the unlink, so nothing needs
+// to be tracked.
+var deferRemoval = runtime.GOOS == "windows"
+
+// deferredRemoval is a file of an evicted or deleted entry that is removed
+// once the entry's last reader closes it.
+type deferredRemoval struct {
+	path string
+	blob string // Hash of the blob at path, empty for the entry's own file
+}
+
+// cacheFile is a file returned by Get while removals are deferred. Closing it
+// removes files that were dropped from the cache while it was being read.
+type cacheFile struct {
+	*os.File
+	cache *LRUCache
+	key   string
+}
+
+func (f *cacheFile) Close() error {
+	err := f.File.Close()
+	f.cache.closeReader(f.key)
+	return err
+}
+
+// openReader registers a reader of key before its file is opened. The caller
+// must hold the mutex.
+func (c *LRUCache) openReader(key string) {
+	if deferRemoval {
+		c.readers[key]++
+	}
+}
+
+// trackedFile returns file as handed out by Get, wrapped so that closing it
+// ends the read that openReader registered.
+func (c *LRUCache) trackedFile(key string, file *os.File) io.ReadCloser {
+	if !deferRemoval {
+		return file
+	}
+	return &cacheFile{File: file, cache: c, key: key}
+}
+
+// closeReader ends a read registered by openReader and removes the files
+// deferred while it lasted, unless the cache has since stored them again.
+func (c *LRUCache) closeReader(key string) {
+	if !deferRemoval {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.readers[key]--
+	if c.readers[key] > 0 {
+		return
+	}
+	delete(c.readers, key)
+
+	for _, removal := range c.deferred[key] {
+		if removal.blob != "" {
+			if _, reused := c.blobs[removal.blob]; reused {
+				continue
+			}
+		} else if _, restored := c.items[key]; restored {
+			continue
+		}
+		if err := os.Remove(removal.path); err != nil && !os.IsNotExist(err) {
+			logging.Warning("failed to remove file %s: %v", removal.path, err)
+		}
+	}
+	delete(c.deferred, key)
+}
+
+// removeFile removes a file of key's entry, or defers the removal until the
+// entry's readers are done with it. The caller must hold the mutex.
+func (c *LRUCache) removeFile(key, path, blob string) error {
+	if deferRemoval && c.readers[key] > 0 {
+		c.deferred[key] = append(c.deferred[key], deferredRemoval{path: path, blob: blob})
+		return nil
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const redisPoolSize = 8
+
+type RedisHeaderCacheOptions struct {
+	Address     string
+	Password    string
+	DB          int
+	KeyPrefix   string        // Prepended to every cache key, lets several mirrors share one Redis
+	TTL         time.Duration // Zero keeps headers until Redis evicts them
+	DialTimeout time.Duration
+}
+
+// RedisHeaderCache stores headers in Redis so that several mirror nodes
+// sharing a body cache also share header metadata. It speaks the Redis
+// protocol directly and keeps a small pool of connections.
+type RedisHeaderCache struct {
+	options RedisHeaderCacheOptions
+	pool    chan *redisConn
+	mutex   sync.RWMutex
+	closed  bool
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply sent by the server, as opposed to a failure
+// of the connection.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func NewRedisHeaderCache(options RedisHeaderCacheOptions) (*RedisHeaderCache, error) {
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = 5 * time.Second
+	}
+
+	cache := &RedisHeaderCache{
+		options: options,
+		pool:    make(chan *redisConn, redisPoolSize),
+	}
+
+	// Fail early on a wrong address or password rather than on the first request.
+	conn, err := cache.dial()
+	if err != nil {
+		return nil, err
+	}
+	cache.put(conn)
+
+	return cache, nil
+}
+
+func (c *RedisHeaderCache) GetHeaders(key string) (http.Header, error) {
+	reply, err := c.do("GET", c.options.KeyPrefix+key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read headers from redis: %w", err)
+	}
+	if reply == nil {
+		return nil, fmt.Errorf("%w: %s", ErrHeadersNotFound, key)
+	}
+
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected redis reply for %s", key)
+	}
+
+	var headers http.Header
+	if err := json.Unmarshal(data, &headers); err != nil {
+		return nil, fmt.Errorf("failed to parse header cache: %w", err)
+	}
+	return headers, nil
+}
+
+func (c *RedisHeaderCache) PutHeaders(key string, headers http.Header) error {
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return fmt.Errorf("failed to marshal headers: %w", err)
+	}
+
+	args := []string{"SET", c.options.KeyPrefix + key, string(data)}
+	if c.options.TTL > 0 {
+		args = append(args, "PX", strconv.FormatInt(c.options.TTL.Milliseconds(), 10))
+	}
+
+	if _, err := c.do(args...); err != nil {
+		return fmt.Errorf("failed to store headers in redis: %w", err)
+	}
+	return nil
+}
+
+func (c *RedisHeaderCache) DeleteHeaders(key string) error {
+	if _, err := c.do("DEL", c.options.KeyPrefix+key); err != nil {
+		return fmt.Errorf("failed to delete headers from redis: %w", err)
+	}
+	return nil
+}
+
+func (c *RedisHeaderCache) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	close(c.pool)
+	for conn := range c.pool {
+		conn.conn.Close()
+	}
+	return nil
+}
+
+// do sends one command and reads its reply. A connection that fails is
+// dropped; one that merely got an error reply is returned to the pool.
+func (c *RedisHeaderCache) do(args ...string) (interface{}, error) {
+	c.mutex.RLock()
+	closed := c.closed
+	c.mutex.RUnlock()
+	if closed {
+		return nil, fmt.Errorf("header cache is closed")
+	}
+
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.do(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.conn.Close()
+		return nil, err
+	}
+
+	c.put(conn)
+	return reply, err
+}
+
+func (c *RedisHeaderCache) get() (*redisConn, error) {
+	select {
+	case conn, ok := <-c.pool:
+		if ok {
+			return conn, nil
+		}
+		return nil, fmt.Errorf("header cache is closed")
+	default:
+		return c.dial()
+	}
+}
+
+func (c *RedisHeaderCache) put(conn *redisConn) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.closed {
+		conn.conn.Close()
+		return
+	}
+
+	select {
+	case c.pool <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+func (c *RedisHeaderCache) dial() (*redisConn, error) {
+	netConn, err := net.DialTimeout("tcp", c.options.Address, c.options.DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", c.options.Address, err)
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+
+	if c.options.Password != "" {
+		if _, err := conn.do("AUTH", c.options.Password); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("redis authentication failed: %w", err)
+		}
+	}
+	if c.options.DB != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(c.options.DB)); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("failed to select redis database %d: %w", c.options.DB, err)
+		}
+	}
+	return conn, nil
+}
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	rc.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := rc.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+// readReply parses one RESP reply. Bulk strings are returned as []byte and a
+// nil bulk string as nil.
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed redis reply: %q", line)
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed redis bulk length: %q", payload)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed redis array length: %q", payload)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = rc.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type: %q", line)
+	}
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// startFakeRedis serves GET, SET and DEL from a map, enough for the header
+// cache.
+func startFakeRedis(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	data := make(map[string][]byte)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+				for {
+					request, err := rc.readReply()
+					if err != nil {
+						return
+					}
+					args, _ := request.([]interface{})
+					if len(args) < 2 {
+						conn.Write([]byte("-ERR wrong number of arguments\r\n"))
+						continue
+					}
+
+					command := string(args[0].([]byte))
+					key := string(args[1].([]byte))
+					mu.Lock()
+					switch command {
+					case "SET":
+						data[key] = args[2].([]byte)
+						conn.Write([]byte("+OK\r\n"))
+					case "GET":
+						if value, ok := data[key]; ok {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+						} else {
+							conn.Write([]byte("$-1\r\n"))
+						}
+					case "DEL":
+						_, existed := data[key]
+						delete(data, key)
+						if existed {
+							conn.Write([]byte(":1\r\n"))
+						} else {
+							conn.Write([]byte(":0\r\n"))
+						}
+					default:
+						conn.Write([]byte("-ERR unknown command\r\n"))
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestRedisHeaderCacheRoundTrip(t *testing.T) {
+	cache, err := NewRedisHeaderCache(RedisHeaderCacheOptions{
+		Address:   startFakeRedis(t),
+		KeyPrefix: "mirror:",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create redis header cache: %v", err)
+	}
+	defer cache.Close()
+
+	if _, err := cache.GetHeaders("debian/dists/stable/InRelease"); !errors.Is(err, ErrHeadersNotFound) {
+		t.Fatalf("Expected ErrHeadersNotFound for a missing key, got %v", err)
+	}
+
+	headers := http.Header{}
+	headers.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	headers.Add("X-Test", "one")
+	headers.Add("X-Test", "two")
+	if err := cache.PutHeaders("debian/dists/stable/InRelease", headers); err != nil {
+		t.Fatalf("Failed to store headers: %v", err)
+	}
+
+	stored, err := cache.GetHeaders("debian/dists/stable/InRelease")
+	if err != nil {
+		t.Fatalf("Failed to read headers: %v", err)
+	}
+	if stored.Get("Last-Modified") != headers.Get("Last-Modified") || len(stored.Values("X-Test")) != 2 {
+		t.Errorf("Unexpected headers read back: %v", stored)
+	}
+
+	if err := cache.DeleteHeaders("debian/dists/stable/InRelease"); err != nil {
+		t.Fatalf("Failed to delete headers: %v", err)
+	}
+	if _, err := cache.GetHeaders("debian/dists/stable/InRelease"); !errors.Is(err, ErrHeadersNotFound) {
+		t.Errorf("Expected ErrHeadersNotFound after deleting, got %v", err)
+	}
+
+	cache.Close()
+	if err := cache.PutHeaders("debian/dists/stable/InRelease", headers); err == nil {
+		t.Errorf("Expected PutHeaders to fail after Close")
+	}
+}
@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"errors"
 	"io"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 )
@@ -16,15 +18,48 @@ type Storage interface {
 type Cache interface {
 	Get(key string) (io.ReadCloser, int64, time.Time, error)
 	Put(key string, content io.Reader, contentLength int64, lastModified time.Time) error
+	Delete(key string) error
+}
+
+// FilePutter is implemented by caches that can adopt a file written to disk
+// beforehand, so large objects need not be held in memory or copied twice.
+type FilePutter interface {
+	CreateTemp() (*os.File, error)
+	PutFile(key string, tempFilePath string, lastModified time.Time) error
 }
 
 type LRUStatsProvider interface {
 	GetCacheStats() (itemCount int, currentSize int64, maxSize int64)
 }
 
+// ErrHeadersNotFound is returned, possibly wrapped, by every HeaderCache when
+// no headers are stored for a key.
+var ErrHeadersNotFound = errors.New("header cache not found")
+
 type HeaderCache interface {
 	GetHeaders(key string) (http.Header, error)
 	PutHeaders(key string, headers http.Header) error
+	DeleteHeaders(key string) error // Removing headers that do not exist is not an error
+	Close() error
+}
+
+// KeyLister is implemented by caches that can enumerate their entries, which
+// SweepOrphans needs to reconcile a cache with its header cache.
+type KeyLister interface {
+	Keys() ([]string, error)
+}
+
+// EntryTimes tells when a cached entry was written and last requested by a
+// client, see AccessRecorder.
+type EntryTimes struct {
+	Stored   time.Time // Zero for entries found at startup
+	Accessed time.Time // Startup time for entries not requested or written since
+}
+
+// EntryTimesLister is implemented by caches that track when their entries
+// were written and read, which age-based purges select entries by.
+type EntryTimesLister interface {
+	EntryTimes() map[string]EntryTimes
 }
 
 type ValidationCache interface {
@@ -33,6 +68,20 @@ type ValidationCache interface {
 	SetTTL(ttl time.Duration)
 }
 
+// ImmutableEntry describes a cached file whose content never changes once
+// published, such as by-hash indexes.
+type ImmutableEntry struct {
+	Size         int64
+	LastModified time.Time
+	ContentType  string
+}
+
+type ImmutableCache interface {
+	Get(key string) (ImmutableEntry, bool)
+	Put(key string, entry ImmutableEntry)
+	Delete(key string)
+}
+
 type NoopCache struct{}
 
 func NewNoopCache() *NoopCache {
@@ -47,6 +96,10 @@ func (c *NoopCache) Put(key string, content io.Reader, contentLength int64, last
 	return nil
 }
 
+func (c *NoopCache) Delete(key string) error {
+	return nil
+}
+
 type NoopHeaderCache struct{}
 
 func NewNoopHeaderCache() *NoopHeaderCache {
@@ -54,13 +107,21 @@ func NewNoopHeaderCache() *NoopHeaderCache {
 }
 
 func (c *NoopHeaderCache) GetHeaders(key string) (http.Header, error) {
-	return nil, io.EOF
+	return nil, ErrHeadersNotFound
 }
 
 func (c *NoopHeaderCache) PutHeaders(key string, headers http.Header) error {
 	return nil
 }
 
+func (c *NoopHeaderCache) DeleteHeaders(key string) error {
+	return nil
+}
+
+func (c *NoopHeaderCache) Close() error {
+	return nil
+}
+
 type MemoryValidationCache struct {
 	mu    sync.RWMutex
 	cache map[string]time.Time
@@ -124,3 +185,46 @@ func (c *NoopValidationCache) Put(key string, lastValidated time.Time) {
 
 func (c *NoopValidationCache) SetTTL(ttl time.Duration) {
 }
+
+type MemoryImmutableCache struct {
+	mu         sync.RWMutex
+	entries    map[string]ImmutableEntry
+	maxEntries int
+}
+
+func NewMemoryImmutableCache(maxEntries int) *MemoryImmutableCache {
+	return &MemoryImmutableCache{
+		entries:    make(map[string]ImmutableEntry),
+		maxEntries: maxEntries,
+	}
+}
+
+func (c *MemoryImmutableCache) Get(key string) (ImmutableEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, exists := c.entries[key]
+	return entry, exists
+}
+
+func (c *MemoryImmutableCache) Put(key string, entry ImmutableEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[key]; !exists && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		// Entries are cheap to rebuild from the disk cache, so drop an
+		// arbitrary one instead of tracking recency.
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = entry
+}
+
+func (c *MemoryImmutableCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yolkispalkis/go-apt-cache/internal/logging"
+)
+
+// FormatVersion is the version of the on-disk cache layout. Bump it whenever
+// a change makes existing cache entries unreadable or misleading.
+const FormatVersion = 1
+
+const (
+	formatVersionFile   = ".format-version"
+	quarantineDirectory = ".quarantine"
+)
+
+// checkFormatVersion makes sure the cache directory holds entries in the
+// current format. Caches created before the marker existed use the version 1
+// layout and are adopted as they are. A cache written in any other format is
+// moved aside into the quarantine directory rather than deleted, so it can
+// be inspected or restored after a downgrade.
+func checkFormatVersion(basePath string) error {
+	markerPath := filepath.Join(basePath, formatVersionFile)
+
+	data, err := os.ReadFile(markerPath)
+	if os.IsNotExist(err) {
+		return writeFormatVersion(markerPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cache format version: %w", err)
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err == nil && version == FormatVersion {
+		return nil
+	}
+
+	label := strings.TrimSpace(string(data))
+	if err != nil {
+		label = "unknown"
+	}
+	if err := quarantineCache(basePath, label); err != nil {
+		return err
+	}
+	return writeFormatVersion(markerPath)
+}
+
+func writeFormatVersion(markerPath string) error {
+	if err := os.WriteFile(markerPath, []byte(strconv.Itoa(FormatVersion)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write cache format version: %w", err)
+	}
+	return nil
+}
+
+func quarantineCache(basePath, version string) error {
+	target := filepath.Join(basePath, quarantineDirectory, fmt.Sprintf("v%s-%d", version, time.Now().Unix()))
+	logging.Warning("Cache at %s uses format version %s, expected %d; moving it to %s", basePath, version, FormatVersion, target)
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(basePath)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == quarantineDirectory || entry.Name() == formatVersionFile {
+			continue
+		}
+		if err := os.Rename(filepath.Join(basePath, entry.Name()), filepath.Join(target, entry.Name())); err != nil {
+			return fmt.Errorf("failed to quarantine %s: %w", entry.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// ErrWeakChecksum is returned when a file is listed only with checksums
+// weaker than the required minimum.
+var ErrWeakChecksum = errors.New("no checksum of the required strength")
+
+var checksumHashes = map[string]func() hash.Hash{
+	"MD5Sum": md5.New,
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+	"SHA512": sha512.New,
+}
+
+// ParseChecksumAlgorithm returns the Release field name of a checksum
+// algorithm given in any case, with "MD5" accepted for "MD5Sum".
+func ParseChecksumAlgorithm(name string) (string, error) {
+	for _, algorithm := range releaseChecksumFields {
+		if strings.EqualFold(name, algorithm) {
+			return algorithm, nil
+		}
+	}
+	if strings.EqualFold(name, "MD5") {
+		return "MD5Sum", nil
+	}
+	return "", fmt.Errorf("unknown checksum algorithm %q", name)
+}
+
+// checksumStrength ranks a checksum algorithm, weakest first. Unknown
+// algorithms rank below all others.
+func checksumStrength(algorithm string) int {
+	for i, field := range releaseChecksumFields {
+		if field == algorithm {
+			return i
+		}
+	}
+	return -1
+}
+
+// SelectChecksum returns the strongest of the checksums listed for a file,
+// keyed by algorithm, and its algorithm. Weaker checksums are ignored once a
+// stronger one is listed. If minimum is not empty and the strongest checksum
+// is weaker than it, ErrWeakChecksum is returned.
+func SelectChecksum(hashes map[string]string, minimum string) (algorithm, sum string, err error) {
+	for i := len(releaseChecksumFields) - 1; i >= 0; i-- {
+		if sum, ok := hashes[releaseChecksumFields[i]]; ok {
+			algorithm = releaseChecksumFields[i]
+			if minimum != "" && i < checksumStrength(minimum) {
+				return algorithm, sum, fmt.Errorf("%w: strongest is %s, %s required", ErrWeakChecksum, algorithm, minimum)
+			}
+			return algorithm, sum, nil
+		}
+	}
+	return "", "", errors.New("no checksum listed")
+}
+
+// ChecksumVerifier computes the digest of everything written to it, so a
+// body can be verified while it is copied elsewhere in a single pass.
+type ChecksumVerifier struct {
+	algorithm string
+	expected  string
+	hash      hash.Hash
+}
+
+// NewChecksumVerifier returns a verifier comparing against the hex digest
+// expected of the given Release checksum algorithm.
+func NewChecksumVerifier(algorithm, expected string) (*ChecksumVerifier, error) {
+	newHash, ok := checksumHashes[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown checksum algorithm %q", algorithm)
+	}
+	return &ChecksumVerifier{algorithm: algorithm, expected: strings.ToLower(expected), hash: newHash()}, nil
+}
+
+func (v *ChecksumVerifier) Write(p []byte) (int, error) {
+	return v.hash.Write(p)
+}
+
+// Algorithm returns the checksum algorithm the verifier computes.
+func (v *ChecksumVerifier) Algorithm() string {
+	return v.algorithm
+}
+
+// Verify reports whether the digest of the data written so far matches the
+// expected one.
+func (v *ChecksumVerifier) Verify() error {
+	if sum := hex.EncodeToString(v.hash.Sum(nil)); sum != v.expected {
+		return fmt.Errorf("%s mismatch: expected %s, got %s", v.algorithm, v.expected, sum)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	arMagic        = "!<arch>\n"
+	arHeaderLength = 60
+)
+
+// IsDebPackage reports whether the path names a binary package.
+func IsDebPackage(p string) bool {
+	switch path.Ext(p) {
+	case ".deb", ".udeb", ".ddeb":
+		return true
+	}
+	return false
+}
+
+// ValidateDebStructure checks that content is a structurally complete Debian
+// binary package: an ar archive starting with a debian-binary member,
+// followed by control.tar and data.tar members that are all present in full.
+// It does not look inside the members, so it catches truncated downloads and
+// error pages but not tampering.
+func ValidateDebStructure(content io.Reader) error {
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(content, magic); err != nil || string(magic) != arMagic {
+		return errors.New("not an ar archive")
+	}
+
+	var seenControl bool
+	header := make([]byte, arHeaderLength)
+	for index := 0; ; index++ {
+		if _, err := io.ReadFull(content, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("missing data.tar member")
+			}
+			return fmt.Errorf("truncated member header: %w", err)
+		}
+		if string(header[58:60]) != "`\n" {
+			return fmt.Errorf("malformed header of member %d", index)
+		}
+
+		name := strings.TrimSuffix(strings.TrimSpace(string(header[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid size of member %s", name)
+		}
+
+		if index == 0 {
+			if name != "debian-binary" {
+				return fmt.Errorf("first member is %s, expected debian-binary", name)
+			}
+			version := make([]byte, size)
+			if _, err := io.ReadFull(content, version); err != nil {
+				return fmt.Errorf("truncated debian-binary member: %w", err)
+			}
+			if !bytes.HasPrefix(version, []byte("2.")) {
+				return fmt.Errorf("unsupported package format %q", bytes.TrimSpace(version))
+			}
+		} else if _, err := io.CopyN(io.Discard, content, size); err != nil {
+			return fmt.Errorf("truncated member %s: %w", name, err)
+		}
+
+		switch {
+		case name == "control.tar" || strings.HasPrefix(name, "control.tar."):
+			seenControl = true
+		case name == "data.tar" || strings.HasPrefix(name, "data.tar."):
+			if !seenControl {
+				return errors.New("data.tar member precedes control.tar")
+			}
+			return nil
+		}
+
+		// Members are padded to an even size.
+		if size%2 == 1 {
+			if _, err := io.CopyN(io.Discard, content, 1); err != nil && !errors.Is(err, io.EOF) {
+				return fmt.Errorf("truncated padding after member %s: %w", name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Paragraph is one deb822 stanza. Field names keep the case they were
+// written in; use Get to look them up case-insensitively as deb822 requires.
+// Multi-line values hold one line per continuation line, without the leading
+// whitespace, with a first line that is empty if the field began with none.
+type Paragraph map[string]string
+
+// Get returns the value of a field, matching its name case-insensitively.
+func (p Paragraph) Get(name string) (string, bool) {
+	if value, ok := p[name]; ok {
+		return value, true
+	}
+	for field, value := range p {
+		if strings.EqualFold(field, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// ParseDeb822 parses deb822 control data into its paragraphs. Paragraphs are
+// separated by blank lines, lines starting with # are comments, and lines
+// starting with a space or tab continue the previous field; a continuation
+// line of a single "." stands for an empty line.
+func ParseDeb822(data []byte) ([]Paragraph, error) {
+	var paragraphs []Paragraph
+	var current Paragraph
+	var field string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if strings.TrimSpace(line) == "" {
+			if current != nil {
+				paragraphs = append(paragraphs, current)
+				current, field = nil, ""
+			}
+			continue
+		}
+		if line[0] == '#' {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if field == "" {
+				return nil, fmt.Errorf("line %d: continuation line without a field", lineNumber)
+			}
+			value := strings.TrimSpace(line)
+			if value == "." {
+				value = ""
+			}
+			current[field] += "\n" + value
+			continue
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("line %d: expected a field, got %q", lineNumber, line)
+		}
+		if current == nil {
+			current = make(Paragraph)
+		}
+		if _, exists := current.Get(name); exists {
+			return nil, fmt.Errorf("line %d: duplicate field %s", lineNumber, name)
+		}
+		field = name
+		current[field] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		paragraphs = append(paragraphs, current)
+	}
+	return paragraphs, nil
+}
+
+// StripPGPSignature returns the signed content of a clearsigned message,
+// such as an InRelease file, undoing dash-escaping. Data that is not
+// clearsigned is returned unchanged.
+func StripPGPSignature(data []byte) []byte {
+	const (
+		beginMessage   = "-----BEGIN PGP SIGNED MESSAGE-----"
+		beginSignature = "-----BEGIN PGP SIGNATURE-----"
+	)
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if !bytes.HasPrefix(trimmed, []byte(beginMessage)) {
+		return data
+	}
+
+	var out bytes.Buffer
+	lines := strings.Split(string(trimmed), "\n")
+	i := 1
+	// Armor headers such as "Hash: SHA512" end at the first blank line.
+	for ; i < len(lines) && strings.TrimRight(lines[i], "\r") != ""; i++ {
+	}
+	for i++; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		if line == beginSignature {
+			break
+		}
+		out.WriteString(strings.TrimPrefix(line, "- "))
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// Checksum algorithms that may list files in a Release file, weakest first.
+var releaseChecksumFields = []string{"MD5Sum", "SHA1", "SHA256", "SHA512"}
+
+// ReleaseFile is a file listed in a Release file's checksum sections.
+type ReleaseFile struct {
+	Size   int64
+	Hashes map[string]string // Checksum by algorithm, e.g. "SHA256"
+}
+
+// Release is a parsed Release or InRelease file.
+type Release struct {
+	Fields        Paragraph
+	AcquireByHash bool                    // Indexes may be fetched from by-hash directories
+	Files         map[string]*ReleaseFile // Keyed by path relative to the suite directory
+}
+
+// ParseRelease parses a Release file, or an InRelease file after removing its
+// signature. Files listed by several checksum sections are merged; sections
+// must agree on a file's size.
+func ParseRelease(data []byte) (*Release, error) {
+	paragraphs, err := ParseDeb822(StripPGPSignature(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(paragraphs) == 0 {
+		return nil, fmt.Errorf("release file is empty")
+	}
+
+	release := &Release{
+		Fields: paragraphs[0],
+		Files:  make(map[string]*ReleaseFile),
+	}
+	if value, ok := release.Fields.Get("Acquire-By-Hash"); ok {
+		release.AcquireByHash = strings.EqualFold(value, "yes")
+	}
+
+	for _, algorithm := range releaseChecksumFields {
+		section, ok := release.Fields.Get(algorithm)
+		if !ok {
+			continue
+		}
+		for _, line := range strings.Split(section, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("malformed %s entry %q", algorithm, line)
+			}
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("malformed size in %s entry %q", algorithm, line)
+			}
+
+			file := release.Files[fields[2]]
+			if file == nil {
+				file = &ReleaseFile{Size: size, Hashes: make(map[string]string)}
+				release.Files[fields[2]] = file
+			} else if file.Size != size {
+				return nil, fmt.Errorf("%s lists %s with size %d, another section with %d", algorithm, fields[2], size, file.Size)
+			}
+			file.Hashes[algorithm] = strings.ToLower(fields[0])
+		}
+	}
+	return release, nil
+}
+
+// Checksum returns the strongest checksum listed for path and its algorithm.
+func (r *Release) Checksum(path string) (algorithm, hash string, ok bool) {
+	file := r.Files[path]
+	if file == nil {
+		return "", "", false
+	}
+	algorithm, hash, err := SelectChecksum(file.Hashes, "")
+	return algorithm, hash, err == nil
+}
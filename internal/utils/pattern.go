@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchPathPattern reports whether a slash-separated path matches a glob
+// pattern. Segments are matched with path.Match, and a "**" segment matches
+// zero or more whole path segments.
+func MatchPathPattern(pattern, p string) bool {
+	patternParts := splitPathSegments(pattern)
+	pathParts := splitPathSegments(p)
+	return matchSegments(patternParts, pathParts)
+}
+
+// MatchAnyPathPattern reports whether the path matches at least one pattern.
+func MatchAnyPathPattern(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if MatchPathPattern(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchPathPatternPrefix reports whether some path inside the directory dir
+// could match the pattern, e.g. "dists/stable" for "dists/*/main/**".
+func MatchPathPatternPrefix(pattern, dir string) bool {
+	patternParts := splitPathSegments(pattern)
+	for _, part := range splitPathSegments(dir) {
+		if len(patternParts) == 0 {
+			return false
+		}
+		if patternParts[0] == "**" {
+			return true
+		}
+		if matched, err := path.Match(patternParts[0], part); err != nil || !matched {
+			return false
+		}
+		patternParts = patternParts[1:]
+	}
+	return len(patternParts) > 0
+}
+
+func splitPathSegments(p string) []string {
+	return strings.FieldsFunc(p, func(r rune) bool {
+		return r == '/'
+	})
+}
+
+func matchSegments(patternParts, pathParts []string) bool {
+	for len(patternParts) > 0 {
+		if patternParts[0] == "**" {
+			rest := patternParts[1:]
+			if len(rest) == 0 {
+				return true
+			}
+			for i := 0; i <= len(pathParts); i++ {
+				if matchSegments(rest, pathParts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(pathParts) == 0 {
+			return false
+		}
+
+		matched, err := path.Match(patternParts[0], pathParts[0])
+		if err != nil || !matched {
+			return false
+		}
+
+		patternParts = patternParts[1:]
+		pathParts = pathParts[1:]
+	}
+
+	return len(pathParts) == 0
+}
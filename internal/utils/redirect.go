@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxRedirects is the hop limit used when none is configured.
+const DefaultMaxRedirects = 10
+
+// ErrRedirectRejected is returned, wrapped, by a RedirectPolicy when a
+// redirect exceeds the hop limit or leaves the allowed hosts.
+var ErrRedirectRejected = errors.New("redirect rejected")
+
+// RedirectPolicy returns a CheckRedirect function that follows at most
+// maxRedirects hops (DefaultMaxRedirects if zero or less). With sameHost set
+// or allowedHosts given, only redirects to the original request's host or to
+// one of allowedHosts are followed.
+func RedirectPolicy(maxRedirects int, sameHost bool, allowedHosts []string) func(req *http.Request, via []*http.Request) error {
+	if maxRedirects <= 0 {
+		maxRedirects = DefaultMaxRedirects
+	}
+	restricted := sameHost || len(allowedHosts) > 0
+
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxRedirects {
+			return fmt.Errorf("%w: stopped after %d redirects", ErrRedirectRejected, maxRedirects)
+		}
+		if !restricted || strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+			return nil
+		}
+		for _, host := range allowedHosts {
+			if strings.EqualFold(host, req.URL.Host) || strings.EqualFold(host, req.URL.Hostname()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s is not an allowed host", ErrRedirectRejected, req.URL.Host)
+	}
+}
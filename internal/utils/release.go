@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// IsReleaseFile reports whether the path names a suite's Release or InRelease file.
+func IsReleaseFile(p string) bool {
+	base := path.Base(p)
+	return base == "Release" || base == "InRelease"
+}
+
+// SuitePrefix returns the portion of a path up to and including the suite
+// directory, e.g. "ubuntu/dists/jammy" for "ubuntu/dists/jammy/main/...".
+func SuitePrefix(p string) (string, bool) {
+	p = strings.TrimPrefix(p, "/")
+	idx := strings.Index("/"+p, "/dists/")
+	if idx < 0 {
+		return "", false
+	}
+	rest := p[idx+len("dists/"):]
+	suite, _, found := strings.Cut(rest, "/")
+	if !found || suite == "" {
+		return "", false
+	}
+	return p[:idx+len("dists/")+len(suite)], true
+}
+
+// ParseReleaseFileSizes extracts the files listed in the checksum sections of
+// a Release or InRelease file, keyed by their path relative to the suite
+// directory and mapped to their declared size. Unlike ParseRelease it is
+// lenient: malformed entries are skipped rather than failing the whole file,
+// and a file whose sections disagree on its size is left out.
+func ParseReleaseFileSizes(data []byte) map[string]int64 {
+	files := make(map[string]int64)
+	conflicting := make(map[string]bool)
+	inChecksums := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(StripPGPSignature(data)))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if line == "" || (line[0] != ' ' && line[0] != '\t') {
+			field, _, _ := strings.Cut(line, ":")
+			inChecksums = false
+			for _, algorithm := range releaseChecksumFields {
+				if strings.EqualFold(field, algorithm) {
+					inChecksums = true
+				}
+			}
+			continue
+		}
+
+		if !inChecksums {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 0 {
+			continue
+		}
+		if previous, ok := files[fields[2]]; ok && previous != size {
+			conflicting[fields[2]] = true
+		}
+		files[fields[2]] = size
+	}
+
+	for relPath := range conflicting {
+		delete(files, relPath)
+	}
+	return files
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrCertificatePinMismatch is returned, wrapped, when an origin presents a
+// certificate that matches none of the fingerprints pinned for its host.
+var ErrCertificatePinMismatch = errors.New("certificate pin mismatch")
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion returns the TLS version named like "1.2".
+func ParseTLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToUpper(name), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", name)
+	}
+	return version, nil
+}
+
+// ParseCipherSuites returns the IDs of the named cipher suites, e.g.
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Only suites Go considers secure
+// are accepted.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if strings.EqualFold(suite.Name, name) {
+				ids = append(ids, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+	}
+	return ids, nil
+}
+
+// ParseFingerprint normalizes a SHA-256 certificate fingerprint given as hex,
+// with or without colons.
+func ParseFingerprint(fingerprint string) (string, error) {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+	if decoded, err := hex.DecodeString(normalized); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 fingerprint %q", fingerprint)
+	}
+	return normalized, nil
+}
+
+// OriginTLSConfig returns the TLS configuration for connections to origins.
+// minVersion ("1.2" etc.) and cipherSuites restrict the handshake when set;
+// Go does not allow the TLS 1.3 suites to be chosen. pins maps host names to
+// SHA-256 fingerprints of certificates accepted for them: on top of the
+// regular chain verification, a host with pins must present a leaf
+// certificate matching one of them. Hosts are matched against the server name
+// sent in the handshake, which origins addressed by IP address do not send;
+// pins under "*" apply to every host without pins of its own, including
+// those.
+func OriginTLSConfig(minVersion string, cipherSuites []string, pins map[string][]string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if minVersion != "" {
+		version, err := ParseTLSVersion(minVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = version
+	}
+	if len(cipherSuites) > 0 {
+		ids, err := ParseCipherSuites(cipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = ids
+	}
+
+	if len(pins) == 0 {
+		return tlsConfig, nil
+	}
+	pinned := make(map[string]map[string]bool, len(pins))
+	for host, fingerprints := range pins {
+		set := make(map[string]bool, len(fingerprints))
+		for _, fingerprint := range fingerprints {
+			normalized, err := ParseFingerprint(fingerprint)
+			if err != nil {
+				return nil, fmt.Errorf("pin for %s: %w", host, err)
+			}
+			set[normalized] = true
+		}
+		pinned[strings.ToLower(host)] = set
+	}
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		set, ok := pinned[strings.ToLower(state.ServerName)]
+		if !ok {
+			if set, ok = pinned["*"]; !ok {
+				return nil
+			}
+		}
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("%w: %s presented no certificate", ErrCertificatePinMismatch, state.ServerName)
+		}
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		fingerprint := hex.EncodeToString(sum[:])
+		if !set[fingerprint] {
+			return fmt.Errorf("%w: %s presented a certificate with fingerprint %s", ErrCertificatePinMismatch, state.ServerName, fingerprint)
+		}
+		return nil
+	}
+	return tlsConfig, nil
+}
@@ -1,15 +1,19 @@
 package utils
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/yolkispalkis/go-apt-cache/internal/ftp"
 	"github.com/yolkispalkis/go-apt-cache/internal/logging"
 )
 
@@ -36,7 +40,10 @@ func CreateHTTPClient(timeoutSeconds int) *http.Client {
 		MaxIdleConnsPerHost: 200,
 		MaxConnsPerHost:     500,
 		IdleConnTimeout:     120 * time.Second,
-		DisableCompression:  false,
+		// Store exactly what the origin sent. With compression enabled the
+		// transport would ask for gzip and transparently decompress it,
+		// leaving cached bytes that no longer match the origin's headers.
+		DisableCompression:  true,
 		ForceAttemptHTTP2:   true,
 		TLSHandshakeTimeout: 10 * time.Second,
 		DialContext: (&net.Dialer{
@@ -53,6 +60,9 @@ func CreateHTTPClient(timeoutSeconds int) *http.Client {
 	proxyFunc := http.ProxyFromEnvironment
 	transport.Proxy = proxyFunc
 
+	// ftp:// origins are fetched by a dedicated transport selected by scheme
+	transport.RegisterProtocol("ftp", ftp.NewTransport(15*time.Second))
+
 	client := &http.Client{
 		Transport: transport,
 		Timeout:   time.Duration(timeoutSeconds) * time.Second,
@@ -92,14 +102,69 @@ func NormalizeBasePath(basePath string) string {
 	return basePath
 }
 
-func NormalizeURL(url string) string {
-	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
-		url = "http://" + url
+// NormalizeOriginURL validates an origin base URL and returns it without a
+// trailing slash. A missing scheme defaults to defaultScheme ("https" if
+// empty) and a missing port to defaultPort, if given. Only http, https and
+// ftp origins are accepted, without query or fragment.
+func NormalizeOriginURL(raw, defaultScheme, defaultPort string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", fmt.Errorf("origin URL is empty")
+	}
+	if defaultScheme == "" {
+		defaultScheme = "https"
+	}
+	if !strings.Contains(raw, "://") {
+		raw = defaultScheme + "://" + raw
 	}
 
-	url = strings.TrimSuffix(url, "/")
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse origin URL %q: %w", raw, err)
+	}
+
+	switch parsed.Scheme {
+	case "http", "https", "ftp":
+	case "file":
+		return normalizeFileOriginURL(parsed, raw)
+	default:
+		return "", fmt.Errorf("unsupported scheme %q in origin URL %q", parsed.Scheme, raw)
+	}
+	if parsed.Hostname() == "" {
+		return "", fmt.Errorf("origin URL %q has no host", raw)
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", fmt.Errorf("origin URL %q must not have a query or fragment", raw)
+	}
+
+	if parsed.Port() == "" && defaultPort != "" {
+		parsed.Host = net.JoinHostPort(parsed.Hostname(), defaultPort)
+	}
+	parsed.Path = strings.TrimRight(parsed.Path, "/")
+	parsed.RawPath = ""
+
+	return parsed.String(), nil
+}
+
+// normalizeFileOriginURL checks a file:// origin, which names a local
+// directory and so needs an absolute path and no host other than localhost.
+func normalizeFileOriginURL(parsed *url.URL, raw string) (string, error) {
+	if parsed.Host != "" && parsed.Host != "localhost" {
+		return "", fmt.Errorf("file origin URL %q must not have a host", raw)
+	}
+	if !path.IsAbs(parsed.Path) {
+		return "", fmt.Errorf("file origin URL %q needs an absolute path", raw)
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", fmt.Errorf("origin URL %q must not have a query or fragment", raw)
+	}
+	return "file://" + path.Clean(parsed.Path), nil
+}
 
-	return url
+// LocalOriginPath returns the directory of a file:// origin URL as returned
+// by NormalizeOriginURL, and false for any other origin.
+func LocalOriginPath(originURL string) (string, bool) {
+	return strings.CutPrefix(originURL, "file://")
 }
 
 type FileType int
@@ -138,12 +203,13 @@ var (
 		{Pattern: "Sources.bz2", Type: TypeFrequentlyChanging},
 		{Pattern: "Contents-", Type: TypeFrequentlyChanging},
 		{Pattern: "Index", Type: TypeFrequentlyChanging},
-		{Pattern: "i18n", Type: TypeFrequentlyChanging},
+		{Pattern: "/i18n/", Type: TypeFrequentlyChanging},
 		{Pattern: "dep11", Type: TypeFrequentlyChanging},
 		{Pattern: "icons-", Type: TypeFrequentlyChanging},
 
 		{Pattern: ".deb", Type: TypeRarelyChanging},
 		{Pattern: ".udeb", Type: TypeRarelyChanging},
+		{Pattern: ".ddeb", Type: TypeRarelyChanging},
 		{Pattern: ".dsc", Type: TypeRarelyChanging},
 		{Pattern: ".tar.gz", Type: TypeRarelyChanging},
 		{Pattern: ".tar.xz", Type: TypeRarelyChanging},
@@ -156,7 +222,7 @@ var (
 		{Extensions: []string{".gz", ".gzip"}, MIMEType: "application/gzip"},
 		{Extensions: []string{".bz2"}, MIMEType: "application/x-bzip2"},
 		{Extensions: []string{".xz"}, MIMEType: "application/x-xz"},
-		{Extensions: []string{".deb", ".udeb"}, MIMEType: "application/vnd.debian.binary-package"},
+		{Extensions: []string{".deb", ".udeb", ".ddeb"}, MIMEType: "application/vnd.debian.binary-package"},
 		{Extensions: []string{".asc"}, MIMEType: "application/pgp-signature"},
 		{Extensions: []string{".gpg"}, MIMEType: "application/pgp-encrypted"},
 		{Extensions: []string{".json"}, MIMEType: "application/json"},
@@ -177,6 +243,17 @@ var (
 	}
 )
 
+// IsPdiffPatch reports whether the path names an individual pdiff patch
+// (e.g. Packages.diff/T-2024-01-01-0000.00-F-...gz). Patches are never
+// modified once published, unlike the Packages.diff/Index that lists them.
+func IsPdiffPatch(path string) bool {
+	dir, file := filepath.Split(filepath.ToSlash(path))
+	if !strings.HasSuffix(dir, ".diff/") {
+		return false
+	}
+	return file != "" && file != "Index"
+}
+
 func GetFilePatternType(path string) FileType {
 	normalizedPath := filepath.ToSlash(path)
 
@@ -184,6 +261,10 @@ func GetFilePatternType(path string) FileType {
 		return TypeFrequentlyChanging
 	}
 
+	if IsPdiffPatch(normalizedPath) {
+		return TypeRarelyChanging
+	}
+
 	for _, pattern := range filePatterns {
 		if strings.Contains(normalizedPath, pattern.Pattern) {
 			return pattern.Type
@@ -200,26 +281,45 @@ func GetFilePatternType(path string) FileType {
 	}
 }
 
-func GetContentType(path string) string {
+// LookupContentType returns the MIME type registered for the path's
+// extension and whether one was found.
+func LookupContentType(path string) (string, bool) {
 	ext := strings.ToLower(filepath.Ext(path))
 	if ext == "" {
-		logging.Warning("Could not determine content type for: %s, no extension", path)
-		return "application/octet-stream"
+		return "", false
 	}
 
-	ext = ext[1:]
-
 	for _, mapping := range contentTypes {
 		for _, extension := range mapping.Extensions {
 			if extension == ext {
-				return mapping.MIMEType
+				return mapping.MIMEType, true
 			}
 		}
 	}
+	return "", false
+}
+
+func GetContentType(path string) string {
+	if contentType, ok := LookupContentType(path); ok {
+		return contentType
+	}
 	logging.Warning("Could not determine content type for: %s", path)
 	return "application/octet-stream"
 }
 
+// SniffContentType detects the content type from the first 512 bytes of
+// content. The returned reader replays the sniffed bytes followed by the rest
+// of the content.
+func SniffContentType(content io.Reader) (string, io.Reader, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", content, err
+	}
+	head = head[:n]
+	return http.DetectContentType(head), io.MultiReader(bytes.NewReader(head), content), nil
+}
+
 func WrapError(message string, err error) error {
 	if err == nil {
 		return nil
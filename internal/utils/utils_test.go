@@ -0,0 +1,478 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetFilePatternTypePdiff(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected FileType
+	}{
+		{"dists/bookworm/main/binary-amd64/Packages.diff/Index", TypeFrequentlyChanging},
+		{"dists/bookworm/main/binary-amd64/Packages.diff/T-2024-01-01-0000.00-F-2023-12-31-2000.00.gz", TypeRarelyChanging},
+		{"dists/bookworm/main/source/Sources.diff/2024-01-01-1410.04.gz", TypeRarelyChanging},
+		{"dists/bookworm/main/i18n/Translation-en.diff/Index", TypeFrequentlyChanging},
+	}
+
+	for _, test := range tests {
+		if got := GetFilePatternType(test.path); got != test.expected {
+			t.Errorf("GetFilePatternType(%q) = %v, expected %v", test.path, got, test.expected)
+		}
+	}
+}
+
+func TestNormalizeOriginURL(t *testing.T) {
+	tests := []struct {
+		raw, scheme, port string
+		expected          string
+		wantErr           bool
+	}{
+		{"deb.debian.org/debian", "", "", "https://deb.debian.org/debian", false},
+		{"deb.debian.org/debian/", "http", "", "http://deb.debian.org/debian", false},
+		{"http://archive.ubuntu.com/ubuntu///", "", "", "http://archive.ubuntu.com/ubuntu", false},
+		{"mirror.internal", "http", "8080", "http://mirror.internal:8080", false},
+		{"http://mirror.internal:3142/debian", "", "8080", "http://mirror.internal:3142/debian", false},
+		{"ftp://ftp.example.org/debian", "", "", "ftp://ftp.example.org/debian", false},
+		{"file:///srv/reprepro/debian/", "", "", "file:///srv/reprepro/debian", false},
+		{"file://localhost/srv/aptly", "", "8080", "file:///srv/aptly", false},
+		{"file://mirror.internal/srv/aptly", "", "", "", true},
+		{"file://srv/aptly", "", "", "", true},
+		{"gopher://example.org", "", "", "", true},
+		{"http:///debian", "", "", "", true},
+		{"http://example.org/debian?x=1", "", "", "", true},
+		{"", "", "", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := NormalizeOriginURL(test.raw, test.scheme, test.port)
+		if (err != nil) != test.wantErr {
+			t.Errorf("NormalizeOriginURL(%q) error = %v, wantErr %v", test.raw, err, test.wantErr)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("NormalizeOriginURL(%q) = %q, expected %q", test.raw, got, test.expected)
+		}
+	}
+}
+
+func TestHTTPClientKeepsOriginContentEncoding(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("Package: example\n"))
+	gz.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "" {
+			t.Errorf("Expected no Accept-Encoding to be sent, got %q", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	resp, err := CreateHTTPClient(5).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(body, compressed.Bytes()) || resp.Header.Get("Content-Encoding") != "gzip" || resp.Uncompressed {
+		t.Errorf("Expected the compressed bytes and Content-Encoding to be kept as sent")
+	}
+}
+
+func TestGetFilePatternTypeTranslations(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected FileType
+	}{
+		{"dists/bookworm/main/i18n/Translation-en", TypeFrequentlyChanging},
+		{"dists/bookworm/main/i18n/Translation-en.gz", TypeFrequentlyChanging},
+		{"dists/bookworm/main/i18n/Translation-pt_BR.xz", TypeFrequentlyChanging},
+		{"dists/bookworm/contrib/i18n/Translation-de.bz2", TypeFrequentlyChanging},
+		{"debian/dists/bookworm/main/i18n/Translation-en.xz", TypeFrequentlyChanging},
+		{"dists/bookworm/main/i18n/Translation-en.diff/Index", TypeFrequentlyChanging},
+		{"dists/bookworm/main/i18n/Translation-en.diff/T-2024-01-01-0000.00-F-2023-12-31-2000.00.gz", TypeRarelyChanging},
+		{"pool/main/i/i18nspector/i18nspector_0.27.2-1_all.deb", TypeRarelyChanging},
+	}
+
+	for _, test := range tests {
+		if got := GetFilePatternType(test.path); got != test.expected {
+			t.Errorf("GetFilePatternType(%q) = %v, expected %v", test.path, got, test.expected)
+		}
+	}
+}
+
+func buildDeb(members ...[2]string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("!<arch>\n")
+	for _, member := range members {
+		fmt.Fprintf(&buf, "%-16s%-12s%-6s%-6s%-8s%-10d`\n", member[0], "0", "0", "0", "100644", len(member[1]))
+		buf.WriteString(member[1])
+		if len(member[1])%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestValidateDebStructure(t *testing.T) {
+	valid := buildDeb(
+		[2]string{"debian-binary", "2.0\n"},
+		[2]string{"control.tar.xz", "control"},
+		[2]string{"data.tar.xz", "package data"},
+	)
+
+	tests := []struct {
+		name    string
+		content []byte
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"gnu member names", buildDeb([2]string{"debian-binary/", "2.0\n"}, [2]string{"control.tar/", "c"}, [2]string{"data.tar.zst/", "d"}), false},
+		{"truncated", valid[:len(valid)-4], true},
+		{"html error page", []byte("<html><body>502 Bad Gateway</body></html>"), true},
+		{"missing data", buildDeb([2]string{"debian-binary", "2.0\n"}, [2]string{"control.tar.gz", "control"}), true},
+		{"wrong first member", buildDeb([2]string{"control.tar.gz", "control"}, [2]string{"data.tar.gz", "data"}), true},
+		{"empty", nil, true},
+	}
+
+	for _, test := range tests {
+		err := ValidateDebStructure(bytes.NewReader(test.content))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: ValidateDebStructure() error = %v, wantErr %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("elsewhere"))
+	}))
+	defer other.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/away":
+			http.Redirect(w, r, other.URL+"/file", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/hop":
+			http.Redirect(w, r, "/file", http.StatusFound)
+		default:
+			w.Write([]byte("here"))
+		}
+	}))
+	defer origin.Close()
+
+	tests := []struct {
+		name     string
+		policy   func(*http.Request, []*http.Request) error
+		path     string
+		rejected bool
+	}{
+		{"same host hop", RedirectPolicy(0, true, nil), "/hop", false},
+		{"other host with same-host", RedirectPolicy(0, true, nil), "/away", true},
+		{"other host allowed", RedirectPolicy(0, true, []string{"127.0.0.1"}), "/away", false},
+		{"other host unrestricted", RedirectPolicy(0, false, nil), "/away", false},
+		{"hop limit", RedirectPolicy(3, false, nil), "/loop", true},
+	}
+
+	for _, tt := range tests {
+		client := CreateHTTPClient(5)
+		client.CheckRedirect = tt.policy
+
+		resp, err := client.Get(origin.URL + tt.path)
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if rejected := errors.Is(err, ErrRedirectRejected); rejected != tt.rejected {
+			t.Errorf("%s: expected rejected=%v, got error %v", tt.name, tt.rejected, err)
+		}
+	}
+}
+
+// debianRelease follows the layout of Debian bookworm's Release file.
+const debianRelease = `Origin: Debian
+Label: Debian
+Suite: stable
+Version: 12.5
+Codename: bookworm
+Changelogs: https://metadata.ftp-master.debian.org/changelogs/@CHANGEPATH@_changelog
+Date: Sat, 10 Feb 2024 10:03:08 UTC
+Acquire-By-Hash: yes
+No-Support-for-Architecture-all: Packages
+Architectures: all amd64 arm64 armel armhf i386 mips64el mipsel ppc64el s390x
+Components: main contrib non-free-firmware non-free
+Description: Debian 12.5 Released 10 February 2024
+MD5Sum:
+ 0ed6d4c8891eb86358b94bb35d9e4da4  1484322 contrib/Contents-all
+ d0a0325a97c42fd5f66a8c3e29bcea64    98581 contrib/Contents-all.gz
+ 1f5b4a7d14a59e5e4c3bc25bc7bfbf6b   145813 main/binary-amd64/Packages.xz
+SHA256:
+ 3957f28db16e3f28c7b34ae84f1c929c567de6970f3f1b95dac9b498dd80fe63  1484322 contrib/Contents-all
+ 3e9a121d599b56c08bc8f144e4830807c77c29d7114316d6984ba54695d3db7b    98581 contrib/Contents-all.gz
+ 9bf1a9d7bb1f2ae6d4e5f0b7e6f9b1b2c2a7e0e8f8c3b4b5a6d7e8f9a0b1c2d3   145813 main/binary-amd64/Packages.xz
+`
+
+// ubuntuInRelease follows the layout of Ubuntu jammy's clearsigned InRelease
+// file, which lists Acquire-By-Hash after the checksums.
+const ubuntuInRelease = `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA512
+
+Origin: Ubuntu
+Label: Ubuntu
+Suite: jammy
+Version: 22.04
+Codename: jammy
+Date: Thu, 21 Apr 2022 17:16:08 UTC
+Architectures: amd64 arm64 armhf i386 ppc64el riscv64 s390x
+Components: main restricted universe multiverse
+Description: Ubuntu Jammy 22.04
+MD5Sum:
+ ff8cce1b2b3d6ba0b5e3e8d1b7b8e4ab           129978 main/binary-amd64/Packages.gz
+ 7f2a6c4e1bba5f0b7a02b5f9a35c1f43          1792365 main/binary-amd64/Packages.xz
+SHA1:
+ 0e1d2f3a4b5c6d7e8f9a0b1c2d3e4f5a6b7c8d9e           129978 main/binary-amd64/Packages.gz
+SHA256:
+ 4a7D0D8F4C2D8E6B1A3E5F7C9B1D3F5A7C9E1B3D5F7A9C1E3B5D7F9A1C3E5B7D           129978 main/binary-amd64/Packages.gz
+ 2b1c6e8d7f0a9b3c5d4e6f8a0b2c4d6e8f0a1b3c5d7e9f1a3b5c7d9e1f3a5b7c          1792365 main/binary-amd64/Packages.xz
+Acquire-By-Hash: yes
+-----BEGIN PGP SIGNATURE-----
+
+iQIzBAEBCgAdFiEEFN9YBxQWvjN4F8BpUnZwDRaBG4MFAmJhkFwACgkQUnZwDRaB
+=L0nT
+-----END PGP SIGNATURE-----
+`
+
+func TestParseReleaseDebianAndUbuntu(t *testing.T) {
+	debian, err := ParseRelease([]byte(debianRelease))
+	if err != nil {
+		t.Fatalf("Failed to parse the Debian Release file: %v", err)
+	}
+	if codename, _ := debian.Fields.Get("codename"); codename != "bookworm" {
+		t.Errorf("Expected codename bookworm, got %q", codename)
+	}
+	if !debian.AcquireByHash {
+		t.Error("Expected Acquire-By-Hash for Debian")
+	}
+	if len(debian.Files) != 3 {
+		t.Errorf("Expected 3 files, got %d", len(debian.Files))
+	}
+	file := debian.Files["contrib/Contents-all.gz"]
+	if file == nil || file.Size != 98581 || file.Hashes["MD5Sum"] != "d0a0325a97c42fd5f66a8c3e29bcea64" {
+		t.Errorf("Unexpected entry for contrib/Contents-all.gz: %+v", file)
+	}
+	if algorithm, hash, ok := debian.Checksum("contrib/Contents-all"); !ok || algorithm != "SHA256" || hash != "3957f28db16e3f28c7b34ae84f1c929c567de6970f3f1b95dac9b498dd80fe63" {
+		t.Errorf("Expected the SHA256 checksum, got %s %s %v", algorithm, hash, ok)
+	}
+
+	ubuntu, err := ParseRelease([]byte(ubuntuInRelease))
+	if err != nil {
+		t.Fatalf("Failed to parse the Ubuntu InRelease file: %v", err)
+	}
+	if suite, _ := ubuntu.Fields.Get("Suite"); suite != "jammy" {
+		t.Errorf("Expected suite jammy, got %q", suite)
+	}
+	if !ubuntu.AcquireByHash {
+		t.Error("Expected Acquire-By-Hash for Ubuntu, listed after the checksums")
+	}
+	gz := ubuntu.Files["main/binary-amd64/Packages.gz"]
+	if gz == nil || len(gz.Hashes) != 3 || gz.Size != 129978 {
+		t.Fatalf("Expected Packages.gz with three checksums, got %+v", gz)
+	}
+	if gz.Hashes["SHA256"] != "4a7d0d8f4c2d8e6b1a3e5f7c9b1d3f5a7c9e1b3d5f7a9c1e3b5d7f9a1c3e5b7d" {
+		t.Errorf("Expected the SHA256 checksum in lower case, got %s", gz.Hashes["SHA256"])
+	}
+	if xz := ubuntu.Files["main/binary-amd64/Packages.xz"]; xz == nil || len(xz.Hashes) != 2 {
+		t.Errorf("Expected Packages.xz without a SHA1 checksum, got %+v", xz)
+	}
+	if _, _, ok := ubuntu.Checksum("main/missing"); ok {
+		t.Error("Expected no checksum for an unlisted file")
+	}
+
+	sizes := ParseReleaseFileSizes([]byte(ubuntuInRelease))
+	if len(sizes) != 2 || sizes["main/binary-amd64/Packages.xz"] != 1792365 {
+		t.Errorf("Unexpected sizes: %v", sizes)
+	}
+}
+
+func TestParseReleaseRejectsInconsistentSizes(t *testing.T) {
+	release := "Suite: stable\nMD5Sum:\n abc 10 main/Packages\nSHA256:\n def 11 main/Packages\n"
+	if _, err := ParseRelease([]byte(release)); err == nil {
+		t.Error("Expected an error for sections disagreeing on a size")
+	}
+	if _, err := ParseRelease([]byte("Suite: stable\nSHA256:\n abc main/Packages\n")); err == nil {
+		t.Error("Expected an error for an entry without a size")
+	}
+	if sizes := ParseReleaseFileSizes([]byte(release)); len(sizes) != 0 {
+		t.Errorf("Expected no size for a file the sections disagree on, got %v", sizes)
+	}
+
+	// One malformed entry must not drop the sizes of the others.
+	release = "Suite: stable\nSHA256:\n abc main/Packages\n def 11 main/Sources\n"
+	if sizes := ParseReleaseFileSizes([]byte(release)); len(sizes) != 1 || sizes["main/Sources"] != 11 {
+		t.Errorf("Expected the well-formed entry of a partly malformed file, got %v", sizes)
+	}
+}
+
+func TestOriginTLSConfigEnforcesVersionAndPins(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0) // Refused handshakes are expected
+	server.StartTLS()
+	defer server.Close()
+
+	sum := sha256.Sum256(server.Certificate().Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+	roots := server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	// The test certificate is valid for example.com, which is dialed at the
+	// test server so the handshake carries a server name to pin.
+	get := func(tlsConfig *tls.Config) error {
+		tlsConfig.RootCAs = roots
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+			},
+		}}
+		resp, err := client.Get("https://example.com/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	tlsConfig, err := OriginTLSConfig("1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, map[string][]string{"example.com": {strings.ToUpper(fingerprint)}})
+	if err != nil {
+		t.Fatalf("OriginTLSConfig failed: %v", err)
+	}
+	if err := get(tlsConfig); err != nil {
+		t.Errorf("Expected the pinned certificate to be accepted: %v", err)
+	}
+
+	other := strings.Repeat("ab:", 31) + "ab"
+	tlsConfig, _ = OriginTLSConfig("", nil, map[string][]string{"*": {other}})
+	if err := get(tlsConfig); !errors.Is(err, ErrCertificatePinMismatch) || !strings.Contains(err.Error(), fingerprint) {
+		t.Errorf("Expected a pin mismatch naming the presented fingerprint, got %v", err)
+	}
+
+	tlsConfig, _ = OriginTLSConfig("1.3", nil, nil)
+	if err := get(tlsConfig); err == nil {
+		t.Error("Expected a TLS 1.2 origin to be refused with a TLS 1.3 minimum")
+	}
+
+	if _, err := OriginTLSConfig("1.4", nil, nil); err == nil {
+		t.Error("Expected an unknown TLS version to be rejected")
+	}
+	if _, err := OriginTLSConfig("", []string{"TLS_RSA_WITH_RC4_128_SHA"}, nil); err == nil {
+		t.Error("Expected an insecure cipher suite to be rejected")
+	}
+	if _, err := OriginTLSConfig("", nil, map[string][]string{"example.com": {"abc"}}); err == nil {
+		t.Error("Expected a malformed fingerprint to be rejected")
+	}
+}
+
+func TestSelectChecksumPrefersTheStrongest(t *testing.T) {
+	hashes := map[string]string{"MD5Sum": "m", "SHA1": "s1", "SHA256": "s256"}
+	if algorithm, sum, err := SelectChecksum(hashes, ""); err != nil || algorithm != "SHA256" || sum != "s256" {
+		t.Errorf("Expected SHA256, got %s %s %v", algorithm, sum, err)
+	}
+	if _, _, err := SelectChecksum(hashes, "SHA256"); err != nil {
+		t.Errorf("Expected SHA256 to satisfy a SHA256 minimum: %v", err)
+	}
+	if _, _, err := SelectChecksum(hashes, "SHA512"); !errors.Is(err, ErrWeakChecksum) {
+		t.Errorf("Expected ErrWeakChecksum below a SHA512 minimum, got %v", err)
+	}
+	if _, _, err := SelectChecksum(map[string]string{"MD5Sum": "m", "SHA1": "s1"}, "SHA256"); !errors.Is(err, ErrWeakChecksum) {
+		t.Errorf("Expected weak-only checksums to be rejected, got %v", err)
+	}
+	if _, _, err := SelectChecksum(nil, ""); err == nil {
+		t.Error("Expected an error without checksums")
+	}
+
+	if algorithm, err := ParseChecksumAlgorithm("md5"); err != nil || algorithm != "MD5Sum" {
+		t.Errorf("Expected md5 to parse as MD5Sum, got %s %v", algorithm, err)
+	}
+	if _, err := ParseChecksumAlgorithm("crc32"); err == nil {
+		t.Error("Expected an unknown algorithm to be rejected")
+	}
+}
+
+func TestChecksumVerifier(t *testing.T) {
+	// sha512("abc") from FIPS 180-2.
+	const abc = "ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f"
+	verifier, err := NewChecksumVerifier("SHA512", strings.ToUpper(abc))
+	if err != nil {
+		t.Fatalf("NewChecksumVerifier failed: %v", err)
+	}
+	io.Copy(verifier, strings.NewReader("abc"))
+	if err := verifier.Verify(); err != nil {
+		t.Errorf("Expected the digest to match: %v", err)
+	}
+
+	verifier, _ = NewChecksumVerifier("SHA512", abc)
+	io.Copy(verifier, strings.NewReader("abd"))
+	if err := verifier.Verify(); err == nil {
+		t.Error("Expected a mismatch for different content")
+	}
+	if _, err := NewChecksumVerifier("CRC32", abc); err == nil {
+		t.Error("Expected an unknown algorithm to be rejected")
+	}
+}
+
+func TestParseDeb822(t *testing.T) {
+	data := "# A comment\r\nPackage: hello\r\nDescription: example package\r\n first line\r\n .\r\n\tlast line\r\n\r\n\r\nPackage: world\nVersion: 1.0\n"
+	paragraphs, err := ParseDeb822([]byte(data))
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(paragraphs) != 2 {
+		t.Fatalf("Expected 2 paragraphs, got %d", len(paragraphs))
+	}
+	if got, _ := paragraphs[0].Get("description"); got != "example package\nfirst line\n\nlast line" {
+		t.Errorf("Unexpected multi-line value %q", got)
+	}
+	if got, ok := paragraphs[1].Get("VERSION"); !ok || got != "1.0" {
+		t.Errorf("Expected case-insensitive lookup, got %q %v", got, ok)
+	}
+
+	for _, invalid := range []string{
+		" continuation first\n",
+		"Package: a\nno colon here\n",
+		"Package: a\npackage: b\n",
+	} {
+		if _, err := ParseDeb822([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestStripPGPSignatureUndoesDashEscaping(t *testing.T) {
+	signed := "-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA256\n\nSuite: x\n- -----not armor\n-----BEGIN PGP SIGNATURE-----\nabc\n-----END PGP SIGNATURE-----\n"
+	if got := string(StripPGPSignature([]byte(signed))); got != "Suite: x\n-----not armor\n" {
+		t.Errorf("Unexpected content %q", got)
+	}
+	if got := string(StripPGPSignature([]byte("Suite: x\n"))); got != "Suite: x\n" {
+		t.Errorf("Expected unsigned data unchanged, got %q", got)
+	}
+}